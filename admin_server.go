@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/arrikto/oidc-authservice/authenticators"
+	"github.com/arrikto/oidc-authservice/common"
+	"github.com/arrikto/oidc-authservice/sessions"
+	"github.com/gorilla/mux"
+	gsessions "github.com/gorilla/sessions"
+	"github.com/pkg/errors"
+)
+
+const (
+	adminSessionsPath = "/sessions"
+	adminSessionPath  = "/sessions/{id}"
+)
+
+// AdminServer serves the session administration API, which lists and revokes
+// the user sessions. It only accepts requests authenticated with the API keys
+// of ADMIN_API_KEYS_PATH.
+type AdminServer struct {
+	Store         sessions.IndexedStore
+	Providers     *sessions.Providers
+	TLSConfig     common.TlsConfig
+	SessionDomain string
+	Authenticator authenticators.Authenticator
+}
+
+// AdminSession is a user session, as shown by the admin API.
+type AdminSession struct {
+	// ID identifies the session in the admin API. It is derived from, but
+	// isn't, the session's cookie value, which is a credential.
+	ID           string     `json:"id"`
+	User         string     `json:"user"`
+	Groups       []string   `json:"groups"`
+	Provider     string     `json:"provider"`
+	CreatedAt    *time.Time `json:"createdAt,omitempty"`
+	LastActivity *time.Time `json:"lastActivity,omitempty"`
+}
+
+// AdminRevokeResult is the response of the requests that revoke sessions.
+type AdminRevokeResult struct {
+	// Revoked is the number of sessions that were deleted.
+	Revoked int `json:"revoked"`
+	// Errors are the errors of the sessions that couldn't be deleted and of
+	// the tokens that the OIDC provider couldn't revoke.
+	Errors []string `json:"errors,omitempty"`
+}
+
+func (s *AdminServer) Start(addr string) error {
+	return http.ListenAndServe(addr, s.Handler())
+}
+
+// Handler returns the handler of the admin API.
+func (s *AdminServer) Handler() http.Handler {
+	router := mux.NewRouter()
+	router.Use(s.authMiddleware)
+	router.HandleFunc(adminSessionsPath, s.listSessions).Methods(http.MethodGet)
+	router.HandleFunc(adminSessionsPath, s.revokeUserSessions).Methods(http.MethodDelete)
+	router.HandleFunc(adminSessionPath, s.getSession).Methods(http.MethodGet)
+	router.HandleFunc(adminSessionPath, s.revokeSession).Methods(http.MethodDelete)
+	return router
+}
+
+func (s *AdminServer) authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := common.RequestLogger(r, "admin API")
+		user, _, err := s.Authenticator.Authenticate(w, r)
+		if err != nil || user == nil {
+			if err != nil {
+				logger.Infof("Failed to authenticate admin request: %v", err)
+			}
+			common.ReturnMessage(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+		logger.WithField("user", user.Name).Infof("%s %s", r.Method, r.URL.Path)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// listSessions lists the sessions of the user of the "user" query parameter,
+// or all the sessions.
+func (s *AdminServer) listSessions(w http.ResponseWriter, r *http.Request) {
+	key := sessions.AllSessionsIndexKey
+	if user := r.URL.Query().Get("user"); user != "" {
+		key = sessions.UserIndexKey(user)
+	}
+	found, err := s.indexedSessions(r.Context(), key)
+	if err != nil {
+		s.returnError(w, r, err)
+		return
+	}
+	list := []AdminSession{}
+	for _, session := range found {
+		list = append(list, session.info)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].User != list[j].User {
+			return list[i].User < list[j].User
+		}
+		return list[i].ID < list[j].ID
+	})
+	common.ReturnJSONMessage(w, http.StatusOK, map[string]interface{}{"sessions": list})
+}
+
+func (s *AdminServer) getSession(w http.ResponseWriter, r *http.Request) {
+	session, err := s.findSession(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		s.returnError(w, r, err)
+		return
+	}
+	common.ReturnJSONMessage(w, http.StatusOK, session.info)
+}
+
+func (s *AdminServer) revokeSession(w http.ResponseWriter, r *http.Request) {
+	session, err := s.findSession(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		s.returnError(w, r, err)
+		return
+	}
+	s.revokeSessions(w, r, []*adminSession{session})
+}
+
+// revokeUserSessions revokes all the sessions of the user of the "user" query
+// parameter.
+func (s *AdminServer) revokeUserSessions(w http.ResponseWriter, r *http.Request) {
+	user := r.URL.Query().Get("user")
+	if user == "" {
+		common.ReturnMessage(w, http.StatusBadRequest, "The 'user' query parameter is required.")
+		return
+	}
+	found, err := s.indexedSessions(r.Context(), sessions.UserIndexKey(user))
+	if err != nil {
+		s.returnError(w, r, err)
+		return
+	}
+	s.revokeSessions(w, r, found)
+}
+
+// revokeSessions revokes the given sessions and returns the result. It goes
+// on after errors, so that a failing session doesn't keep the rest of them
+// alive, and returns a 500 if some sessions weren't deleted. Sessions whose
+// tokens the OIDC provider couldn't revoke are still deleted, so they only
+// show up in the errors.
+func (s *AdminServer) revokeSessions(w http.ResponseWriter, r *http.Request, found []*adminSession) {
+	result := AdminRevokeResult{}
+	code := http.StatusOK
+	for _, session := range found {
+		tokensErr, err := s.revoke(r.Context(), session)
+		if tokensErr != nil {
+			result.Errors = append(result.Errors, tokensErr.Error())
+		}
+		if err != nil {
+			result.Errors = append(result.Errors, err.Error())
+			code = http.StatusInternalServerError
+			continue
+		}
+		result.Revoked++
+	}
+	if len(result.Errors) > 0 {
+		common.RequestLogger(r, "admin API").Errorf("Errors revoking sessions: %v", result.Errors)
+	}
+	common.ReturnJSONMessage(w, code, result)
+}
+
+// adminSession is a session found in the session index.
+type adminSession struct {
+	sessions.IndexedSession
+	info AdminSession
+}
+
+var errSessionNotFound = errors.New("session not found")
+
+// indexedSessions returns the sessions under the given index key.
+func (s *AdminServer) indexedSessions(ctx context.Context, key string) ([]*adminSession, error) {
+	indexed, err := sessions.LoadIndexedSessions(ctx, s.Store, key)
+	if err != nil {
+		return nil, err
+	}
+	found := []*adminSession{}
+	for _, session := range indexed {
+		found = append(found, &adminSession{IndexedSession: session,
+			info: adminSessionInfo(session.ID, session.Session)})
+	}
+	return found, nil
+}
+
+func (s *AdminServer) findSession(ctx context.Context, adminID string) (*adminSession, error) {
+	found, err := s.indexedSessions(ctx, sessions.AllSessionsIndexKey)
+	if err != nil {
+		return nil, err
+	}
+	for _, session := range found {
+		if session.info.ID == adminID {
+			return session, nil
+		}
+	}
+	return nil, errSessionNotFound
+}
+
+// revoke revokes the tokens of the session at the OIDC provider and deletes
+// the session from the store and the index. The session is deleted even if
+// the provider can't revoke its tokens, so that revoking a session doesn't
+// depend on the provider. The error of the provider is returned separately.
+func (s *AdminServer) revoke(ctx context.Context, session *adminSession) (tokensErr, err error) {
+	sessionManager := s.Providers.ForSession(session.Session).SessionManager
+	if err := sessionManager.RevokeOIDCTokens(ctx, session.Session, s.TLSConfig); err != nil {
+		tokensErr = errors.Wrapf(err, "couldn't revoke the tokens of session %s", session.info.ID)
+	}
+	if err := sessions.DeleteSession(ctx, session.Session); err != nil {
+		return tokensErr, errors.Wrapf(err, "couldn't delete session %s", session.info.ID)
+	}
+	err = s.Store.UnindexSession(ctx, session.ID, sessions.AllSessionsIndexKey,
+		sessions.UserIndexKey(session.info.User))
+	if err != nil {
+		return tokensErr, errors.Wrapf(err, "couldn't unindex session %s", session.info.ID)
+	}
+	return tokensErr, nil
+}
+
+func (s *AdminServer) returnError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errSessionNotFound) {
+		common.ReturnMessage(w, http.StatusNotFound, "Session not found.")
+		return
+	}
+	common.RequestLogger(r, "admin API").Errorf("%v", err)
+	common.ReturnMessage(w, http.StatusInternalServerError, err.Error())
+}
+
+// adminSessionInfo returns the admin API view of the session with the given
+// ID.
+func adminSessionInfo(id string, session *gsessions.Session) AdminSession {
+	hash := sha256.Sum256([]byte(id))
+	info := AdminSession{ID: hex.EncodeToString(hash[:16]), Groups: []string{}}
+	info.User, _ = session.Values[sessions.UserSessionUserID].(string)
+	if groups, ok := session.Values[sessions.UserSessionGroups].([]string); ok {
+		info.Groups = groups
+	}
+	info.Provider, _ = session.Values[sessions.UserSessionProvider].(string)
+	if info.Provider == "" {
+		info.Provider = sessions.DefaultProviderName
+	}
+	if secs, ok := session.Values[sessions.UserSessionCreatedAt].(int64); ok {
+		t := time.Unix(secs, 0).UTC()
+		info.CreatedAt = &t
+	}
+	if secs, ok := session.Values[sessions.UserSessionLastActivity].(int64); ok {
+		t := time.Unix(secs, 0).UTC()
+		info.LastActivity = &t
+	}
+	return info
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/arrikto/oidc-authservice/authenticators"
+	"github.com/arrikto/oidc-authservice/common"
+	"github.com/arrikto/oidc-authservice/oidc"
+	"github.com/arrikto/oidc-authservice/sessions"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/oauth2"
+)
+
+// newTestOIDCProvider returns a fake OIDC provider, which counts the token
+// revocation requests. It uses TLS, as the revocation endpoint must be https.
+func newTestOIDCProvider(t *testing.T, revocations *int) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{
+				"issuer":                 server.URL,
+				"authorization_endpoint": server.URL + "/auth",
+				"token_endpoint":         server.URL + "/token",
+				"jwks_uri":               server.URL + "/keys",
+				"revocation_endpoint":    server.URL + "/revoke",
+			})
+		case "/revoke":
+			*revocations++
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// newTestProviders returns the providers with the given fake OIDC provider
+// as the default one, and the TLS configuration that trusts it.
+func newTestProviders(t *testing.T, provider *httptest.Server) (*sessions.Providers, common.TlsConfig) {
+	providerURL, err := url.Parse(provider.URL)
+	require.NoError(t, err)
+	tlsCfg := common.TlsConfig(pem.EncodeToMemory(&pem.Block{
+		Type: "CERTIFICATE", Bytes: provider.Certificate().Raw}))
+	sessionManager := sessions.NewSessionManager(tlsCfg.Context(context.Background()), "client", "secret",
+		providerURL, &url.URL{}, &url.URL{}, []string{"openid"}, oidc.PKCEMethodNone, false)
+	providers, err := sessions.NewProviders(&sessions.Provider{
+		Name:           sessions.DefaultProviderName,
+		SessionManager: &sessionManager,
+	})
+	require.NoError(t, err)
+	return providers, tlsCfg
+}
+
+func newTestAdminServer(t *testing.T, revocations *int) (*AdminServer, sessions.IndexedStore) {
+	dir := t.TempDir()
+	store, stateStore := sessions.InitiateSessionStores(&common.Config{
+		SessionStoreType:   "boltdb",
+		SessionStorePath:   filepath.Join(dir, "data.db"),
+		OIDCStateStorePath: filepath.Join(dir, "state.db"),
+	})
+	t.Cleanup(func() {
+		stateStore.Close()
+		store.Close()
+	})
+
+	providers, tlsCfg := newTestProviders(t, newTestOIDCProvider(t, revocations))
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("admin.admin-key"), bcrypt.MinCost)
+	require.NoError(t, err)
+	keysPath := filepath.Join(dir, "keys.yaml")
+	require.NoError(t, ioutil.WriteFile(keysPath, []byte(fmt.Sprintf(
+		"keys:\n- name: admin\n  user: admin\n  hash: %q\n", hash)), 0600))
+	authn, err := authenticators.NewAPIKeyAuthenticator("Authorization", keysPath)
+	require.NoError(t, err)
+
+	return &AdminServer{Store: store, Providers: providers, TLSConfig: tlsCfg, Authenticator: authn}, store
+}
+
+// createTestSession creates and indexes a session, as the callback does.
+func createTestSession(t *testing.T, store sessions.IndexedStore, user string) {
+	session := sessions.NewSession(store, sessions.UserSessionCookie)
+	session.Options.MaxAge = 3600
+	session.Values[sessions.UserSessionUserID] = user
+	session.Values[sessions.UserSessionGroups] = []string{"users"}
+	session.Values[sessions.UserSessionOAuth2Tokens] = oauth2.Token{AccessToken: "access"}
+	sessions.StartActivity(session, time.Now())
+	w := httptest.NewRecorder()
+	require.NoError(t, session.Save(httptest.NewRequest(http.MethodGet, "/", nil), w))
+	sessionID, err := sessions.SessionIDFromResponse(w, sessions.UserSessionCookie)
+	require.NoError(t, err)
+	require.NoError(t, store.IndexSession(context.Background(), sessionID, time.Hour,
+		sessions.UserIndexKey(user), sessions.AllSessionsIndexKey))
+}
+
+func adminRequest(t *testing.T, handler http.Handler, method, target string, v interface{}) int {
+	r := httptest.NewRequest(method, target, nil)
+	r.Header.Set("Authorization", "Bearer admin.admin-key")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if v != nil && w.Code == http.StatusOK {
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), v))
+	}
+	return w.Code
+}
+
+func TestAdminServer(t *testing.T) {
+	revocations := 0
+	admin, store := newTestAdminServer(t, &revocations)
+	handler := admin.Handler()
+
+	createTestSession(t, store, "alice")
+	createTestSession(t, store, "alice")
+	createTestSession(t, store, "bob")
+
+	// Requests without an admin API key are rejected
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/sessions", nil))
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+
+	var list struct {
+		Sessions []AdminSession `json:"sessions"`
+	}
+	require.Equal(t, http.StatusOK, adminRequest(t, handler, http.MethodGet, "/sessions", &list))
+	require.Len(t, list.Sessions, 3)
+	require.Equal(t, http.StatusOK, adminRequest(t, handler, http.MethodGet, "/sessions?user=alice", &list))
+	require.Len(t, list.Sessions, 2)
+	require.Equal(t, []string{"users"}, list.Sessions[0].Groups)
+	require.NotNil(t, list.Sessions[0].CreatedAt)
+
+	var session AdminSession
+	id := list.Sessions[0].ID
+	require.Equal(t, http.StatusOK, adminRequest(t, handler, http.MethodGet, "/sessions/"+id, &session))
+	require.Equal(t, "alice", session.User)
+
+	// Revoke a single session
+	require.Equal(t, http.StatusOK, adminRequest(t, handler, http.MethodDelete, "/sessions/"+id, nil))
+	require.Equal(t, http.StatusNotFound, adminRequest(t, handler, http.MethodGet, "/sessions/"+id, nil))
+	require.Equal(t, 1, revocations)
+
+	// Revoke all the sessions of a user
+	var revoked struct {
+		Revoked int `json:"revoked"`
+	}
+	require.Equal(t, http.StatusBadRequest, adminRequest(t, handler, http.MethodDelete, "/sessions", nil))
+	require.Equal(t, http.StatusOK, adminRequest(t, handler, http.MethodDelete, "/sessions?user=alice", &revoked))
+	require.Equal(t, 1, revoked.Revoked)
+	require.Equal(t, 2, revocations)
+
+	require.Equal(t, http.StatusOK, adminRequest(t, handler, http.MethodGet, "/sessions", &list))
+	require.Len(t, list.Sessions, 1)
+	require.Equal(t, "bob", list.Sessions[0].User)
+}
+
+func TestAdminServerProviderUnreachable(t *testing.T) {
+	revocations := 0
+	admin, store := newTestAdminServer(t, &revocations)
+	// The provider becomes unreachable after the discovery
+	provider := newTestOIDCProvider(t, &revocations)
+	admin.Providers, admin.TLSConfig = newTestProviders(t, provider)
+	provider.Close()
+	handler := admin.Handler()
+
+	createTestSession(t, store, "alice")
+	createTestSession(t, store, "alice")
+
+	// The sessions are deleted anyway and the errors of the provider are
+	// reported for each one of them
+	var result AdminRevokeResult
+	require.Equal(t, http.StatusOK, adminRequest(t, handler, http.MethodDelete, "/sessions?user=alice", &result))
+	require.Equal(t, 2, result.Revoked)
+	require.Len(t, result.Errors, 2)
+	require.Equal(t, 0, revocations)
+
+	var list struct {
+		Sessions []AdminSession `json:"sessions"`
+	}
+	require.Equal(t, http.StatusOK, adminRequest(t, handler, http.MethodGet, "/sessions", &list))
+	require.Empty(t, list.Sessions)
+}
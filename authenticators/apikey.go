@@ -0,0 +1,281 @@
+package authenticators
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arrikto/oidc-authservice/common"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// APIKeyFile is the schema of the API keys file. Since YAML is a superset of
+// JSON, the file can be in either format.
+type APIKeyFile struct {
+	Keys []APIKey `yaml:"keys"`
+}
+
+// APIKey describes a long-lived API key and the user it authenticates. Keys
+// are of the form "<name>.<secret>", so that each request is compared against
+// the hash of a single key.
+type APIKey struct {
+	// Name identifies the key, e.g., in the logs. It is the public part of
+	// the key and can't contain dots.
+	Name string `yaml:"name"`
+	// Hash is the bcrypt or argon2 hash of the whole key, in the standard
+	// "$2b$..." and "$argon2id$..." formats respectively.
+	Hash   string   `yaml:"hash"`
+	User   string   `yaml:"user"`
+	Groups []string `yaml:"groups"`
+	// Expires is the time after which the key is no longer accepted.
+	// Keys without an expiry never expire.
+	Expires *time.Time `yaml:"expires"`
+}
+
+func (k *APIKey) expired(now time.Time) bool {
+	return k.Expires != nil && now.After(*k.Expires)
+}
+
+type APIKeyAuthenticator struct {
+	// Header is the header where the API key is found.
+	Header string
+
+	path string
+	// keys are the API keys by name.
+	keys map[string]APIKey
+	// generation counts the loads of the file. It scopes the cache keys, so
+	// that the users cached before a reload aren't used after it.
+	generation int
+	lock       sync.RWMutex
+}
+
+// NewAPIKeyAuthenticator returns an authenticator that validates the API keys
+// found in the given header against the hashed keys of the file at path. The
+// file is reloaded every time it changes.
+func NewAPIKeyAuthenticator(header, path string) (Authenticator, error) {
+	s := &APIKeyAuthenticator{Header: header, path: path}
+	if err := s.loadKeys(); err != nil {
+		return nil, errors.Wrap(err, "Error creating API key authenticator")
+	}
+
+	common.WatchFile("apiKeyAuthenticator", s.path, s.loadKeys)
+
+	return s, nil
+}
+
+func (s *APIKeyAuthenticator) loadKeys() error {
+	raw, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("failed to read API keys file: %v", err)
+	}
+	keys, err := parseAPIKeys(raw)
+	if err != nil {
+		return fmt.Errorf("failed to parse API keys file: %v", err)
+	}
+
+	log.Infof("loaded %d API keys from %s", len(keys), s.path)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.keys = keys
+	s.generation++
+	return nil
+}
+
+func parseAPIKeys(raw []byte) (map[string]APIKey, error) {
+	var f APIKeyFile
+	if err := yaml.Unmarshal(raw, &f); err != nil {
+		return nil, err
+	}
+	keys := map[string]APIKey{}
+	for i, k := range f.Keys {
+		if k.Name == "" {
+			return nil, errors.Errorf("key %d: 'name' field is missing", i)
+		}
+		if strings.Contains(k.Name, ".") {
+			return nil, errors.Errorf("key %s: name can't contain dots", k.Name)
+		}
+		if _, ok := keys[k.Name]; ok {
+			return nil, errors.Errorf("key %s: duplicate name", k.Name)
+		}
+		if k.User == "" {
+			return nil, errors.Errorf("key %s: 'user' field is missing", k.Name)
+		}
+		switch {
+		case strings.HasPrefix(k.Hash, "$argon2"):
+			if _, err := parseArgon2Hash(k.Hash); err != nil {
+				return nil, errors.Wrapf(err, "key %s", k.Name)
+			}
+		case !strings.HasPrefix(k.Hash, "$2"):
+			return nil, errors.Errorf("key %s: unsupported hash, expected a "+
+				"bcrypt or argon2 hash", k.Name)
+		}
+		if k.Groups == nil {
+			k.Groups = []string{}
+		}
+		keys[k.Name] = k
+	}
+	return keys, nil
+}
+
+func (s *APIKeyAuthenticator) Authenticate(w http.ResponseWriter, r *http.Request) (*common.User, bool, error) {
+	logger := common.RequestLogger(r, "API key authenticator")
+
+	apiKey := s.getAPIKey(r)
+	if apiKey == "" {
+		logger.Debugf("No API key found in the %s header", s.Header)
+		return nil, false, nil
+	}
+
+	// Only the hash of the key that the name points to is compared, since
+	// hashes are slow on purpose.
+	s.lock.RLock()
+	k, found := s.keys[apiKeyName(apiKey)]
+	s.lock.RUnlock()
+	if !found {
+		logger.Info("API key doesn't match any known key")
+		return nil, false, nil
+	}
+
+	ok, err := compareAPIKeyHash(k.Hash, apiKey)
+	if err != nil {
+		logger.Errorf("Error comparing API key %s: %v", k.Name, err)
+		return nil, false, nil
+	}
+	if !ok {
+		logger.Infof("API key doesn't match the hash of key %s", k.Name)
+		return nil, false, nil
+	}
+	if k.expired(time.Now()) {
+		return nil, false, &common.LoginExpiredError{
+			Err: errors.Errorf("API key %s has expired", k.Name),
+		}
+	}
+
+	logger.Infof("Authenticated request with API key %s", k.Name)
+	// Authentication using header successfully completed
+	extra := map[string][]string{"auth-method": {"header"}}
+	return &common.User{
+		Name:   k.User,
+		Groups: k.Groups,
+		Extra:  extra,
+	}, true, nil
+}
+
+// The API Key Authenticator implements the Cacheable
+// interface with the getCacheKey(). The cache key is scoped to the loaded
+// version of the keys file, so that removed or changed keys aren't accepted
+// from the cache, and unknown or expired keys aren't looked up at all.
+func (s *APIKeyAuthenticator) GetCacheKey(r *http.Request) string {
+	apiKey := s.getAPIKey(r)
+	if apiKey == "" {
+		return ""
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	k, found := s.keys[apiKeyName(apiKey)]
+	if !found || k.expired(time.Now()) {
+		return ""
+	}
+	return fmt.Sprintf("%d:%s", s.generation, apiKey)
+}
+
+// apiKeyName returns the name part of an API key.
+func apiKeyName(apiKey string) string {
+	return strings.SplitN(apiKey, ".", 2)[0]
+}
+
+func (s *APIKeyAuthenticator) getAPIKey(r *http.Request) string {
+	value := r.Header.Get(s.Header)
+	// Also accept the key as a bearer token, in case the header is the
+	// Authorization header.
+	if strings.HasPrefix(value, "Bearer ") {
+		return common.GetBearerToken(value)
+	}
+	return value
+}
+
+// compareAPIKeyHash examines if the key matches the bcrypt or argon2 hash.
+func compareAPIKeyHash(hash, key string) (bool, error) {
+	if strings.HasPrefix(hash, "$argon2") {
+		return compareArgon2Hash(hash, key)
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(key))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// argon2Params is an argon2 hash and the parameters it was created with.
+type argon2Params struct {
+	variant    string
+	memory     uint32
+	iterations uint32
+	threads    uint8
+	salt       []byte
+	hash       []byte
+}
+
+// parseArgon2Hash parses an argon2 hash in the PHC string format, e.g.:
+// $argon2id$v=19$m=65536,t=3,p=4$<base64 salt>$<base64 hash>
+func parseArgon2Hash(hash string) (*argon2Params, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return nil, errors.New("malformed argon2 hash")
+	}
+	h := &argon2Params{variant: parts[1]}
+	if h.variant != "argon2id" && h.variant != "argon2i" {
+		return nil, errors.Errorf("unsupported argon2 variant %s", h.variant)
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return nil, errors.Wrap(err, "malformed argon2 hash version")
+	}
+	if version != argon2.Version {
+		return nil, errors.Errorf("unsupported argon2 version %d", version)
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.iterations, &h.threads); err != nil {
+		return nil, errors.Wrap(err, "malformed argon2 hash parameters")
+	}
+	// argon2 panics with fewer than one iteration or thread
+	if h.iterations < 1 || h.threads < 1 {
+		return nil, errors.New("argon2 hash iterations and threads must be at least 1")
+	}
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, errors.Wrap(err, "malformed argon2 hash salt")
+	}
+	if h.hash, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return nil, errors.Wrap(err, "malformed argon2 hash")
+	}
+	if len(h.hash) == 0 {
+		return nil, errors.New("empty argon2 hash")
+	}
+	return h, nil
+}
+
+// compareArgon2Hash examines if the key matches an argon2 hash in the PHC
+// string format.
+func compareArgon2Hash(hash, key string) (bool, error) {
+	h, err := parseArgon2Hash(hash)
+	if err != nil {
+		return false, err
+	}
+	var actual []byte
+	if h.variant == "argon2id" {
+		actual = argon2.IDKey([]byte(key), h.salt, h.iterations, h.memory, h.threads, uint32(len(h.hash)))
+	} else {
+		actual = argon2.Key([]byte(key), h.salt, h.iterations, h.memory, h.threads, uint32(len(h.hash)))
+	}
+	return subtle.ConstantTimeCompare(actual, h.hash) == 1, nil
+}
@@ -0,0 +1,275 @@
+package authenticators
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/arrikto/oidc-authservice/common"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func bcryptHash(t *testing.T, key string) string {
+	hash, err := bcrypt.GenerateFromPassword([]byte(key), bcrypt.MinCost)
+	require.NoError(t, err)
+	return string(hash)
+}
+
+func argon2Hash(key string) string {
+	salt := []byte("0123456789abcdef")
+	hash := argon2.IDKey([]byte(key), salt, 1, 1024, 1, 32)
+	return fmt.Sprintf("$argon2id$v=%d$m=1024,t=1,p=1$%s$%s", argon2.Version,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(hash))
+}
+
+// apiKeysPath returns a path for an API keys file in a new temporary
+// directory. The directory is not removed at the end of the test, since the
+// file watcher exits the process if the file disappears for good.
+func apiKeysPath(t *testing.T, name string) string {
+	dir, err := ioutil.TempDir("", "apikeys")
+	require.NoError(t, err)
+	return filepath.Join(dir, name)
+}
+
+func writeAPIKeys(t *testing.T, path, content string) {
+	require.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+}
+
+func TestAPIKeyAuthenticator(t *testing.T) {
+
+	path := apiKeysPath(t, "keys.yaml")
+	writeAPIKeys(t, path, fmt.Sprintf(`
+keys:
+- name: ci
+  hash: %q
+  user: ci-bot
+  groups: [automation]
+- name: backup
+  hash: %q
+  user: backup-bot
+- name: old
+  hash: %q
+  user: old-bot
+  expires: 2020-01-01T00:00:00Z
+`, bcryptHash(t, "ci.ci-secret"), argon2Hash("backup.backup-secret"), bcryptHash(t, "old.old-secret")))
+
+	authn, err := NewAPIKeyAuthenticator("X-API-Key", path)
+	require.NoError(t, err)
+
+	tests := []struct {
+		testName string
+		header   string
+		key      string
+		user     string
+		groups   []string
+		expired  bool
+		success  bool
+	}{
+		{
+			testName: "No API key",
+			success:  false,
+		},
+		{
+			testName: "bcrypt key",
+			header:   "X-API-Key",
+			key:      "ci.ci-secret",
+			user:     "ci-bot",
+			groups:   []string{"automation"},
+			success:  true,
+		},
+		{
+			testName: "argon2 key",
+			header:   "X-API-Key",
+			key:      "backup.backup-secret",
+			user:     "backup-bot",
+			groups:   []string{},
+			success:  true,
+		},
+		{
+			testName: "Unknown key",
+			header:   "X-API-Key",
+			key:      "unknown",
+			success:  false,
+		},
+		{
+			testName: "Key with another name",
+			header:   "X-API-Key",
+			key:      "backup.ci-secret",
+			success:  false,
+		},
+		{
+			testName: "Key without a name",
+			header:   "X-API-Key",
+			key:      "ci-secret",
+			success:  false,
+		},
+		{
+			testName: "Key in another header",
+			header:   "X-Other",
+			key:      "ci.ci-secret",
+			success:  false,
+		},
+		{
+			testName: "Expired key",
+			header:   "X-API-Key",
+			key:      "old.old-secret",
+			expired:  true,
+			success:  false,
+		},
+	}
+
+	for _, c := range tests {
+		t.Run(c.testName, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			if c.header != "" {
+				r.Header.Set(c.header, c.key)
+			}
+
+			user, found, err := authn.Authenticate(httptest.NewRecorder(), r)
+			var expiredErr *common.LoginExpiredError
+			require.Equal(t, c.expired, errors.As(err, &expiredErr), "unexpected error: %v", err)
+			require.Equal(t, c.success, found)
+			if c.success {
+				require.Equal(t, c.user, user.Name)
+				require.Equal(t, c.groups, user.Groups)
+			}
+		})
+	}
+}
+
+func TestAPIKeyAuthenticatorReload(t *testing.T) {
+
+	path := apiKeysPath(t, "keys.json")
+	writeAPIKeys(t, path, `{"keys": []}`)
+
+	authn, err := NewAPIKeyAuthenticator("Authorization", path)
+	require.NoError(t, err)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer new.new-secret")
+	_, found, err := authn.Authenticate(httptest.NewRecorder(), r)
+	require.NoError(t, err)
+	require.False(t, found)
+
+	keys := fmt.Sprintf(`{"keys": [{"name": "new", "hash": %q, "user": "new-bot"}]}`,
+		bcryptHash(t, "new.new-secret"))
+
+	// The file watcher starts in the background, so keep writing the file
+	// until it picks up the change.
+	require.Eventually(t, func() bool {
+		writeAPIKeys(t, path, keys)
+		time.Sleep(50 * time.Millisecond)
+		user, found, _ := authn.Authenticate(httptest.NewRecorder(), r)
+		return found && user.Name == "new-bot"
+	}, 5*time.Second, 50*time.Millisecond)
+	require.Regexp(t, `^[0-9]+:new\.new-secret$`, authn.(*APIKeyAuthenticator).GetCacheKey(r))
+}
+
+func TestAPIKeyAuthenticatorCacheKey(t *testing.T) {
+
+	path := apiKeysPath(t, "keys.yaml")
+	writeAPIKeys(t, path, fmt.Sprintf(`
+keys:
+- name: ci
+  hash: %q
+  user: ci-bot
+- name: old
+  hash: %q
+  user: old-bot
+  expires: 2020-01-01T00:00:00Z
+`, bcryptHash(t, "ci.ci-secret"), bcryptHash(t, "old.old-secret")))
+	authn := &APIKeyAuthenticator{Header: "X-API-Key", path: path}
+	require.NoError(t, authn.loadKeys())
+
+	cacheKey := func(key string) string {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-API-Key", key)
+		return authn.GetCacheKey(r)
+	}
+	first := cacheKey("ci.ci-secret")
+	require.NotEmpty(t, first)
+	// Unknown and expired keys are never accepted from the cache
+	require.Empty(t, cacheKey("unknown.secret"))
+	require.Empty(t, cacheKey("old.old-secret"))
+
+	// The users cached before a reload aren't used after it
+	require.NoError(t, authn.loadKeys())
+	second := cacheKey("ci.ci-secret")
+	require.NotEmpty(t, second)
+	require.NotEqual(t, first, second)
+}
+
+func TestParseAPIKeys(t *testing.T) {
+
+	tests := []struct {
+		testName string
+		raw      string
+		success  bool
+	}{
+		{
+			testName: "Valid keys",
+			raw:      `keys: [{name: a, hash: "$2a$10$abc", user: a}]`,
+			success:  true,
+		},
+		{
+			testName: "Missing name",
+			raw:      `keys: [{hash: "$2a$10$abc", user: a}]`,
+			success:  false,
+		},
+		{
+			testName: "Duplicate name",
+			raw:      `keys: [{name: a, hash: "$2a$10$abc", user: a}, {name: a, hash: "$2a$10$abc", user: b}]`,
+			success:  false,
+		},
+		{
+			testName: "Name with a dot",
+			raw:      `keys: [{name: a.b, hash: "$2a$10$abc", user: a}]`,
+			success:  false,
+		},
+		{
+			testName: "Missing user",
+			raw:      `keys: [{name: a, hash: "$2a$10$abc"}]`,
+			success:  false,
+		},
+		{
+			testName: "Valid argon2 hash",
+			raw:      fmt.Sprintf(`keys: [{name: a, hash: %q, user: a}]`, argon2Hash("a.secret")),
+			success:  true,
+		},
+		{
+			testName: "Malformed argon2 hash",
+			raw:      `keys: [{name: a, hash: "$argon2id$v=19$m=1024,t=1$c2FsdA$aGFzaA", user: a}]`,
+			success:  false,
+		},
+		{
+			testName: "Argon2 hash without threads",
+			raw:      `keys: [{name: a, hash: "$argon2id$v=19$m=1024,t=1,p=0$c2FsdA$aGFzaA", user: a}]`,
+			success:  false,
+		},
+		{
+			testName: "Unsupported argon2 variant",
+			raw:      `keys: [{name: a, hash: "$argon2d$v=19$m=1024,t=1,p=1$c2FsdA$aGFzaA", user: a}]`,
+			success:  false,
+		},
+		{
+			testName: "Plaintext key",
+			raw:      `keys: [{name: a, hash: "secret", user: a}]`,
+			success:  false,
+		},
+	}
+
+	for _, c := range tests {
+		t.Run(c.testName, func(t *testing.T) {
+			_, err := parseAPIKeys([]byte(c.raw))
+			require.Equal(t, c.success, err == nil, "unexpected error: %v", err)
+		})
+	}
+}
@@ -0,0 +1,384 @@
+package authenticators
+
+import (
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/arrikto/oidc-authservice/common"
+	"github.com/pkg/errors"
+)
+
+const (
+	// XFCCHeader is the header where Envoy forwards the client certificate
+	// details of mTLS connections.
+	XFCCHeader = "X-Forwarded-Client-Cert"
+
+	certSourceCN  = "cn"
+	certSourceDNS = "dns"
+	certSourceURI = "uri"
+)
+
+// defaultCertificateRules identify callers by their SPIFFE ID, if they have
+// one, and otherwise by the CN of their certificate subject.
+const defaultCertificateRules = `[
+	{"source": "uri", "matches": "^spiffe://.+$", "user": "$0"},
+	{"source": "cn", "matches": "^.+$", "user": "$0"}
+]`
+
+// certificateRule maps a certificate identity (the subject CN, a DNS SAN or a
+// URI SAN) that matches a regular expression to a user name and groups. The
+// user name and groups may reference the submatches of the expression, e.g.
+// $1, as in regexp.Expand.
+type certificateRule struct {
+	Source  string   `json:"source"`
+	Matches string   `json:"matches"`
+	User    string   `json:"user"`
+	Groups  []string `json:"groups"`
+
+	matches *regexp.Regexp
+}
+
+// certificateIdentity holds the identities of a client certificate.
+type certificateIdentity struct {
+	CommonName string
+	DNSNames   []string
+	URIs       []string
+}
+
+type CertificateAuthenticator struct {
+	// rules are evaluated in order, the first one that matches identifies
+	// the caller.
+	rules []certificateRule
+	// trustedProxies are the networks of the proxies that are allowed to
+	// forward client certificate details in the XFCC header.
+	trustedProxies []*net.IPNet
+}
+
+// NewCertificateAuthenticator returns an authenticator that identifies callers
+// by their client certificate, either from the TLS connection or from the
+// Envoy XFCC header of trusted proxies. Rules are given in JSON format:
+//
+//	[
+//	  {"source": "uri", "matches": "regex", "user": "value", "groups": ["value"]}
+//	]
+func NewCertificateAuthenticator(rules string, trustedProxies []string) (Authenticator, error) {
+	if rules == "" {
+		rules = defaultCertificateRules
+	}
+	parsedRules, err := parseCertificateRules(rules)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error creating certificate authenticator")
+	}
+
+	proxies, err := parseTrustedProxies(trustedProxies)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error creating certificate authenticator")
+	}
+
+	return &CertificateAuthenticator{rules: parsedRules, trustedProxies: proxies}, nil
+}
+
+func parseCertificateRules(value string) ([]certificateRule, error) {
+	var rules []certificateRule
+	if err := json.Unmarshal([]byte(value), &rules); err != nil {
+		return nil, errors.Wrap(err, "error unmarshalling certificate rules")
+	}
+	for i := range rules {
+		switch rules[i].Source {
+		case certSourceCN, certSourceDNS, certSourceURI:
+		default:
+			return nil, errors.Errorf("certificate rule %d: unsupported source "+
+				"'%s', expected one of cn, dns or uri", i, rules[i].Source)
+		}
+		if rules[i].User == "" {
+			return nil, errors.Errorf("certificate rule %d: 'user' field is missing", i)
+		}
+		re, err := regexp.Compile(rules[i].Matches)
+		if err != nil {
+			return nil, errors.Wrapf(err, "certificate rule %d: invalid regular expression", i)
+		}
+		rules[i].matches = re
+	}
+	return rules, nil
+}
+
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, p := range proxies {
+		if !strings.Contains(p, "/") {
+			if ip := net.ParseIP(p); ip != nil && ip.To4() != nil {
+				p += "/32"
+			} else {
+				p += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid trusted proxy address '%s'", p)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func (ca *CertificateAuthenticator) Authenticate(w http.ResponseWriter, r *http.Request) (*common.User, bool, error) {
+	logger := common.RequestLogger(r, "certificate authenticator")
+
+	// The TLS peer certificate of a trusted proxy identifies the proxy
+	// itself, which forwards the certificate of the client in the XFCC
+	// header instead.
+	fromProxy := ca.trustedProxy(r.RemoteAddr)
+	xfcc := r.Header.Get(XFCCHeader)
+
+	var identity *certificateIdentity
+	var authMethod string
+	switch {
+	case xfcc != "" && fromProxy:
+		var err error
+		identity, err = identityFromXFCC(xfcc)
+		if err != nil {
+			return nil, false, &common.AuthenticatorSpecificError{Err: err}
+		}
+		authMethod = "header"
+	case r.TLS != nil && len(r.TLS.PeerCertificates) > 0 && !fromProxy:
+		// AuthService terminates TLS and the client presented a
+		// certificate, which the TLS handshake has already verified.
+		if xfcc != "" {
+			logger.Warnf("Ignoring %s header from untrusted address %s", XFCCHeader, r.RemoteAddr)
+		}
+		identity = identityFromCertificate(r.TLS.PeerCertificates[0])
+		authMethod = "certificate"
+	case xfcc != "":
+		logger.Warnf("Ignoring %s header from untrusted address %s", XFCCHeader, r.RemoteAddr)
+		return nil, false, nil
+	default:
+		logger.Debug("No client certificate found")
+		return nil, false, nil
+	}
+
+	user, ok := ca.matchRules(identity)
+	if !ok {
+		logger.Infof("Client certificate %+v didn't match any rule", *identity)
+		return nil, false, nil
+	}
+	user.Extra = map[string][]string{"auth-method": {authMethod}}
+	return user, true, nil
+}
+
+// trustedProxy examines if the given remote address belongs to one of the
+// trusted proxies.
+func (ca *CertificateAuthenticator) trustedProxy(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range ca.trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchRules returns the user of the first rule that matches one of the
+// certificate identities.
+func (ca *CertificateAuthenticator) matchRules(identity *certificateIdentity) (*common.User, bool) {
+	for _, rule := range ca.rules {
+		var values []string
+		switch rule.Source {
+		case certSourceCN:
+			values = []string{identity.CommonName}
+		case certSourceDNS:
+			values = identity.DNSNames
+		case certSourceURI:
+			values = identity.URIs
+		}
+		for _, v := range values {
+			if v == "" {
+				continue
+			}
+			match := rule.matches.FindStringSubmatchIndex(v)
+			if match == nil {
+				continue
+			}
+			expand := func(template string) string {
+				return string(rule.matches.ExpandString(nil, template, v, match))
+			}
+			// A template that expands to nothing, e.g., a subexpression
+			// that didn't participate in the match, isn't a match.
+			user := expand(rule.User)
+			if user == "" {
+				continue
+			}
+			groups := []string{}
+			for _, g := range rule.Groups {
+				if group := expand(g); group != "" {
+					groups = append(groups, group)
+				}
+			}
+			return &common.User{Name: user, Groups: groups}, true
+		}
+	}
+	return nil, false
+}
+
+func identityFromCertificate(cert *x509.Certificate) *certificateIdentity {
+	identity := &certificateIdentity{
+		CommonName: cert.Subject.CommonName,
+		DNSNames:   cert.DNSNames,
+	}
+	for _, u := range cert.URIs {
+		identity.URIs = append(identity.URIs, u.String())
+	}
+	return identity
+}
+
+// identityFromXFCC extracts the client certificate identities from the Envoy
+// XFCC header. Each proxy appends an element with the details of its own
+// client, so the last element describes the client of the trusted proxy. See:
+// https://www.envoyproxy.io/docs/envoy/latest/configuration/http/http_conn_man/headers#x-forwarded-client-cert
+func identityFromXFCC(value string) (*certificateIdentity, error) {
+	elements, err := splitXFCC(value, ',')
+	if err != nil {
+		return nil, err
+	}
+	pairs, err := splitXFCC(elements[len(elements)-1], ';')
+	if err != nil {
+		return nil, err
+	}
+
+	identity := &certificateIdentity{}
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("malformed %s header: invalid key-value pair '%s'", XFCCHeader, pair)
+		}
+		key, val := strings.ToLower(parts[0]), unquoteXFCC(parts[1])
+		switch key {
+		case "cert":
+			// If the whole certificate is forwarded, prefer it.
+			certPEM, err := url.QueryUnescape(val)
+			if err != nil {
+				return nil, errors.Wrapf(err, "malformed %s header: invalid Cert value", XFCCHeader)
+			}
+			block, _ := pem.Decode([]byte(certPEM))
+			if block == nil {
+				return nil, errors.Errorf("malformed %s header: Cert is not PEM encoded", XFCCHeader)
+			}
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, errors.Wrapf(err, "malformed %s header: invalid Cert", XFCCHeader)
+			}
+			return identityFromCertificate(cert), nil
+		case "subject":
+			identity.CommonName = commonNameFromSubject(val)
+		case "uri":
+			identity.URIs = append(identity.URIs, val)
+		case "dns":
+			identity.DNSNames = append(identity.DNSNames, val)
+		}
+	}
+	return identity, nil
+}
+
+// splitXFCC splits the value on the separator, ignoring separators inside
+// double-quoted strings.
+func splitXFCC(value string, sep rune) ([]string, error) {
+	var parts []string
+	var current strings.Builder
+	quoted, escaped := false, false
+	for _, c := range value {
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\' && quoted:
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case c == sep && !quoted:
+			parts = append(parts, strings.TrimSpace(current.String()))
+			current.Reset()
+			continue
+		}
+		current.WriteRune(c)
+	}
+	if quoted {
+		return nil, errors.Errorf("malformed %s header: unterminated quoted string", XFCCHeader)
+	}
+	parts = append(parts, strings.TrimSpace(current.String()))
+	return parts, nil
+}
+
+func unquoteXFCC(value string) string {
+	if len(value) < 2 || !strings.HasPrefix(value, `"`) || !strings.HasSuffix(value, `"`) {
+		return value
+	}
+	value = value[1 : len(value)-1]
+	return strings.NewReplacer(`\"`, `"`, `\\`, `\`).Replace(value)
+}
+
+// commonNameFromSubject returns the CN of an RFC2253 formatted subject. The
+// attributes are separated by unescaped commas or plus signs, and the values
+// may escape special characters with a backslash, e.g., "CN=Doe\, John", or
+// use hex pairs, e.g., "CN=Doe\2C John".
+func commonNameFromSubject(subject string) string {
+	var attrs []string
+	var current strings.Builder
+	for i := 0; i < len(subject); i++ {
+		c := subject[i]
+		switch {
+		case c == '\\' && i+1 < len(subject):
+			// Keep the escape, so that escaped separators aren't split.
+			current.WriteByte(c)
+			i++
+			current.WriteByte(subject[i])
+		case c == ',' || c == '+':
+			attrs = append(attrs, current.String())
+			current.Reset()
+		default:
+			current.WriteByte(c)
+		}
+	}
+	attrs = append(attrs, current.String())
+
+	for _, attr := range attrs {
+		attr = strings.TrimSpace(attr)
+		if strings.HasPrefix(strings.ToUpper(attr), "CN=") {
+			return unescapeRDNValue(attr[len("CN="):])
+		}
+	}
+	return ""
+}
+
+// unescapeRDNValue unescapes an RFC2253 attribute value.
+func unescapeRDNValue(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c != '\\' || i+1 >= len(value) {
+			b.WriteByte(c)
+			continue
+		}
+		if i+2 < len(value) {
+			if decoded, err := hex.DecodeString(value[i+1 : i+3]); err == nil {
+				b.Write(decoded)
+				i += 2
+				continue
+			}
+		}
+		i++
+		b.WriteByte(value[i])
+	}
+	return b.String()
+}
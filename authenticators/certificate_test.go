@@ -0,0 +1,256 @@
+package authenticators
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestCertificate(t *testing.T, cn string, dnsNames []string, uris []string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     dnsNames,
+	}
+	for _, u := range uris {
+		parsed, err := url.Parse(u)
+		require.NoError(t, err)
+		template.URIs = append(template.URIs, parsed)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert
+}
+
+func TestCertificateAuthenticator(t *testing.T) {
+
+	rules := `[
+		{"source": "uri", "matches": "^spiffe://cluster.local/ns/([^/]+)/sa/([^/]+)$",
+		 "user": "system:serviceaccount:$1:$2", "groups": ["system:serviceaccounts:$1"]},
+		{"source": "dns", "matches": "^(.+)\\.internal$", "user": "$1"},
+		{"source": "dns", "matches": "^(?:([a-z]+)\\.)?svc\\.example$", "user": "$1", "groups": ["$1"]},
+		{"source": "cn", "matches": "^admin$", "user": "$0", "groups": ["admins"]}
+	]`
+	authn, err := NewCertificateAuthenticator(rules, []string{"10.0.0.0/8", "127.0.0.1"})
+	require.NoError(t, err)
+
+	spiffeCert := newTestCertificate(t, "ignored", nil,
+		[]string{"spiffe://cluster.local/ns/kubeflow/sa/pipeline-runner"})
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: spiffeCert.Raw})
+
+	tests := []struct {
+		testName   string
+		remoteAddr string
+		xfcc       string
+		peerCert   *x509.Certificate
+		user       string
+		groups     []string
+		success    bool
+	}{
+		{
+			testName: "No certificate",
+			success:  false,
+		},
+		{
+			testName: "TLS peer certificate with SPIFFE ID",
+			peerCert: spiffeCert,
+			user:     "system:serviceaccount:kubeflow:pipeline-runner",
+			groups:   []string{"system:serviceaccounts:kubeflow"},
+			success:  true,
+		},
+		{
+			testName: "TLS peer certificate with DNS SAN",
+			peerCert: newTestCertificate(t, "ignored", []string{"billing.internal"}, nil),
+			user:     "billing",
+			groups:   []string{},
+			success:  true,
+		},
+		{
+			testName: "TLS peer certificate matches no rule",
+			peerCert: newTestCertificate(t, "nobody", []string{"example.com"}, nil),
+			success:  false,
+		},
+		{
+			testName:   "XFCC from trusted proxy",
+			remoteAddr: "10.1.2.3:4567",
+			xfcc: `By=spiffe://cluster.local/ns/istio-system/sa/authservice;` +
+				`Hash=abcd;Subject="CN=admin,O=Example";URI=`,
+			user:    "admin",
+			groups:  []string{"admins"},
+			success: true,
+		},
+		{
+			testName:   "XFCC from trusted proxy uses the last element",
+			remoteAddr: "127.0.0.1:4567",
+			xfcc: `Hash=abcd;Subject="CN=admin";URI=,` +
+				`Hash=efgh;URI=spiffe://cluster.local/ns/team-a/sa/default`,
+			user:    "system:serviceaccount:team-a:default",
+			groups:  []string{"system:serviceaccounts:team-a"},
+			success: true,
+		},
+		{
+			testName:   "XFCC with the whole certificate",
+			remoteAddr: "10.1.2.3:4567",
+			xfcc:       `Hash=abcd;Cert="` + url.QueryEscape(string(certPEM)) + `";Subject="CN=admin"`,
+			user:       "system:serviceaccount:kubeflow:pipeline-runner",
+			groups:     []string{"system:serviceaccounts:kubeflow"},
+			success:    true,
+		},
+		{
+			testName: "TLS peer certificate with a template that expands to nothing",
+			peerCert: newTestCertificate(t, "ignored", []string{"svc.example"}, nil),
+			success:  false,
+		},
+		{
+			testName: "TLS peer certificate with an optional subexpression",
+			peerCert: newTestCertificate(t, "ignored", []string{"team.svc.example"}, nil),
+			user:     "team",
+			groups:   []string{"team"},
+			success:  true,
+		},
+		{
+			testName:   "XFCC with an escaped comma in the subject",
+			remoteAddr: "10.1.2.3:4567",
+			xfcc:       `Hash=abcd;Subject="O=Evil\\, CN=admin,CN=other"`,
+			success:    false,
+		},
+		{
+			testName:   "XFCC from untrusted address",
+			remoteAddr: "192.168.1.1:4567",
+			xfcc:       `Hash=abcd;Subject="CN=admin"`,
+			success:    false,
+		},
+		{
+			testName:   "XFCC from trusted proxy over mTLS",
+			remoteAddr: "10.1.2.3:4567",
+			xfcc:       `Hash=abcd;Subject="CN=admin"`,
+			peerCert:   newTestCertificate(t, "ignored", []string{"envoy.internal"}, nil),
+			user:       "admin",
+			groups:     []string{"admins"},
+			success:    true,
+		},
+		{
+			testName:   "TLS peer certificate of trusted proxy without XFCC",
+			remoteAddr: "10.1.2.3:4567",
+			peerCert:   newTestCertificate(t, "ignored", []string{"envoy.internal"}, nil),
+			success:    false,
+		},
+		{
+			testName:   "XFCC from untrusted client with TLS peer certificate",
+			remoteAddr: "192.168.1.1:4567",
+			xfcc:       `Hash=abcd;Subject="CN=admin"`,
+			peerCert:   newTestCertificate(t, "ignored", []string{"billing.internal"}, nil),
+			user:       "billing",
+			groups:     []string{},
+			success:    true,
+		},
+		{
+			testName:   "Malformed XFCC",
+			remoteAddr: "10.1.2.3:4567",
+			xfcc:       `Hash=abcd;Subject="CN=admin`,
+			success:    false,
+		},
+	}
+
+	for _, c := range tests {
+		t.Run(c.testName, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			if c.remoteAddr != "" {
+				r.RemoteAddr = c.remoteAddr
+			}
+			if c.xfcc != "" {
+				r.Header.Set(XFCCHeader, c.xfcc)
+			}
+			if c.peerCert != nil {
+				r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{c.peerCert}}
+			}
+
+			user, found, _ := authn.Authenticate(httptest.NewRecorder(), r)
+			require.Equal(t, c.success, found)
+			if c.success {
+				require.Equal(t, c.user, user.Name)
+				require.Equal(t, c.groups, user.Groups)
+			}
+		})
+	}
+}
+
+func TestCommonNameFromSubject(t *testing.T) {
+	tests := map[string]string{
+		"CN=admin,O=Example":         "admin",
+		"O=Example, cn=admin":        "admin",
+		`CN=Doe\, John,O=Example`:    "Doe, John",
+		`CN=Doe\2C John`:             "Doe, John",
+		`O=Evil\, CN=admin,CN=other`: "other",
+		"CN=admin+UID=1,O=Example":   "admin",
+		"O=Example":                  "",
+	}
+	for subject, cn := range tests {
+		require.Equal(t, cn, commonNameFromSubject(subject), subject)
+	}
+}
+
+func TestNewCertificateAuthenticator(t *testing.T) {
+
+	tests := []struct {
+		testName       string
+		rules          string
+		trustedProxies []string
+		success        bool
+	}{
+		{
+			testName: "Default rules",
+			success:  true,
+		},
+		{
+			testName: "Unsupported source",
+			rules:    `[{"source": "email", "matches": ".*", "user": "$0"}]`,
+			success:  false,
+		},
+		{
+			testName: "Missing user",
+			rules:    `[{"source": "cn", "matches": ".*"}]`,
+			success:  false,
+		},
+		{
+			testName: "Invalid regular expression",
+			rules:    `[{"source": "cn", "matches": "(", "user": "$0"}]`,
+			success:  false,
+		},
+		{
+			testName:       "Invalid trusted proxy",
+			trustedProxies: []string{"not-an-ip"},
+			success:        false,
+		},
+		{
+			testName:       "IPv6 trusted proxy",
+			trustedProxies: []string{"::1", "fd00::/8"},
+			success:        true,
+		},
+	}
+
+	for _, c := range tests {
+		t.Run(c.testName, func(t *testing.T) {
+			_, err := NewCertificateAuthenticator(c.rules, c.trustedProxies)
+			require.Equal(t, c.success, err == nil, "unexpected error: %v", err)
+		})
+	}
+}
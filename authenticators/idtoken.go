@@ -81,7 +81,11 @@ func (s *IDTokenAuthenticator) Authenticate(w http.ResponseWriter, r *http.Reque
 		return &common.User{}, true, nil
 	}
 
-	groups := claims.Groups()
+	groups, err := claims.Groups()
+	if err != nil {
+		logger.Errorf("retrieving user groups failed: %v", err)
+		return nil, false, &common.AuthenticatorSpecificError{Err: err}
+	}
 
 	// Authentication using header successfully completed
 	extra := map[string][]string{"auth-method": {"header"}}
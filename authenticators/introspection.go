@@ -0,0 +1,158 @@
+package authenticators
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/arrikto/oidc-authservice/common"
+	"github.com/arrikto/oidc-authservice/oidc"
+	"github.com/patrickmn/go-cache"
+	"github.com/pkg/errors"
+)
+
+// TokenIntrospector introspects access tokens, as described in RFC7662.
+// It is implemented by *sessions.SessionManager.
+type TokenIntrospector interface {
+	IntrospectToken(ctx context.Context, token string) (*oidc.Introspection, error)
+}
+
+type IntrospectionAuthenticator struct {
+	Header       string   // header name where the access token is stored
+	UserIDClaim  string   // retrieve the userid claim
+	GroupsClaim  string   // retrieve the groups claim
+	Audiences    []string // if not empty, the token must have one of them
+	Scopes       []string // if not empty, the token must have all of them
+	Introspector TokenIntrospector
+	TLSConfig    common.TlsConfig
+
+	// cache holds the users of active tokens until the tokens expire.
+	cache *cache.Cache
+}
+
+func NewIntrospectionAuthenticator(
+	header string,
+	userIDClaim string,
+	groupsClaim string,
+	audiences []string,
+	scopes []string,
+	tlsCfg common.TlsConfig,
+	introspector TokenIntrospector,
+) Authenticator {
+	return &IntrospectionAuthenticator{
+		Header:       header,
+		UserIDClaim:  userIDClaim,
+		GroupsClaim:  groupsClaim,
+		Audiences:    audiences,
+		Scopes:       scopes,
+		Introspector: introspector,
+		TLSConfig:    tlsCfg,
+		cache:        cache.New(cache.NoExpiration, 10*time.Minute),
+	}
+}
+
+func (s *IntrospectionAuthenticator) Authenticate(w http.ResponseWriter, r *http.Request) (*common.User, bool, error) {
+	logger := common.RequestLogger(r, "introspection access token authenticator")
+
+	bearer := common.GetBearerToken(r.Header.Get(s.Header))
+	if len(bearer) == 0 {
+		logger.Debug("No bearer token found")
+		return nil, false, nil
+	}
+
+	if cached, found := s.cache.Get(bearer); found {
+		logger.Debug("Found introspected token in the cache")
+		return cached.(*common.User), true, nil
+	}
+
+	ctx := s.TLSConfig.Context(r.Context())
+	introspection, err := s.Introspector.IntrospectToken(ctx, bearer)
+	if err != nil {
+		var reqErr *common.RequestError
+		if !errors.As(err, &reqErr) {
+			return nil, false, errors.Wrap(err, "Introspection request failed unexpectedly")
+		}
+
+		return nil, false, errors.Wrapf(err, "Introspection request failed with code '%d'", reqErr.Response.StatusCode)
+	}
+
+	// The token may be a session ID or an ID token, which the IdP doesn't
+	// know of, so let the next authenticators try it.
+	if !introspection.Active {
+		logger.Info("Access token is not active")
+		return nil, false, nil
+	}
+
+	if err := s.validate(introspection); err != nil {
+		logger.Infof("Access token validation failed: %v", err)
+		return nil, false, &common.AuthenticatorSpecificError{Err: err}
+	}
+
+	var claims map[string]interface{}
+	if claimErr := introspection.Claims(&claims); claimErr != nil {
+		logger.Errorf("Retrieving user claims failed: %v", claimErr)
+		return nil, false, &common.AuthenticatorSpecificError{Err: claimErr}
+	}
+
+	userID, groups, claimErr := s.retrieveUserIDGroupsClaims(claims)
+	if claimErr != nil {
+		return nil, false, &common.AuthenticatorSpecificError{Err: claimErr}
+	}
+
+	// Authentication using header successfully completed
+	extra := map[string][]string{"auth-method": {"header"}}
+
+	user := &common.User{
+		Name:   userID,
+		Groups: groups,
+		Extra:  extra,
+	}
+
+	// Cache the result until the token expires. The introspection endpoint
+	// is the only one that knows if a token without an expiry is still
+	// active, so don't cache those.
+	if expiry := introspection.ExpiresAt(); !expiry.IsZero() {
+		s.cache.Set(bearer, user, time.Until(expiry))
+	}
+	return user, true, nil
+}
+
+// validate examines if the token is active and has the expected audiences
+// and scopes.
+func (s *IntrospectionAuthenticator) validate(introspection *oidc.Introspection) error {
+	if !introspection.Active {
+		return errors.New("access token is not active")
+	}
+	if expiry := introspection.ExpiresAt(); !expiry.IsZero() && time.Now().After(expiry) {
+		return errors.New("access token has expired")
+	}
+	if len(s.Audiences) > 0 && !common.Contains(s.Audiences, introspection.Audience) {
+		return errors.Errorf("access token audiences %v don't include any of the "+
+			"expected audiences %v", introspection.Audience, s.Audiences)
+	}
+	tokenScopes := introspection.Scopes()
+	for _, scope := range s.Scopes {
+		if !common.Contains(tokenScopes, []string{scope}) {
+			return errors.Errorf("access token doesn't have the required scope '%s'", scope)
+		}
+	}
+	return nil
+}
+
+// Retrieve the USERID_CLAIM and the GROUPS_CLAIM from the introspection
+// response. Unlike the userinfo response, the introspection response often
+// doesn't include the user's groups, so a missing GROUPS_CLAIM is allowed.
+func (s *IntrospectionAuthenticator) retrieveUserIDGroupsClaims(claims map[string]interface{}) (string, []string, error) {
+
+	userID, err := common.UserIDFromClaims(claims, s.UserIDClaim)
+	if err != nil {
+		return "", []string{}, errors.Wrap(err, "failed to retrieve USERID_CLAIM from the introspection response")
+	}
+
+	groups, err := common.GroupsFromClaims(claims, s.GroupsClaim)
+	if err != nil && !common.IsClaimNotFound(err) {
+		return "", []string{}, errors.Wrap(err, "failed to retrieve GROUPS_CLAIM from the introspection response")
+	}
+
+	return userID, groups, nil
+}
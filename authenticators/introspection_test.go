@@ -0,0 +1,178 @@
+package authenticators
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/arrikto/oidc-authservice/common"
+	"github.com/arrikto/oidc-authservice/oidc"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+// fakeIntrospector serves the introspection responses of known tokens and
+// counts the introspection requests.
+type fakeIntrospector struct {
+	responses map[string]string
+	requests  int
+}
+
+func (f *fakeIntrospector) IntrospectToken(ctx context.Context, token string) (*oidc.Introspection, error) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.requests++
+		resp, ok := f.responses[r.PostFormValue("token")]
+		if !ok {
+			resp = `{"active": false}`
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(resp))
+	}))
+	defer srv.Close()
+	return oidc.IntrospectToken(ctx, srv.URL, token, &oauth2.Config{})
+}
+
+func introspectionFromJSON(raw string) (*oidc.Introspection, error) {
+	introspection := &oidc.Introspection{}
+	if err := json.Unmarshal([]byte(raw), introspection); err != nil {
+		return nil, err
+	}
+	return introspection, nil
+}
+
+func TestIntrospectionAuthenticatorValidate(t *testing.T) {
+
+	s := &IntrospectionAuthenticator{
+		Audiences: []string{"api"},
+		Scopes:    []string{"read", "write"},
+	}
+	future := time.Now().Add(time.Hour).Unix()
+	past := time.Now().Add(-time.Hour).Unix()
+
+	tests := []struct {
+		testName string
+		resp     string
+		success  bool
+	}{
+		{
+			testName: "Inactive token",
+			resp:     `{"active": false}`,
+			success:  false,
+		},
+		{
+			testName: "Expired token",
+			resp:     fmt.Sprintf(`{"active": true, "aud": "api", "scope": "read write", "exp": %d}`, past),
+			success:  false,
+		},
+		{
+			testName: "Unexpected audience",
+			resp:     fmt.Sprintf(`{"active": true, "aud": ["other"], "scope": "read write", "exp": %d}`, future),
+			success:  false,
+		},
+		{
+			testName: "Missing scope",
+			resp:     fmt.Sprintf(`{"active": true, "aud": "api", "scope": "read", "exp": %d}`, future),
+			success:  false,
+		},
+		{
+			testName: "Valid token",
+			resp:     fmt.Sprintf(`{"active": true, "aud": ["other", "api"], "scope": "write read", "exp": %d}`, future),
+			success:  true,
+		},
+	}
+
+	for _, c := range tests {
+		t.Run(c.testName, func(t *testing.T) {
+			introspection, err := introspectionFromJSON(c.resp)
+			require.NoError(t, err)
+
+			err = s.validate(introspection)
+			require.Equal(t, c.success, err == nil, "unexpected error: %v", err)
+		})
+	}
+}
+
+func TestIntrospectionAuthenticator(t *testing.T) {
+
+	introspector := &fakeIntrospector{responses: map[string]string{
+		"token": fmt.Sprintf(`{"active": true, "exp": %d, "email": "user@example.com",
+			"groups": ["a", "b"]}`, time.Now().Add(time.Hour).Unix()),
+		"no-exp":    `{"active": true, "email": "other@example.com"}`,
+		"no-userid": `{"active": true, "sub": "1234"}`,
+	}}
+	s := NewIntrospectionAuthenticator("Authorization", "email", "groups", nil, nil,
+		common.TlsConfig{}, introspector)
+
+	tests := []struct {
+		testName string
+		token    string
+		user     string
+		groups   []string
+		requests int
+		success  bool
+	}{
+		{
+			testName: "Inactive token",
+			token:    "unknown",
+			requests: 1,
+			success:  false,
+		},
+		{
+			testName: "Active token",
+			token:    "token",
+			user:     "user@example.com",
+			groups:   []string{"a", "b"},
+			requests: 2,
+			success:  true,
+		},
+		{
+			testName: "Active token is cached until it expires",
+			token:    "token",
+			user:     "user@example.com",
+			groups:   []string{"a", "b"},
+			requests: 2,
+			success:  true,
+		},
+		{
+			testName: "Active token without expiry",
+			token:    "no-exp",
+			user:     "other@example.com",
+			groups:   []string{},
+			requests: 3,
+			success:  true,
+		},
+		{
+			testName: "Active token without expiry is not cached",
+			token:    "no-exp",
+			user:     "other@example.com",
+			groups:   []string{},
+			requests: 4,
+			success:  true,
+		},
+		{
+			testName: "No USERID_CLAIM found",
+			token:    "no-userid",
+			requests: 5,
+			success:  false,
+		},
+	}
+
+	for _, c := range tests {
+		t.Run(c.testName, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("Authorization", "Bearer "+c.token)
+
+			user, found, err := s.Authenticate(httptest.NewRecorder(), r)
+			require.Equal(t, c.success, found, "unexpected error: %v", err)
+			require.Equal(t, c.requests, introspector.requests)
+			if c.success {
+				require.Equal(t, c.user, user.Name)
+				require.Equal(t, c.groups, user.Groups)
+			}
+		})
+	}
+}
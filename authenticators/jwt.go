@@ -8,6 +8,7 @@ import (
 
 	"github.com/arrikto/oidc-authservice/common"
 	"github.com/arrikto/oidc-authservice/sessions"
+	"github.com/pkg/errors"
 )
 
 const (
@@ -152,19 +153,15 @@ func (s *JWTTokenAuthenticator) performLocalChecks(bearer string) error {
 // Retrieve the USERID_CLAIM and the GROUPS_CLAIM from the JWT access token
 func (s *JWTTokenAuthenticator) retrieveUserIDGroupsClaims(claims map[string]interface{}) (string, []string, error) {
 
-	if claims[s.UserIDClaim] == nil {
-		claimErr := fmt.Errorf("USERID_CLAIM not found in the JWT token")
-		return "", []string{}, claimErr
+	userID, err := common.UserIDFromClaims(claims, s.UserIDClaim)
+	if err != nil {
+		return "", []string{}, errors.Wrap(err, "failed to retrieve USERID_CLAIM from the JWT token")
 	}
 
-	groups := []string{}
-	groupsClaim := claims[s.GroupsClaim]
-	if groupsClaim == nil {
-		claimErr := fmt.Errorf("GROUPS_CLAIM not found in the JWT token")
-		return "", []string{}, claimErr
+	groups, err := common.GroupsFromClaims(claims, s.GroupsClaim)
+	if err != nil {
+		return "", []string{}, errors.Wrap(err, "failed to retrieve GROUPS_CLAIM from the JWT token")
 	}
 
-	groups = common.InterfaceSliceToStringSlice(groupsClaim.([]interface{}))
-
-	return claims[s.UserIDClaim].(string), groups, nil
+	return userID, groups, nil
 }
@@ -87,21 +87,17 @@ func (s *OpaqueTokenAuthenticator) Authenticate(w http.ResponseWriter, r *http.R
 // Retrieve the USERID_CLAIM and the GROUPS_CLAIM from the /userinfo response
 func (s *OpaqueTokenAuthenticator) retrieveUserIDGroupsClaims(claims map[string]interface{}) (string, []string, error) {
 
-	if claims[s.UserIDClaim] == nil {
-		claimErr := errors.New("USERID_CLAIM not found in the response of the userinfo endpoint")
-		return "", []string{}, claimErr
+	userID, err := common.UserIDFromClaims(claims, s.UserIDClaim)
+	if err != nil {
+		return "", []string{}, errors.Wrap(err, "failed to retrieve USERID_CLAIM from the response of the userinfo endpoint")
 	}
 
-	groups := []string{}
-	groupsClaim := claims[s.GroupsClaim]
-	if groupsClaim == nil {
-		claimErr := errors.New("GROUPS_CLAIM not found in the response of the userinfo endpoint")
-		return "", []string{}, claimErr
+	groups, err := common.GroupsFromClaims(claims, s.GroupsClaim)
+	if err != nil {
+		return "", []string{}, errors.Wrap(err, "failed to retrieve GROUPS_CLAIM from the response of the userinfo endpoint")
 	}
 
-	groups = common.InterfaceSliceToStringSlice(groupsClaim.([]interface{}))
-
-	return claims[s.UserIDClaim].(string), groups, nil
+	return userID, groups, nil
 }
 
 // The Opaque Access Token Authenticator implements the Cacheable
@@ -68,3 +68,11 @@ func TestRetrieveUserIDGroupsUserInfo(t *testing.T) {
 		})
 	}
 }
+
+func TestOpaqueTokenAuthenticatorCacheable(t *testing.T) {
+
+	var authn Authenticator = &OpaqueTokenAuthenticator{}
+	if _, ok := authn.(Cacheable); !ok {
+		t.Errorf("OpaqueTokenAuthenticator doesn't implement Cacheable")
+	}
+}
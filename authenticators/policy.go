@@ -0,0 +1,151 @@
+package authenticators
+
+import (
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	"github.com/arrikto/oidc-authservice/common"
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// PoliciesConfig is the schema of the file with the authentication policies.
+type PoliciesConfig struct {
+	Policies []*Policy `yaml:"policies"`
+}
+
+// Policy chooses how the requests that it matches are authenticated. A
+// request matches a policy if it matches all of its non-empty match fields.
+type Policy struct {
+	// Name identifies the policy in the logs.
+	Name string `yaml:"name"`
+
+	// Hosts are the hosts of the requests, as glob patterns.
+	Hosts []string `yaml:"hosts"`
+	// PathPrefixes are the prefixes of the paths of the requests.
+	PathPrefixes []string `yaml:"pathPrefixes"`
+	// PathRegex is a regular expression that the paths of the requests
+	// must match.
+	PathRegex string `yaml:"pathRegex"`
+	// Methods are the HTTP methods of the requests.
+	Methods []string `yaml:"methods"`
+
+	// Anonymous allows the requests without authentication.
+	Anonymous bool `yaml:"anonymous"`
+	// Authenticators are the names of the authenticators of the chain that
+	// the requests are authenticated with. Empty means all of them.
+	Authenticators []string `yaml:"authenticators"`
+	// Login chooses whether unauthenticated users are redirected to log in
+	// or denied with a 401. Defaults to true.
+	Login *bool `yaml:"login"`
+
+	pathRegex *regexp.Regexp
+}
+
+// LoadPoliciesConfig reads and validates the file with the authentication
+// policies. The policies may only refer to authenticators of the given
+// chain.
+func LoadPoliciesConfig(configPath string, chain Chain) (*PoliciesConfig, error) {
+	raw, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read authentication policies file")
+	}
+	var c PoliciesConfig
+	if err := yaml.Unmarshal(raw, &c); err != nil {
+		return nil, errors.Wrap(err, "failed to parse authentication policies file")
+	}
+
+	names := map[string]bool{}
+	for _, link := range chain {
+		names[link.Name] = true
+	}
+	for i, p := range c.Policies {
+		if p.Name == "" {
+			return nil, errors.Errorf("policy %d: 'name' field is missing", i)
+		}
+		if p.PathRegex != "" {
+			if p.pathRegex, err = regexp.Compile(p.PathRegex); err != nil {
+				return nil, errors.Wrapf(err, "policy %s: invalid pathRegex", p.Name)
+			}
+		}
+		for _, name := range p.Authenticators {
+			if !names[name] {
+				return nil, errors.Errorf("policy %s: unknown authenticator '%s'", p.Name, name)
+			}
+		}
+	}
+	return &c, nil
+}
+
+// Match returns the first policy that matches a request with the given host,
+// method and path, or nil if no policy matches.
+func (c *PoliciesConfig) Match(host, method, path string) *Policy {
+	if c == nil {
+		return nil
+	}
+	for _, p := range c.Policies {
+		if p.matches(host, method, path) {
+			return p
+		}
+	}
+	return nil
+}
+
+func (p *Policy) matches(host, method, path string) bool {
+	if len(p.Hosts) > 0 && !common.MatchHost(p.Hosts, host) {
+		return false
+	}
+	if len(p.Methods) > 0 && !containsFold(p.Methods, method) {
+		return false
+	}
+	if len(p.PathPrefixes) > 0 && !hasAnyPrefix(path, p.PathPrefixes) {
+		return false
+	}
+	if p.pathRegex != nil && !p.pathRegex.MatchString(path) {
+		return false
+	}
+	return true
+}
+
+// LoginEnabled examines if the unauthenticated users are redirected to log
+// in.
+func (p *Policy) LoginEnabled() bool {
+	return p.Login == nil || *p.Login
+}
+
+// Chain returns the authenticators of the given chain that the policy
+// allows, in the order of the chain.
+func (p *Policy) Chain(chain Chain) Chain {
+	if len(p.Authenticators) == 0 {
+		return chain
+	}
+	filtered := Chain{}
+	for _, link := range chain {
+		for _, name := range p.Authenticators {
+			if link.Name == name {
+				filtered = append(filtered, link)
+				break
+			}
+		}
+	}
+	return filtered
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
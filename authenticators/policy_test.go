@@ -0,0 +1,128 @@
+package authenticators
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func loadTestPolicies(t *testing.T, config string, chain Chain) (*PoliciesConfig, error) {
+	path := filepath.Join(t.TempDir(), "policies.yaml")
+	require.NoError(t, ioutil.WriteFile(path, []byte(config), 0600))
+	return LoadPoliciesConfig(path, chain)
+}
+
+func TestPolicies(t *testing.T) {
+	chain := Chain{{Name: "kubernetes"}, {Name: "session"}, {Name: "jwt"}}
+	policies, err := loadTestPolicies(t, `
+policies:
+- name: health
+  pathPrefixes: ["/healthz", "/readyz"]
+  anonymous: true
+- name: api
+  hosts: ["api.example.com", "*.api.example.com"]
+  authenticators: [jwt, kubernetes]
+  login: false
+- name: ui-writes
+  hosts: ["ui.example.com"]
+  methods: [POST, PUT]
+  pathRegex: "^/apis/[^/]+/v1/"
+  authenticators: [session]
+`, chain)
+	require.NoError(t, err)
+
+	tests := []struct {
+		testName       string
+		host           string
+		method         string
+		path           string
+		policy         string
+		authenticators []string
+		login          bool
+	}{
+		{
+			testName: "anonymous path",
+			host:     "ui.example.com", method: "GET", path: "/healthz",
+			policy: "health", authenticators: []string{"kubernetes", "session", "jwt"}, login: true,
+		},
+		{
+			testName: "api host with port",
+			host:     "v2.API.example.com:443", method: "GET", path: "/apis",
+			policy: "api", authenticators: []string{"kubernetes", "jwt"}, login: false,
+		},
+		{
+			testName: "method and regex",
+			host:     "ui.example.com", method: "post", path: "/apis/pipelines/v1/runs",
+			policy: "ui-writes", authenticators: []string{"session"}, login: true,
+		},
+		{
+			testName: "regex mismatch",
+			host:     "ui.example.com", method: "POST", path: "/apis/pipelines/v2/runs",
+		},
+		{
+			testName: "method mismatch",
+			host:     "ui.example.com", method: "GET", path: "/apis/pipelines/v1/runs",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			policy := policies.Match(test.host, test.method, test.path)
+			if test.policy == "" {
+				require.Nil(t, policy)
+				return
+			}
+			require.NotNil(t, policy)
+			require.Equal(t, test.policy, policy.Name)
+			require.Equal(t, test.login, policy.LoginEnabled())
+			names := []string{}
+			for _, link := range policy.Chain(chain) {
+				names = append(names, link.Name)
+			}
+			require.Equal(t, test.authenticators, names)
+		})
+	}
+
+	// No policies match nothing
+	var none *PoliciesConfig
+	require.Nil(t, none.Match("ui.example.com", "GET", "/"))
+}
+
+func TestLoadPoliciesConfigErrors(t *testing.T) {
+	chain := Chain{{Name: "session"}}
+	tests := []struct {
+		testName string
+		config   string
+	}{
+		{
+			testName: "missing name",
+			config: `
+policies:
+- hosts: ["api.example.com"]
+`,
+		},
+		{
+			testName: "invalid regex",
+			config: `
+policies:
+- name: api
+  pathRegex: "("
+`,
+		},
+		{
+			testName: "unknown authenticator",
+			config: `
+policies:
+- name: api
+  authenticators: [jwt]
+`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			_, err := loadTestPolicies(t, test.config, chain)
+			require.Error(t, err)
+		})
+	}
+}
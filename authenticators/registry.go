@@ -0,0 +1,119 @@
+package authenticators
+
+import (
+	"io/ioutil"
+	"sort"
+
+	"github.com/arrikto/oidc-authservice/common"
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// Error policies of a chain entry, i.e., whether an error of its
+// authenticator ends the authentication of the request with a 401 or the
+// next authenticator of the chain is tried.
+const (
+	// OnErrorDefault ends the authentication on a LoginExpiredError or an
+	// AuthenticatorSpecificError and tries the next authenticator on any
+	// other error.
+	OnErrorDefault = ""
+	// OnErrorStop ends the authentication on any error.
+	OnErrorStop = "stop"
+	// OnErrorContinue tries the next authenticator on any error.
+	OnErrorContinue = "continue"
+)
+
+// ChainConfig is the schema of the file with the authenticator chain.
+type ChainConfig struct {
+	Authenticators []ChainEntry `yaml:"authenticators"`
+}
+
+// ChainEntry configures an authenticator of the chain.
+type ChainEntry struct {
+	common.TypedEntry `yaml:",inline"`
+	// OnError is the error policy of the entry.
+	OnError string `yaml:"onError"`
+}
+
+// Factory creates the authenticator of a chain entry.
+type Factory func(entry *ChainEntry) (Authenticator, error)
+
+// Registry holds the authenticator factories by type.
+type Registry struct {
+	factories map[string]Factory
+}
+
+func NewRegistry() *Registry {
+	return &Registry{factories: map[string]Factory{}}
+}
+
+// Register adds the factory of an authenticator type.
+func (r *Registry) Register(typ string, factory Factory) {
+	r.factories[typ] = factory
+}
+
+// Types returns the registered authenticator types.
+func (r *Registry) Types() []string {
+	types := []string{}
+	for typ := range r.factories {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// Link is an authenticator of the chain.
+type Link struct {
+	Authenticator
+	Name    string
+	OnError string
+}
+
+// Chain is the ordered list of authenticators that a request is
+// authenticated with.
+type Chain []Link
+
+// NewChain creates the authenticators of the given entries.
+func (r *Registry) NewChain(entries []ChainEntry) (Chain, error) {
+	typed := make([]*common.TypedEntry, len(entries))
+	for i := range entries {
+		typed[i] = &entries[i].TypedEntry
+	}
+	if err := common.ValidateEntries("authenticator", typed, r.Types()); err != nil {
+		return nil, err
+	}
+
+	chain := Chain{}
+	for i := range entries {
+		entry := &entries[i]
+		switch entry.OnError {
+		case OnErrorDefault, OnErrorStop, OnErrorContinue:
+		default:
+			return nil, errors.Errorf("authenticator '%s': invalid onError '%s', must be one of "+
+				"'%s' or '%s'", entry.Name, entry.OnError, OnErrorStop, OnErrorContinue)
+		}
+
+		authn, err := r.factories[entry.Type](entry)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error creating authenticator '%s'", entry.Name)
+		}
+		chain = append(chain, Link{Authenticator: authn, Name: entry.Name, OnError: entry.OnError})
+	}
+	return chain, nil
+}
+
+// LoadChainConfig reads the file with the authenticator chain.
+func LoadChainConfig(configPath string) (*ChainConfig, error) {
+	raw, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read authenticators file")
+	}
+	var c ChainConfig
+	if err := yaml.Unmarshal(raw, &c); err != nil {
+		return nil, errors.Wrap(err, "failed to parse authenticators file")
+	}
+	if len(c.Authenticators) == 0 {
+		return nil, errors.New("authenticators file doesn't list any authenticators")
+	}
+	return &c, nil
+}
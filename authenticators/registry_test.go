@@ -0,0 +1,125 @@
+package authenticators
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/arrikto/oidc-authservice/common"
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// staticAuthenticator authenticates every request as the given user.
+type staticAuthenticator struct {
+	user string
+}
+
+func (s *staticAuthenticator) Authenticate(w http.ResponseWriter, r *http.Request) (*common.User, bool, error) {
+	return &common.User{Name: s.user}, true, nil
+}
+
+func testRegistry() *Registry {
+	registry := NewRegistry()
+	registry.Register("static", func(e *ChainEntry) (Authenticator, error) {
+		opts := struct {
+			User string `yaml:"user"`
+		}{User: "default"}
+		if err := e.DecodeOptions(&opts); err != nil {
+			return nil, err
+		}
+		return &staticAuthenticator{user: opts.User}, nil
+	})
+	return registry
+}
+
+func parseChainEntries(t *testing.T, raw string) []ChainEntry {
+	var c ChainConfig
+	require.NoError(t, yaml.Unmarshal([]byte(raw), &c))
+	return c.Authenticators
+}
+
+func TestRegistryNewChain(t *testing.T) {
+	chain, err := testRegistry().NewChain(parseChainEntries(t, `
+authenticators:
+- type: static
+- name: other
+  type: static
+  onError: continue
+  options:
+    user: other
+`))
+	require.NoError(t, err)
+	require.Len(t, chain, 2)
+
+	require.Equal(t, "static", chain[0].Name)
+	require.Equal(t, OnErrorDefault, chain[0].OnError)
+	user, _, _ := chain[0].Authenticate(nil, nil)
+	require.Equal(t, "default", user.Name)
+
+	require.Equal(t, "other", chain[1].Name)
+	require.Equal(t, OnErrorContinue, chain[1].OnError)
+	user, _, _ = chain[1].Authenticate(nil, nil)
+	require.Equal(t, "other", user.Name)
+}
+
+func TestRegistryNewChainErrors(t *testing.T) {
+	tests := []struct {
+		testName string
+		config   string
+	}{
+		{
+			testName: "unknown type",
+			config: `
+authenticators:
+- type: unknown
+`,
+		},
+		{
+			testName: "duplicate name",
+			config: `
+authenticators:
+- type: static
+- type: static
+`,
+		},
+		{
+			testName: "invalid onError",
+			config: `
+authenticators:
+- type: static
+  onError: retry
+`,
+		},
+		{
+			testName: "invalid options",
+			config: `
+authenticators:
+- type: static
+  options:
+    user: [a, b]
+`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			_, err := testRegistry().NewChain(parseChainEntries(t, test.config))
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestLoadChainConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "authenticators.yaml")
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("authenticators: []\n"), 0600))
+	_, err := LoadChainConfig(path)
+	require.Error(t, err)
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("authenticators:\n- type: static\n"), 0600))
+	c, err := LoadChainConfig(path)
+	require.NoError(t, err)
+	require.Len(t, c.Authenticators, 1)
+	require.False(t, c.Authenticators[0].HasOptions())
+}
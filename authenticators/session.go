@@ -3,6 +3,7 @@ package authenticators
 import (
 	"net/http"
 	"net/http/httptest"
+	"time"
 
 	"github.com/arrikto/oidc-authservice/common"
 	"github.com/arrikto/oidc-authservice/sessions"
@@ -27,11 +28,14 @@ type SessionAuthenticator struct {
 	// tlsCfg manages the bundles for CAs to trust when talking with the
 	// OIDC Provider. Relevant only when strictSessionValidation is enabled.
 	TLSConfig common.TlsConfig
-	// SessionManager is responsible for managing OIDC sessions
-	SessionManager sessions.SessionManager
+	// Providers are the OIDC providers, whose SessionManagers are
+	// responsible for managing the OIDC sessions of their users.
+	Providers *sessions.Providers
 	// SessionDomain is the domain that cookies issued by this app
 	// are issued under
 	SessionDomain string
+	// IdleTimeout expires the sessions without recent requests.
+	IdleTimeout sessions.IdleTimeout
 }
 
 func NewSessionAuthenticator(
@@ -40,8 +44,9 @@ func NewSessionAuthenticator(
 	tokenHeader, tokenScheme string,
 	strictSessionValidation bool,
 	tlsCfg common.TlsConfig,
-	sessionManager sessions.SessionManager,
-	sessionDomain string) Authenticator {
+	providers *sessions.Providers,
+	sessionDomain string,
+	idleTimeout sessions.IdleTimeout) Authenticator {
 
 	return &SessionAuthenticator{
 		Store:                   store,
@@ -50,8 +55,9 @@ func NewSessionAuthenticator(
 		TokenScheme:             tokenScheme,
 		StrictSessionValidation: strictSessionValidation,
 		TLSConfig:               tlsCfg,
-		SessionManager:          sessionManager,
+		Providers:               providers,
 		SessionDomain:           sessionDomain,
+		IdleTimeout:             idleTimeout,
 	}
 }
 
@@ -71,15 +77,32 @@ func (sa *SessionAuthenticator) Authenticate(w http.ResponseWriter, r *http.Requ
 		return nil, false, nil
 	}
 
+	// Use the provider that the user logged in with.
+	sessionManager := sa.Providers.ForSession(session).SessionManager
+
 	ctx := sa.TLSConfig.Context(r.Context())
+
+	// Expire the sessions that have been idle for too long, so that the
+	// user has to log in again.
+	now := time.Now()
+	if expired, reason := sa.IdleTimeout.Expired(session, now); expired {
+		logger.Infof("Session has expired: %s, revoking OIDC session", reason)
+		revokeErr := sessionManager.RevokeOIDCSession(ctx, httptest.NewRecorder(),
+			session, sa.TLSConfig, sa.SessionDomain)
+		if revokeErr != nil {
+			logger.Errorf("Failed to revoke tokens: %v", revokeErr)
+		}
+		return nil, false, nil
+	}
+
 	token := session.Values[sessions.UserSessionOAuth2Tokens].(oauth2.Token)
 
-	newToken, err := sa.SessionManager.SaveToken(session, ctx, &token, httptest.NewRecorder())
+	newToken, err := sessionManager.SaveToken(session, ctx, &token, httptest.NewRecorder())
 	if err != nil {
 		logger.Errorf("Failed to refresh token: %v", err)
 		// Access token has expired
 		logger.Info("OAuth2 tokens have expired, revoking OIDC session")
-		revokeErr := sa.SessionManager.RevokeOIDCSession(ctx, httptest.NewRecorder(),
+		revokeErr := sessionManager.RevokeOIDCSession(ctx, httptest.NewRecorder(),
 			session, sa.TLSConfig, sa.SessionDomain)
 		if revokeErr != nil {
 			logger.Errorf("Failed to revoke tokens: %v", revokeErr)
@@ -90,7 +113,7 @@ func (sa *SessionAuthenticator) Authenticate(w http.ResponseWriter, r *http.Requ
 	// User is logged in
 	if sa.StrictSessionValidation {
 		ctx := r.Context()
-		_, err := sa.SessionManager.GetUserInfo(ctx, newToken)
+		_, err := sessionManager.GetUserInfo(ctx, newToken)
 		if err != nil {
 			var reqErr *common.RequestError
 			if !errors.As(err, &reqErr) {
@@ -105,7 +128,7 @@ func (sa *SessionAuthenticator) Authenticate(w http.ResponseWriter, r *http.Requ
 			// access to the ResponseWriter and thus can't set a cookie. This
 			// means that the cookie will remain at the user's browser but it
 			// will be replaced after the user logs in again.
-			err = sa.SessionManager.RevokeSession(ctx, httptest.NewRecorder(), session, sa.TLSConfig, sa.SessionDomain)
+			err = sessionManager.RevokeSession(ctx, httptest.NewRecorder(), session, sa.TLSConfig, sa.SessionDomain)
 			if err != nil {
 				logger.Errorf("Failed to revoke tokens: %v", err)
 			}
@@ -113,6 +136,12 @@ func (sa *SessionAuthenticator) Authenticate(w http.ResponseWriter, r *http.Requ
 		}
 	}
 
+	if sa.IdleTimeout.Enabled() {
+		if err := sa.IdleTimeout.Touch(r.Context(), session, now); err != nil {
+			logger.Errorf("%v", err)
+		}
+	}
+
 	// Data written at a previous version might not have groups stored, so
 	// default to an empty list of strings.
 	// TODO: Consolidate all session serialization/deserialization in one place.
@@ -121,7 +150,11 @@ func (sa *SessionAuthenticator) Authenticate(w http.ResponseWriter, r *http.Requ
 		groups = []string{}
 	}
 
-	extra := map[string][]string{"auth-method": {authMethod}}
+	// Pass on how and when the user authenticated, for the step-up
+	// authentication requirements of the authorizers.
+	claims, _ := session.Values[sessions.UserSessionClaims].(map[string]interface{})
+	extra := common.AuthContextFromClaims(claims).Extra()
+	extra["auth-method"] = []string{authMethod}
 
 	// set auth header with user token
 	idHeader := session.Values[sessions.UserSessionIDToken].(string)
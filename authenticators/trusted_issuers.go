@@ -0,0 +1,337 @@
+package authenticators
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/arrikto/oidc-authservice/common"
+	goidc "github.com/coreos/go-oidc"
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v3"
+	"k8s.io/utils/strings/slices"
+)
+
+// TrustedIssuersConfig is the schema of the file with the trusted JWT
+// issuers.
+type TrustedIssuersConfig struct {
+	Issuers []TrustedIssuer `yaml:"issuers"`
+}
+
+// TrustedIssuer describes an issuer whose JWTs AuthService accepts.
+type TrustedIssuer struct {
+	// Name identifies the issuer in the logs. Defaults to Issuer.
+	Name string `yaml:"name"`
+	// Issuer is the expected "iss" claim of the tokens.
+	Issuer string `yaml:"issuer"`
+	// JWKSURL is the URL of the issuer's keys. If empty, it is discovered
+	// from the issuer's OIDC discovery document.
+	JWKSURL string `yaml:"jwksURL"`
+	// Audiences must contain one of the token's audiences, so that tokens
+	// that the issuer minted for other clients are rejected.
+	Audiences []string `yaml:"audiences"`
+	// Token is where the token is found in the request.
+	Token TokenSource `yaml:"token"`
+	// UserIDClaim and GroupsClaim are the paths of the claims with the
+	// user's identity and groups, e.g., "realm_access.roles". They default
+	// to the USERID_CLAIM and GROUPS_CLAIM settings.
+	UserIDClaim string `yaml:"userIDClaim"`
+	GroupsClaim string `yaml:"groupsClaim"`
+	// RequiredClaims are the claims that the token must have. A claim
+	// matches if it equals the given value or, if it is a list, contains it.
+	RequiredClaims map[string]string `yaml:"requiredClaims"`
+	// SetHeader, if not empty, is the name of the header that the token is
+	// passed on in to the upstream.
+	SetHeader string `yaml:"setHeader"`
+
+	// legacy marks the issuer of the JWTFROMEXTRAPROVIDER_* settings, which
+	// keeps the behaviour of the authenticator it replaced: it rejects the
+	// tokens of other issuers in its cookie and the tokens without groups.
+	legacy bool
+}
+
+// TokenSource is the part of the request that a token is found in. Exactly
+// one of its fields must be set.
+type TokenSource struct {
+	// Header is the name of a header with a bearer token.
+	Header string `yaml:"header"`
+	// Cookie is the name of a cookie.
+	Cookie string `yaml:"cookie"`
+	// Query is the name of a query parameter.
+	Query string `yaml:"query"`
+}
+
+func (ts TokenSource) validate() error {
+	set := 0
+	for _, v := range []string{ts.Header, ts.Cookie, ts.Query} {
+		if v != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return errors.New("exactly one of 'header', 'cookie' and 'query' must be set")
+	}
+	return nil
+}
+
+// token returns the token of the request and the authentication method
+// that it was found with.
+func (ts TokenSource) token(r *http.Request) (string, string) {
+	switch {
+	case ts.Header != "":
+		return common.GetBearerToken(r.Header.Get(ts.Header)), "header"
+	case ts.Cookie != "":
+		cookie, err := r.Cookie(ts.Cookie)
+		if err != nil {
+			return "", "cookie"
+		}
+		return cookie.Value, "cookie"
+	default:
+		return r.URL.Query().Get(ts.Query), "query"
+	}
+}
+
+// LoadTrustedIssuersConfig reads and validates the file with the trusted JWT
+// issuers.
+func LoadTrustedIssuersConfig(configPath string) (*TrustedIssuersConfig, error) {
+	raw, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read trusted issuers file")
+	}
+	var c TrustedIssuersConfig
+	if err := yaml.Unmarshal(raw, &c); err != nil {
+		return nil, errors.Wrap(err, "failed to parse trusted issuers file")
+	}
+	for i, issuer := range c.Issuers {
+		if issuer.Issuer == "" {
+			return nil, errors.Errorf("issuer %d: 'issuer' field is missing", i)
+		}
+		if err := issuer.Token.validate(); err != nil {
+			return nil, errors.Wrapf(err, "issuer %s: invalid 'token' field", issuer.Issuer)
+		}
+	}
+	return &c, nil
+}
+
+// NewLegacyTrustedIssuer returns the trusted issuer configured by the
+// JWTFROMEXTRAPROVIDER_* settings, which accept the JWTs of one extra
+// provider in a cookie.
+func NewLegacyTrustedIssuer(cookieName, issuer, issuerName, clientID, setHeader string,
+	providerURL *url.URL) (TrustedIssuer, error) {
+
+	if !slices.Contains([]string{"http", "https"}, providerURL.Scheme) {
+		return TrustedIssuer{}, fmt.Errorf(
+			"Error creating jwt from extra provider authenticator: "+
+				"provider URL is incorrect: %s",
+			providerURL.String())
+	}
+	if cookieName == "" {
+		return TrustedIssuer{}, errors.New(
+			"Error creating jwt from extra provider authenticator: cookie name is empty")
+	}
+	if clientID == "" {
+		return TrustedIssuer{}, errors.New(
+			"Error creating jwt from extra provider authenticator: clientID is empty")
+	}
+
+	return TrustedIssuer{
+		Name:        issuerName,
+		Issuer:      issuer,
+		JWKSURL:     providerURL.String() + "/keys",
+		Audiences:   []string{clientID},
+		Token:       TokenSource{Cookie: cookieName},
+		UserIDClaim: "email",
+		GroupsClaim: "groups",
+		SetHeader:   setHeader,
+		legacy:      true,
+	}, nil
+}
+
+type trustedIssuersAuthenticator struct {
+	issuers   []*trustedIssuer
+	tlsConfig common.TlsConfig
+}
+
+type trustedIssuer struct {
+	TrustedIssuer
+
+	mu       sync.Mutex
+	verifier *goidc.IDTokenVerifier
+}
+
+// NewTrustedIssuersAuthenticator returns an authenticator that accepts the
+// JWTs of the given issuers. userIDClaim and groupsClaim are used for the
+// issuers that don't specify their own claims.
+func NewTrustedIssuersAuthenticator(issuers []TrustedIssuer, userIDClaim,
+	groupsClaim string, tlsCfg common.TlsConfig) (Authenticator, error) {
+
+	s := &trustedIssuersAuthenticator{tlsConfig: tlsCfg}
+	for _, issuer := range issuers {
+		if err := issuer.Token.validate(); err != nil {
+			return nil, errors.Wrapf(err, "issuer %s: invalid token source", issuer.Issuer)
+		}
+		if len(issuer.Audiences) == 0 {
+			return nil, errors.Errorf("issuer %s: 'audiences' field is missing", issuer.Issuer)
+		}
+		if issuer.Name == "" {
+			issuer.Name = issuer.Issuer
+		}
+		if issuer.UserIDClaim == "" {
+			issuer.UserIDClaim = userIDClaim
+		}
+		if issuer.GroupsClaim == "" {
+			issuer.GroupsClaim = groupsClaim
+		}
+		paths := []string{issuer.UserIDClaim, issuer.GroupsClaim}
+		for path := range issuer.RequiredClaims {
+			paths = append(paths, path)
+		}
+		for _, path := range paths {
+			if _, err := common.ParseClaimPath(path); err != nil {
+				return nil, errors.Wrapf(err, "issuer %s", issuer.Issuer)
+			}
+		}
+		ti := &trustedIssuer{TrustedIssuer: issuer}
+		if issuer.JWKSURL != "" {
+			keySet := goidc.NewRemoteKeySet(tlsCfg.Context(context.Background()), issuer.JWKSURL)
+			ti.verifier = goidc.NewVerifier(issuer.Issuer, keySet, verifierConfig)
+		}
+		s.issuers = append(s.issuers, ti)
+	}
+	return s, nil
+}
+
+// The audiences are checked against all the configured audiences of an
+// issuer, instead of a single client ID.
+var verifierConfig = &goidc.Config{SkipClientIDCheck: true}
+
+func (s *trustedIssuersAuthenticator) Authenticate(w http.ResponseWriter, r *http.Request) (*common.User, bool, error) {
+	logger := common.RequestLogger(r, "trusted issuers JWT authenticator")
+
+	for _, issuer := range s.issuers {
+		token, authMethod := issuer.Token.token(r)
+		if token == "" {
+			continue
+		}
+		// Tokens of other issuers may be found in the same place, e.g., the
+		// Authorization header, so only verify the tokens of this issuer.
+		if !issuer.legacy && tokenIssuer(token) != issuer.Issuer {
+			continue
+		}
+		logger = logger.WithField("issuer", issuer.Name)
+
+		verifier, err := issuer.getVerifier(s.tlsConfig.Context(context.Background()))
+		if err != nil {
+			return nil, false, errors.Wrapf(err, "failed to discover the keys of issuer %s", issuer.Name)
+		}
+		jwt, err := verifier.Verify(s.tlsConfig.Context(r.Context()), token)
+		if err != nil {
+			logger.Errorf("JWT verification failed: %v", err)
+			return nil, false, &common.AuthenticatorSpecificError{Err: err}
+		}
+		if !common.Contains(issuer.Audiences, jwt.Audience) {
+			err := errors.Errorf("JWT audiences %v don't include any of the expected "+
+				"audiences %v", jwt.Audience, issuer.Audiences)
+			return nil, false, &common.AuthenticatorSpecificError{Err: err}
+		}
+
+		var claims map[string]interface{}
+		if claimErr := jwt.Claims(&claims); claimErr != nil {
+			logger.Errorf("Retrieving user claims failed: %v", claimErr)
+			return nil, false, &common.AuthenticatorSpecificError{Err: claimErr}
+		}
+		if claimErr := issuer.checkRequiredClaims(claims); claimErr != nil {
+			return nil, false, &common.AuthenticatorSpecificError{Err: claimErr}
+		}
+		userID, groups, claimErr := issuer.retrieveUserIDGroupsClaims(claims)
+		if claimErr != nil {
+			return nil, false, &common.AuthenticatorSpecificError{Err: claimErr}
+		}
+
+		user := common.User{
+			Name:   userID,
+			Groups: groups,
+			Extra:  map[string][]string{"auth-method": {authMethod}},
+		}
+		if issuer.SetHeader != "" {
+			user.Extra[issuer.SetHeader] = []string{token}
+		}
+		return &user, true, nil
+	}
+	return nil, false, nil
+}
+
+// getVerifier returns the verifier of the issuer, discovering its keys on
+// first use. The verifier fetches the keys with the given context, so it must
+// not be the context of a request.
+func (ti *trustedIssuer) getVerifier(ctx context.Context) (*goidc.IDTokenVerifier, error) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	if ti.verifier != nil {
+		return ti.verifier, nil
+	}
+	provider, err := goidc.NewProvider(ctx, ti.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	ti.verifier = provider.Verifier(verifierConfig)
+	return ti.verifier, nil
+}
+
+// checkRequiredClaims examines if the token has all the required claims.
+func (ti *trustedIssuer) checkRequiredClaims(claims map[string]interface{}) error {
+	for path, expected := range ti.RequiredClaims {
+		value, err := common.LookupClaim(claims, path)
+		if err != nil {
+			return errors.Wrap(err, "required claim not found in the JWT")
+		}
+		matched := false
+		switch v := value.(type) {
+		case []interface{}:
+			values, err := common.ClaimStrings(v)
+			matched = err == nil && slices.Contains(values, expected)
+		default:
+			matched = fmt.Sprint(v) == expected
+		}
+		if !matched {
+			return errors.Errorf("claim '%s' doesn't match the required value '%s'", path, expected)
+		}
+	}
+	return nil
+}
+
+// Retrieve the user's identity and groups from the JWT. Not all issuers
+// include the user's groups, so a missing groups claim is allowed, except for
+// the legacy issuer.
+func (ti *trustedIssuer) retrieveUserIDGroupsClaims(claims map[string]interface{}) (string, []string, error) {
+	userID, err := common.UserIDFromClaims(claims, ti.UserIDClaim)
+	if err != nil {
+		return "", []string{}, errors.Wrap(err, "failed to retrieve the user's identity from the JWT token")
+	}
+
+	groups, err := common.GroupsFromClaims(claims, ti.GroupsClaim)
+	if err != nil && (ti.legacy || !common.IsClaimNotFound(err)) {
+		return "", []string{}, errors.Wrap(err, "failed to retrieve the user's groups from the JWT token")
+	}
+	return userID, groups, nil
+}
+
+// tokenIssuer returns the unverified "iss" claim of a JWT, or an empty
+// string if the token is not a JWT.
+func tokenIssuer(token string) string {
+	payload, err := common.ParseJWT(token)
+	if err != nil {
+		return ""
+	}
+	var claims struct {
+		Issuer string `json:"iss"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return ""
+	}
+	return claims.Issuer
+}
@@ -0,0 +1,306 @@
+package authenticators
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/arrikto/oidc-authservice/common"
+	"github.com/stretchr/testify/require"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+// testIssuer is an issuer that serves its keys and discovery document.
+type testIssuer struct {
+	*httptest.Server
+	signer jose.Signer
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	jwk := jose.JSONWebKey{Key: key, KeyID: "test", Algorithm: string(jose.RS256)}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: jwk}, nil)
+	require.NoError(t, err)
+
+	ti := &testIssuer{signer: signer}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 ti.URL,
+			"jwks_uri":               ti.URL + "/keys",
+			"authorization_endpoint": ti.URL + "/auth",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{jwk.Public()}})
+	})
+	ti.Server = httptest.NewServer(mux)
+	t.Cleanup(ti.Close)
+	return ti
+}
+
+func (ti *testIssuer) token(t *testing.T, claims map[string]interface{}) string {
+	all := map[string]interface{}{
+		"iss": ti.URL,
+		"aud": "authservice",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+	for k, v := range claims {
+		all[k] = v
+	}
+	payload, err := json.Marshal(all)
+	require.NoError(t, err)
+	jws, err := ti.signer.Sign(payload)
+	require.NoError(t, err)
+	token, err := jws.CompactSerialize()
+	require.NoError(t, err)
+	return token
+}
+
+func TestTrustedIssuersAuthenticator(t *testing.T) {
+	ci := newTestIssuer(t)
+	partner := newTestIssuer(t)
+	other := newTestIssuer(t)
+
+	authn, err := NewTrustedIssuersAuthenticator([]TrustedIssuer{
+		{
+			Name:           "ci",
+			Issuer:         ci.URL,
+			JWKSURL:        ci.URL + "/keys",
+			Audiences:      []string{"authservice"},
+			Token:          TokenSource{Header: "Authorization"},
+			UserIDClaim:    "sub",
+			RequiredClaims: map[string]string{"repository_owner": "arrikto"},
+		},
+		{
+			Name:        "partner",
+			Issuer:      partner.URL,
+			Audiences:   []string{"other", "authservice"},
+			Token:       TokenSource{Query: "access_token"},
+			GroupsClaim: "realm_access.roles",
+		},
+	}, "email", "groups", nil)
+	require.NoError(t, err)
+
+	// Issuers without audiences would accept the tokens of any client
+	_, err = NewTrustedIssuersAuthenticator([]TrustedIssuer{{
+		Issuer: partner.URL,
+		Token:  TokenSource{Header: "Authorization"},
+	}}, "email", "groups", nil)
+	require.Error(t, err)
+
+	tests := []struct {
+		testName string
+		header   string
+		query    string
+		found    bool
+		err      bool
+		user     *common.User
+	}{
+		{
+			testName: "no token",
+			found:    false,
+		},
+		{
+			testName: "token of untrusted issuer",
+			header:   "Bearer " + other.token(t, map[string]interface{}{"sub": "ci"}),
+			found:    false,
+		},
+		{
+			testName: "valid header token",
+			header: "Bearer " + ci.token(t, map[string]interface{}{
+				"sub": "repo:arrikto/oidc-authservice", "repository_owner": "arrikto",
+			}),
+			found: true,
+			user: &common.User{
+				Name:   "repo:arrikto/oidc-authservice",
+				Groups: []string{},
+				Extra:  map[string][]string{"auth-method": {"header"}},
+			},
+		},
+		{
+			testName: "required claim mismatch",
+			header: "Bearer " + ci.token(t, map[string]interface{}{
+				"sub": "repo:evil/repo", "repository_owner": "evil",
+			}),
+			err: true,
+		},
+		{
+			testName: "wrong audience",
+			header: "Bearer " + ci.token(t, map[string]interface{}{
+				"sub": "ci", "repository_owner": "arrikto", "aud": "other",
+			}),
+			err: true,
+		},
+		{
+			testName: "expired token",
+			header: "Bearer " + ci.token(t, map[string]interface{}{
+				"sub": "ci", "repository_owner": "arrikto", "exp": time.Now().Add(-time.Hour).Unix(),
+			}),
+			err: true,
+		},
+		{
+			testName: "valid query token with discovery and nested groups",
+			query: partner.token(t, map[string]interface{}{
+				"email":        "user@partner.com",
+				"realm_access": map[string]interface{}{"roles": []string{"a", "b"}},
+			}),
+			found: true,
+			user: &common.User{
+				Name:   "user@partner.com",
+				Groups: []string{"a", "b"},
+				Extra:  map[string][]string{"auth-method": {"query"}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			u := &url.URL{Path: "/"}
+			if test.query != "" {
+				u.RawQuery = url.Values{"access_token": {test.query}}.Encode()
+			}
+			r := httptest.NewRequest(http.MethodGet, u.String(), nil)
+			if test.header != "" {
+				r.Header.Set("Authorization", test.header)
+			}
+			user, found, err := authn.Authenticate(httptest.NewRecorder(), r)
+			if test.err {
+				var authnErr *common.AuthenticatorSpecificError
+				require.ErrorAs(t, err, &authnErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.found, found)
+			require.Equal(t, test.user, user)
+		})
+	}
+}
+
+func TestLoadTrustedIssuersConfig(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		testName string
+		config   string
+		success  bool
+	}{
+		{
+			testName: "valid",
+			config: `
+issuers:
+- issuer: https://token.actions.githubusercontent.com
+  token:
+    header: Authorization
+  requiredClaims:
+    repository_owner: arrikto
+`,
+			success: true,
+		},
+		{
+			testName: "missing issuer",
+			config: `
+issuers:
+- token:
+    header: Authorization
+`,
+			success: false,
+		},
+		{
+			testName: "multiple token sources",
+			config: `
+issuers:
+- issuer: https://token.actions.githubusercontent.com
+  token:
+    header: Authorization
+    cookie: token
+`,
+			success: false,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			path := filepath.Join(dir, "issuers.yaml")
+			require.NoError(t, ioutil.WriteFile(path, []byte(test.config), 0600))
+			_, err := LoadTrustedIssuersConfig(path)
+			if test.success {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestNewLegacyTrustedIssuer(t *testing.T) {
+	issuer, err := NewLegacyTrustedIssuer("token", "https://issuer.example.com", "extra",
+		"client", "X-Token", common.MustParseURL("https://provider.example.com"))
+	require.NoError(t, err)
+	require.Equal(t, "https://provider.example.com/keys", issuer.JWKSURL)
+	require.Equal(t, TokenSource{Cookie: "token"}, issuer.Token)
+	require.Equal(t, []string{"client"}, issuer.Audiences)
+
+	_, err = NewLegacyTrustedIssuer("", "https://issuer.example.com", "extra",
+		"client", "", common.MustParseURL("https://provider.example.com"))
+	require.Error(t, err)
+}
+
+func TestLegacyTrustedIssuer(t *testing.T) {
+	extra := newTestIssuer(t)
+	other := newTestIssuer(t)
+
+	issuer, err := NewLegacyTrustedIssuer("token", extra.URL, "extra",
+		"authservice", "", common.MustParseURL(extra.URL))
+	require.NoError(t, err)
+	authn, err := NewTrustedIssuersAuthenticator([]TrustedIssuer{issuer}, "sub", "roles", nil)
+	require.NoError(t, err)
+
+	tests := []struct {
+		testName string
+		token    string
+		err      bool
+	}{
+		{
+			testName: "valid token",
+			token: extra.token(t, map[string]interface{}{
+				"email": "user@example.com", "groups": []string{"a"},
+			}),
+		},
+		{
+			testName: "token of another issuer",
+			token: other.token(t, map[string]interface{}{
+				"email": "user@example.com", "groups": []string{"a"},
+			}),
+			err: true,
+		},
+		{
+			testName: "missing groups claim",
+			token:    extra.token(t, map[string]interface{}{"email": "user@example.com"}),
+			err:      true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.AddCookie(&http.Cookie{Name: "token", Value: test.token})
+			user, found, err := authn.Authenticate(httptest.NewRecorder(), r)
+			if test.err {
+				var authnErr *common.AuthenticatorSpecificError
+				require.ErrorAs(t, err, &authnErr)
+				return
+			}
+			require.NoError(t, err)
+			require.True(t, found)
+			require.Equal(t, "user@example.com", user.Name)
+			require.Equal(t, []string{"a"}, user.Groups)
+		})
+	}
+}
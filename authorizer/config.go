@@ -2,7 +2,6 @@ package authorizer
 
 import (
 	"bytes"
-	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -11,7 +10,6 @@ import (
 
 	"github.com/arrikto/oidc-authservice/common"
 	log "github.com/sirupsen/logrus"
-	fsnotify "gopkg.in/fsnotify/fsnotify.v1"
 	yaml "gopkg.in/yaml.v3"
 )
 
@@ -29,9 +27,11 @@ type AuthzConfig struct {
 
 // HostRule describes authorization rules for requests that match a given host name.
 //
-// Membership is required for at least 1 group in the list.
+// Membership is required for at least 1 group in the list. If the rule has
+// step-up requirements, the user's authentication must also satisfy them.
 type HostRule struct {
-	Groups []string `yaml:"groups"`
+	Groups        []string `yaml:"groups"`
+	common.StepUp `yaml:",inline"`
 }
 
 // Matcher returns a set of groups to allow or deny.
@@ -44,45 +44,11 @@ type configAuthorizer struct {
 	path           string
 	groupMatcher   map[string]ruleMatcher
 	defaultMatcher ruleMatcher
+	stepUps        map[string]*common.StepUp
+	defaultStepUp  *common.StepUp
 	lock           sync.RWMutex
 }
 
-func watchLoop(watcher *fsnotify.Watcher, path string, do func() error) error {
-	if err := watcher.Add(path); err != nil {
-		return err
-	}
-	for {
-		select {
-		case ev, ok := <-watcher.Events:
-			if !ok {
-				return errors.New("watcher events channel closed")
-			}
-
-			log.Debugf("file watcher event: name=%s op=%s", ev.Name, ev.Op)
-
-			// do nothing on Chmod
-			if ev.Op == fsnotify.Chmod {
-				continue
-			}
-
-			if ev.Op&fsnotify.Remove == fsnotify.Remove {
-				return errors.New("watcher path removed")
-			}
-
-			log.Infof("try to reload %s", path)
-			if err := do(); err != nil {
-				return fmt.Errorf("failed to reload: %w", err)
-			}
-		case err, ok := <-watcher.Errors:
-			if !ok {
-				return fmt.Errorf("watcher event errors channel closed")
-			}
-			return fmt.Errorf("watcher error: %w", err)
-		}
-	}
-
-}
-
 func NewConfigAuthorizer(path string) (Authorizer, error) {
 	ca := configAuthorizer{}
 	ca.path = path
@@ -90,32 +56,7 @@ func NewConfigAuthorizer(path string) (Authorizer, error) {
 		return nil, err
 	}
 
-	go func() {
-		for i := 0; i < 5; i++ { // allow 5 failures before giving up
-
-			// loadConfig() before attempting to create a watcher
-			// We only want to do this on watcher reload (after an error),
-			// and avoid doing this for the first iteration
-			// since we have already run loadConfig() before we entered
-			// this loop
-			if i != 0 {
-				log.Infof("configAuthorizer: try to reload %s", path)
-				if err := ca.loadConfig(); err != nil {
-					log.Errorf("configAuthorizer: failed to reload %q: %v", ca.path, err)
-				}
-			}
-			watcher, err := fsnotify.NewWatcher()
-			if err != nil {
-				log.Errorf("couldn't create fsnotify watcher: %v", err)
-			}
-			if err = watchLoop(watcher, ca.path, ca.loadConfig); err != nil {
-				log.Errorf("configAuthorizer: error watching %q: %v", ca.path, err)
-			}
-			watcher.Close()
-			time.Sleep(1 * time.Second)
-		}
-		log.Fatal("configAuthorizer: watch loop failed, cannot continue")
-	}()
+	common.WatchFile("configAuthorizer", ca.path, ca.loadConfig)
 
 	return &ca, nil
 }
@@ -128,13 +69,18 @@ func (ca *configAuthorizer) loadConfig() error {
 
 	// build groupMatcher map
 	groupMatcher := make(map[string]ruleMatcher)
+	stepUps := make(map[string]*common.StepUp)
 	for host, rule := range authzConfig.Rules {
 		groupMatcher[host] = rule.Matcher()
+		stepUp := rule.StepUp
+		stepUps[host] = &stepUp
 	}
 
 	defaultMatcher := newRuleMatcher([]string{"*"}) // allow all by default
+	var defaultStepUp *common.StepUp
 	if authzConfig.DefaultRule != nil {
 		defaultMatcher = authzConfig.DefaultRule.Matcher()
+		defaultStepUp = &authzConfig.DefaultRule.StepUp
 	}
 
 	log.Infof("loaded AuthzConfig: %+v", *authzConfig)
@@ -142,6 +88,8 @@ func (ca *configAuthorizer) loadConfig() error {
 	defer ca.lock.Unlock()
 	ca.groupMatcher = groupMatcher
 	ca.defaultMatcher = defaultMatcher
+	ca.stepUps = stepUps
+	ca.defaultStepUp = defaultStepUp
 	ca.config = authzConfig
 	return nil
 }
@@ -184,18 +132,27 @@ func (ca *configAuthorizer) Authorize(r *http.Request, user *common.User) (bool,
 
 	ca.lock.RLock()
 	hostMatcher, ok := ca.groupMatcher[host]
+	stepUp := ca.stepUps[host]
 	defaultMatcher := ca.defaultMatcher
+	defaultStepUp := ca.defaultStepUp
 	ca.lock.RUnlock()
 
-	authed := false
-	reason := ""
-	if ok {
-		authed, reason = hostMatcher.Match(user)
-		reason = formatReason(authed, user.Name, host, host, reason)
-	} else {
-		authed, reason = defaultMatcher.Match(user)
-		reason = formatReason(authed, user.Name, host, "default", reason)
+	matched := host
+	if !ok {
+		hostMatcher = defaultMatcher
+		stepUp = defaultStepUp
+		matched = "default"
+	}
+
+	authed, reason := hostMatcher.Match(user)
+	if authed {
+		if stepUpReason := stepUp.Check(common.AuthContextFromUser(user), time.Now()); stepUpReason != "" {
+			reason = formatReason(false, user.Name, host, matched, stepUpReason)
+			log.Infof("authorization: %v", reason)
+			return false, reason, &common.StepUpRequiredError{StepUp: stepUp, Reason: stepUpReason}
+		}
 	}
+	reason = formatReason(authed, user.Name, host, matched, reason)
 
 	log.Infof("authorization: %v", reason)
 	return authed, reason, nil
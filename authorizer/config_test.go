@@ -2,7 +2,9 @@ package authorizer
 
 import (
 	"net/http"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/arrikto/oidc-authservice/common"
 	"github.com/stretchr/testify/require"
@@ -100,3 +102,49 @@ func TestConfigAuthorizerMatching(t *testing.T) {
 		})
 	}
 }
+
+func TestConfigAuthorizerStepUp(t *testing.T) {
+	ca, err := NewConfigAuthorizer("./testdata/stepUp.yaml")
+	require.NoError(t, err)
+
+	fresh := strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10)
+	stale := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	withAuth := func(u *common.User, acr string, amr []string, authTime string) *common.User {
+		u.Extra = map[string][]string{
+			common.ExtraACR:      {acr},
+			common.ExtraAMR:      amr,
+			common.ExtraAuthTime: {authTime},
+		}
+		return u
+	}
+
+	tests := []struct {
+		name    string
+		host    string
+		user    *common.User
+		allowed bool
+		stepUp  bool
+	}{
+		{"no requirements", "notebooks.io", user("user"), true, false},
+		{"wrong group", "admin.io", withAuth(user("user", "users"), "mfa", []string{"otp"}, fresh), false, false},
+		{"satisfied", "admin.io", withAuth(user("admin", "admins"), "mfa", []string{"pwd", "otp"}, fresh), true, false},
+		{"no auth context", "admin.io", user("admin", "admins"), false, true},
+		{"weak acr", "admin.io", withAuth(user("admin", "admins"), "pwd", []string{"otp"}, fresh), false, true},
+		{"missing amr", "admin.io", withAuth(user("admin", "admins"), "mfa", []string{"pwd"}, fresh), false, true},
+		{"stale login", "admin.io", withAuth(user("admin", "admins"), "mfa", []string{"otp"}, stale), false, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			allowed, reason, err := ca.Authorize(&http.Request{Host: tc.host}, tc.user)
+			require.Equalf(t, tc.allowed, allowed, "%s", reason)
+			if !tc.stepUp {
+				require.NoError(t, err)
+				return
+			}
+			var stepUpErr *common.StepUpRequiredError
+			require.ErrorAs(t, err, &stepUpErr)
+			require.Equal(t, []string{"mfa"}, stepUpErr.StepUp.ACRValues)
+			require.Equal(t, 15*time.Minute, stepUpErr.StepUp.MaxAge)
+		})
+	}
+}
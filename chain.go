@@ -0,0 +1,222 @@
+package main
+
+import (
+	"time"
+
+	"github.com/arrikto/oidc-authservice/authenticators"
+	"github.com/arrikto/oidc-authservice/common"
+	"github.com/arrikto/oidc-authservice/sessions"
+	"github.com/pkg/errors"
+)
+
+// Types of the authenticators that the chain can include.
+const (
+	kubernetesAuthenticatorType     = "kubernetes"
+	opaqueAuthenticatorType         = "opaque"
+	jwtAuthenticatorType            = "jwt"
+	introspectionAuthenticatorType  = "introspection"
+	sessionAuthenticatorType        = "session"
+	idTokenAuthenticatorType        = "idtoken"
+	trustedIssuersAuthenticatorType = "trusted-issuers"
+	certificateAuthenticatorType    = "certificate"
+	apiKeyAuthenticatorType         = "api-key"
+)
+
+// defaultChainEntries returns the authenticator chain that the *_AUTHN_*
+// settings configure, which is used if no authenticators file is given.
+func defaultChainEntries(c *common.Config) []authenticators.ChainEntry {
+	var entries []authenticators.ChainEntry
+	add := func(typ string, enabled bool) {
+		if enabled {
+			entries = append(entries, authenticators.ChainEntry{TypedEntry: common.TypedEntry{Type: typ}})
+		}
+	}
+	add(kubernetesAuthenticatorType, c.KubernetesAuthnEnabled)
+	add(c.AccessTokenAuthn, c.AccessTokenAuthnEnabled)
+	add(sessionAuthenticatorType, true)
+	add(idTokenAuthenticatorType, c.IDTokenAuthnEnabled)
+	add(trustedIssuersAuthenticatorType, c.TrustedIssuersConfigPath != "" || c.JWTFromExtraProviderEnabled)
+	add(certificateAuthenticatorType, c.CertificateAuthnEnabled)
+	add(apiKeyAuthenticatorType, c.APIKeyAuthnEnabled)
+	return entries
+}
+
+// newAuthenticatorRegistry returns the registry of all the authenticator
+// types. The options of each type default to the respective settings.
+func newAuthenticatorRegistry(c *common.Config, tlsCfg common.TlsConfig, store sessions.Store,
+	sessionManager *sessions.SessionManager, providers *sessions.Providers) *authenticators.Registry {
+
+	registry := authenticators.NewRegistry()
+
+	registry.Register(kubernetesAuthenticatorType, func(e *authenticators.ChainEntry) (authenticators.Authenticator, error) {
+		opts := struct {
+			Audiences []string `yaml:"audiences"`
+		}{Audiences: c.Audiences}
+		if err := e.DecodeOptions(&opts); err != nil {
+			return nil, err
+		}
+		return authenticators.NewKubernetesAuthenticator(opts.Audiences)
+	})
+
+	registry.Register(opaqueAuthenticatorType, func(e *authenticators.ChainEntry) (authenticators.Authenticator, error) {
+		opts := tokenOptions{Header: c.IDTokenHeader, UserIDClaim: c.UserIDClaim, GroupsClaim: c.GroupsClaim}
+		if err := e.DecodeOptions(&opts); err != nil {
+			return nil, err
+		}
+		return authenticators.NewOpaqueTokenAuthenticator(opts.Header, opts.UserIDClaim,
+			opts.GroupsClaim, tlsCfg, *sessionManager), nil
+	})
+
+	registry.Register(jwtAuthenticatorType, func(e *authenticators.ChainEntry) (authenticators.Authenticator, error) {
+		opts := struct {
+			tokenOptions `yaml:",inline"`
+			Audiences    []string `yaml:"audiences"`
+		}{
+			tokenOptions: tokenOptions{Header: c.IDTokenHeader, UserIDClaim: c.UserIDClaim, GroupsClaim: c.GroupsClaim},
+			Audiences:    c.Audiences,
+		}
+		if err := e.DecodeOptions(&opts); err != nil {
+			return nil, err
+		}
+		return authenticators.NewJWTTokenAuthenticator(opts.Header, opts.Audiences,
+			c.ProviderURL.String(), opts.UserIDClaim, opts.GroupsClaim, tlsCfg, *sessionManager), nil
+	})
+
+	registry.Register(introspectionAuthenticatorType, func(e *authenticators.ChainEntry) (authenticators.Authenticator, error) {
+		opts := struct {
+			tokenOptions `yaml:",inline"`
+			Audiences    []string `yaml:"audiences"`
+			Scopes       []string `yaml:"scopes"`
+		}{
+			tokenOptions: tokenOptions{Header: c.IDTokenHeader, UserIDClaim: c.UserIDClaim, GroupsClaim: c.GroupsClaim},
+			Audiences:    c.IntrospectionAudiences,
+			Scopes:       c.IntrospectionScopes,
+		}
+		if err := e.DecodeOptions(&opts); err != nil {
+			return nil, err
+		}
+		if _, err := sessionManager.IntrospectionEndpoint(); err != nil {
+			return nil, errors.Wrap(err, "token introspection is not supported")
+		}
+		return authenticators.NewIntrospectionAuthenticator(opts.Header, opts.UserIDClaim,
+			opts.GroupsClaim, opts.Audiences, opts.Scopes, tlsCfg, sessionManager), nil
+	})
+
+	registry.Register(sessionAuthenticatorType, func(e *authenticators.ChainEntry) (authenticators.Authenticator, error) {
+		opts := struct {
+			StrictSessionValidation bool `yaml:"strictSessionValidation"`
+		}{StrictSessionValidation: c.StrictSessionValidation}
+		if err := e.DecodeOptions(&opts); err != nil {
+			return nil, err
+		}
+		return authenticators.NewSessionAuthenticator(store, sessions.UserSessionCookie,
+			c.TokenHeader, c.TokenScheme, opts.StrictSessionValidation, tlsCfg, providers,
+			c.SessionDomain, sessions.IdleTimeout{
+				Timeout:        c.SessionIdleTimeout,
+				UpdateInterval: c.SessionActivityUpdateInterval,
+				MaxAge:         time.Duration(c.SessionMaxAge) * time.Second,
+			}), nil
+	})
+
+	registry.Register(idTokenAuthenticatorType, func(e *authenticators.ChainEntry) (authenticators.Authenticator, error) {
+		opts := tokenOptions{Header: c.IDTokenHeader, UserIDClaim: c.UserIDClaim, GroupsClaim: c.GroupsClaim}
+		if err := e.DecodeOptions(&opts); err != nil {
+			return nil, err
+		}
+		return authenticators.NewIDTokenAuthenticator(opts.Header, opts.UserIDClaim,
+			opts.GroupsClaim, tlsCfg, *sessionManager, c.TokenHeader, c.TokenScheme), nil
+	})
+
+	registry.Register(trustedIssuersAuthenticatorType, func(e *authenticators.ChainEntry) (authenticators.Authenticator, error) {
+		// Without options, use the trusted issuers of the settings.
+		if !e.HasOptions() {
+			issuers, err := settingsTrustedIssuers(c)
+			if err != nil {
+				return nil, err
+			}
+			return authenticators.NewTrustedIssuersAuthenticator(issuers, c.UserIDClaim, c.GroupsClaim, tlsCfg)
+		}
+		opts := struct {
+			ConfigPath string                         `yaml:"configPath"`
+			Issuers    []authenticators.TrustedIssuer `yaml:"issuers"`
+		}{}
+		if err := e.DecodeOptions(&opts); err != nil {
+			return nil, err
+		}
+		issuers := opts.Issuers
+		if opts.ConfigPath != "" {
+			trustedIssuersConfig, err := authenticators.LoadTrustedIssuersConfig(opts.ConfigPath)
+			if err != nil {
+				return nil, err
+			}
+			issuers = append(issuers, trustedIssuersConfig.Issuers...)
+		}
+		if len(issuers) == 0 {
+			return nil, errors.New("no trusted issuers configured")
+		}
+		return authenticators.NewTrustedIssuersAuthenticator(issuers, c.UserIDClaim, c.GroupsClaim, tlsCfg)
+	})
+
+	registry.Register(certificateAuthenticatorType, func(e *authenticators.ChainEntry) (authenticators.Authenticator, error) {
+		opts := struct {
+			Rules          string   `yaml:"rules"`
+			TrustedProxies []string `yaml:"trustedProxies"`
+		}{Rules: c.CertificateAuthnRules, TrustedProxies: c.CertificateAuthnTrustedProxies}
+		if err := e.DecodeOptions(&opts); err != nil {
+			return nil, err
+		}
+		return authenticators.NewCertificateAuthenticator(opts.Rules, opts.TrustedProxies)
+	})
+
+	registry.Register(apiKeyAuthenticatorType, func(e *authenticators.ChainEntry) (authenticators.Authenticator, error) {
+		opts := struct {
+			Header   string `yaml:"header"`
+			KeysPath string `yaml:"keysPath"`
+		}{Header: c.APIKeyAuthnHeader, KeysPath: c.APIKeyAuthnKeysPath}
+		if err := e.DecodeOptions(&opts); err != nil {
+			return nil, err
+		}
+		if opts.KeysPath == "" {
+			return nil, errors.New("no API keys file configured")
+		}
+		return authenticators.NewAPIKeyAuthenticator(opts.Header, opts.KeysPath)
+	})
+
+	return registry
+}
+
+// tokenOptions are the options of the authenticators that read a token from
+// a header.
+type tokenOptions struct {
+	Header      string `yaml:"header"`
+	UserIDClaim string `yaml:"userIDClaim"`
+	GroupsClaim string `yaml:"groupsClaim"`
+}
+
+// settingsTrustedIssuers returns the trusted issuers of the
+// TRUSTED_ISSUERS_CONFIG_PATH and JWTFROMEXTRAPROVIDER_* settings.
+func settingsTrustedIssuers(c *common.Config) ([]authenticators.TrustedIssuer, error) {
+	var issuers []authenticators.TrustedIssuer
+	if c.TrustedIssuersConfigPath != "" {
+		trustedIssuersConfig, err := authenticators.LoadTrustedIssuersConfig(c.TrustedIssuersConfigPath)
+		if err != nil {
+			return nil, err
+		}
+		issuers = trustedIssuersConfig.Issuers
+	}
+	// Add the jwt extra authentication
+	if c.JWTFromExtraProviderEnabled {
+		legacyIssuer, err := authenticators.NewLegacyTrustedIssuer(
+			c.JWTFromExtraProviderCookieName,
+			c.JWTFromExtraProviderIssuer,
+			c.JWTFromExtraProviderIssuerName,
+			c.JWTFromExtraProviderClientID,
+			c.JWTFromExtraProviderSetHeader,
+			c.JWTFromExtraProviderProviderURL)
+		if err != nil {
+			return nil, err
+		}
+		issuers = append(issuers, legacyIssuer)
+	}
+	return issuers, nil
+}
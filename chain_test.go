@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/arrikto/oidc-authservice/authenticators"
+	"github.com/arrikto/oidc-authservice/common"
+	"github.com/arrikto/oidc-authservice/oidc"
+	"github.com/arrikto/oidc-authservice/sessions"
+	cache "github.com/patrickmn/go-cache"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+// inactiveIntrospector reports every token as inactive, as an IdP does for
+// the tokens it didn't issue.
+type inactiveIntrospector struct{}
+
+func (inactiveIntrospector) IntrospectToken(ctx context.Context, token string) (*oidc.Introspection, error) {
+	return &oidc.Introspection{Active: false}, nil
+}
+
+func TestChainIntrospectionFallsThroughToSession(t *testing.T) {
+	dir := t.TempDir()
+	store, stateStore := sessions.InitiateSessionStores(&common.Config{
+		SessionStoreType:   "boltdb",
+		SessionStorePath:   filepath.Join(dir, "data.db"),
+		OIDCStateStorePath: filepath.Join(dir, "state.db"),
+	})
+	defer store.Close()
+	defer stateStore.Close()
+
+	var revocations int
+	provider := newTestOIDCProvider(t, &revocations)
+	providerURL, err := url.Parse(provider.URL)
+	require.NoError(t, err)
+	tlsCfg := common.TlsConfig(nil)
+	sessionManager := sessions.NewSessionManager(
+		context.WithValue(context.Background(), oauth2.HTTPClient, provider.Client()),
+		"client", "secret", providerURL, &url.URL{}, &url.URL{}, []string{"openid"},
+		oidc.PKCEMethodNone, false)
+	providers, err := sessions.NewProviders(&sessions.Provider{
+		Name:           sessions.DefaultProviderName,
+		SessionManager: &sessionManager,
+	})
+	require.NoError(t, err)
+
+	// A session of the device flow, whose ID is sent as a bearer token
+	session := sessions.NewSession(store, sessions.UserSessionCookie)
+	session.Options.MaxAge = 3600
+	session.Values[sessions.UserSessionUserID] = "alice"
+	session.Values[sessions.UserSessionGroups] = []string{"users"}
+	session.Values[sessions.UserSessionIDToken] = "idtoken"
+	session.Values[sessions.UserSessionOAuth2Tokens] = oauth2.Token{AccessToken: "access"}
+	w := httptest.NewRecorder()
+	require.NoError(t, session.Save(httptest.NewRequest(http.MethodGet, "/", nil), w))
+	sessionID, err := sessions.SessionIDFromResponse(w, sessions.UserSessionCookie)
+	require.NoError(t, err)
+
+	s := &server{}
+	chain := authenticators.Chain{
+		{
+			Name: introspectionAuthenticatorType,
+			Authenticator: authenticators.NewIntrospectionAuthenticator("Authorization", "email",
+				"groups", nil, nil, tlsCfg, inactiveIntrospector{}),
+		},
+		{
+			Name: sessionAuthenticatorType,
+			Authenticator: authenticators.NewSessionAuthenticator(store, sessions.UserSessionCookie,
+				"Authorization", "Bearer", false, tlsCfg, providers, "", sessions.IdleTimeout{}),
+		},
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Authorization", "Bearer "+sessionID)
+	w = httptest.NewRecorder()
+	user, ok := s.tryAuthenticators(w, r, chain, false)
+	require.True(t, ok, "unexpected response: %d %s", w.Code, w.Body.String())
+	require.NotNil(t, user)
+	require.Equal(t, "alice", user.Name)
+}
+
+// bearerAuthenticator accepts a single bearer token and counts its calls.
+// Its cache key is the bearer token, as for the Kubernetes authenticator.
+type bearerAuthenticator struct {
+	token string
+	calls int
+}
+
+func (b *bearerAuthenticator) Authenticate(w http.ResponseWriter, r *http.Request) (*common.User, bool, error) {
+	b.calls++
+	if r.Header.Get("Authorization") != "Bearer "+b.token {
+		return nil, false, nil
+	}
+	return &common.User{Name: "alice"}, true, nil
+}
+
+func (b *bearerAuthenticator) GetCacheKey(r *http.Request) string {
+	return r.Header.Get("Authorization")
+}
+
+func newCachingTestServer() *server {
+	return &server{
+		cacheEnabled:           true,
+		cacheExpirationMinutes: 5,
+		bearerUserInfoCache:    cache.New(5*time.Minute, time.Minute),
+	}
+}
+
+func TestChainCacheScopedToEntries(t *testing.T) {
+	s := newCachingTestServer()
+	// Two entries of the same type, which accept different tokens, e.g.,
+	// JWT authenticators with other audiences
+	first := &bearerAuthenticator{token: "first"}
+	second := &bearerAuthenticator{token: "second"}
+	chain := authenticators.Chain{
+		{Name: "first", Authenticator: first},
+		{Name: "second", Authenticator: second},
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Authorization", "Bearer second")
+	user, ok := s.tryAuthenticators(httptest.NewRecorder(), r, chain, true)
+	require.True(t, ok)
+	require.NotNil(t, user)
+	require.Equal(t, 1, second.calls)
+
+	// The user is cached for the entry that authenticated them
+	user, ok = s.tryAuthenticators(httptest.NewRecorder(), r, chain, true)
+	require.True(t, ok)
+	require.NotNil(t, user)
+	require.Equal(t, 1, second.calls)
+
+	// The other entry doesn't accept the token from the cache
+	user, ok = s.tryAuthenticators(httptest.NewRecorder(), r, chain[:1], true)
+	require.True(t, ok)
+	require.Nil(t, user)
+	require.Equal(t, 3, first.calls)
+}
+
+func TestPoliciesCacheScopedToChains(t *testing.T) {
+	s := newCachingTestServer()
+	kubernetes := &bearerAuthenticator{token: "service-account"}
+	apiKey := &bearerAuthenticator{token: "ci.secret"}
+	s.authenticators = authenticators.Chain{
+		{Name: "kubernetes", Authenticator: kubernetes},
+		{Name: "api-key", Authenticator: apiKey},
+	}
+	path := filepath.Join(t.TempDir(), "policies.yaml")
+	require.NoError(t, ioutil.WriteFile(path, []byte(`
+policies:
+- name: api
+  hosts: ["api.example.com"]
+  authenticators: [api-key]
+  login: false
+- name: ui
+  hosts: ["ui.example.com"]
+  authenticators: [kubernetes]
+`), 0600))
+	policies, err := authenticators.LoadPoliciesConfig(path, s.authenticators)
+	require.NoError(t, err)
+	s.authnPolicies = policies
+
+	request := func(host, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		s.authenticate(w, r, true)
+		return w
+	}
+
+	// The token is cached while serving the host that accepts it
+	require.Equal(t, http.StatusOK, request("ui.example.com", "service-account").Code)
+	require.Equal(t, http.StatusOK, request("ui.example.com", "service-account").Code)
+	require.Equal(t, 1, kubernetes.calls)
+
+	// The host that only accepts API keys refuses it, even when cached
+	require.Equal(t, http.StatusUnauthorized, request("api.example.com", "service-account").Code)
+	require.Equal(t, 1, kubernetes.calls)
+	require.Equal(t, 1, apiKey.calls)
+	require.Equal(t, http.StatusOK, request("api.example.com", "ci.secret").Code)
+}
@@ -0,0 +1,223 @@
+package common
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+// ClaimPath is the location of a claim inside the claims of a token. It is
+// parsed from a dotted path, e.g., "realm_access.roles", or a JSONPath-style
+// one, e.g., "$.resource_access['my-client'].roles" or "groups[*].name".
+type ClaimPath struct {
+	raw      string
+	segments []claimPathSegment
+}
+
+type claimPathSegment struct {
+	key      string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+// ParseClaimPath parses the given claim path. A path that is a plain claim
+// name is also a valid path.
+func ParseClaimPath(path string) (ClaimPath, error) {
+	p := ClaimPath{raw: path}
+	rest := strings.TrimPrefix(path, "$")
+	if rest != path {
+		rest = strings.TrimPrefix(rest, ".")
+	}
+	if rest == "" {
+		return p, errors.Errorf("invalid claim path '%s': empty path", path)
+	}
+
+	expectKey := true
+	for len(rest) > 0 {
+		switch {
+		case rest[0] == '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return p, errors.Errorf("invalid claim path '%s': missing ']'", path)
+			}
+			inner := rest[1:end]
+			if len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0] {
+				p.segments = append(p.segments, claimPathSegment{key: inner[1 : len(inner)-1]})
+			} else if inner == "*" {
+				p.segments = append(p.segments, claimPathSegment{wildcard: true})
+			} else if index, err := strconv.Atoi(inner); err == nil && index >= 0 {
+				p.segments = append(p.segments, claimPathSegment{index: index, isIndex: true})
+			} else {
+				return p, errors.Errorf("invalid claim path '%s': invalid subscript '[%s]'", path, inner)
+			}
+			rest = rest[end+1:]
+			expectKey = false
+		case rest[0] == '.':
+			if expectKey {
+				return p, errors.Errorf("invalid claim path '%s': empty key", path)
+			}
+			rest = rest[1:]
+			expectKey = true
+			if rest == "" {
+				return p, errors.Errorf("invalid claim path '%s': empty key", path)
+			}
+		default:
+			if !expectKey {
+				return p, errors.Errorf("invalid claim path '%s': missing '.' before '%s'", path, rest)
+			}
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			p.segments = append(p.segments, claimPathSegment{key: rest[:end]})
+			rest = rest[end:]
+			expectKey = false
+		}
+	}
+	return p, nil
+}
+
+func (p ClaimPath) String() string {
+	return p.raw
+}
+
+// Lookup returns the claim at the path. If the path has a wildcard, the
+// claim is the list of the values that the rest of the path selects. For
+// compatibility with claim names that contain dots, e.g., namespaced claims
+// like "https://example.com/groups", a top-level claim with the exact name of
+// the path takes precedence.
+func (p ClaimPath) Lookup(claims map[string]interface{}) (interface{}, bool) {
+	if value, ok := claims[p.raw]; ok {
+		return value, true
+	}
+	return lookupSegments(claims, p.segments)
+}
+
+func lookupSegments(value interface{}, segments []claimPathSegment) (interface{}, bool) {
+	for i, segment := range segments {
+		switch {
+		case segment.wildcard:
+			list, ok := value.([]interface{})
+			if !ok {
+				return nil, false
+			}
+			values := []interface{}{}
+			for _, item := range list {
+				if v, ok := lookupSegments(item, segments[i+1:]); ok {
+					values = append(values, v)
+				}
+			}
+			return values, true
+		case segment.isIndex:
+			list, ok := value.([]interface{})
+			if !ok || segment.index >= len(list) {
+				return nil, false
+			}
+			value = list[segment.index]
+		default:
+			m, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			if value, ok = m[segment.key]; !ok {
+				return nil, false
+			}
+		}
+	}
+	return value, true
+}
+
+var _ error = &ClaimNotFoundError{}
+
+// ClaimNotFoundError is returned when a token doesn't have a claim.
+type ClaimNotFoundError struct {
+	Path string
+}
+
+func (e *ClaimNotFoundError) Error() string {
+	return fmt.Sprintf("claim '%s' not found", e.Path)
+}
+
+// IsClaimNotFound examines if the given error is a ClaimNotFoundError.
+func IsClaimNotFound(err error) bool {
+	var notFound *ClaimNotFoundError
+	return errors.As(err, &notFound)
+}
+
+// LookupClaim returns the claim at the given path. See ParseClaimPath for the
+// syntax of the path.
+func LookupClaim(claims map[string]interface{}, path string) (interface{}, error) {
+	p, err := ParseClaimPath(path)
+	if err != nil {
+		return nil, err
+	}
+	value, ok := p.Lookup(claims)
+	if !ok || value == nil {
+		return nil, &ClaimNotFoundError{Path: path}
+	}
+	return value, nil
+}
+
+// UserIDFromClaims returns the user's identity from the string claim at the
+// given path.
+func UserIDFromClaims(claims map[string]interface{}, path string) (string, error) {
+	value, err := LookupClaim(claims, path)
+	if err != nil {
+		return "", err
+	}
+	userID, ok := value.(string)
+	if !ok || userID == "" {
+		return "", errors.Errorf("claim '%s' is not a non-empty string", path)
+	}
+	return userID, nil
+}
+
+// GroupsFromClaims returns the user's groups from the claim at the given
+// path. The claim may be a list of strings, or a single string with one or
+// more groups separated by commas or spaces. For lists of objects, use a path
+// that selects a field of them, e.g., "groups[*].name".
+func GroupsFromClaims(claims map[string]interface{}, path string) ([]string, error) {
+	value, err := LookupClaim(claims, path)
+	if err != nil {
+		return []string{}, err
+	}
+	groups, err := ClaimStrings(value)
+	if err != nil {
+		return []string{}, errors.Wrapf(err, "claim '%s'", path)
+	}
+	return groups, nil
+}
+
+// ClaimStrings converts a claim to a list of strings. A string claim is split
+// on commas and spaces.
+func ClaimStrings(value interface{}) ([]string, error) {
+	switch v := value.(type) {
+	case nil:
+		return []string{}, nil
+	case string:
+		return strings.FieldsFunc(v, func(r rune) bool {
+			return r == ',' || unicode.IsSpace(r)
+		}), nil
+	case []string:
+		return v, nil
+	case []interface{}:
+		res := make([]string, 0, len(v))
+		for i, elem := range v {
+			switch e := elem.(type) {
+			case string:
+				res = append(res, e)
+			case map[string]interface{}:
+				return nil, errors.Errorf("element %d is an object, select one of its fields, e.g., '[*].name'", i)
+			default:
+				return nil, errors.Errorf("element %d is a %T, not a string", i, elem)
+			}
+		}
+		return res, nil
+	default:
+		return nil, errors.Errorf("is a %T, not a list of strings or a string", value)
+	}
+}
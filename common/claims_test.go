@@ -0,0 +1,101 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseClaimPath(t *testing.T) {
+	valid := []string{
+		"email",
+		"realm_access.roles",
+		"$.resource_access['my.client'].roles",
+		`resource_access["my-client"].roles[0]`,
+		"groups[*].name",
+	}
+	for _, path := range valid {
+		_, err := ParseClaimPath(path)
+		require.NoError(t, err, path)
+	}
+
+	invalid := []string{"", "$", "a..b", "a.", ".a", "a[", "a[x]", "a[-1]", "a[0]b"}
+	for _, path := range invalid {
+		_, err := ParseClaimPath(path)
+		require.Error(t, err, path)
+	}
+}
+
+func TestGroupsFromClaims(t *testing.T) {
+	claims := map[string]interface{}{
+		"groups": []interface{}{"a", "b"},
+		"realm_access": map[string]interface{}{
+			"roles": []interface{}{"admin"},
+		},
+		"resource_access": map[string]interface{}{
+			"my.client": map[string]interface{}{
+				"roles": []interface{}{"viewer"},
+			},
+		},
+		"https://example.com/groups": []interface{}{"namespaced"},
+		"scope":                      "a b,c",
+		"memberships": []interface{}{
+			map[string]interface{}{"name": "x", "id": 1.0},
+			map[string]interface{}{"name": "y", "id": 2.0},
+		},
+		"number": 1.0,
+		"mixed":  []interface{}{"a", 1.0},
+	}
+
+	tests := []struct {
+		path     string
+		expected []string
+		notFound bool
+		invalid  bool
+	}{
+		{path: "groups", expected: []string{"a", "b"}},
+		{path: "realm_access.roles", expected: []string{"admin"}},
+		{path: "$.resource_access['my.client'].roles", expected: []string{"viewer"}},
+		{path: "https://example.com/groups", expected: []string{"namespaced"}},
+		{path: "scope", expected: []string{"a", "b", "c"}},
+		{path: "memberships[*].name", expected: []string{"x", "y"}},
+		{path: "memberships[1].name", expected: []string{"y"}},
+		{path: "missing.roles", notFound: true},
+		{path: "memberships", invalid: true},
+		{path: "number", invalid: true},
+		{path: "mixed", invalid: true},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			groups, err := GroupsFromClaims(claims, test.path)
+			switch {
+			case test.notFound:
+				require.True(t, IsClaimNotFound(err), err)
+			case test.invalid:
+				require.Error(t, err)
+				require.False(t, IsClaimNotFound(err))
+			default:
+				require.NoError(t, err)
+				require.Equal(t, test.expected, groups)
+			}
+		})
+	}
+}
+
+func TestUserIDFromClaims(t *testing.T) {
+	claims := map[string]interface{}{
+		"email":   "user@example.com",
+		"profile": map[string]interface{}{"username": "user"},
+		"sub":     1.0,
+	}
+
+	userID, err := UserIDFromClaims(claims, "profile.username")
+	require.NoError(t, err)
+	require.Equal(t, "user", userID)
+
+	_, err = UserIDFromClaims(claims, "sub")
+	require.Error(t, err)
+
+	_, err = UserIDFromClaims(claims, "name")
+	require.True(t, IsClaimNotFound(err))
+}
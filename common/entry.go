@@ -0,0 +1,52 @@
+package common
+
+import (
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// TypedEntry is an entry of a configuration file that the factory of its
+// type creates, e.g., an authenticator of the chain or a group enricher.
+type TypedEntry struct {
+	// Name identifies the entry in the logs. Defaults to Type.
+	Name string `yaml:"name"`
+	// Type is the name that the factory of the entry is registered with.
+	Type string `yaml:"type"`
+	// Options are the type-specific options of the entry.
+	Options yaml.Node `yaml:"options"`
+}
+
+// HasOptions examines if the entry specifies any options.
+func (e *TypedEntry) HasOptions() bool {
+	return !e.Options.IsZero()
+}
+
+// DecodeOptions decodes the options of the entry into v. Fields of v that
+// the options don't specify keep their values, so v can hold the defaults.
+func (e *TypedEntry) DecodeOptions(v interface{}) error {
+	if !e.HasOptions() {
+		return nil
+	}
+	return errors.Wrapf(e.Options.Decode(v), "invalid options for '%s'", e.Name)
+}
+
+// ValidateEntries defaults the names of the entries to their types and
+// examines if the names are unique and the types are among the given ones.
+// kind names the entries in the errors, e.g., "authenticator".
+func ValidateEntries(kind string, entries []*TypedEntry, types []string) error {
+	names := map[string]bool{}
+	for _, entry := range entries {
+		if entry.Name == "" {
+			entry.Name = entry.Type
+		}
+		if names[entry.Name] {
+			return errors.Errorf("duplicate %s name '%s'", kind, entry.Name)
+		}
+		names[entry.Name] = true
+		if !Contains(types, []string{entry.Type}) {
+			return errors.Errorf("%s '%s': unknown type '%s', must be one of %v",
+				kind, entry.Name, entry.Type, types)
+		}
+	}
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"net/url"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/kelseyhightower/envconfig"
 	log "github.com/sirupsen/logrus"
@@ -21,6 +22,12 @@ type Config struct {
 	OIDCScopes              []string `split_words:"true" default:"openid,email"`
 	StrictSessionValidation bool     `split_words:"true"`
 	OIDCStateStorePath      string   `split_words:"true" default:"/var/lib/authservice/data.db"`
+	OIDCPKCEMethod          string   `split_words:"true" default:"S256" envconfig:"OIDC_PKCE_METHOD"`
+	OIDCPKCERequired        bool     `split_words:"true" envconfig:"OIDC_PKCE_REQUIRED"`
+	OIDCEndSessionEnabled   bool     `split_words:"true" envconfig:"OIDC_END_SESSION_ENABLED"`
+	OIDCProviderDisplayName string   `split_words:"true" default:"Default" envconfig:"OIDC_PROVIDER_DISPLAY_NAME"`
+	OIDCProvidersConfigPath string   `split_words:"true" envconfig:"OIDC_PROVIDERS_CONFIG_PATH"`
+	OIDCProviderSelection   bool     `split_words:"true" envconfig:"OIDC_PROVIDER_SELECTION_ENABLED"`
 
 	// General
 	AuthserviceURLPrefix  *url.URL `required:"true" split_words:"true"`
@@ -59,15 +66,44 @@ type Config struct {
 	Port                  int    `split_words:"true" default:"8080" envconfig:"SERVER_PORT"`
 	WebServerPort         int    `split_words:"true" default:"8082"`
 	ReadinessProbePort    int    `split_words:"true" default:"8081"`
+	HealthCheckTimeout    time.Duration `split_words:"true" default:"5s"`
+	HealthCheckProviderTTL time.Duration `split_words:"true" default:"30s" envconfig:"HEALTH_CHECK_PROVIDER_TTL"`
+	ReadinessNonCriticalChecks []string `split_words:"true" default:"oidc_discovery,jwks" envconfig:"READINESS_NON_CRITICAL_CHECKS"`
+	ShutdownDelay         time.Duration `split_words:"true" default:"5s"`
+	ShutdownTimeout       time.Duration `split_words:"true" default:"25s"`
+	AdminAPIPort          int    `split_words:"true" envconfig:"ADMIN_API_PORT"`
+	AdminAPIKeysPath      string `split_words:"true" envconfig:"ADMIN_API_KEYS_PATH"`
 	CABundlePath          string `split_words:"true" envconfig:"CA_BUNDLE"`
+	ServerTLSCertPath     string `split_words:"true" envconfig:"SERVER_TLS_CERT_PATH"`
+	ServerTLSKeyPath      string `split_words:"true" envconfig:"SERVER_TLS_KEY_PATH"`
+	ServerTLSClientCAPath string `split_words:"true" envconfig:"SERVER_TLS_CLIENT_CA_PATH"`
 	SessionStoreType      string `split_words:"true" default:"boltdb"`
 	SessionStorePath      string `split_words:"true" default:"/var/lib/authservice/data.db"`
-	SessionStoreRedisAddr string `split_words:"true" default:"127.0.0.1:6379"`
+	SessionStoreRedisAddr []string `split_words:"true" default:"127.0.0.1:6379"`
+	SessionStoreRedisUsername string `split_words:"true" envconfig:"SESSION_STORE_REDIS_USERNAME"`
 	SessionStoreRedisPWD  string `split_words:"true" default:"" envconfig:"SESSION_STORE_REDIS_PWD"`
 	SessionStoreRedisDB   int    `split_words:"true" default:"0" envconfig:"SESSION_STORE_REDIS_DB"`
+	SessionStoreRedisMasterName       string `split_words:"true" default:"mymaster" envconfig:"SESSION_STORE_REDIS_MASTER_NAME"`
+	SessionStoreRedisSentinelUsername string `split_words:"true" envconfig:"SESSION_STORE_REDIS_SENTINEL_USERNAME"`
+	SessionStoreRedisSentinelPWD      string `split_words:"true" envconfig:"SESSION_STORE_REDIS_SENTINEL_PWD"`
+	SessionStoreRedisTLSEnabled  bool   `split_words:"true" default:"false" envconfig:"SESSION_STORE_REDIS_TLS_ENABLED"`
+	SessionStoreRedisTLSCAPath   string `split_words:"true" envconfig:"SESSION_STORE_REDIS_TLS_CA_PATH"`
+	SessionStoreRedisTLSCertPath string `split_words:"true" envconfig:"SESSION_STORE_REDIS_TLS_CERT_PATH"`
+	SessionStoreRedisTLSKeyPath  string `split_words:"true" envconfig:"SESSION_STORE_REDIS_TLS_KEY_PATH"`
+	SessionStoreRedisPoolSize     int           `split_words:"true" default:"100" envconfig:"SESSION_STORE_REDIS_POOL_SIZE"`
+	SessionStoreRedisDialTimeout  time.Duration `split_words:"true" default:"5s" envconfig:"SESSION_STORE_REDIS_DIAL_TIMEOUT"`
+	SessionStoreRedisReadTimeout  time.Duration `split_words:"true" default:"3s" envconfig:"SESSION_STORE_REDIS_READ_TIMEOUT"`
+	SessionStoreRedisWriteTimeout time.Duration `split_words:"true" default:"3s" envconfig:"SESSION_STORE_REDIS_WRITE_TIMEOUT"`
+	SessionStoreSQLDSN    string `split_words:"true" envconfig:"SESSION_STORE_SQL_DSN"`
 	SessionMaxAge         int    `split_words:"true" default:"86400"`
+	SessionIdleTimeout    time.Duration `split_words:"true" default:"0"`
+	SessionActivityUpdateInterval time.Duration `split_words:"true" default:"1m"`
+	SessionLimitPerUser   int    `split_words:"true" default:"0"`
+	SessionLimitPolicy    string `split_words:"true" default:"evict_oldest"`
 	SessionSameSite       string `split_words:"true" default:"Lax"`
 	SessionDomain         string `split_words:"true"`
+	SessionEncryptionKeyPaths       []string `split_words:"true" envconfig:"SESSION_ENCRYPTION_KEY_PATHS"`
+	SessionEncryptionAllowPlaintext bool     `split_words:"true" default:"true" envconfig:"SESSION_ENCRYPTION_ALLOW_PLAINTEXT"`
 
 	// Site
 	ClientName          string            `split_words:"true" default:"AuthService"`
@@ -81,10 +117,14 @@ type Config struct {
 	CacheExpirationMinutes int  `split_words:"true" default:"5" envconfig:"CACHE_EXPIRATION_MINUTES"`
 
 	// Authenticators configurations
+	AuthenticatorsConfigPath        string   `split_words:"true" envconfig:"AUTHENTICATORS_CONFIG_PATH"`
+	AuthnPoliciesConfigPath         string   `split_words:"true" envconfig:"AUTHN_POLICIES_CONFIG_PATH"`
 	IDTokenAuthnEnabled             bool     `split_words:"true" default:"true" envconfig:"IDTOKEN_AUTHN_ENABLED"`
 	KubernetesAuthnEnabled          bool     `split_words:"true" default:"true" envconfig:"KUBERNETES_AUTHN_ENABLED"`
 	AccessTokenAuthnEnabled         bool     `split_words:"true" default:"true" envconfig:"ACCESS_TOKEN_AUTHN_ENABLED"`
 	AccessTokenAuthn                string   `split_words:"true" default:"jwt" envconfig:"ACCESS_TOKEN_AUTHN"`
+	IntrospectionAudiences          []string `split_words:"true" envconfig:"INTROSPECTION_AUDIENCES"`
+	IntrospectionScopes             []string `split_words:"true" envconfig:"INTROSPECTION_SCOPES"`
 	JWTFromExtraProviderEnabled     bool     `split_words:"true" default:"false" envconfig:"JWTFROMEXTRAPROVIDER_AUTHN_ENABLED"`
 	JWTFromExtraProviderProviderURL *url.URL `default:"" envconfig:"JWTFROMEXTRAPROVIDER_PROVIDER_URL"`
 	JWTFromExtraProviderCookieName  string   `default:"" envconfig:"JWTFROMEXTRAPROVIDER_COOKIE_NAME"`
@@ -92,11 +132,19 @@ type Config struct {
 	JWTFromExtraProviderIssuerName  string   `default:"" envconfig:"JWTFROMEXTRAPROVIDER_ISSUERNAME"`
 	JWTFromExtraProviderClientID    string   `default:"" envconfig:"JWTFROMEXTRAPROVIDER_CLIENTID"`
 	JWTFromExtraProviderSetHeader   string   `default:"" envconfig:"JWTFROMEXTRAPROVIDER_SETHEADER"`
+	TrustedIssuersConfigPath        string   `split_words:"true" envconfig:"TRUSTED_ISSUERS_CONFIG_PATH"`
+	CertificateAuthnEnabled         bool     `split_words:"true" default:"false" envconfig:"CERTIFICATE_AUTHN_ENABLED"`
+	CertificateAuthnRules           string   `split_words:"true" envconfig:"CERTIFICATE_AUTHN_RULES"`
+	CertificateAuthnTrustedProxies  []string `split_words:"true" envconfig:"CERTIFICATE_AUTHN_TRUSTED_PROXIES"`
+	APIKeyAuthnEnabled              bool     `split_words:"true" default:"false" envconfig:"API_KEY_AUTHN_ENABLED"`
+	APIKeyAuthnHeader               string   `split_words:"true" default:"X-API-Key" envconfig:"API_KEY_AUTHN_HEADER"`
+	APIKeyAuthnKeysPath             string   `split_words:"true" envconfig:"API_KEY_AUTHN_KEYS_PATH"`
 
 	// Authorization
 	GroupsAllowlist  []string `split_words:"true" default:"*"`
 	ExternalAuthzUrl string   `split_words:"true" default:""`
 	AuthzConfigPath  string   `split_words:"true"`
+	GroupEnrichersConfigPath string `split_words:"true" envconfig:"GROUP_ENRICHERS_CONFIG_PATH"`
 }
 
 func ParseConfig() (*Config, error) {
@@ -123,6 +171,10 @@ func ParseConfig() (*Config, error) {
 		log.Fatalf("Unsupported access token authentication configuration:" +
 			"ACCESS_TOKEN_AUTHN=%s",c.AccessTokenAuthn)
 	}
+	if !validPKCEMethod(c.OIDCPKCEMethod, c.OIDCPKCERequired) {
+		log.Fatalf("Unsupported PKCE configuration:" +
+			"OIDC_PKCE_METHOD=%s, OIDC_PKCE_REQUIRED=%t", c.OIDCPKCEMethod, c.OIDCPKCERequired)
+	}
 	if !validSessionStoreType(c.SessionStoreType){
 		log.Fatalf("Unsupported value for the type of the session store:" +
 			"SESSION_STORE_TYPE=%s",c.SessionStoreType)
@@ -131,14 +183,81 @@ func ParseConfig() (*Config, error) {
 		log.Fatalf("Unsupported value for the log level messages:" +
 		"LOG_LEVEL=%s",c.LogLevel)
 	}
+	if c.APIKeyAuthnEnabled && c.APIKeyAuthnKeysPath == "" {
+		log.Fatalf("API_KEY_AUTHN_KEYS_PATH must be set when API_KEY_AUTHN_ENABLED is true")
+	}
+	if c.AdminAPIPort != 0 && c.AdminAPIKeysPath == "" {
+		log.Fatalf("ADMIN_API_KEYS_PATH must be set when ADMIN_API_PORT is set")
+	}
+	if (c.ServerTLSCertPath == "") != (c.ServerTLSKeyPath == "") {
+		log.Fatalf("SERVER_TLS_CERT_PATH and SERVER_TLS_KEY_PATH must be set together")
+	}
+	if c.SessionIdleTimeout > 0 && c.SessionActivityUpdateInterval >= c.SessionIdleTimeout {
+		log.Fatalf("SESSION_ACTIVITY_UPDATE_INTERVAL must be shorter than SESSION_IDLE_TIMEOUT")
+	}
+	if c.SessionStoreType == "redis" && len(c.SessionStoreRedisAddr) != 1 {
+		log.Fatalf("SESSION_STORE_REDIS_ADDR must have exactly one address when SESSION_STORE_TYPE is redis")
+	}
+	if c.SessionStoreType == "rediscluster" && c.SessionStoreRedisDB != 0 {
+		log.Fatalf("SESSION_STORE_REDIS_DB isn't supported when SESSION_STORE_TYPE is rediscluster")
+	}
+	if (c.SessionStoreRedisTLSCertPath == "") != (c.SessionStoreRedisTLSKeyPath == "") {
+		log.Fatalf("SESSION_STORE_REDIS_TLS_CERT_PATH and SESSION_STORE_REDIS_TLS_KEY_PATH must be set together")
+	}
+	if !c.SessionStoreRedisTLSEnabled && (c.SessionStoreRedisTLSCAPath != "" || c.SessionStoreRedisTLSCertPath != "") {
+		log.Fatalf("SESSION_STORE_REDIS_TLS_ENABLED must be true when the Redis TLS paths are set")
+	}
+	if c.SessionStoreType == "sql" && c.SessionStoreSQLDSN == "" {
+		log.Fatalf("SESSION_STORE_SQL_DSN must be set when SESSION_STORE_TYPE is sql")
+	}
+	if c.SessionStoreType == "cookie" {
+		// The cookie session store can't update or look up sessions
+		// other than the one of the request.
+		if len(c.SessionEncryptionKeyPaths) == 0 {
+			log.Fatalf("SESSION_ENCRYPTION_KEY_PATHS must be set when SESSION_STORE_TYPE is cookie")
+		}
+		if c.SessionIdleTimeout > 0 || c.SessionLimitPerUser > 0 || c.AdminAPIPort != 0 {
+			log.Fatalf("SESSION_IDLE_TIMEOUT, SESSION_LIMIT_PER_USER and ADMIN_API_PORT " +
+				"aren't supported when SESSION_STORE_TYPE is cookie")
+		}
+	}
+	if c.HealthCheckTimeout <= 0 {
+		log.Fatalf("HEALTH_CHECK_TIMEOUT must be positive")
+	}
+	if c.HealthCheckProviderTTL < 0 {
+		log.Fatalf("HEALTH_CHECK_PROVIDER_TTL must not be negative")
+	}
+	if c.ShutdownDelay < 0 {
+		log.Fatalf("SHUTDOWN_DELAY must not be negative")
+	}
+	if c.ShutdownTimeout <= 0 {
+		log.Fatalf("SHUTDOWN_TIMEOUT must be positive")
+	}
+	if c.SessionLimitPolicy != "evict_oldest" && c.SessionLimitPolicy != "deny" {
+		log.Fatalf("Unsupported value for SESSION_LIMIT_POLICY: %s, must be one of "+
+			"'evict_oldest' or 'deny'", c.SessionLimitPolicy)
+	}
+	if _, err := ParseClaimPath(c.UserIDClaim); err != nil {
+		log.Fatalf("Unsupported value for USERID_CLAIM: %v", err)
+	}
+	if _, err := ParseClaimPath(c.GroupsClaim); err != nil {
+		log.Fatalf("Unsupported value for GROUPS_CLAIM: %v", err)
+	}
 	c.UserTemplateContext = getEnvsFromPrefix("TEMPLATE_CONTEXT_")
 
 	c.SkipAuthURLs = trimSpaceFromStringSliceElements(c.SkipAuthURLs)
 	c.SkipAuthURLs = ensureInSlice(c.AuthserviceURLPrefix.Path, c.SkipAuthURLs)
 
 	c.OIDCScopes = trimSpaceFromStringSliceElements(c.OIDCScopes)
+
+	c.IntrospectionAudiences = trimSpaceFromStringSliceElements(c.IntrospectionAudiences)
+	c.IntrospectionScopes = trimSpaceFromStringSliceElements(c.IntrospectionScopes)
 	c.OIDCScopes = ensureInSlice("openid", c.OIDCScopes)
 
+	c.CertificateAuthnTrustedProxies = trimSpaceFromStringSliceElements(c.CertificateAuthnTrustedProxies)
+
+	c.SessionEncryptionKeyPaths = trimSpaceFromStringSliceElements(c.SessionEncryptionKeyPaths)
+
 	c.TemplatePath = trimSpaceFromStringSliceElements(c.TemplatePath)
 	c.TemplatePath = ensureInSlice("web/templates/default", c.TemplatePath)
 
@@ -190,10 +309,32 @@ func validAccessTokenAuthn(AccessTokenAuthnEnabledEnv bool, AccessTokenAuthnEnv
 	if AccessTokenAuthnEnv == "opaque"{
 		return true
 	}
+	if AccessTokenAuthnEnv == "introspection" {
+		return true
+	}
 
 	log.Warn("Please select exactly one of the supported options: " +
 	"i) jwt: to enable the JWT access token authentication method, " +
-	"ii) opaque: to enable the opaque access token authentication method")
+	"ii) opaque: to enable the opaque access token authentication method, " +
+	"iii) introspection: to enable the token introspection authentication method")
+
+	return false
+}
+
+// validPKCEMethod() examines if the admins have configured a valid value for
+// the OIDC_PKCE_METHOD envvar, which is compatible with OIDC_PKCE_REQUIRED.
+func validPKCEMethod(method string, required bool) bool {
+	if method == "S256" || method == "plain" {
+		return true
+	}
+	if method == "none" && !required {
+		return true
+	}
+
+	log.Warn("Please select exactly one of the options for the OIDC_PKCE_METHOD: " +
+	"i) S256: to use the SHA-256 code challenge method, " +
+	"ii) plain: to use the plain code challenge method, " +
+	"iii) none: to disable PKCE, which cannot be combined with OIDC_PKCE_REQUIRED")
 
 	return false
 }
@@ -210,11 +351,23 @@ func validSessionStoreType(SessionStoreType string) (bool){
 	if SessionStoreType == "redisfailover"{
 		return true
 	}
+	if SessionStoreType == "rediscluster" {
+		return true
+	}
+	if SessionStoreType == "sql" {
+		return true
+	}
+	if SessionStoreType == "cookie" {
+		return true
+	}
 
 	log.Warn("Please select exactly one of the options: " +
 	"i) boltdb: to select the BoltDB supported session store, " +
 	"ii) redis: to select the Redis supported session store, " +
-	"iiI) redisfailver: to select the RedisFailover supported session store")
+	"iiI) redisfailver: to select the RedisFailover supported session store, " +
+	"iv) rediscluster: to select the Redis Cluster supported session store, " +
+	"v) sql: to select the PostgreSQL supported session store, " +
+	"vi) cookie: to keep the sessions in encrypted cookies")
 
 	return false
 }
@@ -65,6 +65,12 @@ func TestValidAccessTokenAuthn(t *testing.T) {
 			AccessTokenAuthn: "JWT",
 			success: false,
 		},
+		{
+			testName: "Access Token Authenticator is set to introspection",
+			AccessTokenAuthnEnabled: true,
+			AccessTokenAuthn: "introspection",
+			success: true,
+		},
 		{
 			testName: "Access Token Authenticator envvar is invalid (Opaque)",
 			AccessTokenAuthnEnabled: true,
@@ -83,3 +89,51 @@ func TestValidAccessTokenAuthn(t *testing.T) {
 		})
 	}
 }
+
+func TestValidPKCEMethod(t *testing.T) {
+
+	tests := []struct {
+		testName string
+		method   string
+		required bool
+		success  bool
+	}{
+		{
+			testName: "PKCE method is set to S256",
+			method:   "S256",
+			success:  true,
+		},
+		{
+			testName: "PKCE method is set to plain and required",
+			method:   "plain",
+			required: true,
+			success:  true,
+		},
+		{
+			testName: "PKCE is disabled",
+			method:   "none",
+			success:  true,
+		},
+		{
+			testName: "PKCE is disabled but required",
+			method:   "none",
+			required: true,
+			success:  false,
+		},
+		{
+			testName: "PKCE method envvar is invalid",
+			method:   "s256",
+			success:  false,
+		},
+	}
+
+	for _, c := range tests {
+		t.Run(c.testName, func(t *testing.T) {
+			result := validPKCEMethod(c.method, c.required)
+
+			if result != c.success {
+				t.Errorf("validPKCEMethod result for %v is not the expected one.", c)
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package common
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Keys of the authentication context in the Extra field of a User.
+const (
+	ExtraACR      = "acr"
+	ExtraAMR      = "amr"
+	ExtraAuthTime = "auth_time"
+)
+
+// StepUp describes how strong and how recent the authentication of a user
+// must be. Requests of users whose authentication doesn't satisfy it require
+// the user to log in again, i.e., step-up authentication.
+type StepUp struct {
+	// ACRValues are the accepted Authentication Context Class References.
+	// They are sent as the acr_values of the Authentication Request.
+	ACRValues []string `yaml:"acrValues"`
+	// AMR are the Authentication Methods References that are all required,
+	// e.g., "mfa".
+	AMR []string `yaml:"amr"`
+	// MaxAge is the maximum time since the user last actively
+	// authenticated. It is sent as the max_age of the Authentication
+	// Request.
+	MaxAge time.Duration `yaml:"maxAge"`
+}
+
+// Required examines if the step-up has any requirements.
+func (s *StepUp) Required() bool {
+	return s != nil && (len(s.ACRValues) > 0 || len(s.AMR) > 0 || s.MaxAge > 0)
+}
+
+// AuthContext is how and when a user authenticated, as described by the
+// "acr", "amr" and "auth_time" claims of an ID token.
+type AuthContext struct {
+	ACR      string
+	AMR      []string
+	AuthTime time.Time
+}
+
+// AuthContextFromClaims returns the authentication context of the given ID
+// token claims.
+func AuthContextFromClaims(claims map[string]interface{}) AuthContext {
+	ac := AuthContext{}
+	ac.ACR, _ = claims["acr"].(string)
+	if amr, ok := claims["amr"].([]interface{}); ok {
+		ac.AMR, _ = ClaimStrings(amr)
+	}
+	if authTime, ok := claims["auth_time"].(float64); ok {
+		ac.AuthTime = time.Unix(int64(authTime), 0)
+	}
+	return ac
+}
+
+// AuthContextFromUser returns the authentication context that an
+// authenticator stored in the Extra field of the given user.
+func AuthContextFromUser(user *User) AuthContext {
+	ac := AuthContext{}
+	if acr := user.Extra[ExtraACR]; len(acr) > 0 {
+		ac.ACR = acr[0]
+	}
+	ac.AMR = user.Extra[ExtraAMR]
+	if authTime := user.Extra[ExtraAuthTime]; len(authTime) > 0 {
+		if secs, err := strconv.ParseInt(authTime[0], 10, 64); err == nil {
+			ac.AuthTime = time.Unix(secs, 0)
+		}
+	}
+	return ac
+}
+
+// Extra returns the authentication context in the form of the Extra field of
+// a User.
+func (ac AuthContext) Extra() map[string][]string {
+	extra := map[string][]string{}
+	if ac.ACR != "" {
+		extra[ExtraACR] = []string{ac.ACR}
+	}
+	if len(ac.AMR) > 0 {
+		extra[ExtraAMR] = ac.AMR
+	}
+	if !ac.AuthTime.IsZero() {
+		extra[ExtraAuthTime] = []string{strconv.FormatInt(ac.AuthTime.Unix(), 10)}
+	}
+	return extra
+}
+
+// Check examines if the given authentication context satisfies the step-up
+// requirements. It returns the reason why it doesn't, or an empty string.
+func (s *StepUp) Check(ac AuthContext, now time.Time) string {
+	if !s.Required() {
+		return ""
+	}
+	if len(s.ACRValues) > 0 && !Contains(s.ACRValues, []string{ac.ACR}) {
+		return fmt.Sprintf("acr '%s' is not one of %v", ac.ACR, s.ACRValues)
+	}
+	for _, amr := range s.AMR {
+		if !Contains(ac.AMR, []string{amr}) {
+			return fmt.Sprintf("amr %v doesn't include '%s'", ac.AMR, amr)
+		}
+	}
+	if s.MaxAge > 0 {
+		if ac.AuthTime.IsZero() {
+			return "auth_time is missing"
+		}
+		if age := now.Sub(ac.AuthTime); age > s.MaxAge {
+			return fmt.Sprintf("authentication is %v old, more than %v",
+				age.Truncate(time.Second), s.MaxAge)
+		}
+	}
+	return ""
+}
+
+// AuthParams returns the parameters of the Authentication Request that ask
+// the provider to satisfy the step-up requirements. There is no parameter
+// for the amr, so the user is prompted to log in again.
+func (s *StepUp) AuthParams() map[string]string {
+	params := map[string]string{}
+	if len(s.ACRValues) > 0 {
+		params["acr_values"] = strings.Join(s.ACRValues, " ")
+	}
+	if s.MaxAge > 0 {
+		params["max_age"] = strconv.FormatInt(int64(s.MaxAge.Seconds()), 10)
+	}
+	if len(s.AMR) > 0 || len(params) == 0 {
+		params["prompt"] = "login"
+	}
+	return params
+}
+
+var _ error = &StepUpRequiredError{}
+
+// StepUpRequiredError is used by authorizers to inform the calling code that
+// the user must log in again to satisfy the given step-up requirements.
+type StepUpRequiredError struct {
+	StepUp *StepUp
+	Reason string
+}
+
+func (e *StepUpRequiredError) Error() string {
+	return "step-up authentication required: " + e.Reason
+}
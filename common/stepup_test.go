@@ -0,0 +1,76 @@
+package common
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStepUpCheck(t *testing.T) {
+	now := time.Now()
+	stepUp := &StepUp{ACRValues: []string{"silver", "gold"}, AMR: []string{"mfa"}, MaxAge: 10 * time.Minute}
+
+	tests := []struct {
+		name   string
+		claims map[string]interface{}
+		ok     bool
+	}{
+		{
+			name: "satisfied",
+			claims: map[string]interface{}{
+				"acr": "gold", "amr": []interface{}{"pwd", "mfa"}, "auth_time": float64(now.Add(-time.Minute).Unix()),
+			},
+			ok: true,
+		},
+		{
+			name:   "no claims",
+			claims: map[string]interface{}{},
+			ok:     false,
+		},
+		{
+			name: "unaccepted acr",
+			claims: map[string]interface{}{
+				"acr": "bronze", "amr": []interface{}{"mfa"}, "auth_time": float64(now.Unix()),
+			},
+			ok: false,
+		},
+		{
+			name: "missing amr",
+			claims: map[string]interface{}{
+				"acr": "gold", "amr": []interface{}{"pwd"}, "auth_time": float64(now.Unix()),
+			},
+			ok: false,
+		},
+		{
+			name: "old authentication",
+			claims: map[string]interface{}{
+				"acr": "gold", "amr": []interface{}{"mfa"}, "auth_time": float64(now.Add(-time.Hour).Unix()),
+			},
+			ok: false,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ac := AuthContextFromClaims(test.claims)
+			reason := stepUp.Check(ac, now)
+			require.Equal(t, test.ok, reason == "", reason)
+
+			// The authentication context survives the round trip through
+			// the Extra field of a User.
+			fromUser := AuthContextFromUser(&User{Extra: ac.Extra()})
+			require.Equal(t, reason, stepUp.Check(fromUser, now))
+		})
+	}
+
+	var none *StepUp
+	require.False(t, none.Required())
+	require.Empty(t, none.Check(AuthContext{}, now))
+}
+
+func TestStepUpAuthParams(t *testing.T) {
+	require.Equal(t, map[string]string{"acr_values": "silver gold", "max_age": "600"},
+		(&StepUp{ACRValues: []string{"silver", "gold"}, MaxAge: 10 * time.Minute}).AuthParams())
+	require.Equal(t, map[string]string{"prompt": "login"},
+		(&StepUp{AMR: []string{"mfa"}}).AuthParams())
+}
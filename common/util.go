@@ -9,6 +9,7 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 	"net/url"
 	"path"
@@ -20,10 +21,13 @@ import (
 )
 
 var (
-	AfterLogoutPath  = "/site/after_logout"
-	HomepagePath     = "/site/homepage"
-	OIDCCallbackPath = "/oidc/callback"
-	VerifyEndpoint   = "/verify"
+	AfterLogoutPath       = "/site/after_logout"
+	HomepagePath          = "/site/homepage"
+	LoginSelectionPath    = "/site/login"
+	SessionLimitPath      = "/site/session_limit"
+	OIDCCallbackPath      = "/oidc/callback"
+	BackChannelLogoutPath = "/oidc/backchannel_logout"
+	VerifyEndpoint        = "/verify"
 )
 
 // JWTClaimOpts specifies the location of the user's identity inside a JWT's
@@ -135,7 +139,8 @@ func deleteCookie(w http.ResponseWriter, name string) {
 	http.SetCookie(w, &http.Cookie{Name: name, MaxAge: -1, Path: "/"})
 }
 
-func createNonce(length int) (string, error) {
+// CreateNonce creates a cryptographically random string of the given length.
+func CreateNonce(length int) (string, error) {
 	// XXX: To avoid modulo bias, 256 / len(nonceChars) MUST equal 0.
 	// In this case, 256 / 64 = 0. See:
 	// https://research.kudelskisecurity.com/2020/07/28/the-definitive-guide-to-modulo-bias-and-how-to-avoid-it/
@@ -245,3 +250,19 @@ func Contains(sli []string, ele []string) bool {
 	}
 	return false
 }
+
+// MatchHost examines if the given host matches one of the given patterns,
+// ignoring the port and the case. A pattern may be a glob, e.g.,
+// "*.example.com" matches all the subdomains of example.com.
+func MatchHost(patterns []string, host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(strings.ToLower(pattern), host); matched {
+			return true
+		}
+	}
+	return false
+}
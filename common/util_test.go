@@ -20,7 +20,7 @@ func TestCreateNonce_Simple(t *testing.T) {
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			nonce, err := createNonce(test.length)
+			nonce, err := CreateNonce(test.length)
 			if err != nil {
 				t.Fatalf("Unexpected error: %v", err)
 			}
@@ -34,7 +34,7 @@ func TestCreateNonce_Simple(t *testing.T) {
 // See: https://en.wikipedia.org/wiki/Pearson%27s_chi-squared_test
 func TestCreateNonce_Distribution(t *testing.T) {
 
-	nonce, err := createNonce(100000000)
+	nonce, err := CreateNonce(100000000)
 	if err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
@@ -84,3 +84,23 @@ func TestCreateNonce_Distribution(t *testing.T) {
 		t.Fatalf("Nonce characters don't seem to follow a uniform distribution")
 	}
 }
+
+func TestMatchHost(t *testing.T) {
+	patterns := []string{"app.example.com", "*.corp.example.com"}
+	tests := []struct {
+		host    string
+		matched bool
+	}{
+		{host: "app.example.com", matched: true},
+		{host: "APP.example.com:8080", matched: true},
+		{host: "ml.corp.example.com", matched: true},
+		{host: "corp.example.com", matched: false},
+		{host: "a.b.corp.example.com", matched: true},
+		{host: "other.example.com", matched: false},
+	}
+	for _, test := range tests {
+		if matched := MatchHost(patterns, test.host); matched != test.matched {
+			t.Errorf("MatchHost(%v, %q) = %v, expected %v", patterns, test.host, matched, test.matched)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	fsnotify "gopkg.in/fsnotify/fsnotify.v1"
+)
+
+var (
+	// watchStop is closed by StopWatchers to stop the watchers of WatchFile.
+	watchStop     = make(chan struct{})
+	watchStopOnce sync.Once
+	watchers      sync.WaitGroup
+
+	errWatchStopped = errors.New("watcher stopped")
+)
+
+// StopWatchers stops the watchers that WatchFile started and waits for them
+// to exit, e.g., when AuthService shuts down.
+func StopWatchers() {
+	watchStopOnce.Do(func() { close(watchStop) })
+	watchers.Wait()
+}
+
+// WatchLoop calls do every time the file at path changes, until the file is
+// removed, the watcher fails or the watchers are stopped.
+func WatchLoop(watcher *fsnotify.Watcher, path string, do func() error) error {
+	if err := watcher.Add(path); err != nil {
+		return err
+	}
+	for {
+		select {
+		case ev, ok := <-watcher.Events:
+			if !ok {
+				return errors.New("watcher events channel closed")
+			}
+
+			log.Debugf("file watcher event: name=%s op=%s", ev.Name, ev.Op)
+
+			// do nothing on Chmod
+			if ev.Op == fsnotify.Chmod {
+				continue
+			}
+
+			if ev.Op&fsnotify.Remove == fsnotify.Remove {
+				return errors.New("watcher path removed")
+			}
+
+			log.Infof("try to reload %s", path)
+			if err := do(); err != nil {
+				return fmt.Errorf("failed to reload: %w", err)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return fmt.Errorf("watcher event errors channel closed")
+			}
+			return fmt.Errorf("watcher error: %w", err)
+		case <-watchStop:
+			return errWatchStopped
+		}
+	}
+
+}
+
+// WatchFile runs WatchLoop in the background to call load every time the
+// file at path changes. It restarts the loop on failures, e.g., when the file
+// is replaced, as happens with Kubernetes ConfigMaps and Secrets, and exits
+// the process if the loop keeps failing. The caller must have already loaded
+// the file once. The name identifies the caller in the logs. StopWatchers
+// stops it.
+func WatchFile(name, path string, load func() error) {
+	watchers.Add(1)
+	go func() {
+		defer watchers.Done()
+		for i := 0; i < 5; i++ { // allow 5 failures before giving up
+
+			// load() before attempting to create a watcher
+			// We only want to do this on watcher reload (after an error),
+			// and avoid doing this for the first iteration
+			// since the caller has already loaded the file before we
+			// entered this loop
+			if i != 0 {
+				log.Infof("%s: try to reload %s", name, path)
+				if err := load(); err != nil {
+					log.Errorf("%s: failed to reload %q: %v", name, path, err)
+				}
+			}
+			watcher, err := fsnotify.NewWatcher()
+			if err != nil {
+				log.Errorf("couldn't create fsnotify watcher: %v", err)
+			}
+			err = WatchLoop(watcher, path, load)
+			watcher.Close()
+			if err == errWatchStopped {
+				return
+			}
+			if err != nil {
+				log.Errorf("%s: error watching %q: %v", name, path, err)
+			}
+			select {
+			case <-time.After(1 * time.Second):
+			case <-watchStop:
+				return
+			}
+		}
+		log.Fatalf("%s: watch loop failed, cannot continue", name)
+	}()
+}
@@ -0,0 +1,93 @@
+// Copyright © 2019 Arrikto Inc.  All Rights Reserved.
+
+package main
+
+import (
+	"net/http"
+
+	"github.com/arrikto/oidc-authservice/common"
+	"github.com/arrikto/oidc-authservice/oidc"
+	"github.com/pkg/errors"
+)
+
+var (
+	DeviceAuthorizationPath = "/device/authorize"
+	DeviceTokenPath         = "/device/token"
+)
+
+// XXX: The device flow endpoints are served by the envoy-facing server, which
+// means that returning a 2xx other than 200 is necessary, otherwise the
+// request will be proxied upstream.
+
+// deviceAuthorization is the handler that starts an OAuth 2.0 Device
+// Authorization Grant flow at the default provider, on behalf of a client that cannot
+// complete a browser redirect (e.g. a headless notebook or a CI job).
+// It returns the provider's device authorization response, whose user_code
+// and verification_uri the client must present to the user.
+func (s *server) deviceAuthorization(w http.ResponseWriter, r *http.Request) {
+
+	logger := common.RequestLogger(r, logModuleInfo)
+
+	ctx := s.tlsCfg.Context(r.Context())
+	auth, err := s.sessionManager.StartDeviceFlow(ctx)
+	if err != nil {
+		logger.Errorf("Failed to start device flow: %v", err)
+		common.ReturnMessage(w, http.StatusBadGateway, "Failed to start device flow.")
+		return
+	}
+
+	logger.Info("Started device flow.")
+	common.ReturnJSONMessage(w, http.StatusCreated, auth)
+}
+
+// deviceToken is the handler that the client polls with the device_code of a
+// device flow. While the user hasn't completed the flow, it relays the
+// provider's error (e.g. authorization_pending, slow_down). Once the user has
+// completed it, it creates a new user session, the same way the OIDC callback
+// does, and returns its ID, which the client can use in the AUTH_HEADER.
+func (s *server) deviceToken(w http.ResponseWriter, r *http.Request) {
+
+	logger := common.RequestLogger(r, logModuleInfo)
+
+	// Enforce no caching on the client side.
+	w.Header().Add("Cache-Control", "no-cache, no-store")
+
+	deviceCode := r.PostFormValue("device_code")
+	if deviceCode == "" {
+		logger.Error("Missing form parameter: device_code")
+		common.ReturnJSONMessage(w, http.StatusBadRequest, &oidc.DeviceTokenError{
+			ErrorCode:        "invalid_request",
+			ErrorDescription: "Missing form parameter: device_code",
+		})
+		return
+	}
+
+	ctx := s.tlsCfg.Context(r.Context())
+	oauth2Tokens, err := s.sessionManager.PollDeviceToken(ctx, deviceCode)
+	if err != nil {
+		var tokenErr *oidc.DeviceTokenError
+		if errors.As(err, &tokenErr) {
+			logger.Debugf("Device flow is not complete: %v", tokenErr)
+			common.ReturnJSONMessage(w, tokenErr.StatusCode, tokenErr)
+			return
+		}
+		logger.Errorf("Failed to get device flow token: %v", err)
+		common.ReturnMessage(w, http.StatusBadGateway, "Failed to get device flow token.")
+		return
+	}
+
+	_, sessionID, ok := s.createUserSession(w, r, s.providers.Default(), oauth2Tokens, nil)
+	if !ok {
+		return
+	}
+
+	logger.Info("Device flow completed, created user session.")
+	resp := struct {
+		SessionID string `json:"session_id"`
+		ExpiresIn int    `json:"expires_in"`
+	}{
+		SessionID: sessionID,
+		ExpiresIn: s.sessionMaxAgeSeconds,
+	}
+	common.ReturnJSONMessage(w, http.StatusCreated, resp)
+}
@@ -0,0 +1,55 @@
+package enrichers
+
+import (
+	"context"
+
+	"github.com/arrikto/oidc-authservice/common"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// ConfigMapOptions are the options of the "configmap" enricher.
+type ConfigMapOptions struct {
+	Namespace string `yaml:"namespace"`
+	Name      string `yaml:"name"`
+	// Key is the key of the ConfigMap with the GroupsMapping. Defaults to
+	// "groups.yaml".
+	Key string `yaml:"key"`
+}
+
+type configMapEnricher struct {
+	opts   ConfigMapOptions
+	client kubernetes.Interface
+}
+
+// NewConfigMapEnricher returns an enricher that reads the groups of the users
+// from a Kubernetes ConfigMap. The ConfigMap is read on every cache miss, so
+// that changes apply without restarting AuthService.
+func NewConfigMapEnricher(opts ConfigMapOptions, client kubernetes.Interface) (Enricher, error) {
+	if opts.Namespace == "" || opts.Name == "" {
+		return nil, errors.New("'namespace' and 'name' options are required")
+	}
+	if opts.Key == "" {
+		opts.Key = "groups.yaml"
+	}
+	return &configMapEnricher{opts: opts, client: client}, nil
+}
+
+func (cm *configMapEnricher) Groups(ctx context.Context, user *common.User) ([]string, error) {
+	configMap, err := cm.client.CoreV1().ConfigMaps(cm.opts.Namespace).Get(ctx, cm.opts.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get ConfigMap %s/%s", cm.opts.Namespace, cm.opts.Name)
+	}
+	raw, ok := configMap.Data[cm.opts.Key]
+	if !ok {
+		return nil, errors.Errorf("ConfigMap %s/%s doesn't have key '%s'", cm.opts.Namespace,
+			cm.opts.Name, cm.opts.Key)
+	}
+	mapping, err := parseGroupsMapping([]byte(raw))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse key '%s' of ConfigMap %s/%s", cm.opts.Key,
+			cm.opts.Namespace, cm.opts.Name)
+	}
+	return mapping.Users[user.Name], nil
+}
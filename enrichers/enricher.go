@@ -0,0 +1,230 @@
+package enrichers
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/arrikto/oidc-authservice/common"
+	"github.com/patrickmn/go-cache"
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v3"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/controller-runtime/pkg/client/config"
+)
+
+// Enricher returns extra groups of an authenticated user from a source other
+// than the user's credentials, e.g., a file or a web service.
+type Enricher interface {
+	Groups(ctx context.Context, user *common.User) ([]string, error)
+}
+
+// Cacheable is implemented by the enrichers whose groups depend on more than
+// the name of the user. The groups of a user are cached by the returned key.
+type Cacheable interface {
+	GetCacheKey(user *common.User) string
+}
+
+// Error policies of an enricher, i.e., whether its errors deny the request
+// or are ignored.
+const (
+	// OnErrorFail denies the request.
+	OnErrorFail = "fail"
+	// OnErrorIgnore logs the error and continues without the groups of
+	// the enricher.
+	OnErrorIgnore = "ignore"
+)
+
+const defaultCacheTTL = 5 * time.Minute
+
+// Config is the schema of the file with the group enrichers.
+type Config struct {
+	Enrichers []Entry `yaml:"enrichers"`
+}
+
+// Entry configures a group enricher. Its type is one of "file", "webhook"
+// or "configmap".
+type Entry struct {
+	common.TypedEntry `yaml:",inline"`
+	// OnError is the error policy of the enricher. Defaults to "fail".
+	OnError string `yaml:"onError"`
+	// CacheTTL is how long the groups of a user are cached. Defaults to 5
+	// minutes. A negative value disables the cache.
+	CacheTTL time.Duration `yaml:"cacheTTL"`
+}
+
+// LoadConfig reads the file with the group enrichers.
+func LoadConfig(configPath string) (*Config, error) {
+	raw, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read group enrichers file")
+	}
+	var c Config
+	if err := yaml.Unmarshal(raw, &c); err != nil {
+		return nil, errors.Wrap(err, "failed to parse group enrichers file")
+	}
+	return &c, nil
+}
+
+// Factory creates the enricher of an entry.
+type Factory func(entry *Entry) (Enricher, error)
+
+// Stage is the list of enrichers that add groups to the authenticated users
+// before they are authorized.
+type Stage []*stageEnricher
+
+type stageEnricher struct {
+	Enricher
+	name    string
+	onError string
+	cache   *cache.Cache
+}
+
+// NewStage creates the enrichers of the given entries with the factories of
+// their types.
+func NewStage(entries []Entry, factories map[string]Factory) (Stage, error) {
+	types := []string{}
+	for typ := range factories {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	typed := make([]*common.TypedEntry, len(entries))
+	for i := range entries {
+		typed[i] = &entries[i].TypedEntry
+	}
+	if err := common.ValidateEntries("enricher", typed, types); err != nil {
+		return nil, err
+	}
+
+	stage := Stage{}
+	for i := range entries {
+		entry := &entries[i]
+		switch entry.OnError {
+		case "":
+			entry.OnError = OnErrorFail
+		case OnErrorFail, OnErrorIgnore:
+		default:
+			return nil, errors.Errorf("enricher '%s': invalid onError '%s', must be one of "+
+				"'%s' or '%s'", entry.Name, entry.OnError, OnErrorFail, OnErrorIgnore)
+		}
+
+		enricher, err := factories[entry.Type](entry)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error creating enricher '%s'", entry.Name)
+		}
+
+		se := &stageEnricher{Enricher: enricher, name: entry.Name, onError: entry.OnError}
+		ttl := entry.CacheTTL
+		if ttl == 0 {
+			ttl = defaultCacheTTL
+		}
+		if ttl > 0 {
+			se.cache = cache.New(ttl, 2*ttl)
+		}
+		stage = append(stage, se)
+	}
+	return stage, nil
+}
+
+// Enrich returns a copy of the user with the groups of all the enrichers
+// added to the user's groups. The user itself isn't modified, as it may be
+// cached by the authenticators.
+func (s Stage) Enrich(r *http.Request, user *common.User) (*common.User, error) {
+	if len(s) == 0 {
+		return user, nil
+	}
+	logger := common.RequestLogger(r, "group enrichment")
+
+	groups := append([]string{}, user.Groups...)
+	for _, se := range s {
+		extra, err := se.groups(r.Context(), user)
+		if err != nil {
+			if se.onError == OnErrorIgnore {
+				logger.Warnf("Enricher '%s' failed, ignoring its groups: %v", se.name, err)
+				continue
+			}
+			return nil, errors.Wrapf(err, "enricher '%s' failed", se.name)
+		}
+		for _, group := range extra {
+			if !contains(groups, group) {
+				groups = append(groups, group)
+			}
+		}
+	}
+
+	enriched := *user
+	enriched.Groups = groups
+	return &enriched, nil
+}
+
+func (se *stageEnricher) groups(ctx context.Context, user *common.User) ([]string, error) {
+	if se.cache == nil {
+		return se.Groups(ctx, user)
+	}
+	key := user.Name
+	if cacheable, ok := se.Enricher.(Cacheable); ok {
+		key = cacheable.GetCacheKey(user)
+	}
+	if groups, found := se.cache.Get(key); found {
+		return groups.([]string), nil
+	}
+	groups, err := se.Groups(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	se.cache.SetDefault(key, groups)
+	return groups, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Types of the enrichers.
+const (
+	FileEnricherType      = "file"
+	WebhookEnricherType   = "webhook"
+	ConfigMapEnricherType = "configmap"
+)
+
+// DefaultFactories returns the factories of all the enricher types.
+func DefaultFactories(tlsCfg common.TlsConfig) map[string]Factory {
+	return map[string]Factory{
+		FileEnricherType: func(e *Entry) (Enricher, error) {
+			var opts FileOptions
+			if err := e.DecodeOptions(&opts); err != nil {
+				return nil, err
+			}
+			return NewFileEnricher(opts)
+		},
+		WebhookEnricherType: func(e *Entry) (Enricher, error) {
+			var opts WebhookOptions
+			if err := e.DecodeOptions(&opts); err != nil {
+				return nil, err
+			}
+			return NewWebhookEnricher(opts, tlsCfg)
+		},
+		ConfigMapEnricherType: func(e *Entry) (Enricher, error) {
+			var opts ConfigMapOptions
+			if err := e.DecodeOptions(&opts); err != nil {
+				return nil, err
+			}
+			restConfig, err := config.GetConfig()
+			if err != nil {
+				return nil, errors.Wrap(err, "error getting K8s config")
+			}
+			client, err := kubernetes.NewForConfig(restConfig)
+			if err != nil {
+				return nil, errors.Wrap(err, "error creating K8s client")
+			}
+			return NewConfigMapEnricher(opts, client)
+		},
+	}
+}
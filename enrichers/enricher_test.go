@@ -0,0 +1,179 @@
+package enrichers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/arrikto/oidc-authservice/common"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// countingEnricher returns the given groups and counts its calls.
+type countingEnricher struct {
+	groups []string
+	err    error
+	calls  int
+}
+
+func (c *countingEnricher) Groups(ctx context.Context, user *common.User) ([]string, error) {
+	c.calls++
+	return c.groups, c.err
+}
+
+func typed(typ string) common.TypedEntry {
+	return common.TypedEntry{Type: typ}
+}
+
+func newTestStage(t *testing.T, entries []Entry, enrichers map[string]*countingEnricher) Stage {
+	factories := map[string]Factory{}
+	for typ, enricher := range enrichers {
+		enricher := enricher
+		factories[typ] = func(e *Entry) (Enricher, error) { return enricher, nil }
+	}
+	stage, err := NewStage(entries, factories)
+	require.NoError(t, err)
+	return stage
+}
+
+func TestStageEnrich(t *testing.T) {
+	projects := &countingEnricher{groups: []string{"project-a", "idp-group"}}
+	broken := &countingEnricher{err: errors.New("unavailable")}
+	stage := newTestStage(t, []Entry{
+		{TypedEntry: typed("projects")},
+		{TypedEntry: typed("broken"), OnError: OnErrorIgnore, CacheTTL: -1},
+	}, map[string]*countingEnricher{"projects": projects, "broken": broken})
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	user := &common.User{Name: "alice", Groups: []string{"idp-group"}}
+	for i := 0; i < 2; i++ {
+		enriched, err := stage.Enrich(r, user)
+		require.NoError(t, err)
+		require.Equal(t, []string{"idp-group", "project-a"}, enriched.Groups)
+	}
+	// The original user is left as is
+	require.Equal(t, []string{"idp-group"}, user.Groups)
+	// Only the successful results are cached
+	require.Equal(t, 1, projects.calls)
+	require.Equal(t, 2, broken.calls)
+
+	// Errors of enrichers that don't ignore them fail the enrichment
+	stage = newTestStage(t, []Entry{{TypedEntry: typed("broken")}},
+		map[string]*countingEnricher{"broken": broken})
+	_, err := stage.Enrich(r, user)
+	require.Error(t, err)
+}
+
+func TestNewStageErrors(t *testing.T) {
+	enrichers := map[string]*countingEnricher{"projects": {}}
+	for _, entries := range [][]Entry{
+		{{TypedEntry: typed("unknown")}},
+		{{TypedEntry: typed("projects")}, {TypedEntry: typed("projects")}},
+		{{TypedEntry: typed("projects"), OnError: "retry"}},
+	} {
+		factories := map[string]Factory{}
+		for typ, enricher := range enrichers {
+			enricher := enricher
+			factories[typ] = func(e *Entry) (Enricher, error) { return enricher, nil }
+		}
+		_, err := NewStage(entries, factories)
+		require.Error(t, err)
+	}
+}
+
+const testGroupsMapping = `
+users:
+  alice@example.com: [project-a, project-b]
+`
+
+func TestFileEnricher(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "groups.yaml")
+	require.NoError(t, ioutil.WriteFile(path, []byte(testGroupsMapping), 0600))
+
+	enricher, err := NewFileEnricher(FileOptions{Path: path})
+	require.NoError(t, err)
+
+	groups, err := enricher.Groups(context.Background(), &common.User{Name: "alice@example.com"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"project-a", "project-b"}, groups)
+
+	groups, err = enricher.Groups(context.Background(), &common.User{Name: "bob@example.com"})
+	require.NoError(t, err)
+	require.Empty(t, groups)
+}
+
+func TestWebhookEnricher(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req WebhookRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		if req.User.Name != "alice" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(WebhookResponse{Groups: append(req.User.Groups, "project-a")})
+	}))
+	defer server.Close()
+
+	enricher, err := NewWebhookEnricher(WebhookOptions{URL: server.URL}, nil)
+	require.NoError(t, err)
+
+	groups, err := enricher.Groups(context.Background(), &common.User{Name: "alice", Groups: []string{"a"}})
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "project-a"}, groups)
+
+	_, err = enricher.Groups(context.Background(), &common.User{Name: "bob"})
+	require.Error(t, err)
+}
+
+func TestWebhookEnricherCacheKey(t *testing.T) {
+	var calls int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		var req WebhookRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		json.NewEncoder(w).Encode(WebhookResponse{Groups: req.User.Groups})
+	}))
+	defer server.Close()
+
+	enricher, err := NewWebhookEnricher(WebhookOptions{URL: server.URL}, nil)
+	require.NoError(t, err)
+	stage, err := NewStage([]Entry{{TypedEntry: typed("webhook")}}, map[string]Factory{
+		"webhook": func(e *Entry) (Enricher, error) { return enricher, nil },
+	})
+	require.NoError(t, err)
+
+	// The groups are cached per request of the web service, not per name
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, groups := range [][]string{{"a"}, {"b"}, {"a"}} {
+		enriched, err := stage.Enrich(r, &common.User{Name: "alice", Groups: groups})
+		require.NoError(t, err)
+		require.Equal(t, groups, enriched.Groups)
+	}
+	require.Equal(t, 2, calls)
+}
+
+func TestConfigMapEnricher(t *testing.T) {
+	client := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "auth", Name: "groups"},
+		Data:       map[string]string{"groups.yaml": testGroupsMapping},
+	})
+
+	enricher, err := NewConfigMapEnricher(ConfigMapOptions{Namespace: "auth", Name: "groups"}, client)
+	require.NoError(t, err)
+	groups, err := enricher.Groups(context.Background(), &common.User{Name: "alice@example.com"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"project-a", "project-b"}, groups)
+
+	enricher, err = NewConfigMapEnricher(ConfigMapOptions{Namespace: "auth", Name: "missing"}, client)
+	require.NoError(t, err)
+	_, err = enricher.Groups(context.Background(), &common.User{Name: "alice@example.com"})
+	require.Error(t, err)
+}
@@ -0,0 +1,76 @@
+package enrichers
+
+import (
+	"context"
+	"io/ioutil"
+	"sync"
+
+	"github.com/arrikto/oidc-authservice/common"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// GroupsMapping is the schema of the files, and the ConfigMaps, that map the
+// users to their extra groups.
+type GroupsMapping struct {
+	Users map[string][]string `yaml:"users"`
+}
+
+func parseGroupsMapping(raw []byte) (*GroupsMapping, error) {
+	var m GroupsMapping
+	if err := yaml.Unmarshal(raw, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// FileOptions are the options of the "file" enricher.
+type FileOptions struct {
+	// Path is the path of the file with the GroupsMapping. The file is
+	// reloaded when it changes.
+	Path string `yaml:"path"`
+}
+
+type fileEnricher struct {
+	path    string
+	lock    sync.RWMutex
+	mapping *GroupsMapping
+}
+
+// NewFileEnricher returns an enricher that reads the groups of the users
+// from a watched YAML file.
+func NewFileEnricher(opts FileOptions) (Enricher, error) {
+	if opts.Path == "" {
+		return nil, errors.New("'path' option is missing")
+	}
+	f := &fileEnricher{path: opts.Path}
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+	common.WatchFile("fileEnricher", f.path, f.load)
+	return f, nil
+}
+
+func (f *fileEnricher) load() error {
+	raw, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return errors.Wrap(err, "failed to read groups file")
+	}
+	mapping, err := parseGroupsMapping(raw)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse groups file")
+	}
+	log.Infof("Loaded groups of %d users from %s", len(mapping.Users), f.path)
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.mapping = mapping
+	return nil
+}
+
+func (f *fileEnricher) Groups(ctx context.Context, user *common.User) ([]string, error) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	return f.mapping.Users[user.Name], nil
+}
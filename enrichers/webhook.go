@@ -0,0 +1,113 @@
+package enrichers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/arrikto/oidc-authservice/common"
+	"github.com/pkg/errors"
+)
+
+// WebhookOptions are the options of the "webhook" enricher.
+type WebhookOptions struct {
+	// URL is the endpoint that the WebhookRequest is POSTed to.
+	URL string `yaml:"url"`
+	// Timeout is the timeout of the requests. Defaults to 5 seconds.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// WebhookRequest is the body of the requests of the "webhook" enricher.
+type WebhookRequest struct {
+	User WebhookUser `json:"user"`
+}
+
+// WebhookUser is the authenticated user, with the groups of the
+// authenticator.
+type WebhookUser struct {
+	Name   string              `json:"name"`
+	Groups []string            `json:"groups"`
+	Extra  map[string][]string `json:"extra"`
+}
+
+// WebhookResponse is the body of the responses that the "webhook" enricher
+// expects.
+type WebhookResponse struct {
+	Groups []string `json:"groups"`
+}
+
+type webhookEnricher struct {
+	url       string
+	timeout   time.Duration
+	tlsConfig common.TlsConfig
+}
+
+// NewWebhookEnricher returns an enricher that asks a web service for the
+// groups of the users.
+func NewWebhookEnricher(opts WebhookOptions, tlsCfg common.TlsConfig) (Enricher, error) {
+	if opts.URL == "" {
+		return nil, errors.New("'url' option is missing")
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = 5 * time.Second
+	}
+	return &webhookEnricher{url: opts.URL, timeout: opts.Timeout, tlsConfig: tlsCfg}, nil
+}
+
+func newWebhookRequest(user *common.User) ([]byte, error) {
+	return json.Marshal(WebhookRequest{User: WebhookUser{
+		Name:   user.Name,
+		Groups: user.Groups,
+		Extra:  user.Extra,
+	}})
+}
+
+// GetCacheKey returns the hash of the request of the user, since the web
+// service may use all of the user's fields.
+func (wh *webhookEnricher) GetCacheKey(user *common.User) string {
+	body, err := newWebhookRequest(user)
+	if err != nil {
+		return user.Name
+	}
+	hash := sha256.Sum256(body)
+	return hex.EncodeToString(hash[:])
+}
+
+func (wh *webhookEnricher) Groups(ctx context.Context, user *common.User) ([]string, error) {
+	body, err := newWebhookRequest(user)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(wh.tlsConfig.Context(ctx), wh.timeout)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodPost, wh.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := common.DoRequest(ctx, req)
+	if err != nil {
+		return nil, errors.Wrap(err, "error sending the request")
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading the response")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &common.RequestError{Response: resp, Body: respBody,
+			Err: errors.Errorf("unexpected status code %d", resp.StatusCode)}
+	}
+	var whResp WebhookResponse
+	if err := json.Unmarshal(respBody, &whResp); err != nil {
+		return nil, errors.Wrap(err, "error parsing the response")
+	}
+	return whResp.Groups, nil
+}
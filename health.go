@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arrikto/oidc-authservice/common"
+	"github.com/arrikto/oidc-authservice/sessions"
+	"github.com/tevino/abool"
+)
+
+const (
+	healthStatusOK       = "ok"
+	healthStatusFailed   = "failed"
+	healthStatusStarting = "starting"
+	healthStatusDraining = "draining"
+)
+
+// healthCheck checks a dependency of AuthService.
+type healthCheck struct {
+	// name identifies the check in the reports, e.g., "jwks/default".
+	name  string
+	check func(ctx context.Context) error
+	// ttl is how long the result of the check is reused, e.g., so that the
+	// probes don't query the OIDC provider every time.
+	ttl time.Duration
+}
+
+// healthCheckResult is the status of a check, as reported by /readyz.
+type healthCheckResult struct {
+	Status string `json:"status"`
+	// Critical checks fail the readiness of AuthService.
+	Critical bool   `json:"critical"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+type healthReport struct {
+	Status string                       `json:"status"`
+	Checks map[string]healthCheckResult `json:"checks,omitempty"`
+}
+
+// healthServer serves the liveness and readiness probes. AuthService is live
+// as long as it serves the probes, since restarting it doesn't fix its
+// dependencies. It is ready once its setup is complete and its critical
+// checks pass, until it starts shutting down.
+type healthServer struct {
+	isReady *abool.AtomicBool
+	// draining is set when AuthService starts shutting down, so that no new
+	// requests are routed to it.
+	draining *abool.AtomicBool
+	// timeout is how long each check may take.
+	timeout time.Duration
+	// nonCritical are the names of the checks, or of their kinds, e.g.,
+	// "jwks", that don't fail the readiness.
+	nonCritical []string
+
+	mu     sync.RWMutex
+	checks []healthCheck
+	// results are the last results of the checks with a ttl, by name.
+	results map[string]cachedHealthCheckResult
+}
+
+type cachedHealthCheckResult struct {
+	healthCheckResult
+	expiresAt time.Time
+}
+
+// newHealthChecks returns the checks of the session stores and of the OIDC
+// providers. The results of the latter are reused for providerTTL.
+func newHealthChecks(store, oidcStateStore sessions.Store, providers *sessions.Providers,
+	tlsCfg common.TlsConfig, providerTTL time.Duration) []healthCheck {
+
+	checks := []healthCheck{
+		{name: "session_store", check: func(ctx context.Context) error {
+			return sessions.PingStore(ctx, store)
+		}},
+		{name: "oidc_state_store", check: func(ctx context.Context) error {
+			return sessions.PingStore(ctx, oidcStateStore)
+		}},
+	}
+	for _, provider := range providers.List() {
+		sm := provider.SessionManager
+		checks = append(checks,
+			healthCheck{name: "oidc_discovery/" + provider.Name, ttl: providerTTL, check: func(ctx context.Context) error {
+				return sm.CheckDiscovery(tlsCfg.Context(ctx))
+			}},
+			healthCheck{name: "jwks/" + provider.Name, ttl: providerTTL, check: func(ctx context.Context) error {
+				return sm.CheckJWKS(tlsCfg.Context(ctx))
+			}},
+		)
+	}
+	return checks
+}
+
+// SetChecks sets the checks of the readiness probe, once the dependencies
+// have been set up.
+func (hs *healthServer) SetChecks(checks []healthCheck) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	hs.checks = checks
+	hs.results = map[string]cachedHealthCheckResult{}
+}
+
+func (hs *healthServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/livez", hs.livez)
+	mux.HandleFunc("/readyz", hs.readyz)
+	// Keep the original probe, which doesn't run the checks.
+	mux.Handle("/", readiness(hs.isReady, hs.draining))
+	return mux
+}
+
+func (hs *healthServer) livez(w http.ResponseWriter, r *http.Request) {
+	common.ReturnJSONMessage(w, http.StatusOK, healthReport{Status: healthStatusOK})
+}
+
+func (hs *healthServer) readyz(w http.ResponseWriter, r *http.Request) {
+	if !hs.isReady.IsSet() {
+		common.ReturnJSONMessage(w, http.StatusServiceUnavailable, healthReport{Status: healthStatusStarting})
+		return
+	}
+	if hs.draining.IsSet() {
+		common.ReturnJSONMessage(w, http.StatusServiceUnavailable, healthReport{Status: healthStatusDraining})
+		return
+	}
+	report := hs.runChecks(r.Context())
+	code := http.StatusOK
+	if report.Status != healthStatusOK {
+		code = http.StatusServiceUnavailable
+	}
+	common.ReturnJSONMessage(w, code, report)
+}
+
+// runChecks runs all the checks concurrently, each one with its own timeout,
+// unless their previous results are still valid.
+func (hs *healthServer) runChecks(ctx context.Context) healthReport {
+	hs.mu.RLock()
+	checks := hs.checks
+	hs.mu.RUnlock()
+
+	results := make([]healthCheckResult, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		if result, ok := hs.cachedResult(check.name); ok {
+			results[i] = result
+			continue
+		}
+		wg.Add(1)
+		go func(i int, check healthCheck) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, hs.timeout)
+			defer cancel()
+			start := time.Now()
+			err := runWithContext(ctx, check.check)
+			results[i] = healthCheckResult{
+				Status:   healthStatusOK,
+				Critical: hs.critical(check.name),
+				Duration: time.Since(start).Round(time.Millisecond).String(),
+			}
+			if err != nil {
+				results[i].Status = healthStatusFailed
+				results[i].Error = err.Error()
+			}
+			if check.ttl > 0 {
+				hs.cacheResult(check.name, results[i], check.ttl)
+			}
+		}(i, check)
+	}
+	wg.Wait()
+
+	report := healthReport{Status: healthStatusOK, Checks: map[string]healthCheckResult{}}
+	for i, check := range checks {
+		report.Checks[check.name] = results[i]
+		if results[i].Status != healthStatusOK && results[i].Critical {
+			report.Status = healthStatusFailed
+		}
+	}
+	return report
+}
+
+func (hs *healthServer) cachedResult(name string) (healthCheckResult, bool) {
+	hs.mu.RLock()
+	defer hs.mu.RUnlock()
+	cached, ok := hs.results[name]
+	if !ok || time.Now().After(cached.expiresAt) {
+		return healthCheckResult{}, false
+	}
+	return cached.healthCheckResult, true
+}
+
+func (hs *healthServer) cacheResult(name string, result healthCheckResult, ttl time.Duration) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	hs.results[name] = cachedHealthCheckResult{
+		healthCheckResult: result,
+		expiresAt:         time.Now().Add(ttl),
+	}
+}
+
+// runWithContext runs the check and returns early when the context is done,
+// in case the check ignores it.
+func runWithContext(ctx context.Context, check func(ctx context.Context) error) error {
+	errC := make(chan error, 1)
+	go func() { errC <- check(ctx) }()
+	select {
+	case err := <-errC:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// critical examines if the check fails the readiness. A check is
+// non-critical if its name, or the part of its name before the slash, is
+// configured as such.
+func (hs *healthServer) critical(name string) bool {
+	kind := strings.SplitN(name, "/", 2)[0]
+	for _, nc := range hs.nonCritical {
+		if nc == name || nc == kind {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"github.com/tevino/abool"
+)
+
+func TestHealthServer(t *testing.T) {
+	isReady := abool.New()
+	hs := &healthServer{
+		isReady:     isReady,
+		draining:    abool.New(),
+		timeout:     50 * time.Millisecond,
+		nonCritical: []string{"jwks", "oidc_discovery"},
+	}
+	handler := hs.Handler()
+
+	probe := func(path string) (int, healthReport) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		var report healthReport
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+		return w.Code, report
+	}
+
+	// AuthService is live but not ready while starting
+	code, report := probe("/livez")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, healthStatusOK, report.Status)
+	code, report = probe("/readyz")
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.Equal(t, healthStatusStarting, report.Status)
+
+	storeErr := error(nil)
+	hs.SetChecks([]healthCheck{
+		{name: "session_store", check: func(ctx context.Context) error { return storeErr }},
+		{name: "jwks/default", check: func(ctx context.Context) error { return errors.New("no keys") }},
+	})
+	isReady.Set()
+
+	// Non-critical checks are reported without failing the readiness
+	code, report = probe("/readyz")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, healthStatusOK, report.Status)
+	require.Equal(t, healthStatusOK, report.Checks["session_store"].Status)
+	require.True(t, report.Checks["session_store"].Critical)
+	require.Equal(t, healthStatusFailed, report.Checks["jwks/default"].Status)
+	require.Equal(t, "no keys", report.Checks["jwks/default"].Error)
+	require.False(t, report.Checks["jwks/default"].Critical)
+
+	// Critical checks fail it
+	storeErr = errors.New("connection refused")
+	code, report = probe("/readyz")
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.Equal(t, healthStatusFailed, report.Status)
+
+	// Checks that take too long fail
+	hs.SetChecks([]healthCheck{
+		{name: "session_store", check: func(ctx context.Context) error {
+			time.Sleep(time.Second)
+			return nil
+		}},
+	})
+	code, report = probe("/readyz")
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.Equal(t, context.DeadlineExceeded.Error(), report.Checks["session_store"].Error)
+
+	// The results of checks with a ttl are reused until it expires
+	calls := 0
+	hs.SetChecks([]healthCheck{
+		{name: "oidc_discovery/default", ttl: 100 * time.Millisecond, check: func(ctx context.Context) error {
+			calls++
+			return errors.New("unavailable")
+		}},
+	})
+	for i := 0; i < 3; i++ {
+		code, report = probe("/readyz")
+		require.Equal(t, http.StatusOK, code)
+		require.Equal(t, healthStatusFailed, report.Checks["oidc_discovery/default"].Status)
+	}
+	require.Equal(t, 1, calls)
+	time.Sleep(150 * time.Millisecond)
+	probe("/readyz")
+	require.Equal(t, 2, calls)
+}
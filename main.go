@@ -4,19 +4,26 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"os"
+	"os/signal"
 	"path"
+	"syscall"
 	"time"
 
 	"github.com/arrikto/oidc-authservice/authenticators"
 	"github.com/arrikto/oidc-authservice/authorizer"
 	"github.com/arrikto/oidc-authservice/common"
+	"github.com/arrikto/oidc-authservice/enrichers"
 	"github.com/arrikto/oidc-authservice/sessions"
 
 	"github.com/gorilla/mux"
 	"github.com/patrickmn/go-cache"
+	"github.com/pkg/errors"
 	"github.com/tevino/abool"
 )
 
@@ -39,9 +46,42 @@ func newConfigOrGroupsAuthorizer(c *common.Config) authorizer.Authorizer {
 	}
 }
 
+// newJudgeServer returns the server that Envoy consults for every request. If
+// a certificate is configured, it serves TLS and, if a client CA is also
+// configured, it verifies the client certificates that callers present, so
+// that the certificate authenticator can use them.
+func newJudgeServer(c *common.Config, handler http.Handler) (*http.Server, error) {
+	srv := &http.Server{
+		Addr:    fmt.Sprintf("%s:%d", c.Hostname, c.Port),
+		Handler: handler,
+	}
+	if c.ServerTLSCertPath == "" {
+		return srv, nil
+	}
+
+	srv.TLSConfig = &tls.Config{}
+	if c.ServerTLSClientCAPath != "" {
+		caBundle, err := ioutil.ReadFile(c.ServerTLSClientCAPath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not read client CA bundle %s", c.ServerTLSClientCAPath)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caBundle) {
+			return nil, errors.Errorf("no certificates found in client CA bundle %s", c.ServerTLSClientCAPath)
+		}
+		srv.TLSConfig.ClientCAs = pool
+		srv.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return srv, nil
+}
+
 func main() {
 	log := common.StandardLogger()
 
+	if len(os.Args) > 1 && os.Args[1] == "sessions" {
+		os.Exit(runSessionsCommand(os.Args[2:]))
+	}
+
 	c, err := common.ParseConfig()
 	if err != nil {
 		log.Fatalf("Failed to parse configuration: %+v", err)
@@ -51,11 +91,28 @@ func main() {
 	// Set log level
 	common.SetLogLevel(c.LogLevel)
 
+	// Listen for the signals before the setup, so that AuthService can
+	// close the stores it has opened if it's asked to stop while starting.
+	sigC := make(chan os.Signal, 1)
+	signal.Notify(sigC, syscall.SIGTERM, syscall.SIGINT)
+
 	// Start readiness probe immediately
 	log.Infof("Starting readiness probe at %v", c.ReadinessProbePort)
 	isReady := abool.New()
+	health := &healthServer{
+		isReady:     isReady,
+		draining:    abool.New(),
+		timeout:     c.HealthCheckTimeout,
+		nonCritical: c.ReadinessNonCriticalChecks,
+	}
+	healthProbeServer := &http.Server{
+		Addr:    fmt.Sprintf(":%d", c.ReadinessProbePort),
+		Handler: health.Handler(),
+	}
 	go func() {
-		log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", c.ReadinessProbePort), readiness(isReady)))
+		if err := healthProbeServer.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
 	}()
 
 	/////////////////////////////////////////////////////
@@ -68,17 +125,53 @@ func main() {
 	router := mux.NewRouter()
 	router.HandleFunc(c.RedirectURL.Path, s.callback).Methods(http.MethodGet)
 	router.HandleFunc(path.Join(c.AuthserviceURLPrefix.Path, SessionLogoutPath), s.logout).Methods(http.MethodPost)
+	router.HandleFunc(path.Join(c.AuthserviceURLPrefix.Path, LoginPath), s.login).Methods(http.MethodGet)
+	if c.SessionStoreType == "cookie" {
+		// The cookie session store can't look up the sessions of a
+		// subject, so Back-Channel Logout requests are refused instead of
+		// reporting success without revoking anything.
+		log.Warn("Back-Channel Logout isn't supported when SESSION_STORE_TYPE is cookie")
+		router.HandleFunc(path.Join(c.AuthserviceURLPrefix.Path, common.BackChannelLogoutPath), backChannelLogoutUnsupported).Methods(http.MethodPost)
+	} else {
+		router.HandleFunc(path.Join(c.AuthserviceURLPrefix.Path, common.BackChannelLogoutPath), s.backChannelLogout).Methods(http.MethodPost)
+	}
+	router.HandleFunc(path.Join(c.AuthserviceURLPrefix.Path, DeviceAuthorizationPath), s.deviceAuthorization).Methods(http.MethodPost)
+	router.HandleFunc(path.Join(c.AuthserviceURLPrefix.Path, DeviceTokenPath), s.deviceToken).Methods(http.MethodPost)
 
 	router.PathPrefix(c.VerifyAuthURL.Path).Handler(s.whitelistMiddleware(c.SkipAuthURLs, isReady, true)(http.HandlerFunc(s.authenticate_no_login))).Methods(http.MethodGet)
 	router.PathPrefix("/").Handler(s.whitelistMiddleware(c.SkipAuthURLs, isReady, false)(http.HandlerFunc(s.authenticate_or_login)))
 
 	// Start judge server
 	log.Infof("Starting judge server at %v:%v", c.Hostname, c.Port)
-	stopCh := make(chan struct{})
-	go func(stopCh chan struct{}) {
-		log.Fatal(http.ListenAndServe(fmt.Sprintf("%s:%d", c.Hostname, c.Port), router))
-		close(stopCh)
-	}(stopCh)
+	judgeServer, err := newJudgeServer(c, router)
+	if err != nil {
+		log.Fatalf("Error creating judge server: %v", err)
+	}
+	go func() {
+		var err error
+		if judgeServer.TLSConfig != nil {
+			err = judgeServer.ListenAndServeTLS(c.ServerTLSCertPath, c.ServerTLSKeyPath)
+		} else {
+			err = judgeServer.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	// Load the additional OIDC providers, which the login selection page of
+	// the web server lists.
+	providersConfig := &sessions.ProvidersConfig{}
+	if c.OIDCProvidersConfigPath != "" {
+		providersConfig, err = sessions.LoadProvidersConfig(c.OIDCProvidersConfigPath)
+		if err != nil {
+			log.Fatalf("Error loading OIDC providers: %v", err)
+		}
+	}
+	loginProviders := []LoginProvider{{Name: sessions.DefaultProviderName, DisplayName: c.OIDCProviderDisplayName}}
+	for _, pc := range providersConfig.Providers {
+		loginProviders = append(loginProviders, LoginProvider{Name: pc.Name, DisplayName: pc.DisplayName})
+	}
 
 	// Start web server
 	webServer := WebServer{
@@ -87,12 +180,46 @@ func main() {
 		ClientName:    c.ClientName,
 		ThemeURL:      common.ResolvePathReference(c.ThemesURL, c.Theme).String(),
 		Frontend:      c.UserTemplateContext,
+		LoginURL:      common.ResolvePathReference(c.AuthserviceURLPrefix, LoginPath).String(),
+		Providers:     loginProviders,
 	}
 	log.Infof("Starting web server at %v:%v", c.Hostname, c.WebServerPort)
+	webHandler, err := webServer.Handler()
+	if err != nil {
+		log.Fatalf("Error creating web server: %v", err)
+	}
+	webHTTPServer := &http.Server{
+		Addr:    fmt.Sprintf("%s:%d", c.Hostname, c.WebServerPort),
+		Handler: webHandler,
+	}
 	go func() {
-		log.Fatal(webServer.Start(fmt.Sprintf("%s:%d", c.Hostname, c.WebServerPort)))
+		if err := webHTTPServer.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
 	}()
 
+	shutdown := &gracefulShutdown{
+		health:       health,
+		delay:        c.ShutdownDelay,
+		timeout:      c.ShutdownTimeout,
+		servers:      []*http.Server{judgeServer, webHTTPServer},
+		healthServer: healthProbeServer,
+	}
+	// stopRequested shuts AuthService down if it has been asked to stop
+	// during the setup. The readiness probe hasn't succeeded yet, so there
+	// is no need to wait for the endpoints of the Service to be updated.
+	stopRequested := func() bool {
+		select {
+		case sig := <-sigC:
+			log.Infof("Received signal %v during setup", sig)
+			shutdown.delay = 0
+			shutdown.Shutdown()
+			return true
+		default:
+			return false
+		}
+	}
+
 	/////////////////////////////////
 	// Resume setup asynchronously //
 	/////////////////////////////////
@@ -109,17 +236,9 @@ func main() {
 	// Setup session store and state store using the configured session store
 	// type (BoltDB, or redis)
 	store, oidcStateStore := sessions.InitiateSessionStores(c)
-
-	defer store.Close()
-	defer oidcStateStore.Close()
-
-	// Get Kubernetes authenticator
-	k8sAuthenticator, err := authenticators.NewKubernetesAuthenticator(c.Audiences)
-	if err != nil && c.KubernetesAuthnEnabled {
-		log.Fatalf("Error creating K8s authenticator: %v", err)
-	} else {
-		// If Kubernetes authenticator is disabled, ignore the error.
-		log.Debugf("%v. Kubernetes authenticator is disabled, skipping ...", err)
+	shutdown.stores = []sessions.ClosableStore{store, oidcStateStore}
+	if stopRequested() {
+		return
 	}
 
 	tlsCfg := common.TlsConfig(caBundle)
@@ -132,47 +251,84 @@ func main() {
 		c.OIDCAuthURL,
 		c.RedirectURL,
 		c.OIDCScopes,
+		c.OIDCPKCEMethod,
+		c.OIDCPKCERequired,
 	)
 
-	// Setup authenticators.
-	sessionAuthenticator := authenticators.NewSessionAuthenticator(
-		store,
-		sessions.UserSessionCookie,
-		c.TokenHeader,
-		c.TokenScheme,
-		c.StrictSessionValidation,
-		tlsCfg,
-		sessionManager,
-		s.sessionDomain,
-	)
-
-	idTokenAuthenticator := authenticators.NewIDTokenAuthenticator(
-		c.IDTokenHeader,
-		c.UserIDClaim,
-		c.GroupsClaim,
-		tlsCfg,
-		sessionManager,
-		c.TokenHeader,
-		c.TokenScheme,
-	)
+	// Setup the OIDC providers. The one of the OIDC_PROVIDER setting is the
+	// default and any additional ones come from the providers file.
+	defaultProvider := &sessions.Provider{
+		Name:           sessions.DefaultProviderName,
+		DisplayName:    c.OIDCProviderDisplayName,
+		UserIDClaim:    c.UserIDClaim,
+		GroupsClaim:    c.GroupsClaim,
+		SessionManager: &sessionManager,
+	}
+	var extraProviders []*sessions.Provider
+	for _, pc := range providersConfig.Providers {
+		log.Infof("Setting up OIDC provider '%s' at %s", pc.Name, pc.Issuer)
+		provider, err := sessions.NewProvider(tlsCfg.Context(context.Background()),
+			pc, defaultProvider, c.RedirectURL, c.OIDCPKCEMethod, c.OIDCPKCERequired)
+		if err != nil {
+			log.Fatalf("Error creating OIDC provider: %v", err)
+		}
+		extraProviders = append(extraProviders, provider)
+		if stopRequested() {
+			return
+		}
+	}
+	providers, err := sessions.NewProviders(defaultProvider, extraProviders...)
+	if err != nil {
+		log.Fatalf("Error creating OIDC providers: %v", err)
+	}
+	var providerSelectionURL string
+	if c.OIDCProviderSelection {
+		providerSelectionURL = common.ResolvePathReference(c.AuthserviceURLPrefix,
+			common.LoginSelectionPath).String()
+	}
 
-	jwtTokenAuthenticator := authenticators.NewJWTTokenAuthenticator(
-		c.IDTokenHeader,
-		c.Audiences,
-		c.ProviderURL.String(),
-		c.UserIDClaim,
-		c.GroupsClaim,
-		tlsCfg,
-		sessionManager,
-	)
+	// Setup the authenticator chain, either from the authenticators file or
+	// from the *_AUTHN_* settings.
+	chainEntries := defaultChainEntries(c)
+	if c.AuthenticatorsConfigPath != "" {
+		chainConfig, err := authenticators.LoadChainConfig(c.AuthenticatorsConfigPath)
+		if err != nil {
+			log.Fatalf("Error loading authenticators: %v", err)
+		}
+		chainEntries = chainConfig.Authenticators
+	}
+	registry := newAuthenticatorRegistry(c, tlsCfg, store, &sessionManager, providers)
+	authnChain, err := registry.NewChain(chainEntries)
+	if err != nil {
+		log.Fatalf("Error creating authenticators: %v", err)
+	}
+	for _, link := range authnChain {
+		log.Infof("Enabled authenticator '%s'", link.Name)
+	}
+	if stopRequested() {
+		return
+	}
+	var authnPolicies *authenticators.PoliciesConfig
+	if c.AuthnPoliciesConfigPath != "" {
+		authnPolicies, err = authenticators.LoadPoliciesConfig(c.AuthnPoliciesConfigPath, authnChain)
+		if err != nil {
+			log.Fatalf("Error loading authentication policies: %v", err)
+		}
+	}
 
-	opaqueTokenAuthenticator := authenticators.NewOpaqueTokenAuthenticator(
-		c.IDTokenHeader,
-		c.UserIDClaim,
-		c.GroupsClaim,
-		tlsCfg,
-		sessionManager,
-	)
+	// Setup the group enrichers, which add groups to the authenticated
+	// users before they are authorized.
+	var groupEnrichers enrichers.Stage
+	if c.GroupEnrichersConfigPath != "" {
+		enrichersConfig, err := enrichers.LoadConfig(c.GroupEnrichersConfigPath)
+		if err != nil {
+			log.Fatalf("Error loading group enrichers: %v", err)
+		}
+		groupEnrichers, err = enrichers.NewStage(enrichersConfig.Enrichers, enrichers.DefaultFactories(tlsCfg))
+		if err != nil {
+			log.Fatalf("Error creating group enrichers: %v", err)
+		}
+	}
 
 	// Set the bearerUserInfoCache cache to store
 	// the (Bearer Token, UserInfo) pairs.
@@ -191,21 +347,6 @@ func main() {
 		authorizers = append(authorizers, externalAuthorizer)
 	}
 
-	var jwtFromExtraProviderAuthenticator authenticators.Authenticator
-	// Add the jwt extra authentication
-	if c.JWTFromExtraProviderEnabled {
-		jwtFromExtraProviderAuthenticator, err = authenticators.NewJWTFromExtraProviderAuthenticator(
-			c.JWTFromExtraProviderCookieName,
-			c.JWTFromExtraProviderIssuer,
-			c.JWTFromExtraProviderIssuerName,
-			c.JWTFromExtraProviderClientID,
-			c.JWTFromExtraProviderSetHeader,
-			c.JWTFromExtraProviderProviderURL)
-		if err != nil {
-			log.Fatal(err.Error())
-		}
-	}
-
 	// Set the server values.
 	// The isReady atomic variable should protect it from concurrency issues.
 
@@ -236,24 +377,24 @@ func main() {
 		cacheExpirationMinutes: c.CacheExpirationMinutes,
 		jwtCookie:              c.JWTCookie,
 		dynamicCsrfCookieName:  c.DynamicCsrfCookieName,
+		endSessionEnabled:      c.OIDCEndSessionEnabled,
 
-		IDTokenAuthnEnabled:         c.IDTokenAuthnEnabled,
-		KubernetesAuthnEnabled:      c.KubernetesAuthnEnabled,
-		AccessTokenAuthnEnabled:     c.AccessTokenAuthnEnabled,
-		AccessTokenAuthn:            c.AccessTokenAuthn,
-		JWTFromExtraProviderEnabled: c.JWTFromExtraProviderEnabled,
-		authenticators: []authenticators.Authenticator{
-			k8sAuthenticator,
-			opaqueTokenAuthenticator,
-			jwtTokenAuthenticator,
-			sessionAuthenticator,
-			idTokenAuthenticator,
-			jwtFromExtraProviderAuthenticator,
-		},
+		authenticators: authnChain,
+		authnPolicies:  authnPolicies,
+		groupEnrichers: groupEnrichers,
 		authorizers:    authorizers,
 		tlsCfg:         tlsCfg,
 		sessionManager: sessionManager,
+		providers:      providers,
 		sessionDomain:  c.SessionDomain,
+
+		providerSelectionURL: providerSelectionURL,
+		sessionLimit: sessions.SessionLimit{
+			Max:    c.SessionLimitPerUser,
+			Policy: c.SessionLimitPolicy,
+		},
+		sessionLimitURL: common.ResolvePathReference(c.AuthserviceURLPrefix,
+			common.SessionLimitPath).String(),
 	}
 	switch c.SessionSameSite {
 	case "None":
@@ -276,9 +417,42 @@ func main() {
 		},
 	)
 
+	// Start the admin server, which needs the session store and the
+	// providers of the judge server.
+	if c.AdminAPIPort != 0 {
+		adminAuthenticator, err := authenticators.NewAPIKeyAuthenticator("Authorization", c.AdminAPIKeysPath)
+		if err != nil {
+			log.Fatalf("Error creating admin API authenticator: %v", err)
+		}
+		adminServer := AdminServer{
+			Store:         store,
+			Providers:     providers,
+			TLSConfig:     tlsCfg,
+			SessionDomain: c.SessionDomain,
+			Authenticator: adminAuthenticator,
+		}
+		log.Infof("Starting admin server at %v:%v", c.Hostname, c.AdminAPIPort)
+		adminHTTPServer := &http.Server{
+			Addr:    fmt.Sprintf("%s:%d", c.Hostname, c.AdminAPIPort),
+			Handler: adminServer.Handler(),
+		}
+		shutdown.servers = append(shutdown.servers, adminHTTPServer)
+		go func() {
+			if err := adminHTTPServer.ListenAndServe(); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+
 	// Setup complete, mark server ready
+	health.SetChecks(newHealthChecks(store, oidcStateStore, providers, tlsCfg, c.HealthCheckProviderTTL))
+	if stopRequested() {
+		return
+	}
 	isReady.Set()
 
-	// Block until server exits
-	<-stopCh
+	// Block until AuthService is asked to stop
+	sig := <-sigC
+	log.Infof("Received signal %v", sig)
+	shutdown.Shutdown()
 }
@@ -0,0 +1,172 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/arrikto/oidc-authservice/common"
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+)
+
+// OAuth 2.0 Device Authorization Grant helpers, as described in RFC8628:
+// https://tools.ietf.org/html/rfc8628
+
+const deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+// DeviceAuthorization is the response of the provider's device authorization
+// endpoint.
+type DeviceAuthorization struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete,omitempty"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval,omitempty"`
+}
+
+// DeviceTokenError is the error response of the provider's token endpoint
+// while the device flow is still in progress (e.g. authorization_pending,
+// slow_down) or has failed (e.g. access_denied, expired_token).
+type DeviceTokenError struct {
+	StatusCode       int    `json:"-"`
+	ErrorCode        string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+func (e *DeviceTokenError) Error() string {
+	return "device token request failed: " + e.ErrorCode
+}
+
+// DeviceAuthorizationEndpoint parses the OIDC Provider claims from the
+// discovery document and tries to find the device_authorization_endpoint.
+func DeviceAuthorizationEndpoint(p Provider) (string, error) {
+	claims := struct {
+		DeviceAuthorizationEndpoint string `json:"device_authorization_endpoint"`
+	}{}
+	if err := p.Claims(&claims); err != nil {
+		return "", errors.Wrap(err, "Error unmarshalling provider doc into struct")
+	}
+	if claims.DeviceAuthorizationEndpoint == "" {
+		return "", errors.New("Provider doesn't have a device_authorization_endpoint")
+	}
+	return claims.DeviceAuthorizationEndpoint, nil
+}
+
+// RequestDeviceAuthorization starts a device flow at the provider's device
+// authorization endpoint.
+func RequestDeviceAuthorization(ctx context.Context, endpoint string,
+	config *oauth2.Config) (*DeviceAuthorization, error) {
+
+	values := url.Values{}
+	values.Set("client_id", config.ClientID)
+	values.Set("scope", strings.Join(config.Scopes, " "))
+
+	resp, body, err := postForm(ctx, endpoint, values, config)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error contacting device authorization endpoint")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &common.RequestError{
+			Response: resp,
+			Body:     body,
+			Err:      errors.Errorf("Device authorization endpoint returned code %v", resp.StatusCode),
+		}
+	}
+
+	auth := &DeviceAuthorization{}
+	if err := json.Unmarshal(body, auth); err != nil {
+		return nil, errors.Wrap(err, "Error decoding device authorization response")
+	}
+	if auth.DeviceCode == "" || auth.UserCode == "" || auth.VerificationURI == "" {
+		return nil, errors.New("Device authorization response is missing required fields")
+	}
+	return auth, nil
+}
+
+// PollDeviceToken makes a single Device Access Token Request for the given
+// device code. While the user hasn't completed the flow, it returns a
+// *DeviceTokenError.
+func PollDeviceToken(ctx context.Context, deviceCode string,
+	config *oauth2.Config) (*oauth2.Token, error) {
+
+	values := url.Values{}
+	values.Set("grant_type", deviceCodeGrantType)
+	values.Set("device_code", deviceCode)
+	values.Set("client_id", config.ClientID)
+
+	resp, body, err := postForm(ctx, config.Endpoint.TokenURL, values, config)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error contacting token endpoint")
+	}
+	if resp.StatusCode != http.StatusOK {
+		tokenErr := &DeviceTokenError{}
+		if err := json.Unmarshal(body, tokenErr); err != nil || tokenErr.ErrorCode == "" {
+			return nil, &common.RequestError{
+				Response: resp,
+				Body:     body,
+				Err:      errors.Errorf("Token endpoint returned code %v", resp.StatusCode),
+			}
+		}
+		tokenErr.StatusCode = resp.StatusCode
+		return nil, tokenErr
+	}
+
+	raw := map[string]interface{}{}
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil, errors.Wrap(err, "Error decoding token response")
+	}
+	tokenResp := struct {
+		AccessToken  string `json:"access_token"`
+		TokenType    string `json:"token_type"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int64  `json:"expires_in"`
+	}{}
+	if err := json.Unmarshal(body, &tokenResp); err != nil {
+		return nil, errors.Wrap(err, "Error decoding token response")
+	}
+	if tokenResp.AccessToken == "" {
+		return nil, errors.New("Token response doesn't contain an access_token")
+	}
+
+	token := &oauth2.Token{
+		AccessToken:  tokenResp.AccessToken,
+		TokenType:    tokenResp.TokenType,
+		RefreshToken: tokenResp.RefreshToken,
+	}
+	if tokenResp.ExpiresIn > 0 {
+		token.Expiry = time.Now().Add(time.Duration(tokenResp.ExpiresIn) * time.Second)
+	}
+	return token.WithExtra(raw), nil
+}
+
+// postForm POSTs the given form to the endpoint, authenticating with the
+// client credentials, and returns the response along with its body.
+func postForm(ctx context.Context, endpoint string, values url.Values,
+	config *oauth2.Config) (*http.Response, []byte, error) {
+
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(values.Encode()))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	// We only support basic auth now, same as for token revocation.
+	req.SetBasicAuth(url.QueryEscape(config.ClientID), url.QueryEscape(config.ClientSecret))
+
+	resp, err := common.DoRequest(ctx, req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp, body, nil
+}
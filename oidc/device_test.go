@@ -0,0 +1,65 @@
+package oidc
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+func TestDeviceFlow(t *testing.T) {
+
+	authorized := false
+	mux := http.NewServeMux()
+	mux.HandleFunc("/device/code", func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "openid email", r.PostFormValue("scope"))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"device_code": "dc", "user_code": "ABCD-EFGH",
+			"verification_uri": "https://example.test/device", "expires_in": 300}`))
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, deviceCodeGrantType, r.PostFormValue("grant_type"))
+		require.Equal(t, "dc", r.PostFormValue("device_code"))
+		w.Header().Set("Content-Type", "application/json")
+		if !authorized {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": "authorization_pending"}`))
+			return
+		}
+		w.Write([]byte(`{"access_token": "at", "token_type": "Bearer",
+			"refresh_token": "rt", "expires_in": 3600, "id_token": "idt"}`))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	config := &oauth2.Config{
+		ClientID:     "client",
+		ClientSecret: "secret",
+		Endpoint:     oauth2.Endpoint{TokenURL: srv.URL + "/token"},
+		Scopes:       []string{"openid", "email"},
+	}
+	ctx := context.Background()
+
+	auth, err := RequestDeviceAuthorization(ctx, srv.URL+"/device/code", config)
+	require.NoError(t, err)
+	require.Equal(t, "dc", auth.DeviceCode)
+	require.Equal(t, "ABCD-EFGH", auth.UserCode)
+
+	_, err = PollDeviceToken(ctx, auth.DeviceCode, config)
+	var tokenErr *DeviceTokenError
+	require.True(t, errors.As(err, &tokenErr), "unexpected error: %v", err)
+	require.Equal(t, "authorization_pending", tokenErr.ErrorCode)
+	require.Equal(t, http.StatusBadRequest, tokenErr.StatusCode)
+
+	authorized = true
+	token, err := PollDeviceToken(ctx, auth.DeviceCode, config)
+	require.NoError(t, err)
+	require.Equal(t, "at", token.AccessToken)
+	require.Equal(t, "rt", token.RefreshToken)
+	require.Equal(t, "idt", token.Extra("id_token"))
+	require.False(t, token.Expiry.IsZero())
+}
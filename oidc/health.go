@@ -0,0 +1,82 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/arrikto/oidc-authservice/common"
+	"github.com/pkg/errors"
+)
+
+// ErrDiscoveryChanged is returned by CheckDiscovery if the discovery document
+// of the provider has changed since it was discovered.
+var ErrDiscoveryChanged = errors.New("discovery document has changed")
+
+// discoveryDocument holds the fields of the discovery document that
+// AuthService depends on.
+type discoveryDocument struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// CheckDiscovery fetches the discovery document of the provider again and
+// examines if it still matches the one that AuthService discovered.
+func CheckDiscovery(ctx context.Context, p Provider) error {
+	var discovered discoveryDocument
+	if err := p.Claims(&discovered); err != nil {
+		return errors.Wrap(err, "Error unmarshalling provider doc into struct")
+	}
+	wellKnown := strings.TrimSuffix(discovered.Issuer, "/") + "/.well-known/openid-configuration"
+	var current discoveryDocument
+	if err := getJSON(ctx, wellKnown, &current); err != nil {
+		return errors.Wrap(err, "failed to fetch discovery document")
+	}
+	if current != discovered {
+		return ErrDiscoveryChanged
+	}
+	return nil
+}
+
+// CheckJWKS fetches the JSON Web Key Set of the provider, which verifies the
+// ID tokens, and examines if it has any keys.
+func CheckJWKS(ctx context.Context, p Provider) error {
+	var discovered discoveryDocument
+	if err := p.Claims(&discovered); err != nil {
+		return errors.Wrap(err, "Error unmarshalling provider doc into struct")
+	}
+	if discovered.JWKSURI == "" {
+		return errors.New("Provider doesn't have a jwks_uri")
+	}
+	jwks := struct {
+		Keys []json.RawMessage `json:"keys"`
+	}{}
+	if err := getJSON(ctx, discovered.JWKSURI, &jwks); err != nil {
+		return errors.Wrap(err, "failed to fetch JWKS")
+	}
+	if len(jwks.Keys) == 0 {
+		return errors.New("JWKS has no keys")
+	}
+	return nil
+}
+
+// getJSON GETs the JSON document of the given URL.
+func getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := common.DoRequest(ctx, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("%s returned status %d", url, resp.StatusCode)
+	}
+	return errors.Wrapf(json.NewDecoder(resp.Body).Decode(v), "failed to decode %s", url)
+}
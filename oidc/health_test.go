@@ -0,0 +1,53 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/coreos/go-oidc"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthChecks(t *testing.T) {
+	var srvURL string
+	jwksURI := "/jwks"
+	keys := `{"keys": [{"kty": "RSA", "kid": "1", "n": "AQAB", "e": "AQAB"}]}`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{
+				"issuer":                 srvURL,
+				"authorization_endpoint": srvURL + "/auth",
+				"token_endpoint":         srvURL + "/token",
+				"jwks_uri":               srvURL + jwksURI,
+			})
+		case "/jwks":
+			w.Write([]byte(keys))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	srvURL = srv.URL
+
+	ctx := context.Background()
+	provider, err := oidc.NewProvider(ctx, srv.URL)
+	require.NoError(t, err)
+	require.NoError(t, CheckDiscovery(ctx, provider))
+	require.NoError(t, CheckJWKS(ctx, provider))
+
+	// An empty JWKS can't verify any tokens
+	keys = `{"keys": []}`
+	require.Error(t, CheckJWKS(ctx, provider))
+
+	// The discovery document is stale once the provider changes it
+	jwksURI = "/keys"
+	require.Equal(t, ErrDiscoveryChanged, CheckDiscovery(ctx, provider))
+
+	srv.Close()
+	require.Error(t, CheckDiscovery(ctx, provider))
+}
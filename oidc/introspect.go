@@ -0,0 +1,98 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/arrikto/oidc-authservice/common"
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+)
+
+// OAuth 2.0 Token Introspection helpers, as described in RFC7662:
+// https://tools.ietf.org/html/rfc7662
+
+// Introspection is the response of the provider's introspection endpoint.
+type Introspection struct {
+	Active    bool            `json:"active"`
+	Scope     string          `json:"scope"`
+	ClientID  string          `json:"client_id"`
+	Username  string          `json:"username"`
+	TokenType string          `json:"token_type"`
+	Expiry    int64           `json:"exp"`
+	Subject   string          `json:"sub"`
+	Audience  common.Audience `json:"aud"`
+	Issuer    string          `json:"iss"`
+
+	rawClaims []byte
+}
+
+// Claims unmarshals all the claims of the introspection response, including
+// any extension claims, e.g., the user's groups.
+func (i *Introspection) Claims(v interface{}) error {
+	if i.rawClaims == nil {
+		return errors.New("introspection response doesn't have claims")
+	}
+	return json.Unmarshal(i.rawClaims, v)
+}
+
+// Scopes returns the scopes of the token.
+func (i *Introspection) Scopes() []string {
+	return strings.Fields(i.Scope)
+}
+
+// ExpiresAt returns the expiry of the token, or the zero time if the
+// introspection response doesn't include one.
+func (i *Introspection) ExpiresAt() time.Time {
+	if i.Expiry == 0 {
+		return time.Time{}
+	}
+	return time.Unix(i.Expiry, 0)
+}
+
+// IntrospectionEndpoint parses the OIDC Provider claims from the discovery
+// document and tries to find the introspection_endpoint.
+func IntrospectionEndpoint(p Provider) (string, error) {
+	claims := struct {
+		IntrospectionEndpoint string `json:"introspection_endpoint"`
+	}{}
+	if err := p.Claims(&claims); err != nil {
+		return "", errors.Wrap(err, "Error unmarshalling provider doc into struct")
+	}
+	if claims.IntrospectionEndpoint == "" {
+		return "", errors.New("Provider doesn't have an introspection_endpoint")
+	}
+	return claims.IntrospectionEndpoint, nil
+}
+
+// IntrospectToken asks the provider's introspection endpoint about the given
+// access token, authenticating with the client credentials.
+func IntrospectToken(ctx context.Context, endpoint, token string,
+	config *oauth2.Config) (*Introspection, error) {
+
+	values := url.Values{}
+	values.Set("token", token)
+	values.Set("token_type_hint", "access_token")
+
+	resp, body, err := postForm(ctx, endpoint, values, config)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error contacting introspection endpoint")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &common.RequestError{
+			Response: resp,
+			Body:     body,
+			Err:      errors.Errorf("Introspection endpoint returned code %v", resp.StatusCode),
+		}
+	}
+
+	introspection := &Introspection{rawClaims: body}
+	if err := json.Unmarshal(body, introspection); err != nil {
+		return nil, errors.Wrap(err, "Error decoding introspection response")
+	}
+	return introspection, nil
+}
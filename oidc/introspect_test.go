@@ -0,0 +1,49 @@
+package oidc
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+func TestIntrospectToken(t *testing.T) {
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientID, clientSecret, ok := r.BasicAuth()
+		require.True(t, ok)
+		require.Equal(t, "client", clientID)
+		require.Equal(t, "secret", clientSecret)
+		require.Equal(t, "access_token", r.PostFormValue("token_type_hint"))
+
+		w.Header().Set("Content-Type", "application/json")
+		if r.PostFormValue("token") != "valid" {
+			w.Write([]byte(`{"active": false}`))
+			return
+		}
+		w.Write([]byte(`{"active": true, "scope": "openid profile", "aud": "api",
+			"exp": 2000000000, "email": "user@example.com", "groups": ["a", "b"]}`))
+	}))
+	defer srv.Close()
+
+	config := &oauth2.Config{ClientID: "client", ClientSecret: "secret"}
+	ctx := context.Background()
+
+	introspection, err := IntrospectToken(ctx, srv.URL, "invalid", config)
+	require.NoError(t, err)
+	require.False(t, introspection.Active)
+
+	introspection, err = IntrospectToken(ctx, srv.URL, "valid", config)
+	require.NoError(t, err)
+	require.True(t, introspection.Active)
+	require.Equal(t, []string{"openid", "profile"}, introspection.Scopes())
+	require.Equal(t, []string{"api"}, []string(introspection.Audience))
+	require.Equal(t, int64(2000000000), introspection.ExpiresAt().Unix())
+
+	var claims map[string]interface{}
+	require.NoError(t, introspection.Claims(&claims))
+	require.Equal(t, "user@example.com", claims["email"])
+}
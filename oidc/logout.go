@@ -0,0 +1,42 @@
+package oidc
+
+import (
+	"github.com/pkg/errors"
+)
+
+// backChannelLogoutEvent is the member of the events claim that identifies
+// a Logout Token.
+const backChannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+
+// LogoutToken represents the claims of an OIDC Back-Channel Logout Token that
+// identify the sessions to log out:
+// https://openid.net/specs/openid-connect-backchannel-1_0.html#LogoutToken
+type LogoutToken struct {
+	Subject   string
+	SessionID string
+}
+
+// ParseLogoutToken validates the claims of an already verified Logout Token,
+// as described in:
+// https://openid.net/specs/openid-connect-backchannel-1_0.html#Validation
+func ParseLogoutToken(cp ClaimProvider) (*LogoutToken, error) {
+	claims := struct {
+		Subject   string                            `json:"sub"`
+		SessionID string                            `json:"sid"`
+		Nonce     *string                           `json:"nonce"`
+		Events    map[string]map[string]interface{} `json:"events"`
+	}{}
+	if err := cp.Claims(&claims); err != nil {
+		return nil, errors.Wrap(err, "Error unmarshalling logout token claims")
+	}
+	if _, ok := claims.Events[backChannelLogoutEvent]; !ok {
+		return nil, errors.New("Logout token doesn't contain a back-channel logout event")
+	}
+	if claims.Nonce != nil {
+		return nil, errors.New("Logout token must not contain a nonce claim")
+	}
+	if claims.Subject == "" && claims.SessionID == "" {
+		return nil, errors.New("Logout token contains neither a sub nor a sid claim")
+	}
+	return &LogoutToken{Subject: claims.Subject, SessionID: claims.SessionID}, nil
+}
@@ -185,26 +185,19 @@ func NewClaims(cp ClaimProvider, userIDClaim, groupsClaim string) (Claims, error
 	return c, err
 }
 
+// UserID returns the user's identity from the userID claim.
 func (c *Claims) UserID() (string, error) {
-	claim := c.rawClaims[c.userIDClaim]
-	if claim == nil {
-		return "", errors.New("Couldn't find userID claim")
-	}
-	return claim.(string), nil
+	return common.UserIDFromClaims(c.rawClaims, c.userIDClaim)
 }
 
-func (c *Claims) Groups() []string {
-	gc := c.rawClaims[c.groupsClaim]
-	if gc == nil {
-		return []string{}
-	}
-
-	in := gc.([]interface{})
-	res := []string{}
-	for _, elem := range in {
-		res = append(res, elem.(string))
+// Groups returns the user's groups from the groups claim. A missing groups
+// claim means that the user has no groups.
+func (c *Claims) Groups() ([]string, error) {
+	groups, err := common.GroupsFromClaims(c.rawClaims, c.groupsClaim)
+	if common.IsClaimNotFound(err) {
+		return []string{}, nil
 	}
-	return res
+	return groups, err
 }
 
 func (c *Claims) Claims() map[string]interface{} {
@@ -2,6 +2,7 @@ package oidc
 
 import (
 	"context"
+	"encoding/json"
 	"html/template"
 	"net/http"
 	"testing"
@@ -188,3 +189,74 @@ func TestParseUserInfo(t *testing.T) {
 		})
 	}
 }
+
+func TestEndSessionURL(t *testing.T) {
+	endSessionURL, err := EndSessionURL("https://example.test/logout?foo=bar",
+		"idtoken", "client", "https://app.example.test/after_logout")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := "https://example.test/logout?client_id=client&foo=bar" +
+		"&id_token_hint=idtoken" +
+		"&post_logout_redirect_uri=https%3A%2F%2Fapp.example.test%2Fafter_logout"
+	if endSessionURL != expected {
+		t.Fatalf("Got wrong end session URL. Got '%v', expected '%v'.",
+			endSessionURL, expected)
+	}
+}
+
+type rawClaims []byte
+
+func (c rawClaims) Claims(v interface{}) error {
+	return json.Unmarshal(c, v)
+}
+
+func TestParseLogoutToken(t *testing.T) {
+
+	tests := []struct {
+		testName string
+		claims   string
+		success  bool
+	}{
+		{
+			testName: "Logout token with sub and sid",
+			claims:   `{"sub": "user", "sid": "session", "events": {"http://schemas.openid.net/event/backchannel-logout": {}}}`,
+			success:  true,
+		},
+		{
+			testName: "Logout token with sid only",
+			claims:   `{"sid": "session", "events": {"http://schemas.openid.net/event/backchannel-logout": {}}}`,
+			success:  true,
+		},
+		{
+			testName: "Logout token without sub and sid",
+			claims:   `{"events": {"http://schemas.openid.net/event/backchannel-logout": {}}}`,
+			success:  false,
+		},
+		{
+			testName: "Logout token without events",
+			claims:   `{"sub": "user"}`,
+			success:  false,
+		},
+		{
+			testName: "Logout token with nonce",
+			claims:   `{"sub": "user", "nonce": "n", "events": {"http://schemas.openid.net/event/backchannel-logout": {}}}`,
+			success:  false,
+		},
+	}
+
+	for _, c := range tests {
+		t.Run(c.testName, func(t *testing.T) {
+			_, err := ParseLogoutToken(rawClaims(c.claims))
+
+			success := true
+			if err != nil {
+				success = false
+			}
+
+			if success != c.success {
+				t.Errorf("ParseLogoutToken result for %v is not the expected one. Error %v", c, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+)
+
+// Proof Key for Code Exchange (PKCE) helpers, as described in RFC7636:
+// https://tools.ietf.org/html/rfc7636
+
+const (
+	PKCEMethodS256  = "S256"
+	PKCEMethodPlain = "plain"
+	// PKCEMethodNone disables PKCE altogether.
+	PKCEMethodNone = "none"
+
+	// codeVerifierEntropy is the number of random bytes used to generate a
+	// code verifier. 32 bytes result in a 43-character base64url string,
+	// which is the minimum length allowed by the RFC.
+	codeVerifierEntropy = 32
+)
+
+// NewCodeVerifier creates a high-entropy cryptographic random string, to be
+// used as a PKCE code_verifier.
+func NewCodeVerifier() (string, error) {
+	b := make([]byte, codeVerifierEntropy)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "Error generating PKCE code verifier")
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// CodeChallenge derives the code_challenge from the given code_verifier
+// using the given code_challenge_method.
+func CodeChallenge(verifier, method string) string {
+	if method == PKCEMethodPlain {
+		return verifier
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// CodeChallengeOptions returns the Authorization Request parameters that
+// carry the code_challenge for the given code_verifier.
+func CodeChallengeOptions(verifier, method string) []oauth2.AuthCodeOption {
+	return []oauth2.AuthCodeOption{
+		oauth2.SetAuthURLParam("code_challenge", CodeChallenge(verifier, method)),
+		oauth2.SetAuthURLParam("code_challenge_method", method),
+	}
+}
+
+// CodeVerifierOption returns the Token Request parameter that carries the
+// code_verifier.
+func CodeVerifierOption(verifier string) oauth2.AuthCodeOption {
+	return oauth2.SetAuthURLParam("code_verifier", verifier)
+}
+
+// CodeChallengeMethodsSupported parses the OIDC Provider claims from the
+// discovery document and returns the advertised code_challenge_methods.
+func CodeChallengeMethodsSupported(p Provider) ([]string, error) {
+	claims := struct {
+		CodeChallengeMethodsSupported []string `json:"code_challenge_methods_supported"`
+	}{}
+	if err := p.Claims(&claims); err != nil {
+		return nil, errors.Wrap(err, "Error unmarshalling provider doc into struct")
+	}
+	return claims.CodeChallengeMethodsSupported, nil
+}
@@ -0,0 +1,48 @@
+package oidc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCodeChallenge(t *testing.T) {
+
+	tests := []struct {
+		testName  string
+		verifier  string
+		method    string
+		challenge string
+	}{
+		{
+			// Example from RFC7636, Appendix B
+			testName:  "S256",
+			verifier:  "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk",
+			method:    PKCEMethodS256,
+			challenge: "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM",
+		},
+		{
+			testName:  "plain",
+			verifier:  "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk",
+			method:    PKCEMethodPlain,
+			challenge: "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk",
+		},
+	}
+
+	for _, c := range tests {
+		t.Run(c.testName, func(t *testing.T) {
+			require.Equal(t, c.challenge, CodeChallenge(c.verifier, c.method))
+		})
+	}
+}
+
+func TestNewCodeVerifier(t *testing.T) {
+	verifier, err := NewCodeVerifier()
+	require.NoError(t, err)
+	// RFC7636 requires a verifier between 43 and 128 characters long.
+	require.Len(t, verifier, 43)
+
+	other, err := NewCodeVerifier()
+	require.NoError(t, err)
+	require.NotEqual(t, verifier, other)
+}
@@ -29,6 +29,40 @@ func RevocationEndpoint(p Provider) (string, error) {
 	return claims.RevocationEndpoint, nil
 }
 
+// EndSessionEndpoint parses the OIDC Provider claims from the discovery document
+// and tries to find the end_session_endpoint.
+func EndSessionEndpoint(p Provider) (string, error) {
+	claims := struct {
+		EndSessionEndpoint string `json:"end_session_endpoint"`
+	}{}
+	if err := p.Claims(&claims); err != nil {
+		return "", errors.Wrap(err, "Error unmarshalling provider doc into struct")
+	}
+	if claims.EndSessionEndpoint == "" {
+		return "", errors.New("Provider doesn't have an end_session_endpoint")
+	}
+	return claims.EndSessionEndpoint, nil
+}
+
+// EndSessionURL builds the URL for an RP-Initiated Logout request, as
+// described in https://openid.net/specs/openid-connect-rpinitiated-1_0.html
+func EndSessionURL(endSessionEndpoint, idToken, clientID, postLogoutRedirectURI string) (string, error) {
+	u, err := url.Parse(endSessionEndpoint)
+	if err != nil {
+		return "", errors.Wrap(err, "Error parsing end_session_endpoint")
+	}
+	q := u.Query()
+	if idToken != "" {
+		q.Set("id_token_hint", idToken)
+	}
+	q.Set("client_id", clientID)
+	if postLogoutRedirectURI != "" {
+		q.Set("post_logout_redirect_uri", postLogoutRedirectURI)
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
 // RevokeTokens is a helper that takes an oauth2.Token and revokes the access and refresh tokens.
 // If no tokens are found, it succeeds.
 func RevokeTokens(ctx context.Context, revocationEndpoint string, token *oauth2.Token, clientID, clientSecret string) error {
@@ -46,11 +80,13 @@ func RevokeTokens(ctx context.Context, revocationEndpoint string, token *oauth2.
 		log.Info("Attempting to revoke access token...")
 		err := revokeToken(ctx, revocationEndpoint, token.AccessToken, "access_token", clientID, clientSecret)
 		if err != nil {
-			code := err.(*common.RequestError).Response.StatusCode
-			if code == 400 {
+			// Errors other than the responses of the provider, e.g., when
+			// it can't be reached, have no status code.
+			var reqErr *common.RequestError
+			if errors.As(err, &reqErr) && reqErr.Response.StatusCode == 400 {
 				bodyMap := make(map[string]string)
 
-				err2 := json.Unmarshal(err.(*common.RequestError).Body, &bodyMap)
+				err2 := json.Unmarshal(reqErr.Body, &bodyMap)
 				if err2 != nil {
 					err2 = errors.Wrap(err2, "Error while attempting to unmarshal the body of the request")
 					full_error := errors.New(err.Error() + err2.Error())
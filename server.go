@@ -3,8 +3,11 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"reflect"
 	"strings"
 	"time"
@@ -12,11 +15,15 @@ import (
 	"github.com/arrikto/oidc-authservice/authenticators"
 	"github.com/arrikto/oidc-authservice/authorizer"
 	"github.com/arrikto/oidc-authservice/common"
+	"github.com/arrikto/oidc-authservice/enrichers"
 	"github.com/arrikto/oidc-authservice/oidc"
 	"github.com/arrikto/oidc-authservice/sessions"
+	goidc "github.com/coreos/go-oidc"
 	cache "github.com/patrickmn/go-cache"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 	"github.com/tevino/abool"
+	"golang.org/x/oauth2"
 )
 
 const (
@@ -24,22 +31,17 @@ const (
 )
 
 var (
-	SessionLogoutPath     = "/logout"
-	authenticatorsMapping = []string{
-		0: "kubernetes authenticator",
-		1: "opaque access token authenticator",
-		2: "JWT access token authenticator",
-		3: "session authenticator",
-		4: "idtoken authenticator",
-		5: "jwt from extra provider authenticator",
-	}
+	SessionLogoutPath = "/logout"
+	LoginPath         = "/login"
 )
 
 type server struct {
-	store                  sessions.ClosableStore
+	store                  sessions.IndexedStore
 	oidcStateStore         sessions.ClosableStore
 	bearerUserInfoCache    *cache.Cache
-	authenticators         []authenticators.Authenticator
+	authenticators         authenticators.Chain
+	authnPolicies          *authenticators.PoliciesConfig
+	groupEnrichers         enrichers.Stage
 	authorizers            []authorizer.Authorizer
 	afterLoginRedirectURL  string
 	homepageURL            string
@@ -48,18 +50,14 @@ type server struct {
 	sessionMaxAgeSeconds   int
 	jwtCookie              string
 	dynamicCsrfCookieName  bool
+	// endSessionEnabled redirects the user to the provider's
+	// end_session_endpoint after logout.
+	endSessionEnabled bool
 
 	// Cache Configurations
 	cacheEnabled           bool
 	cacheExpirationMinutes int
 
-	// Authenticators Configurations
-	IDTokenAuthnEnabled         bool
-	KubernetesAuthnEnabled      bool
-	AccessTokenAuthnEnabled     bool
-	AccessTokenAuthn            string
-	JWTFromExtraProviderEnabled bool
-
 	authHeader        string
 	idTokenOpts       common.JWTClaimOpts
 	userHeaderHelper  *userHeaderHelper
@@ -67,6 +65,18 @@ type server struct {
 	sessionSameSite   http.SameSite
 	sessionDomain     string
 	sessionManager    sessions.SessionManager
+	providers         *sessions.Providers
+	// providerSelectionURL is the login selection page, where users
+	// choose the provider to log in with. It is empty if the page is
+	// disabled.
+	providerSelectionURL string
+	sessionLimit         sessions.SessionLimit
+	// sessionLimitURL is the page that explains to the users that they
+	// can't log in, as they have too many sessions.
+	sessionLimitURL string
+	// sessionLimitLocks serialize the logins of each user while the
+	// session limit is enforced.
+	sessionLimitLocks sessions.UserLocks
 	tlsCfg            common.TlsConfig
 	newState          sessions.StateFunc
 }
@@ -184,10 +194,20 @@ func (s *server) authenticate(w http.ResponseWriter, r *http.Request, promptLogi
 	// Enforce no caching on the browser side.
 	w.Header().Add("Cache-Control", "private, max-age=0, no-cache, no-store")
 
+	// The authentication policy of the request chooses the authenticators
+	// and whether the user is redirected to log in.
+	chain := s.authenticators
+	login := promptLogin
+	if policy := s.authnPolicies.Match(r.Host, r.Method, s.requestPath(r, !promptLogin)); policy != nil {
+		logger = logger.WithField("policy", policy.Name)
+		chain = policy.Chain(chain)
+		login = promptLogin && policy.LoginEnabled()
+	}
+
 	// Try each one of the available enabled authenticators, if none of them
 	// achieves to authenticate the request then userInfo will be nil and
 	// Authorization Code Flow will begin.
-	userInfo, authorized := s.tryAuthenticators(w, r, promptLogin)
+	userInfo, authorized := s.tryAuthenticators(w, r, chain, promptLogin)
 	if !authorized {
 		return nil, false
 	}
@@ -195,9 +215,10 @@ func (s *server) authenticate(w http.ResponseWriter, r *http.Request, promptLogi
 	// Preliminary check for the /verify endpoint
 	// if the user is not authenticated return 401
 	if userInfo == nil {
-		// Preliminary check for the /verify endpoint
-		// if the user is not authenticated return 401
-		if !promptLogin {
+		// Preliminary check for the /verify endpoint and the policies
+		// that don't allow logins, if the user is not authenticated
+		// return 401
+		if !login {
 			common.ReturnMessage(w, http.StatusUnauthorized, "Unauthorized")
 			return nil, false
 		}
@@ -208,11 +229,19 @@ func (s *server) authenticate(w http.ResponseWriter, r *http.Request, promptLogi
 		return nil, false
 	}
 
+	// Add the groups of the group enrichers
+	userInfo, err := s.groupEnrichers.Enrich(r, userInfo)
+	if err != nil {
+		logger.Errorf("Error enriching the user's groups: %v", err)
+		common.ReturnMessage(w, http.StatusInternalServerError, "Failed to retrieve the user's groups.")
+		return nil, false
+	}
+
 	logger = logger.WithField("user", userInfo)
 	logger.Info("Authorizing request...")
 
 	// Ensure that all authorizers allow the access to the requested resource
-	authorized = s.authorized(w, r, userInfo)
+	authorized = s.authorized(w, r, userInfo, login)
 	if !authorized {
 		return nil, false
 	}
@@ -220,19 +249,15 @@ func (s *server) authenticate(w http.ResponseWriter, r *http.Request, promptLogi
 	return userInfo, true
 }
 
-// tryAuthenticators will iterate over the available enabled authenticators.
+// tryAuthenticators will iterate over the authenticators of the given chain.
 // If one of them manages to authenticate the user who is making the requester
 // then it will return their user Info and all the other authenticator will be
 // skipped.
-func (s *server) tryAuthenticators(w http.ResponseWriter, r *http.Request, promptLogin bool) (*common.User, bool) {
+func (s *server) tryAuthenticators(w http.ResponseWriter, r *http.Request, chain authenticators.Chain, promptLogin bool) (*common.User, bool) {
 	logger := common.RequestLogger(r, logModuleInfo)
 
 	var userInfo *common.User
-	for i, auth := range s.authenticators {
-		if !s.enabledAuthenticator(authenticatorsMapping[i]) {
-			continue
-		}
-
+	for _, link := range chain {
 		var cacheKey string
 
 		if s.cacheEnabled {
@@ -240,7 +265,7 @@ func (s *server) tryAuthenticators(w http.ResponseWriter, r *http.Request, promp
 			// implements the cacheable interface then try to
 			// retrieve the UserInfo from cache and the cacheKey for
 			// this cache entry.
-			userInfo, cacheKey = s.getCachedUser(auth, r)
+			userInfo, cacheKey = s.getCachedUser(link, r)
 
 			if userInfo != nil {
 				logger.Infof("Successfully authenticated request using the cache.")
@@ -249,10 +274,12 @@ func (s *server) tryAuthenticators(w http.ResponseWriter, r *http.Request, promp
 			}
 		}
 
-		logger.Debugf("%s starting...", strings.Title(authenticatorsMapping[i]))
-		resp, found, err := auth.Authenticate(w, r)
+		logger.Debugf("Authenticator '%s' starting...", link.Name)
+		resp, found, err := link.Authenticate(w, r)
 		if err != nil {
-			logger.Errorf("Error authenticating request using %s: %v", authenticatorsMapping[i], err)
+			logger.Errorf("Error authenticating request using authenticator '%s': %v", link.Name, err)
+		}
+		if err != nil && link.OnError != authenticators.OnErrorContinue {
 			// If we get a login expired error, it means the
 			// authenticator recognised a valid authentication method
 			// which has expired
@@ -271,9 +298,14 @@ func (s *server) tryAuthenticators(w http.ResponseWriter, r *http.Request, promp
 				return nil, false
 			}
 
+			// Chain entries may stop at any other error too.
+			if link.OnError == authenticators.OnErrorStop {
+				common.ReturnMessage(w, http.StatusUnauthorized, "Unauthorized")
+				return nil, false
+			}
 		}
 		if found {
-			logger.Infof("Successfully authenticated request using %s", authenticatorsMapping[i])
+			logger.Infof("Successfully authenticated request using authenticator '%s'", link.Name)
 			userInfo = resp
 			logger.Debugf("UserInfo: %+v", userInfo)
 
@@ -290,12 +322,19 @@ func (s *server) tryAuthenticators(w http.ResponseWriter, r *http.Request, promp
 
 // authorize tries out all of the available authorizers. If at least one of them
 // does not allow the user to make the request then AuthService denies the access
-// to this resource.
-func (s *server) authorized(w http.ResponseWriter, r *http.Request, userInfo *common.User) bool {
+// to this resource. If an authorizer requires step-up authentication and login
+// is true, the user of a session cookie is sent to log in again.
+func (s *server) authorized(w http.ResponseWriter, r *http.Request, userInfo *common.User, login bool) bool {
 	logger := common.RequestLogger(r, logModuleInfo)
 
 	for _, authz := range s.authorizers {
 		allowed, reason, err := authz.Authorize(r, userInfo)
+		var stepUpErr *common.StepUpRequiredError
+		if errors.As(err, &stepUpErr) && login && isCookieUser(userInfo) {
+			logger.Infof("Authorizer '%T' requires step-up authentication: %s", authz, stepUpErr.Reason)
+			s.stepUpAuthenticationRequest(w, r, stepUpErr.StepUp)
+			return false
+		}
 		if err != nil {
 			logger.Errorf("Error authorizing request using authorizer %T: %v", authz, err)
 			w.WriteHeader(http.StatusForbidden)
@@ -311,7 +350,8 @@ func (s *server) authorized(w http.ResponseWriter, r *http.Request, userInfo *co
 				logger.Errorf("Error getting session for request: %v", err)
 			}
 			if !session.IsNew {
-				err := s.sessionManager.RevokeSession(r.Context(), w, session, s.tlsCfg, s.sessionDomain)
+				sessionManager := s.providers.ForSession(session).SessionManager
+				err := sessionManager.RevokeSession(r.Context(), w, session, s.tlsCfg, s.sessionDomain)
 				if err != nil {
 					logger.Errorf("Failed to revoke session after authorization fail: %v", err)
 				}
@@ -327,12 +367,39 @@ func (s *server) authorized(w http.ResponseWriter, r *http.Request, userInfo *co
 	return true
 }
 
+// isCookieUser examines if the user was authenticated with a session cookie,
+// i.e., by a browser that can be redirected to log in.
+func isCookieUser(user *common.User) bool {
+	authMethod := user.Extra["auth-method"]
+	return len(authMethod) > 0 && authMethod[0] == "cookie"
+}
+
+// stepUpAuthenticationRequest initiates an OIDC Authorization Code flow with
+// the provider of the user's session, asking it to satisfy the given step-up
+// requirements.
+func (s *server) stepUpAuthenticationRequest(w http.ResponseWriter, r *http.Request, stepUp *common.StepUp) {
+	provider := s.providers.Default()
+	session, _, err := sessions.SessionFromRequest(r, s.store, sessions.UserSessionCookie, s.authHeader)
+	if err == nil && !session.IsNew {
+		provider = s.providers.ForSession(session)
+	}
+
+	state := s.newState(r)
+	state.StepUp = stepUp
+	s.startAuthCodeFlow(w, r, provider, state)
+}
+
 // getCachedUser returns:
 // * the UserInfo
 // * the cacheKey
 // if there is an entry in the cache for the examined user.
 // Otherwise, it returns nil and an empty string respectively.
-func (s *server) getCachedUser(auth authenticators.Authenticator, r *http.Request) (*common.User, string) {
+//
+// The cache key is scoped to the chain entry, since the same credentials
+// may be accepted by one entry and refused by another one, e.g., a JWT
+// authenticator with other audiences or an entry of another policy.
+func (s *server) getCachedUser(link authenticators.Link, r *http.Request) (*common.User, string) {
+	auth := link.Authenticator
 	logger := common.RequestLogger(r, logModuleInfo)
 
 	// If the cache is enabled, check if the current authenticator implements the Cacheable interface.
@@ -347,6 +414,7 @@ func (s *server) getCachedUser(auth authenticators.Authenticator, r *http.Reques
 		cacheKey := cacheableAuthenticator.GetCacheKey(r)
 
 		if cacheKey != "" {
+			cacheKey = link.Name + ":" + cacheKey
 			cachedUserInfo, found := s.bearerUserInfoCache.Get(cacheKey)
 			if found {
 				userInfo := cachedUserInfo.(*common.User)
@@ -362,20 +430,125 @@ func (s *server) getCachedUser(auth authenticators.Authenticator, r *http.Reques
 }
 
 // authCodeFlowAuthenticationRequest initiates an OIDC Authorization Code flow
+// with the provider of the request's host. If no provider is configured for
+// the host and the login selection page is enabled, it redirects the user
+// there to choose one.
 func (s *server) authCodeFlowAuthenticationRequest(w http.ResponseWriter, r *http.Request) {
+	state := s.newState(r)
+
+	provider, ok := s.providers.ForHost(r.Host)
+	if !ok {
+		if s.providerSelectionURL != "" {
+			selectionURL := common.MustParseURL(s.providerSelectionURL)
+			q := selectionURL.Query()
+			q.Set("next", state.FirstVisitedURL)
+			selectionURL.RawQuery = q.Encode()
+			http.Redirect(w, r, selectionURL.String(), http.StatusFound)
+			return
+		}
+		provider = s.providers.Default()
+	}
+	s.startAuthCodeFlow(w, r, provider, state)
+}
+
+// login is the handler that initiates an OIDC Authorization Code flow with
+// the provider that the user chose in the login selection page. After login,
+// it redirects the user to the URL of the "next" query parameter.
+func (s *server) login(w http.ResponseWriter, r *http.Request) {
+	logger := common.RequestLogger(r, logModuleInfo)
+
+	name := r.FormValue("provider")
+	provider, ok := s.providers.Get(name)
+	if !ok {
+		logger.Errorf("Unknown OIDC provider '%s'", name)
+		common.ReturnMessage(w, http.StatusBadRequest, "Unknown OIDC provider.")
+		return
+	}
+
+	state := s.newState(r)
+	state.FirstVisitedURL = "/"
+	if next := r.FormValue("next"); next != "" {
+		if !s.validRedirect(next) {
+			logger.Errorf("Invalid redirect URL '%s'", next)
+			common.ReturnMessage(w, http.StatusBadRequest, "Invalid redirect URL.")
+			return
+		}
+		state.FirstVisitedURL = next
+	}
+	s.startAuthCodeFlow(w, r, provider, state)
+}
+
+// validRedirect examines if it is safe to redirect the user to the given URL
+// after login, i.e., it is a relative URL or, if SESSION_DOMAIN is set, a URL
+// under the session domain. Browsers treat backslashes as slashes, so they
+// are normalized before the URL is parsed, e.g., "/\evil.example" is the
+// host "evil.example".
+func (s *server) validRedirect(rawURL string) bool {
+	for _, c := range rawURL {
+		if c < 0x20 || c == 0x7f {
+			return false
+		}
+	}
+	normalized := strings.ReplaceAll(rawURL, "\\", "/")
+	u, err := url.Parse(normalized)
+	if err != nil {
+		return false
+	}
+	if u.Scheme == "" && u.Host == "" {
+		// The path is examined unescaped too, e.g., "/%5Cevil.example"
+		return strings.HasPrefix(u.Path, "/") && !strings.HasPrefix(u.Path, "//") &&
+			!strings.Contains(u.Path, "\\")
+	}
+	if s.sessionDomain == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return false
+	}
+	domain := strings.TrimPrefix(s.sessionDomain, ".")
+	host := u.Hostname()
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// startAuthCodeFlow saves the given state and redirects the user to the
+// authorization endpoint of the given provider.
+func (s *server) startAuthCodeFlow(w http.ResponseWriter, r *http.Request,
+	provider *sessions.Provider, state *sessions.State) {
+
 	logger := common.RequestLogger(r, logModuleInfo)
+	sessionManager := provider.SessionManager
+
+	if provider != s.providers.Default() {
+		state.Provider = provider.Name
+	}
+
+	// Generate the PKCE code_verifier, which is kept in the state store and
+	// replayed when exchanging the authorization code.
+	codeVerifier, err := sessionManager.NewCodeVerifier()
+	if err != nil {
+		logger.Errorf("Failed to create PKCE code verifier: %v", err)
+		common.ReturnMessage(w, http.StatusInternalServerError, "Failed to create PKCE code verifier.")
+		return
+	}
+	state.PKCEVerifier = codeVerifier
+
+	// Generate the nonce, which binds the ID token to this login.
+	nonce, err := sessions.NewNonce()
+	if err != nil {
+		logger.Errorf("Failed to create nonce: %v", err)
+		common.ReturnMessage(w, http.StatusInternalServerError, "Failed to create nonce.")
+		return
+	}
+	state.Nonce = nonce
 
 	// Initiate OIDC Flow with Authorization Request.
-	state, err := sessions.CreateState(r, w, s.oidcStateStore, s.sessionDomain,
-		s.newState, s.dynamicCsrfCookieName)
+	stateID, err := sessions.CreateState(r, w, s.oidcStateStore, s.sessionDomain,
+		state, s.dynamicCsrfCookieName)
 	if err != nil {
 		logger.Errorf("Failed to save state in store: %v", err)
 		common.ReturnMessage(w, http.StatusInternalServerError, "Failed to save state in store.")
 		return
 	}
 
-	w.Header().Add("X-OIDC-Device-Flow-Url", s.sessionManager.DeviceAuthURL())
-	http.Redirect(w, r, s.sessionManager.AuthCodeURL(state), http.StatusFound)
+	w.Header().Add("X-OIDC-Device-Flow-Url", sessionManager.DeviceAuthURL())
+	http.Redirect(w, r, sessionManager.AuthCodeURL(stateID, state), http.StatusFound)
 }
 
 // callback is the handler responsible for exchanging the auth_code and retrieving an id_token.
@@ -414,47 +587,143 @@ func (s *server) callback(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	provider, ok := s.providers.ForState(state)
+	if !ok {
+		logger.Errorf("Unknown OIDC provider '%s' in state", state.Provider)
+		common.ReturnMessage(w, http.StatusBadRequest, "Unknown OIDC provider."+
+			" Please try to login again.")
+		return
+	}
+	sessionManager := provider.SessionManager
+
+	// States created before PKCE was enabled don't have a code_verifier.
+	if state.PKCEVerifier == "" && sessionManager.PKCERequired() {
+		logger.Error("PKCE is required but the state has no code verifier")
+		common.ReturnMessage(w, http.StatusBadRequest, "Login flow was started"+
+			" without PKCE. Please try to login again.")
+		return
+	}
+
 	ctx := s.tlsCfg.Context(r.Context())
-	oauth2Tokens, err := s.sessionManager.ExchangeCode(ctx, authCode)
+	oauth2Tokens, err := sessionManager.ExchangeCode(ctx, authCode, state.PKCEVerifier)
 	if err != nil {
 		logger.Errorf("Failed to exchange authorization code with token: %v", err)
 		common.ReturnMessage(w, http.StatusInternalServerError, "Failed to exchange authorization code with token.")
 		return
 	}
 
+	rawIDToken, _, ok := s.createUserSession(w, r, provider, oauth2Tokens, state)
+	if !ok {
+		return
+	}
+
+	// Getting the firstVisitedURL from the OIDC state
+	var destination = state.FirstVisitedURL
+	if s.afterLoginRedirectURL != "" {
+		// Redirect to a predefined url from config, add the original url as
+		// `next` query parameter.
+		afterLoginRedirectURL := common.MustParseURL(s.afterLoginRedirectURL)
+		q := afterLoginRedirectURL.Query()
+		q.Set("next", state.FirstVisitedURL)
+		afterLoginRedirectURL.RawQuery = q.Encode()
+		destination = afterLoginRedirectURL.String()
+	}
+	logger.WithField("redirectTo", destination).
+		Info("Login validated with ID token, redirecting.")
+
+	// Add JWT cookie if needed
+	if s.jwtCookie != "" {
+		http.SetCookie(w, &http.Cookie{
+			Name:     s.jwtCookie,
+			Value:    rawIDToken,
+			Path:     "/",
+			Domain:   s.sessionDomain,
+			MaxAge:   s.sessionMaxAgeSeconds,
+			SameSite: s.sessionSameSite,
+			Secure:   true,
+			HttpOnly: true,
+		})
+	}
+	http.Redirect(w, r, destination, http.StatusFound)
+}
+
+// createUserSession verifies the tokens of a completed OIDC flow with the
+// given provider, fetches the user's claims and creates a new user session.
+// If the flow was started with an OIDC state, the nonce of the ID token is
+// verified as well.
+// It returns the raw ID token and the ID of the new session. On failure, it writes the
+// error response and returns false.
+func (s *server) createUserSession(w http.ResponseWriter, r *http.Request,
+	provider *sessions.Provider, oauth2Tokens *oauth2.Token,
+	state *sessions.State) (string, string, bool) {
+
+	logger := common.RequestLogger(r, logModuleInfo).WithField("provider", provider.Name)
+	ctx := s.tlsCfg.Context(r.Context())
+	sessionManager := provider.SessionManager
+
 	rawIDToken, ok := oauth2Tokens.Extra("id_token").(string)
 	if !ok {
 		logger.Error("No id_token field available.")
 		common.ReturnMessage(w, http.StatusInternalServerError, "No id_token field in OAuth 2.0 token.")
-		return
+		return "", "", false
 	}
 
 	// Verifying received ID token
-	_, err = s.sessionManager.Verify(ctx, rawIDToken, "")
+	idToken, err := sessionManager.Verify(ctx, rawIDToken, "")
 	if err != nil {
 		logger.Errorf("Not able to verify ID token: %v", err)
 		common.ReturnMessage(w, http.StatusInternalServerError, "Unable to verify ID token.")
-		return
+		return "", "", false
+	}
+
+	// Ensure that the ID token was issued for this login and is not replayed.
+	if state != nil {
+		if err := sessions.VerifyNonce(state, idToken); err != nil {
+			logger.Errorf("Failed to verify ID token nonce: %v", err)
+			common.ReturnMessage(w, http.StatusUnauthorized, "Invalid nonce in ID"+
+				" token. The login may have been tampered with. Please try to"+
+				" login again.")
+			return "", "", false
+		}
+	}
+
+	var idTokenClaims map[string]interface{}
+	if err := idToken.Claims(&idTokenClaims); err != nil {
+		logger.Errorf("Not able to parse ID token claims: %v", err)
+		common.ReturnMessage(w, http.StatusInternalServerError, "Unable to parse ID token claims.")
+		return "", "", false
+	}
+
+	// Ensure that a step-up login satisfies the requirements it was started
+	// for. Otherwise, the user would be sent to log in again and again.
+	if state != nil && state.StepUp.Required() {
+		authContext := common.AuthContextFromClaims(idTokenClaims)
+		if reason := state.StepUp.Check(authContext, time.Now()); reason != "" {
+			logger.Errorf("Login doesn't satisfy the step-up authentication requirements: %s", reason)
+			common.ReturnMessage(w, http.StatusForbidden, "The login doesn't satisfy the "+
+				"step-up authentication requirements: "+reason)
+			return "", "", false
+		}
 	}
 
 	// UserInfo endpoint to get claims
-	newTokens, _, err := s.sessionManager.TokenSource(ctx, oauth2Tokens)
-	userInfo, err := s.sessionManager.GetUserInfo(ctx, newTokens)
+	newTokens, _, err := sessionManager.TokenSource(ctx, oauth2Tokens)
+	userInfo, err := sessionManager.GetUserInfo(ctx, newTokens)
 	if err != nil {
 		logger.Errorf("Not able to fetch userinfo: %v", err)
 		common.ReturnMessage(w, http.StatusInternalServerError, "Not able to fetch userinfo.")
-		return
+		return "", "", false
 	}
 
 	claims, err := oidc.NewClaims(
 		userInfo,
-		s.idTokenOpts.UserIDClaim,
-		s.idTokenOpts.GroupsClaim,
+		provider.UserIDClaim,
+		provider.GroupsClaim,
 	)
 	if err != nil {
 		logger.Errorf("Problem getting userinfo claims: %v", err)
 		common.ReturnMessage(w, http.StatusInternalServerError, "Not able to fetch userinfo claims.")
-		return
+		return "", "", false
 	}
 
 	// User is authenticated, create new session.
@@ -472,73 +741,148 @@ func (s *server) callback(w http.ResponseWriter, r *http.Request) {
 		logger.Errorf("%v", err)
 		common.ReturnMessage(w, http.StatusInternalServerError,
 			fmt.Sprintf("%v", err))
-		return
+		return "", "", false
+	}
+
+	groups, err := claims.Groups()
+	if err != nil {
+		logger.Errorf("%v", err)
+		common.ReturnMessage(w, http.StatusInternalServerError,
+			fmt.Sprintf("%v", err))
+		return "", "", false
+	}
+
+	// Make room for the new session, or refuse it, if the user has too many.
+	// The logins of the user are serialized until the new session is
+	// indexed, so that concurrent logins see each other's sessions.
+	if s.sessionLimit.Enabled() {
+		defer s.sessionLimitLocks.Lock(userID)()
+		denied, err := s.enforceSessionLimit(r, userID)
+		if err != nil {
+			logger.Errorf("Couldn't enforce the session limit: %v", err)
+			common.ReturnMessage(w, http.StatusInternalServerError, "Error creating user session")
+			return "", "", false
+		}
+		if denied {
+			logger.WithField("userid", userID).Info("Refusing login, user has too many sessions")
+			// Logins with an OIDC state come from a browser, which is
+			// sent to the page that explains why.
+			if state != nil {
+				http.Redirect(w, r, s.sessionLimitURL, http.StatusFound)
+			} else {
+				common.ReturnMessage(w, http.StatusForbidden, fmt.Sprintf("You have reached "+
+					"the maximum number of %d sessions. Log out of another session "+
+					"and try again.", s.sessionLimit.Max))
+			}
+			return "", "", false
+		}
 	}
 
 	session.Values[sessions.UserSessionUserID] = userID
-	session.Values[sessions.UserSessionGroups] = claims.Groups()
-	session.Values[sessions.UserSessionClaims] = claims.Claims()
+	session.Values[sessions.UserSessionGroups] = groups
+	// The acr, amr and auth_time claims, which describe how the user
+	// authenticated, are always taken from the verified ID token, even if
+	// the UserInfo response has them too.
+	sessionClaims := claims.Claims()
+	for _, claim := range []string{"acr", "amr", "auth_time"} {
+		if value, ok := idTokenClaims[claim]; ok {
+			sessionClaims[claim] = value
+		} else {
+			delete(sessionClaims, claim)
+		}
+	}
+	session.Values[sessions.UserSessionClaims] = sessionClaims
 	session.Values[sessions.UserSessionIDToken] = rawIDToken
 	session.Values[sessions.UserSessionOAuth2Tokens] = oauth2Tokens
+	session.Values[sessions.UserSessionProvider] = provider.Name
+	sessions.StartActivity(session, time.Now())
 	if err := session.Save(r, w); err != nil {
 		logger.Errorf("Couldn't create user session: %v", err)
 		common.ReturnMessage(w, http.StatusInternalServerError, "Error creating user session")
-		return
+		return "", "", false
 	}
 
-	// Getting the firstVisitedURL from the OIDC state
-	var destination = state.FirstVisitedURL
-	if s.afterLoginRedirectURL != "" {
-		// Redirect to a predefined url from config, add the original url as
-		// `next` query parameter.
-		afterLoginRedirectURL := common.MustParseURL(s.afterLoginRedirectURL)
-		q := afterLoginRedirectURL.Query()
-		q.Set("next", state.FirstVisitedURL)
-		afterLoginRedirectURL.RawQuery = q.Encode()
-		destination = afterLoginRedirectURL.String()
+	sessionID, err := sessions.SessionIDFromResponse(w, sessions.UserSessionCookie)
+	if err != nil {
+		logger.Errorf("Couldn't get user session ID: %v", err)
+		common.ReturnMessage(w, http.StatusInternalServerError, "Error creating user session")
+		return "", "", false
 	}
-	logger.WithField("redirectTo", destination).
-		Info("Login validated with ID token, redirecting.")
 
-	// Add JWT cookie if needed
-	if s.jwtCookie != "" {
-		http.SetCookie(w, &http.Cookie{
-			Name:     s.jwtCookie,
-			Value:    rawIDToken,
-			Path:     "/",
-			Domain:   session.Options.Domain,
-			MaxAge:   s.sessionMaxAgeSeconds,
-			SameSite: session.Options.SameSite,
-			Secure:   true,
-			HttpOnly: true,
-		})
+	// Index the session by the subject and the provider's session ID, so that
+	// it can be revoked by a Back-Channel Logout request, and by the user, so
+	// that it can be managed through the admin API.
+	if err := s.indexSession(r, provider, sessionID, userID, idToken); err != nil {
+		logger.Errorf("Couldn't index user session: %v", err)
 	}
-	http.Redirect(w, r, destination, http.StatusFound)
+
+	return rawIDToken, sessionID, true
+
 }
 
-// enabledAuthenticator indicates if the examined authenticator is enabled.
-func (s *server) enabledAuthenticator(authenticator string) bool {
-	if authenticator == "kubernetes authenticator" && s.KubernetesAuthnEnabled {
-		return true
+// enforceSessionLimit makes room for a new session of the given user. If the
+// user has reached the session limit, it either revokes the oldest sessions of
+// the user, along with their tokens, or reports that the new session must be
+// denied, depending on the policy of the limit.
+func (s *server) enforceSessionLimit(r *http.Request, userID string) (bool, error) {
+	userSessions, err := sessions.UserSessions(r.Context(), s.store, userID)
+	if err != nil {
+		return false, err
 	}
-	if s.AccessTokenAuthnEnabled {
-		if authenticator == "opaque access token authenticator" && s.AccessTokenAuthn == "opaque" {
-			return true
+	excess := s.sessionLimit.Excess(userSessions)
+	if len(excess) == 0 {
+		return false, nil
+	}
+	if s.sessionLimit.Policy == sessions.SessionLimitDeny {
+		return true, nil
+	}
+
+	logger := common.RequestLogger(r, logModuleInfo).WithField("userid", userID)
+	for _, evicted := range excess {
+		sessionManager := s.providers.ForSession(evicted.Session).SessionManager
+		err := sessionManager.RevokeOIDCSession(r.Context(), httptest.NewRecorder(),
+			evicted.Session, s.tlsCfg, s.sessionDomain)
+		if err != nil {
+			return false, errors.Wrap(err, "Couldn't evict session")
 		}
-		if authenticator == "JWT access token authenticator" && s.AccessTokenAuthn == "jwt" {
-			return true
+		err = s.store.UnindexSession(r.Context(), evicted.ID, sessions.UserIndexKey(userID),
+			sessions.AllSessionsIndexKey)
+		if err != nil {
+			return false, errors.Wrap(err, "Couldn't remove evicted session from index")
 		}
+		logger.Info("Evicted the oldest session of the user to make room for a new one")
 	}
-	if authenticator == "session authenticator" {
-		return true
+	return false, nil
+}
+
+// indexSession adds the given user session to the session index, under the subject and the sid (if any) of the given ID token,
+// and under the given user ID.
+func (s *server) indexSession(r *http.Request, provider *sessions.Provider,
+	sessionID, userID string, idToken *goidc.IDToken) error {
+	sidClaim := struct {
+		SessionID string `json:"sid"`
+	}{}
+	if err := idToken.Claims(&sidClaim); err != nil {
+		return errors.Wrap(err, "Couldn't get sid claim from ID token")
 	}
-	if authenticator == "idtoken authenticator" && s.IDTokenAuthnEnabled {
-		return true
+	keys := []string{s.providerIndexKey(provider, sessions.SubjectIndexKey(idToken.Subject))}
+	if sidClaim.SessionID != "" {
+		keys = append(keys, s.providerIndexKey(provider, sessions.SIDIndexKey(sidClaim.SessionID)))
 	}
-	if authenticator == "jwt from extra provider authenticator" && s.JWTFromExtraProviderEnabled {
-		return true
+	keys = append(keys, sessions.UserIndexKey(userID), sessions.AllSessionsIndexKey)
+	maxAge := time.Duration(s.sessionMaxAgeSeconds) * time.Second
+	return s.store.IndexSession(r.Context(), sessionID, maxAge, keys...)
+}
+
+// providerIndexKey qualifies the given index key with the name of the
+// provider, since subjects and provider sessions are only unique per provider.
+// Keys of the default provider are left as is, for compatibility with
+// existing sessions.
+func (s *server) providerIndexKey(provider *sessions.Provider, key string) string {
+	if provider == s.providers.Default() {
+		return key
 	}
-	return false
+	return provider.Name + "/" + key
 }
 
 // logout is the handler responsible for revoking the user's session.
@@ -564,8 +908,11 @@ func (s *server) logout(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	logger = logger.WithField("userid", session.Values[sessions.UserSessionUserID].(string))
+	// Keep the ID token, as it is used as a hint for the provider's logout.
+	idToken, _ := session.Values[sessions.UserSessionIDToken].(string)
 
-	err = s.sessionManager.RevokeSession(r.Context(), w, session, s.tlsCfg, s.sessionDomain)
+	sessionManager := s.providers.ForSession(session).SessionManager
+	err = sessionManager.RevokeSession(r.Context(), w, session, s.tlsCfg, s.sessionDomain)
 	if err != nil {
 		logger.Errorf("Error revoking tokens: %v", err)
 		statusCode := http.StatusInternalServerError
@@ -580,29 +927,152 @@ func (s *server) logout(w http.ResponseWriter, r *http.Request) {
 	}
 
 	logger.Info("Successful logout.")
+	afterLogoutURL := s.afterLogoutRedirectURL
+	if s.endSessionEnabled {
+		// Log the user out of the provider as well, which will then
+		// redirect them to the after logout URL.
+		endSessionURL, err := sessionManager.EndSessionURL(idToken, s.afterLogoutRedirectURL)
+		if err != nil {
+			logger.Warnf("Error getting provider's end_session_endpoint: %v", err)
+		} else {
+			afterLogoutURL = endSessionURL
+		}
+	}
 	resp := struct {
 		AfterLogoutURL string `json:"afterLogoutURL"`
 	}{
-		AfterLogoutURL: s.afterLogoutRedirectURL,
+		AfterLogoutURL: afterLogoutURL,
 	}
 	// Return 201 because the logout endpoint is still on the envoy-facing server,
 	// meaning that returning a 200 will result in the request being proxied upstream.
 	common.ReturnJSONMessage(w, http.StatusCreated, resp)
 }
 
+// backChannelLogoutUnsupported is the handler of Back-Channel Logout requests
+// when the session store can't look up the sessions of a subject, e.g., the
+// cookie session store. It tells the provider that the logout failed.
+func backChannelLogoutUnsupported(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Cache-Control", "no-cache, no-store")
+	common.ReturnJSONMessage(w, http.StatusNotImplemented, struct {
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}{
+		Error:            "unsupported",
+		ErrorDescription: "Back-Channel Logout isn't supported by the session store",
+	})
+}
+
+// backChannelLogout is the handler that receives OIDC Back-Channel Logout
+// requests from the provider and revokes all the sessions of the subject or the
+// provider session (sid) that the logout token refers to. See:
+// https://openid.net/specs/openid-connect-backchannel-1_0.html
+func (s *server) backChannelLogout(w http.ResponseWriter, r *http.Request) {
+
+	logger := common.RequestLogger(r, logModuleInfo)
+
+	// The response must not be cached.
+	w.Header().Add("Cache-Control", "no-cache, no-store")
+
+	badRequest := func(description string) {
+		common.ReturnJSONMessage(w, http.StatusBadRequest, struct {
+			Error            string `json:"error"`
+			ErrorDescription string `json:"error_description"`
+		}{
+			Error:            "invalid_request",
+			ErrorDescription: description,
+		})
+	}
+
+	rawLogoutToken := r.PostFormValue("logout_token")
+	if rawLogoutToken == "" {
+		logger.Error("Missing form parameter: logout_token")
+		badRequest("Missing form parameter: logout_token")
+		return
+	}
+
+	// Find the provider that issued the logout token, before verifying it
+	// with that provider's keys.
+	provider, err := s.logoutTokenProvider(rawLogoutToken)
+	if err != nil {
+		logger.Errorf("Failed to find provider of logout token: %v", err)
+		badRequest("Invalid logout token")
+		return
+	}
+	logger = logger.WithField("provider", provider.Name)
+
+	ctx := s.tlsCfg.Context(r.Context())
+	logoutToken, err := provider.SessionManager.VerifyLogoutToken(ctx, rawLogoutToken)
+	if err != nil {
+		logger.Errorf("Failed to verify logout token: %v", err)
+		badRequest("Invalid logout token")
+		return
+	}
+	logger = logger.WithFields(logrus.Fields{
+		"sub": logoutToken.Subject,
+		"sid": logoutToken.SessionID,
+	})
+
+	// If both sub and sid are present, only the sessions of the specific
+	// provider session must be revoked.
+	key := sessions.SubjectIndexKey(logoutToken.Subject)
+	if logoutToken.SessionID != "" {
+		key = sessions.SIDIndexKey(logoutToken.SessionID)
+	}
+	key = s.providerIndexKey(provider, key)
+	revoked, err := sessions.RevokeIndexedSessions(r.Context(), s.store, key)
+	if err != nil {
+		logger.Errorf("Failed to revoke sessions: %v", err)
+		common.ReturnMessage(w, http.StatusInternalServerError, "Failed to revoke sessions")
+		return
+	}
+
+	logger.Infof("Back-channel logout revoked %d session(s).", revoked)
+	w.WriteHeader(http.StatusOK)
+}
+
+// logoutTokenProvider returns the provider whose issuer matches the, not yet
+// verified, iss claim of the given logout token.
+func (s *server) logoutTokenProvider(rawLogoutToken string) (*sessions.Provider, error) {
+	payload, err := common.ParseJWT(rawLogoutToken)
+	if err != nil {
+		return nil, err
+	}
+	claims := struct {
+		Issuer string `json:"iss"`
+	}{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, errors.Wrap(err, "Couldn't get iss claim from logout token")
+	}
+	provider, ok := s.providers.ForIssuer(claims.Issuer)
+	if !ok {
+		return nil, errors.Errorf("No provider found for issuer '%s'", claims.Issuer)
+	}
+	return provider, nil
+}
+
 // readiness is the handler that checks if the authservice is ready for serving
 // requests.
-// Currently, it checks if the provider is nil, meaning that the setup hasn't finished yet.
-func readiness(isReady *abool.AtomicBool) http.HandlerFunc {
+// Currently, it checks if the setup has finished and the authservice isn't
+// shutting down.
+func readiness(isReady, draining *abool.AtomicBool) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		code := http.StatusOK
-		if !isReady.IsSet() {
+		if !isReady.IsSet() || draining.IsSet() {
 			code = http.StatusServiceUnavailable
 		}
 		w.WriteHeader(code)
 	}
 }
 
+// requestPath returns the path of the examined request. If called by the
+// `/authservice/verify` router, it trims the verifyAuthURL prefix.
+func (s *server) requestPath(r *http.Request, verify bool) string {
+	if verify {
+		return strings.TrimPrefix(r.URL.Path, s.verifyAuthURL)
+	}
+	return r.URL.Path
+}
+
 // whitelistMiddleware is a middleware that
 // - Allows all requests that match the whitelist
 // - If the server is ready, forwards requests to be evaluated further
@@ -617,13 +1087,7 @@ func (s *server) whitelistMiddleware(whitelist []string, isReady *abool.AtomicBo
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			logger := common.RequestLogger(r, logModuleInfo)
 
-			path := r.URL.Path
-			// If called by the `/authservice/verify` router then
-			// first trim the verifyAuthURL prefix and then examine
-			// if the remaining path is whitelisted.
-			if verify {
-				path = strings.TrimPrefix(r.URL.Path, s.verifyAuthURL)
-			}
+			path := s.requestPath(r, verify)
 			// Check whitelist
 			for _, prefix := range whitelist {
 				if strings.HasPrefix(path, prefix) {
@@ -641,6 +1105,17 @@ func (s *server) whitelistMiddleware(whitelist []string, isReady *abool.AtomicBo
 				common.ReturnMessage(w, http.StatusServiceUnavailable, "OIDC Setup is not complete yet.")
 				return
 			}
+			// Check the authentication policies, which are only
+			// available once the server is ready.
+			if policy := s.authnPolicies.Match(r.Host, r.Method, path); policy != nil && policy.Anonymous {
+				logger.Debugf("Policy '%s' allows anonymous access. Accepted without authorization.", policy.Name)
+				if verify {
+					w.WriteHeader(http.StatusNoContent)
+				} else {
+					common.ReturnMessage(w, http.StatusOK, "OK")
+				}
+				return
+			}
 			// Server ready, continue.
 			handler.ServeHTTP(w, r)
 		})
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidRedirect(t *testing.T) {
+	tests := []struct {
+		url   string
+		valid bool
+	}{
+		{url: "/", valid: true},
+		{url: "/notebooks/?ns=alice", valid: true},
+		{url: "https://app.example.com/notebooks", valid: true},
+		{url: "https://example.com/", valid: true},
+		{url: "notebooks", valid: false},
+		{url: "//evil.example", valid: false},
+		{url: "/\\evil.example", valid: false},
+		{url: "/\\/evil.example", valid: false},
+		{url: "\\\\evil.example", valid: false},
+		{url: "/%5Cevil.example", valid: false},
+		{url: "/%5C%5Cevil.example", valid: false},
+		{url: "/%2F%2Fevil.example", valid: false},
+		{url: "/\t/evil.example", valid: false},
+		{url: "https://evil.example/", valid: false},
+		{url: "https://evil.example\\@app.example.com/", valid: false},
+		{url: "javascript://app.example.com/%0aalert(1)", valid: false},
+	}
+	s := &server{sessionDomain: ".example.com"}
+	for _, test := range tests {
+		require.Equal(t, test.valid, s.validRedirect(test.url), test.url)
+	}
+}
+
+func TestBackChannelLogoutUnsupported(t *testing.T) {
+	w := httptest.NewRecorder()
+	backChannelLogoutUnsupported(w, httptest.NewRequest(http.MethodPost, "/", nil))
+	require.Equal(t, http.StatusNotImplemented, w.Code)
+	require.Equal(t, "no-cache, no-store", w.Header().Get("Cache-Control"))
+}
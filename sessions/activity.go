@@ -0,0 +1,104 @@
+package sessions
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/pkg/errors"
+)
+
+const (
+	// UserSessionCreatedAt is when the user logged in, as a Unix time.
+	UserSessionCreatedAt = "created_at"
+	// UserSessionLastActivity is when the user last made a request, as a
+	// Unix time. It is updated at most once every UpdateInterval.
+	UserSessionLastActivity = "last_activity"
+)
+
+// IdleTimeout expires the sessions that have had no requests for a while, in
+// addition to the absolute max age of the sessions.
+type IdleTimeout struct {
+	// Timeout is how long a session may have no requests. Zero disables
+	// the idle timeout.
+	Timeout time.Duration
+	// UpdateInterval is how often the last activity of a session is
+	// written to the store, so that not every request writes to it. A
+	// session may thus expire up to UpdateInterval earlier than Timeout
+	// after its last request.
+	UpdateInterval time.Duration
+	// MaxAge is the absolute max age of the sessions, which the writes of
+	// the last activity don't extend.
+	MaxAge time.Duration
+}
+
+// Enabled examines if the idle timeout is enabled.
+func (it IdleTimeout) Enabled() bool {
+	return it.Timeout > 0
+}
+
+// StartActivity records the login time of a new session.
+func StartActivity(session *sessions.Session, now time.Time) {
+	session.Values[UserSessionCreatedAt] = now.Unix()
+	session.Values[UserSessionLastActivity] = now.Unix()
+}
+
+func sessionTime(session *sessions.Session, key string) (time.Time, bool) {
+	secs, ok := session.Values[key].(int64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(secs, 0), true
+}
+
+// Expired examines if the session has been idle for longer than the timeout,
+// or is older than the max age. Sessions created by versions that didn't
+// record their activity never expire idle before their first update.
+func (it IdleTimeout) Expired(session *sessions.Session, now time.Time) (bool, string) {
+	if createdAt, ok := sessionTime(session, UserSessionCreatedAt); ok && it.MaxAge > 0 {
+		if now.Sub(createdAt) > it.MaxAge {
+			return true, "session is older than its max age"
+		}
+	}
+	if lastActivity, ok := sessionTime(session, UserSessionLastActivity); ok && it.Enabled() {
+		if idle := now.Sub(lastActivity); idle > it.Timeout {
+			return true, "session has been idle for " + idle.Truncate(time.Second).String()
+		}
+	}
+	return false, ""
+}
+
+// Touch records a request of the session, writing it to the store only if
+// the last write was at least UpdateInterval ago. The write keeps the
+// expiration of the session in the store at its absolute max age.
+func (it IdleTimeout) Touch(ctx context.Context, session *sessions.Session, now time.Time) error {
+	lastActivity, ok := sessionTime(session, UserSessionLastActivity)
+	if ok && now.Sub(lastActivity) < it.UpdateInterval {
+		return nil
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	session.Values[UserSessionLastActivity] = now.Unix()
+	if createdAt, ok := sessionTime(session, UserSessionCreatedAt); ok && it.MaxAge > 0 {
+		remaining := it.MaxAge - now.Sub(createdAt)
+		// A MaxAge of zero or less would delete the session.
+		if remaining < time.Second {
+			remaining = time.Second
+		}
+		// Some stores share the options of the sessions they load, so
+		// don't modify them in place.
+		options := *session.Options
+		options.MaxAge = int(remaining.Seconds())
+		session.Options = &options
+	}
+	// The cookie of the session doesn't change, so only write the
+	// session to the store.
+	r := &http.Request{}
+	if err := session.Save(r.WithContext(ctx), httptest.NewRecorder()); err != nil {
+		return errors.Wrap(err, "failed to update the last activity of the session")
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package sessions
+
+import (
+	"context"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdleTimeout(t *testing.T) {
+	store, err := newBoltDBSessionStore(filepath.Join(t.TempDir(), "data.db"), "sessions", false)
+	require.NoError(t, err)
+	defer store.Close()
+
+	ctx := context.Background()
+	it := IdleTimeout{Timeout: 30 * time.Minute, UpdateInterval: time.Minute, MaxAge: 8 * time.Hour}
+	login := time.Now().Truncate(time.Second)
+
+	session := NewSession(store, UserSessionCookie)
+	session.Options.MaxAge = int(it.MaxAge.Seconds())
+	StartActivity(session, login)
+	w := httptest.NewRecorder()
+	require.NoError(t, session.Save(httptest.NewRequest("GET", "/", nil), w))
+	sessionID, err := SessionIDFromResponse(w, UserSessionCookie)
+	require.NoError(t, err)
+
+	lastActivity := func() int64 {
+		loaded, err := SessionFromID(sessionID, store)
+		require.NoError(t, err)
+		require.False(t, loaded.IsNew)
+		return loaded.Values[UserSessionLastActivity].(int64)
+	}
+
+	// Requests within the update interval are not written
+	require.NoError(t, it.Touch(ctx, session, login.Add(30*time.Second)))
+	require.Equal(t, login.Unix(), lastActivity())
+
+	expired, _ := it.Expired(session, login.Add(29*time.Minute))
+	require.False(t, expired)
+	require.NoError(t, it.Touch(ctx, session, login.Add(29*time.Minute)))
+	require.Equal(t, login.Add(29*time.Minute).Unix(), lastActivity())
+	require.Equal(t, int((8*time.Hour - 29*time.Minute).Seconds()), session.Options.MaxAge)
+
+	expired, _ = it.Expired(session, login.Add(58*time.Minute))
+	require.False(t, expired)
+	expired, _ = it.Expired(session, login.Add(60*time.Minute))
+	require.True(t, expired)
+
+	// The activity doesn't extend the max age
+	session.Values[UserSessionLastActivity] = login.Add(8 * time.Hour).Unix()
+	expired, _ = it.Expired(session, login.Add(8*time.Hour+time.Minute))
+	require.True(t, expired)
+
+	// Sessions without activity don't expire idle
+	delete(session.Values, UserSessionCreatedAt)
+	delete(session.Values, UserSessionLastActivity)
+	expired, _ = it.Expired(session, login.Add(24*time.Hour))
+	require.False(t, expired)
+}
@@ -1,26 +1,58 @@
 package sessions
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/arrikto/oidc-authservice/common"
 	"github.com/boltdb/bolt"
 	"github.com/emirpasic/gods/sets/hashset"
+	"github.com/gogo/protobuf/proto"
+	"github.com/gorilla/securecookie"
 	"github.com/gorilla/sessions"
 	"github.com/pkg/errors"
 	"github.com/yosssi/boltstore/reaper"
+	"github.com/yosssi/boltstore/shared"
+	"github.com/yosssi/boltstore/shared/protobuf"
 	boltstore "github.com/yosssi/boltstore/store"
 )
 
+const (
+	// boltIndexReapInterval is how often the expired index entries are
+	// deleted.
+	boltIndexReapInterval = time.Minute
+	// boltIndexReapBatchSize is the maximum number of index keys that are
+	// pruned at a time.
+	boltIndexReapBatchSize = 100
+)
+
 type boltDBSessionStore struct {
 	sessions.Store
 	// DB is the underlying BoltDB instance.
 	DB *bolt.DB
+	// path is the key of the DB in existingDBs.
+	path string
+	// bucket is the bucket that holds the sessions.
+	bucket []byte
+	// indexBucket is the bucket that holds the SessionIndex entries. It has
+	// a nested bucket for each index key, which maps the IDs of the sessions
+	// under the key to their expiration time, so that indexing a session only
+	// writes its own entries.
+	indexBucket []byte
 	// Channels for BoltDB reaper
 	// quitC sends the quit signal to the reaper goroutine.
 	// doneC receives the signal that the reaper has quit.
 	quitC chan<- struct{}
 	doneC <-chan struct{}
+	// Channels for the reaper of the index, as above.
+	indexQuitC chan struct{}
+	indexDoneC chan struct{}
 }
 
 type existingDBEntry struct {
@@ -28,7 +60,10 @@ type existingDBEntry struct {
 	buckets *hashset.Set
 }
 
-var existingDBs = map[string]*existingDBEntry{}
+var (
+	existingDBs   = map[string]*existingDBEntry{}
+	existingDBsMu sync.Mutex
+)
 
 // newBoltDBSessionStore returns a session store backed by BoltDB. The database
 // is stored in the given path and keys are stored in the given bucket. If the
@@ -47,6 +82,9 @@ func newBoltDBSessionStore(path, bucket string, allowDBReuse bool) (*boltDBSessi
 		}
 	}
 
+	existingDBsMu.Lock()
+	defer existingDBsMu.Unlock()
+
 	// Retrieve existing DB or create new one
 	var db *bolt.DB
 	if existingDB, ok := existingDBs[path]; ok {
@@ -76,17 +114,347 @@ func newBoltDBSessionStore(path, bucket string, allowDBReuse bool) (*boltDBSessi
 		return nil, err
 	}
 	existingDBs[path].buckets.Add(bucket)
+	indexBucket := []byte(bucket + "_index")
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(indexBucket)
+		if err != nil {
+			return err
+		}
+		return migrateBoltDBIndex(b)
+	})
+	if err != nil {
+		return nil, err
+	}
 	// Invoke a reaper which checks and removes expired sessions periodically
 	quitC, doneC := reaper.Run(db, reaper.Options{BucketName: []byte(bucket)})
-	return &boltDBSessionStore{
-		Store: store,
-		DB:    db,
-		doneC: doneC,
-		quitC: quitC,
-	}, nil
+	bsc := &boltDBSessionStore{
+		Store:       store,
+		DB:          db,
+		path:        path,
+		bucket:      []byte(bucket),
+		indexBucket: indexBucket,
+		doneC:       doneC,
+		quitC:       quitC,
+		indexQuitC:  make(chan struct{}),
+		indexDoneC:  make(chan struct{}),
+	}
+	go bsc.reapIndex(boltIndexReapInterval)
+	return bsc, nil
+}
+
+// migrateBoltDBIndex moves the index keys of older versions, which are JSON
+// maps of the session IDs to their expiration time, to nested buckets.
+func migrateBoltDBIndex(b *bolt.Bucket) error {
+	legacy := map[string][]byte{}
+	err := b.ForEach(func(k, v []byte) error {
+		if v != nil {
+			legacy[string(k)] = append([]byte(nil), v...)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	for key, data := range legacy {
+		entry := map[string]int64{}
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return errors.Wrapf(err, "error decoding index entry '%s'", key)
+		}
+		if err := b.Delete([]byte(key)); err != nil {
+			return err
+		}
+		nested, err := b.CreateBucket([]byte(key))
+		if err != nil {
+			return err
+		}
+		for id, expiresAt := range entry {
+			if expiresAt <= now {
+				continue
+			}
+			if err := nested.Put([]byte(id), encodeExpiresAt(expiresAt)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (bsc *boltDBSessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(bsc, name)
+}
+
+// New loads the session of the request. Session IDs of the other stores are
+// accepted as cookies, so that sessions migrated from them stay valid.
+func (bsc *boltDBSessionStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	if c, err := r.Cookie(name); err == nil && isRawSessionID(c.Value) {
+		encoded, err := securecookie.EncodeMulti(name, c.Value, boltCookieCodecs...)
+		if err == nil {
+			r = withSessionCookie(r, name, encoded)
+		}
+	}
+	return bsc.Store.New(r, name)
+}
+
+// Ping examines if the bucket of the sessions can be read.
+func (bsc *boltDBSessionStore) Ping(ctx context.Context) error {
+	return bsc.DB.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(bsc.bucket) == nil {
+			return errors.Errorf("bucket '%s' not found", bsc.bucket)
+		}
+		return nil
+	})
 }
 
+// Close stops the reapers of the store and closes the DB, unless another
+// store still uses it, in which case the last one to close it does.
 func (bsc *boltDBSessionStore) Close() error {
 	reaper.Quit(bsc.quitC, bsc.doneC)
+	close(bsc.indexQuitC)
+	<-bsc.indexDoneC
+
+	existingDBsMu.Lock()
+	defer existingDBsMu.Unlock()
+	if existingDB, ok := existingDBs[bsc.path]; ok && existingDB.DB == bsc.DB {
+		existingDB.buckets.Remove(string(bsc.bucket))
+		if !existingDB.buckets.Empty() {
+			return nil
+		}
+		delete(existingDBs, bsc.path)
+	}
 	return bsc.DB.Close()
 }
+
+func encodeExpiresAt(expiresAt int64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(expiresAt))
+	return b
+}
+
+func decodeExpiresAt(b []byte) int64 {
+	if len(b) != 8 {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(b))
+}
+
+func (bsc *boltDBSessionStore) IndexSession(ctx context.Context, sessionID string,
+	maxAge time.Duration, keys ...string) error {
+
+	expiresAt := encodeExpiresAt(time.Now().Add(maxAge).Unix())
+	return bsc.DB.Update(func(tx *bolt.Tx) error {
+		for _, key := range keys {
+			b, err := tx.Bucket(bsc.indexBucket).CreateBucketIfNotExists([]byte(key))
+			if err != nil {
+				return errors.Wrapf(err, "error creating index key '%s'", key)
+			}
+			if err := b.Put([]byte(sessionID), expiresAt); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (bsc *boltDBSessionStore) IndexedSessions(ctx context.Context, key string) ([]string, error) {
+	var sessionIDs []string
+	now := time.Now().Unix()
+	err := bsc.DB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bsc.indexBucket).Bucket([]byte(key))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			// Drop the sessions that have already expired.
+			if decodeExpiresAt(v) > now {
+				sessionIDs = append(sessionIDs, string(k))
+			}
+			return nil
+		})
+	})
+	return sessionIDs, err
+}
+
+func (bsc *boltDBSessionStore) UnindexSession(ctx context.Context, sessionID string, keys ...string) error {
+	return bsc.DB.Update(func(tx *bolt.Tx) error {
+		for _, key := range keys {
+			b := tx.Bucket(bsc.indexBucket).Bucket([]byte(key))
+			if b == nil {
+				continue
+			}
+			if err := b.Delete([]byte(sessionID)); err != nil {
+				return err
+			}
+			if k, _ := b.Cursor().First(); k == nil {
+				if err := tx.Bucket(bsc.indexBucket).DeleteBucket([]byte(key)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// pruneIndex deletes the expired entries of up to limit index keys, starting
+// from the key after the given one, and deletes the keys that are left
+// empty. It returns the number of deleted entries and the key to continue
+// from, which is nil once all the keys have been pruned. A zero limit prunes
+// all the keys.
+func (bsc *boltDBSessionStore) pruneIndex(tx *bolt.Tx, after []byte, limit int, now int64) (int, []byte, error) {
+	index := tx.Bucket(bsc.indexBucket)
+	var keys [][]byte
+	var next []byte
+	c := index.Cursor()
+	k, _ := c.First()
+	if after != nil {
+		k, _ = c.Seek(after)
+		if k != nil && bytes.Equal(k, after) {
+			k, _ = c.Next()
+		}
+	}
+	for ; k != nil; k, _ = c.Next() {
+		if limit > 0 && len(keys) == limit {
+			next = keys[len(keys)-1]
+			break
+		}
+		keys = append(keys, append([]byte(nil), k...))
+	}
+
+	pruned := 0
+	for _, key := range keys {
+		b := index.Bucket(key)
+		if b == nil {
+			continue
+		}
+		var expired [][]byte
+		remaining := 0
+		err := b.ForEach(func(id, v []byte) error {
+			if decodeExpiresAt(v) <= now {
+				expired = append(expired, append([]byte(nil), id...))
+			} else {
+				remaining++
+			}
+			return nil
+		})
+		if err != nil {
+			return pruned, nil, err
+		}
+		for _, id := range expired {
+			if err := b.Delete(id); err != nil {
+				return pruned, nil, err
+			}
+		}
+		pruned += len(expired)
+		if remaining == 0 {
+			if err := index.DeleteBucket(key); err != nil {
+				return pruned, nil, err
+			}
+		}
+	}
+	return pruned, next, nil
+}
+
+// reapIndex deletes the expired index entries periodically, a batch of index
+// keys at a time, as the BoltDB reaper does for the sessions.
+func (bsc *boltDBSessionStore) reapIndex(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var next []byte
+	for {
+		select {
+		case <-bsc.indexQuitC:
+			close(bsc.indexDoneC)
+			return
+		case <-ticker.C:
+			err := bsc.DB.Update(func(tx *bolt.Tx) error {
+				var err error
+				_, next, err = bsc.pruneIndex(tx, next, boltIndexReapBatchSize, time.Now().Unix())
+				return err
+			})
+			if err != nil {
+				common.StandardLogger().Errorf("Failed to delete expired index entries: %v", err)
+			}
+		}
+	}
+}
+
+func (bsc *boltDBSessionStore) ForEachSession(ctx context.Context, fn func(SessionRecord) error) error {
+	return bsc.DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bsc.bucket).ForEach(func(k, v []byte) error {
+			data, err := shared.Session(v)
+			if err != nil {
+				return errors.Wrapf(err, "error decoding session '%s'", k)
+			}
+			if shared.Expired(data) {
+				return nil
+			}
+			// The values are only valid during the transaction.
+			return fn(SessionRecord{
+				ID:        string(k),
+				ExpiresAt: time.Unix(data.GetExpiresAt(), 0),
+				Data:      append([]byte(nil), data.Values...),
+			})
+		})
+	})
+}
+
+func (bsc *boltDBSessionStore) ForEachIndexEntry(ctx context.Context, fn func(SessionRecord) error) error {
+	now := time.Now().Unix()
+	return bsc.DB.View(func(tx *bolt.Tx) error {
+		index := tx.Bucket(bsc.indexBucket)
+		return index.ForEach(func(key, _ []byte) error {
+			b := index.Bucket(key)
+			if b == nil {
+				return nil
+			}
+			return b.ForEach(func(id, v []byte) error {
+				expiresAt := decodeExpiresAt(v)
+				if expiresAt <= now {
+					return nil
+				}
+				return fn(SessionRecord{ID: string(id), Key: string(key), ExpiresAt: time.Unix(expiresAt, 0)})
+			})
+		})
+	})
+}
+
+func (bsc *boltDBSessionStore) ImportSession(ctx context.Context, rec SessionRecord) error {
+	expiresAt := rec.ExpiresAt.Unix()
+	data, err := proto.Marshal(&protobuf.Session{Values: rec.Data, ExpiresAt: &expiresAt})
+	if err != nil {
+		return err
+	}
+	return bsc.DB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bsc.bucket).Put([]byte(rec.ID), data)
+	})
+}
+
+// PurgeExpired deletes the expired sessions and index entries at once, rather
+// than in the batches of the reaper.
+func (bsc *boltDBSessionStore) PurgeExpired(ctx context.Context) (int, error) {
+	purged := 0
+	err := bsc.DB.Update(func(tx *bolt.Tx) error {
+		var expired [][]byte
+		err := tx.Bucket(bsc.bucket).ForEach(func(k, v []byte) error {
+			data, err := shared.Session(v)
+			if err == nil && shared.Expired(data) {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := tx.Bucket(bsc.bucket).Delete(k); err != nil {
+				return err
+			}
+		}
+		purged += len(expired)
+
+		prunedEntries, _, err := bsc.pruneIndex(tx, nil, 0, time.Now().Unix())
+		purged += prunedEntries
+		return err
+	})
+	return purged, err
+}
@@ -0,0 +1,131 @@
+package sessions
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBoltDBSessionIndex(t *testing.T) {
+	store, err := newBoltDBSessionStore(filepath.Join(t.TempDir(), "data.db"), "sessions", false)
+	require.NoError(t, err)
+	defer store.Close()
+
+	ctx := context.Background()
+	sub := SubjectIndexKey("user")
+	sid := SIDIndexKey("session")
+
+	require.NoError(t, store.IndexSession(ctx, "a", time.Hour, sub, sid))
+	require.NoError(t, store.IndexSession(ctx, "b", time.Hour, sub))
+	// Expired sessions are not returned
+	require.NoError(t, store.IndexSession(ctx, "c", -time.Hour, sub))
+
+	ids, err := store.IndexedSessions(ctx, sub)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"a", "b"}, ids)
+
+	ids, err = store.IndexedSessions(ctx, sid)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"a"}, ids)
+
+	require.NoError(t, store.UnindexSession(ctx, "a", sub, sid))
+	ids, err = store.IndexedSessions(ctx, sub)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"b"}, ids)
+
+	ids, err = store.IndexedSessions(ctx, sid)
+	require.NoError(t, err)
+	require.Empty(t, ids)
+}
+
+func TestBoltDBSessionIndexPrune(t *testing.T) {
+	store, err := newBoltDBSessionStore(filepath.Join(t.TempDir(), "data.db"), "sessions", false)
+	require.NoError(t, err)
+	defer store.Close()
+
+	ctx := context.Background()
+	require.NoError(t, store.IndexSession(ctx, "a", time.Hour, SubjectIndexKey("alice"), AllSessionsIndexKey))
+	require.NoError(t, store.IndexSession(ctx, "b", time.Minute, SubjectIndexKey("bob"), AllSessionsIndexKey))
+	require.NoError(t, store.IndexSession(ctx, "c", time.Minute, SubjectIndexKey("carol"), AllSessionsIndexKey))
+
+	indexKeys := func() []string {
+		var keys []string
+		require.NoError(t, store.DB.View(func(tx *bolt.Tx) error {
+			return tx.Bucket(store.indexBucket).ForEach(func(k, v []byte) error {
+				keys = append(keys, string(k))
+				return nil
+			})
+		}))
+		return keys
+	}
+
+	// The keys are pruned a batch at a time, and the keys that are left
+	// empty are deleted
+	later := time.Now().Add(30 * time.Minute).Unix()
+	var next []byte
+	total := 0
+	for i := 0; i < 2; i++ {
+		require.NoError(t, store.DB.Update(func(tx *bolt.Tx) error {
+			pruned, n, err := store.pruneIndex(tx, next, 2, later)
+			total += pruned
+			next = n
+			return err
+		}))
+	}
+	require.Nil(t, next)
+	require.Equal(t, 4, total)
+	require.ElementsMatch(t, []string{AllSessionsIndexKey, SubjectIndexKey("alice")}, indexKeys())
+
+	ids, err := store.IndexedSessions(ctx, AllSessionsIndexKey)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a"}, ids)
+}
+
+func TestBoltDBSessionIndexMigration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.db")
+	store, err := newBoltDBSessionStore(path, "sessions", false)
+	require.NoError(t, err)
+
+	// An index key of an older version
+	expiresAt := time.Now().Add(time.Hour).Unix()
+	require.NoError(t, store.DB.Update(func(tx *bolt.Tx) error {
+		index := tx.Bucket(store.indexBucket)
+		require.NoError(t, index.Put([]byte(AllSessionsIndexKey),
+			[]byte(`{"a": `+fmt.Sprint(expiresAt)+`, "expired": 1}`)))
+		return nil
+	}))
+	require.NoError(t, store.Close())
+
+	store, err = newBoltDBSessionStore(path, "sessions", false)
+	require.NoError(t, err)
+	defer store.Close()
+	ids, err := store.IndexedSessions(context.Background(), AllSessionsIndexKey)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a"}, ids)
+}
+
+func TestBoltDBSharedClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.db")
+	sessions, err := newBoltDBSessionStore(path, "sessions", true)
+	require.NoError(t, err)
+	states, err := newBoltDBSessionStore(path, "states", true)
+	require.NoError(t, err)
+	require.Same(t, sessions.DB, states.DB)
+
+	// The DB stays open for the store that still uses it
+	require.NoError(t, sessions.Close())
+	require.NoError(t, states.Ping(context.Background()))
+
+	require.NoError(t, states.Close())
+	require.Error(t, states.Ping(context.Background()))
+
+	// The path can be opened again
+	sessions, err = newBoltDBSessionStore(path, "sessions", false)
+	require.NoError(t, err)
+	require.NoError(t, sessions.Close())
+}
@@ -0,0 +1,196 @@
+package sessions
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/gob"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/pkg/errors"
+)
+
+const (
+	// cookieChunkSize is the size of the value of each cookie of a
+	// session, which leaves room for the name and the attributes of the
+	// cookie in the 4KB limit of the browsers.
+	cookieChunkSize = 3800
+	// cookieMaxChunks is the maximum number of cookies of a session.
+	cookieMaxChunks = 8
+)
+
+// cookieSession is the payload of the cookies of a session.
+type cookieSession struct {
+	Values map[interface{}]interface{}
+	// ExpiresAt is when the session expires, as a Unix time. The cookies
+	// carry it, since clients can keep them past their Max-Age.
+	ExpiresAt int64
+}
+
+// cookieSessionStore is a session store which keeps the sessions in encrypted
+// cookies, instead of a database, so that AuthService needs no state of its
+// own. A session that doesn't fit in a cookie is split across the cookies
+// NAME, NAME_1, NAME_2 and so on.
+//
+// The sessions can't be indexed, so the cookie session store can't revoke
+// sessions other than the one of the request.
+type cookieSessionStore struct {
+	keys *SessionKeys
+}
+
+func newCookieSessionStore(keys *SessionKeys) *cookieSessionStore {
+	return &cookieSessionStore{keys: keys}
+}
+
+// chunkCookieName returns the name of the i-th additional cookie of a session.
+func chunkCookieName(name string, i int) string {
+	return name + "_" + strconv.Itoa(i)
+}
+
+func (cs *cookieSessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(cs, name)
+}
+
+// New decrypts the session from the cookies of the request. Expired sessions
+// are returned as new.
+func (cs *cookieSessionStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(cs, name)
+	session.IsNew = true
+	c, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	encoded := c.Value
+	for i := 1; i < cookieMaxChunks; i++ {
+		chunk, err := r.Cookie(chunkCookieName(name, i))
+		if err != nil {
+			break
+		}
+		encoded += chunk.Value
+	}
+
+	payload, err := cs.decode(name, encoded)
+	if err != nil {
+		return session, err
+	}
+	remaining := time.Until(time.Unix(payload.ExpiresAt, 0))
+	if remaining <= 0 {
+		return session, nil
+	}
+	session.Values = payload.Values
+	session.Options = &sessions.Options{
+		Path:     "/",
+		MaxAge:   int(remaining.Seconds()),
+		Secure:   true,
+		HttpOnly: true,
+	}
+	session.IsNew = false
+	return session, nil
+}
+
+// Save encrypts the session into the cookies of the response. It also deletes
+// the additional cookies of the request that the session no longer needs.
+func (cs *cookieSessionStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	name := session.Name()
+	if session.Options.MaxAge < 0 {
+		http.SetCookie(w, sessions.NewCookie(name, "", session.Options))
+		for i := 1; i < cookieMaxChunks; i++ {
+			http.SetCookie(w, sessions.NewCookie(chunkCookieName(name, i), "", session.Options))
+		}
+		return nil
+	}
+
+	payload := cookieSession{
+		Values:    session.Values,
+		ExpiresAt: time.Now().Add(time.Duration(session.Options.MaxAge) * time.Second).Unix(),
+	}
+	encoded, err := cs.encode(name, payload)
+	if err != nil {
+		return err
+	}
+	chunks := []string{}
+	for len(encoded) > cookieChunkSize {
+		chunks = append(chunks, encoded[:cookieChunkSize])
+		encoded = encoded[cookieChunkSize:]
+	}
+	chunks = append(chunks, encoded)
+	if len(chunks) > cookieMaxChunks {
+		return errors.Errorf("session is too large for the cookie session store: %d cookies "+
+			"needed, at most %d allowed", len(chunks), cookieMaxChunks)
+	}
+
+	http.SetCookie(w, sessions.NewCookie(name, chunks[0], session.Options))
+	for i := 1; i < len(chunks); i++ {
+		http.SetCookie(w, sessions.NewCookie(chunkCookieName(name, i), chunks[i], session.Options))
+	}
+	deleteOptions := *session.Options
+	deleteOptions.MaxAge = -1
+	for i := len(chunks); i < cookieMaxChunks; i++ {
+		if _, err := r.Cookie(chunkCookieName(name, i)); err == nil {
+			http.SetCookie(w, sessions.NewCookie(chunkCookieName(name, i), "", &deleteOptions))
+		}
+	}
+	return nil
+}
+
+// encode encrypts the payload, binding it to the cookie name, so that the
+// cookies of one store can't be used for another.
+func (cs *cookieSessionStore) encode(name string, payload cookieSession) (string, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(payload); err != nil {
+		return "", errors.Wrap(err, "failed to encode session values")
+	}
+	enc, err := cs.keys.encryptBytes(buf.Bytes(), name)
+	if err != nil {
+		return "", err
+	}
+	buf.Reset()
+	if err := gob.NewEncoder(&buf).Encode(enc); err != nil {
+		return "", errors.Wrap(err, "failed to encode encrypted session")
+	}
+	return base64.RawURLEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+func (cs *cookieSessionStore) decode(name, encoded string) (*cookieSession, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode session cookie")
+	}
+	var enc encryptedValues
+	if err := gob.NewDecoder(bytes.NewReader(raw)).Decode(&enc); err != nil {
+		return nil, errors.Wrap(err, "failed to decode encrypted session")
+	}
+	plaintext, err := cs.keys.decryptBytes(enc, name)
+	if err != nil {
+		return nil, err
+	}
+	var payload cookieSession
+	if err := gob.NewDecoder(bytes.NewReader(plaintext)).Decode(&payload); err != nil {
+		return nil, errors.Wrap(err, "failed to decode session values")
+	}
+	return &payload, nil
+}
+
+func (cs *cookieSessionStore) Close() error {
+	return nil
+}
+
+// The cookie session store keeps no index, so its sessions are never found by
+// index key.
+
+func (cs *cookieSessionStore) IndexSession(ctx context.Context, sessionID string,
+	maxAge time.Duration, keys ...string) error {
+	return nil
+}
+
+func (cs *cookieSessionStore) IndexedSessions(ctx context.Context, key string) ([]string, error) {
+	return nil, nil
+}
+
+func (cs *cookieSessionStore) UnindexSession(ctx context.Context, sessionID string, keys ...string) error {
+	return nil
+}
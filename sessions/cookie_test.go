@@ -0,0 +1,92 @@
+package sessions
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCookieSessionStore(t *testing.T) {
+	keys, err := NewSessionKeys(bytes.Repeat([]byte{1}, sessionKeySize))
+	require.NoError(t, err)
+	store := newCookieSessionStore(keys)
+
+	// requestWithCookies returns a request with the cookies of the response.
+	requestWithCookies := func(w *httptest.ResponseRecorder) *http.Request {
+		r := httptest.NewRequest("GET", "/", nil)
+		for _, c := range w.Result().Cookies() {
+			if c.MaxAge >= 0 {
+				r.AddCookie(c)
+			}
+		}
+		return r
+	}
+
+	// Large sessions are split across many cookies
+	largeToken := strings.Repeat("a", 3*cookieChunkSize)
+	session := NewSession(store, UserSessionCookie)
+	session.Options.MaxAge = 3600
+	session.Values[UserSessionUserID] = "alice"
+	session.Values[UserSessionIDToken] = largeToken
+	w := httptest.NewRecorder()
+	require.NoError(t, session.Save(httptest.NewRequest("GET", "/", nil), w))
+	chunks := len(w.Result().Cookies())
+	require.Greater(t, chunks, 3)
+	for _, c := range w.Result().Cookies() {
+		require.NotContains(t, c.Value, "alice")
+	}
+
+	loaded, err := store.Get(requestWithCookies(w), UserSessionCookie)
+	require.NoError(t, err)
+	require.False(t, loaded.IsNew)
+	require.Equal(t, "alice", loaded.Values[UserSessionUserID])
+	require.Equal(t, largeToken, loaded.Values[UserSessionIDToken])
+
+	// The joined cookies can be sent as a session ID
+	sessionID, err := SessionIDFromResponse(w, UserSessionCookie)
+	require.NoError(t, err)
+	loaded, err = SessionFromID(sessionID, store)
+	require.NoError(t, err)
+	require.Equal(t, "alice", loaded.Values[UserSessionUserID])
+
+	// Cookies that the session no longer needs are deleted
+	delete(loaded.Values, UserSessionIDToken)
+	w2 := httptest.NewRecorder()
+	require.NoError(t, store.Save(requestWithCookies(w), w2, loaded))
+	deleted := 0
+	for _, c := range w2.Result().Cookies() {
+		if c.MaxAge < 0 {
+			deleted++
+		}
+	}
+	require.Equal(t, chunks-1, deleted)
+
+	// Tampered cookies are rejected
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: UserSessionCookie, Value: sessionID[:len(sessionID)-4] + "AAAA"})
+	_, err = store.New(r, UserSessionCookie)
+	require.Error(t, err)
+	_, err = SessionFromID(sessionID[:cookieChunkSize], store)
+	require.Error(t, err)
+
+	// Cookies of a session can't be used for another one
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: oidcStateCookie, Value: sessionID})
+	_, err = store.New(r, oidcStateCookie)
+	require.Error(t, err)
+
+	// Expired sessions are new, even if the client kept their cookies
+	encoded, err := store.encode(UserSessionCookie, cookieSession{
+		Values:    map[interface{}]interface{}{UserSessionUserID: "alice"},
+		ExpiresAt: time.Now().Add(-time.Minute).Unix(),
+	})
+	require.NoError(t, err)
+	loaded, err = SessionFromID(encoded, store)
+	require.NoError(t, err)
+	require.True(t, loaded.IsNew)
+}
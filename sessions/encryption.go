@@ -0,0 +1,281 @@
+package sessions
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/sessions"
+	"github.com/pkg/errors"
+)
+
+// encryptedValuesKey is the only value of an encrypted session in the
+// underlying store.
+const encryptedValuesKey = "encrypted"
+
+// sessionKeySize is the size of the session encryption keys, for AES-256.
+const sessionKeySize = 32
+
+func init() {
+	gob.Register(encryptedValues{})
+}
+
+// encryptedValues are the values of a session, encrypted with envelope
+// encryption: a random data key encrypts the values and a session key
+// encrypts the data key.
+type encryptedValues struct {
+	// KeyID identifies the session key that encrypted the data key.
+	KeyID string
+	// DataKey is the encrypted data key.
+	DataKey []byte
+	// Values are the gob-encoded values of the session, encrypted with the
+	// data key.
+	Values []byte
+}
+
+type sessionKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// SessionKeys are the keys that encrypt the sessions at rest. The first key is
+// the primary key, which encrypts the sessions as they are saved. All the keys
+// decrypt them, so that a new primary key can be added while the sessions
+// encrypted with the old ones are still valid.
+type SessionKeys struct {
+	keys []sessionKey
+}
+
+// NewSessionKeys returns the session keys with the given AES-256 keys, primary
+// first.
+func NewSessionKeys(keys ...[]byte) (*SessionKeys, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no session keys")
+	}
+	sk := &SessionKeys{}
+	for _, key := range keys {
+		if len(key) != sessionKeySize {
+			return nil, errors.Errorf("session keys must be %d bytes, got %d", sessionKeySize, len(key))
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		// The ID of a key is derived from it, so that the keys don't
+		// need to be named.
+		hash := sha256.Sum256(key)
+		sk.keys = append(sk.keys, sessionKey{id: hex.EncodeToString(hash[:8]), aead: aead})
+	}
+	return sk, nil
+}
+
+// LoadSessionKeys reads the session keys from the given files, primary first.
+// Each file holds a base64-encoded 32-byte key, e.g., as generated by
+// `openssl rand -base64 32`.
+func LoadSessionKeys(paths []string) (*SessionKeys, error) {
+	keys := [][]byte{}
+	for _, path := range paths {
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read session key file")
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(raw)))
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to decode session key file '%s'", path)
+		}
+		keys = append(keys, key)
+	}
+	return NewSessionKeys(keys...)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create AES cipher")
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts the plaintext and prepends the random nonce it used.
+func seal(aead cipher.AEAD, plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, errors.Wrap(err, "failed to generate nonce")
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func open(aead cipher.AEAD, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext is too short")
+	}
+	nonce, ciphertext := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
+
+// encrypt encrypts the values of the session with the given ID using the
+// primary key. The ciphertexts are bound to the session ID, so that they can't
+// be moved to another session.
+func (sk *SessionKeys) encrypt(sessionID string, values map[interface{}]interface{}) (*encryptedValues, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(values); err != nil {
+		return nil, errors.Wrap(err, "failed to encode session values")
+	}
+	return sk.encryptBytes(buf.Bytes(), sessionID)
+}
+
+// decrypt decrypts the values of the session with the given ID with any one
+// of the keys.
+func (sk *SessionKeys) decrypt(sessionID string, enc encryptedValues) (map[interface{}]interface{}, error) {
+	plaintext, err := sk.decryptBytes(enc, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	values := map[interface{}]interface{}{}
+	if err := gob.NewDecoder(bytes.NewReader(plaintext)).Decode(&values); err != nil {
+		return nil, errors.Wrap(err, "failed to decode session values")
+	}
+	return values, nil
+}
+
+// encryptBytes encrypts the plaintext with a new data key, which it encrypts
+// with the primary key. Both ciphertexts are bound to the additional data.
+func (sk *SessionKeys) encryptBytes(plaintext []byte, additionalData string) (*encryptedValues, error) {
+	dataKey := make([]byte, sessionKeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, errors.Wrap(err, "failed to generate data key")
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	encValues, err := seal(dataAEAD, plaintext, []byte(additionalData))
+	if err != nil {
+		return nil, err
+	}
+	primary := sk.keys[0]
+	encDataKey, err := seal(primary.aead, dataKey, []byte(additionalData))
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedValues{KeyID: primary.id, DataKey: encDataKey, Values: encValues}, nil
+}
+
+func (sk *SessionKeys) decryptBytes(enc encryptedValues, additionalData string) ([]byte, error) {
+	var key *sessionKey
+	for i := range sk.keys {
+		if sk.keys[i].id == enc.KeyID {
+			key = &sk.keys[i]
+			break
+		}
+	}
+	if key == nil {
+		return nil, errors.Errorf("session is encrypted with unknown key '%s'", enc.KeyID)
+	}
+	dataKey, err := open(key.aead, enc.DataKey, []byte(additionalData))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decrypt data key")
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := open(dataAEAD, enc.Values, []byte(additionalData))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decrypt session values")
+	}
+	return plaintext, nil
+}
+
+// encryptedStore is a session store which encrypts the values of the sessions
+// before they reach the underlying store.
+type encryptedStore struct {
+	IndexedStore
+	keys *SessionKeys
+	// allowPlaintext accepts the plaintext sessions of the underlying
+	// store, i.e., the ones saved before encryption was enabled. They are
+	// encrypted the next time they are saved.
+	allowPlaintext bool
+}
+
+// NewEncryptedStore returns a session store which encrypts the values of the
+// sessions with the given keys before saving them in the given store.
+func NewEncryptedStore(store IndexedStore, keys *SessionKeys, allowPlaintext bool) IndexedStore {
+	return &encryptedStore{IndexedStore: store, keys: keys, allowPlaintext: allowPlaintext}
+}
+
+func (es *encryptedStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(es, name)
+}
+
+// New loads the session from the underlying store and decrypts its values.
+// The returned session is saved through the encrypted store.
+func (es *encryptedStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	inner, err := es.IndexedStore.New(r, name)
+	session := sessions.NewSession(es, name)
+	session.ID = inner.ID
+	session.Options = inner.Options
+	session.IsNew = inner.IsNew
+	if err != nil || inner.IsNew {
+		return session, err
+	}
+
+	enc, ok := inner.Values[encryptedValuesKey].(encryptedValues)
+	if !ok {
+		if !es.allowPlaintext {
+			session.IsNew = true
+			return session, errors.New("session isn't encrypted")
+		}
+		session.Values = inner.Values
+		return session, nil
+	}
+	values, err := es.keys.decrypt(session.ID, enc)
+	if err != nil {
+		session.IsNew = true
+		return session, err
+	}
+	session.Values = values
+	return session, nil
+}
+
+// Save encrypts the values of the session with the primary key and saves it
+// in the underlying store.
+func (es *encryptedStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	inner := sessions.NewSession(es.IndexedStore, session.Name())
+	inner.Options = session.Options
+	inner.IsNew = session.IsNew
+	// Deleted sessions have nothing to encrypt.
+	if session.Options.MaxAge >= 0 {
+		// Generate the ID of new sessions, as the stores do, since the
+		// ciphertexts are bound to it.
+		if session.ID == "" {
+			id := make([]byte, 32)
+			if _, err := io.ReadFull(rand.Reader, id); err != nil {
+				return errors.Wrap(err, "failed to generate session ID")
+			}
+			session.ID = strings.TrimRight(base32.StdEncoding.EncodeToString(id), "=")
+		}
+		enc, err := es.keys.encrypt(session.ID, session.Values)
+		if err != nil {
+			return err
+		}
+		inner.Values[encryptedValuesKey] = *enc
+		// Keep the user ID in plaintext, as the index keys do, for the
+		// stores that look up the sessions of a user by it.
+		if userID, ok := session.Values[UserSessionUserID]; ok {
+			inner.Values[UserSessionUserID] = userID
+		}
+	}
+	inner.ID = session.ID
+	return es.IndexedStore.Save(r, w, inner)
+}
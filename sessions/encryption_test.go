@@ -0,0 +1,84 @@
+package sessions
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/stretchr/testify/require"
+	"github.com/yosssi/boltstore/shared"
+	"golang.org/x/oauth2"
+)
+
+func TestEncryptedStore(t *testing.T) {
+	boltStore, err := newBoltDBSessionStore(filepath.Join(t.TempDir(), "data.db"), shared.DefaultBucketName, false)
+	require.NoError(t, err)
+	defer boltStore.Close()
+
+	oldKey := bytes.Repeat([]byte{1}, sessionKeySize)
+	newKey := bytes.Repeat([]byte{2}, sessionKeySize)
+	oldKeys, err := NewSessionKeys(oldKey)
+	require.NoError(t, err)
+	rotatedKeys, err := NewSessionKeys(newKey, oldKey)
+	require.NoError(t, err)
+
+	saveSession := func(store Store) string {
+		session := NewSession(store, UserSessionCookie)
+		session.Options.MaxAge = 3600
+		session.Values[UserSessionUserID] = "alice"
+		session.Values[UserSessionOAuth2Tokens] = oauth2.Token{AccessToken: "secret-access-token"}
+		w := httptest.NewRecorder()
+		require.NoError(t, session.Save(httptest.NewRequest("GET", "/", nil), w))
+		sessionID, err := SessionIDFromResponse(w, UserSessionCookie)
+		require.NoError(t, err)
+		return sessionID
+	}
+	loadSession := func(store Store, sessionID string) map[interface{}]interface{} {
+		session, err := SessionFromID(sessionID, store)
+		require.NoError(t, err)
+		require.False(t, session.IsNew)
+		return session.Values
+	}
+
+	// The tokens aren't stored in plaintext
+	store := NewEncryptedStore(boltStore, oldKeys, false)
+	sessionID := saveSession(store)
+	require.NoError(t, boltStore.DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(shared.DefaultBucketName)).ForEach(func(k, v []byte) error {
+			require.NotContains(t, string(v), "secret-access-token")
+			return nil
+		})
+	}))
+	values := loadSession(store, sessionID)
+	require.Equal(t, "alice", values[UserSessionUserID])
+	require.Equal(t, "secret-access-token", values[UserSessionOAuth2Tokens].(oauth2.Token).AccessToken)
+
+	// Sessions of the old key are decrypted after a rotation and encrypted
+	// with the new primary key when they are saved again
+	rotated := NewEncryptedStore(boltStore, rotatedKeys, false)
+	session, err := SessionFromID(sessionID, rotated)
+	require.NoError(t, err)
+	require.Equal(t, "alice", session.Values[UserSessionUserID])
+	require.NoError(t, session.Save(httptest.NewRequest("GET", "/", nil), httptest.NewRecorder()))
+	_, err = SessionFromID(sessionID, store)
+	require.Error(t, err)
+	require.Equal(t, "alice", loadSession(rotated, sessionID)[UserSessionUserID])
+
+	// Plaintext sessions are only accepted while migrating
+	plaintextID := saveSession(boltStore)
+	_, err = SessionFromID(plaintextID, rotated)
+	require.Error(t, err)
+	migrating := NewEncryptedStore(boltStore, rotatedKeys, true)
+	require.Equal(t, "alice", loadSession(migrating, plaintextID)[UserSessionUserID])
+
+	// Deleting sessions still works
+	session, err = SessionFromID(sessionID, rotated)
+	require.NoError(t, err)
+	require.NoError(t, revokeSession(context.Background(), httptest.NewRecorder(), session, ""))
+	session, err = SessionFromID(sessionID, rotated)
+	require.NoError(t, err)
+	require.True(t, session.IsNew)
+}
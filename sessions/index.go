@@ -0,0 +1,104 @@
+package sessions
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	subjectIndexPrefix = "sub:"
+	sidIndexPrefix     = "sid:"
+	userIndexPrefix    = "user:"
+
+	// AllSessionsIndexKey is the index key for all the user sessions.
+	AllSessionsIndexKey = "all"
+)
+
+// SessionIndex is a secondary index from arbitrary keys (e.g. the subject of
+// the ID token) to the IDs of the sessions associated with them. Index entries
+// expire along with the sessions they point to.
+type SessionIndex interface {
+	// IndexSession adds the session ID under each one of the given keys.
+	IndexSession(ctx context.Context, sessionID string, maxAge time.Duration, keys ...string) error
+	// IndexedSessions returns the IDs of the unexpired sessions under the
+	// given key.
+	IndexedSessions(ctx context.Context, key string) ([]string, error)
+	// UnindexSession removes the session ID from each one of the given keys.
+	UnindexSession(ctx context.Context, sessionID string, keys ...string) error
+}
+
+// IndexedStore is a session store which also maintains a SessionIndex.
+type IndexedStore interface {
+	ClosableStore
+	SessionIndex
+}
+
+// SubjectIndexKey returns the index key for the sessions of an OIDC subject.
+func SubjectIndexKey(sub string) string {
+	return subjectIndexPrefix + sub
+}
+
+// SIDIndexKey returns the index key for the sessions of an OIDC provider
+// session, as identified by the sid claim.
+func SIDIndexKey(sid string) string {
+	return sidIndexPrefix + sid
+}
+
+// UserIndexKey returns the index key for the sessions of a user, as
+// identified by the user ID of the sessions.
+func UserIndexKey(userID string) string {
+	return userIndexPrefix + userID
+}
+
+// SessionIDFromResponse returns the ID of a session that has just been saved,
+// as found in the cookie that the store set in the response. This is the
+// value that clients send in the session cookie or in the AUTH_HEADER. The
+// values of sessions split across many cookies are joined.
+func SessionIDFromResponse(w http.ResponseWriter, cookie string) (string, error) {
+	resp := http.Response{Header: w.Header()}
+	// Use the last cookie, in case the same cookie has been set many times.
+	values := map[string]string{}
+	for _, c := range resp.Cookies() {
+		values[c.Name] = c.Value
+	}
+	sessionID := values[cookie]
+	if sessionID == "" {
+		return "", errors.Errorf("No cookie '%s' found in response", cookie)
+	}
+	for i := 1; values[chunkCookieName(cookie, i)] != ""; i++ {
+		sessionID += values[chunkCookieName(cookie, i)]
+	}
+	return sessionID, nil
+}
+
+// RevokeIndexedSessions deletes all the sessions found under the given index
+// key and removes them from the index. It returns the number of the sessions
+// that were deleted.
+func RevokeIndexedSessions(ctx context.Context, store IndexedStore, key string) (int, error) {
+	sessionIDs, err := store.IndexedSessions(ctx, key)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Couldn't get sessions for index key '%s'", key)
+	}
+
+	revoked := 0
+	for _, id := range sessionIDs {
+		session, err := SessionFromID(id, store)
+		if err != nil {
+			return revoked, errors.Wrap(err, "Couldn't get user session")
+		}
+		if !session.IsNew {
+			if err := revokeSession(ctx, httptest.NewRecorder(), session, ""); err != nil {
+				return revoked, err
+			}
+			revoked++
+		}
+		if err := store.UnindexSession(ctx, id, key); err != nil {
+			return revoked, errors.Wrapf(err, "Couldn't remove session from index key '%s'", key)
+		}
+	}
+	return revoked, nil
+}
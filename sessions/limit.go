@@ -0,0 +1,131 @@
+package sessions
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/gorilla/sessions"
+	"github.com/pkg/errors"
+)
+
+// Policies of the session limit, i.e., what happens when a user with the
+// maximum number of sessions logs in again.
+const (
+	// SessionLimitEvictOldest revokes the oldest sessions of the user to
+	// make room for the new one.
+	SessionLimitEvictOldest = "evict_oldest"
+	// SessionLimitDeny refuses the new login.
+	SessionLimitDeny = "deny"
+)
+
+// SessionLimit is the maximum number of active sessions per user.
+type SessionLimit struct {
+	// Max is the maximum number of sessions. Zero disables the limit.
+	Max int
+	// Policy is one of SessionLimitEvictOldest or SessionLimitDeny.
+	Policy string
+}
+
+// Enabled examines if the session limit is enabled.
+func (l SessionLimit) Enabled() bool {
+	return l.Max > 0
+}
+
+// Excess returns the sessions that must be evicted for one more session to
+// fit in the limit. The given sessions must be sorted oldest first, as
+// returned by UserSessions.
+func (l SessionLimit) Excess(userSessions []IndexedSession) []IndexedSession {
+	if !l.Enabled() || len(userSessions) < l.Max {
+		return nil
+	}
+	return userSessions[:len(userSessions)-l.Max+1]
+}
+
+// UserLocks serializes the logins of each user, so that concurrent logins
+// can't all see room for one more session and exceed the session limit.
+// They only serialize the logins that this process serves. The zero value is
+// ready to use.
+type UserLocks struct {
+	mu    sync.Mutex
+	locks map[string]*userLock
+}
+
+type userLock struct {
+	sync.Mutex
+	refs int
+}
+
+// Lock locks the logins of the given user and returns the function that
+// unlocks them.
+func (l *UserLocks) Lock(userID string) func() {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = map[string]*userLock{}
+	}
+	lock, ok := l.locks[userID]
+	if !ok {
+		lock = &userLock{}
+		l.locks[userID] = lock
+	}
+	lock.refs++
+	l.mu.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(l.locks, userID)
+		}
+	}
+}
+
+// IndexedSession is a session found in the session index.
+type IndexedSession struct {
+	// ID is the value of the session's cookie.
+	ID      string
+	Session *sessions.Session
+}
+
+// LoadIndexedSessions returns the sessions under the given index key.
+// Sessions that no longer exist, e.g., because the user logged out, are
+// removed from the key and from AllSessionsIndexKey.
+func LoadIndexedSessions(ctx context.Context, store IndexedStore, key string) ([]IndexedSession, error) {
+	ids, err := store.IndexedSessions(ctx, key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Couldn't get sessions for index key '%s'", key)
+	}
+	found := []IndexedSession{}
+	for _, id := range ids {
+		session, err := SessionFromID(id, store)
+		if err != nil {
+			return nil, errors.Wrap(err, "Couldn't get user session")
+		}
+		if session.IsNew {
+			if err := store.UnindexSession(ctx, id, key, AllSessionsIndexKey); err != nil {
+				return nil, errors.Wrap(err, "Couldn't remove session from index")
+			}
+			continue
+		}
+		found = append(found, IndexedSession{ID: id, Session: session})
+	}
+	return found, nil
+}
+
+// UserSessions returns the sessions of a user, oldest first. Sessions that
+// don't record when they were created are considered the oldest.
+func UserSessions(ctx context.Context, store IndexedStore, userID string) ([]IndexedSession, error) {
+	found, err := LoadIndexedSessions(ctx, store, UserIndexKey(userID))
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(found, func(i, j int) bool {
+		ti, _ := sessionTime(found[i].Session, UserSessionCreatedAt)
+		tj, _ := sessionTime(found[j].Session, UserSessionCreatedAt)
+		return ti.Before(tj)
+	})
+	return found, nil
+}
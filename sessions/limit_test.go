@@ -0,0 +1,88 @@
+package sessions
+
+import (
+	"context"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUserSessionsAndLimit(t *testing.T) {
+	store, err := newBoltDBSessionStore(filepath.Join(t.TempDir(), "data.db"), "sessions", false)
+	require.NoError(t, err)
+	defer store.Close()
+
+	ctx := context.Background()
+	now := time.Now()
+	createSession := func(createdAt time.Time) string {
+		session := NewSession(store, UserSessionCookie)
+		session.Options.MaxAge = 3600
+		StartActivity(session, createdAt)
+		w := httptest.NewRecorder()
+		require.NoError(t, session.Save(httptest.NewRequest("GET", "/", nil), w))
+		sessionID, err := SessionIDFromResponse(w, UserSessionCookie)
+		require.NoError(t, err)
+		require.NoError(t, store.IndexSession(ctx, sessionID, time.Hour,
+			UserIndexKey("alice"), AllSessionsIndexKey))
+		return sessionID
+	}
+	newest := createSession(now)
+	oldest := createSession(now.Add(-2 * time.Hour))
+	middle := createSession(now.Add(-time.Hour))
+	// Sessions that no longer exist are removed from the index
+	deleted, err := SessionFromID(createSession(now), store)
+	require.NoError(t, err)
+	require.NoError(t, revokeSession(ctx, httptest.NewRecorder(), deleted, ""))
+
+	userSessions, err := UserSessions(ctx, store, "alice")
+	require.NoError(t, err)
+	ids := []string{}
+	for _, s := range userSessions {
+		ids = append(ids, s.ID)
+	}
+	require.Equal(t, []string{oldest, middle, newest}, ids)
+	all, err := store.IndexedSessions(ctx, AllSessionsIndexKey)
+	require.NoError(t, err)
+	require.Len(t, all, 3)
+
+	// Room must be made for the new session
+	require.Equal(t, userSessions[:2], SessionLimit{Max: 2}.Excess(userSessions))
+	require.Equal(t, userSessions[:1], SessionLimit{Max: 3}.Excess(userSessions))
+	require.Empty(t, SessionLimit{Max: 4}.Excess(userSessions))
+	require.Empty(t, SessionLimit{}.Excess(userSessions))
+}
+
+func TestUserLocks(t *testing.T) {
+	var locks UserLocks
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	active, maxActive := 0, 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer locks.Lock("alice")()
+			mu.Lock()
+			active++
+			if active > maxActive {
+				maxActive = active
+			}
+			mu.Unlock()
+			time.Sleep(time.Millisecond)
+			mu.Lock()
+			active--
+			mu.Unlock()
+		}()
+	}
+	// The logins of other users aren't serialized with them
+	unlock := locks.Lock("bob")
+	unlock()
+	wg.Wait()
+
+	require.Equal(t, 1, maxActive)
+	require.Empty(t, locks.locks)
+}
@@ -0,0 +1,388 @@
+package sessions
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/arrikto/oidc-authservice/common"
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/securecookie"
+	"github.com/pkg/errors"
+)
+
+// Kinds of the records of a session export.
+const (
+	RecordKindSession   = "session"
+	RecordKindOIDCState = "oidc_state"
+	RecordKindIndex     = "index"
+)
+
+// SessionRecord is an entry of a session store, as exported by the sessions
+// command: a user session, an OIDC state or the entry of a session under an
+// index key.
+type SessionRecord struct {
+	Kind string `json:"kind"`
+	// ID is the ID of the session in the store or, for index entries, the
+	// session ID under the index key.
+	ID string `json:"id"`
+	// Key is the index key of index entries.
+	Key       string    `json:"key,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// Data are the gob-encoded values of the session, as all the stores
+	// keep them. Encrypted sessions stay encrypted.
+	Data []byte `json:"data,omitempty"`
+}
+
+// MaintainableStore is a session store whose entries can be exported, imported
+// and purged while AuthService isn't using it.
+type MaintainableStore interface {
+	IndexedStore
+	// ForEachSession calls fn with each unexpired session of the store.
+	ForEachSession(ctx context.Context, fn func(SessionRecord) error) error
+	// ForEachIndexEntry calls fn with each unexpired index entry of the
+	// store.
+	ForEachIndexEntry(ctx context.Context, fn func(SessionRecord) error) error
+	// ImportSession saves an exported session in the store, keeping its ID
+	// and its expiration.
+	ImportSession(ctx context.Context, rec SessionRecord) error
+	// PurgeExpired deletes the expired sessions and index entries of the
+	// store and returns how many it deleted.
+	PurgeExpired(ctx context.Context) (int, error)
+}
+
+// Maintainable returns the underlying store of the given session store, as
+// returned by InitiateSessionStores, which the sessions command works on.
+// Encrypted sessions are handled as they are stored.
+func Maintainable(store Store) (MaintainableStore, error) {
+	if es, ok := store.(*encryptedStore); ok {
+		store = es.IndexedStore
+	}
+	if _, ok := store.(*cookieSessionStore); ok {
+		return nil, errors.New("the cookie session store keeps the sessions in the browsers")
+	}
+	ms, ok := store.(MaintainableStore)
+	if !ok {
+		return nil, errors.Errorf("session store %T doesn't support maintenance", store)
+	}
+	return ms, nil
+}
+
+// CopySessions copies the user sessions, their index entries and the OIDC
+// states of the source stores to fn, in that order. It returns the number of
+// the records it copied.
+func CopySessions(ctx context.Context, store, stateStore MaintainableStore,
+	fn func(SessionRecord) error) (int, error) {
+
+	copied := 0
+	withKind := func(kind string) func(SessionRecord) error {
+		return func(rec SessionRecord) error {
+			rec.Kind = kind
+			copied++
+			return fn(rec)
+		}
+	}
+	if err := store.ForEachSession(ctx, withKind(RecordKindSession)); err != nil {
+		return copied, errors.Wrap(err, "failed to read sessions")
+	}
+	if err := store.ForEachIndexEntry(ctx, withKind(RecordKindIndex)); err != nil {
+		return copied, errors.Wrap(err, "failed to read session index")
+	}
+	if err := stateStore.ForEachSession(ctx, withKind(RecordKindOIDCState)); err != nil {
+		return copied, errors.Wrap(err, "failed to read OIDC states")
+	}
+	return copied, nil
+}
+
+// ImportRecord saves the record in the store of its kind.
+func ImportRecord(ctx context.Context, store, stateStore MaintainableStore, rec SessionRecord) error {
+	switch rec.Kind {
+	case RecordKindSession:
+		return store.ImportSession(ctx, rec)
+	case RecordKindOIDCState:
+		return stateStore.ImportSession(ctx, rec)
+	case RecordKindIndex:
+		maxAge := time.Until(rec.ExpiresAt)
+		if maxAge <= 0 {
+			return nil
+		}
+		return store.IndexSession(ctx, rec.ID, maxAge, rec.Key)
+	default:
+		return errors.Errorf("unknown record kind '%s'", rec.Kind)
+	}
+}
+
+// ExportSessions writes the records of the stores to w as JSON, one record per
+// line, and returns their number.
+func ExportSessions(ctx context.Context, store, stateStore MaintainableStore, w io.Writer) (int, error) {
+	enc := json.NewEncoder(w)
+	return CopySessions(ctx, store, stateStore, func(rec SessionRecord) error {
+		return enc.Encode(rec)
+	})
+}
+
+// ImportSessions reads the records that ExportSessions wrote from r, saves
+// them in the stores and returns their number. Records that have expired
+// since the export are skipped.
+func ImportSessions(ctx context.Context, store, stateStore MaintainableStore, r io.Reader) (int, error) {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	imported := 0
+	for {
+		var rec SessionRecord
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			return imported, nil
+		}
+		if err != nil {
+			return imported, errors.Wrap(err, "failed to decode session record")
+		}
+		if !rec.ExpiresAt.After(time.Now()) {
+			continue
+		}
+		if err := ImportRecord(ctx, store, stateStore, rec); err != nil {
+			return imported, errors.Wrapf(err, "failed to import %s '%s'", rec.Kind, rec.ID)
+		}
+		imported++
+	}
+}
+
+// SessionStats are statistics about the sessions of a store.
+type SessionStats struct {
+	Sessions   int
+	OIDCStates int
+	// Users are the numbers of the sessions of each user.
+	Users map[string]int
+	// Oldest and Newest are the creation times of the oldest and the newest
+	// sessions. Sessions that don't record their creation time, or are
+	// encrypted with unknown keys, aren't taken into account.
+	Oldest time.Time
+	Newest time.Time
+}
+
+// UserCount is the number of the sessions of a user.
+type UserCount struct {
+	UserID   string
+	Sessions int
+}
+
+// TopUsers returns the users with the most sessions, most sessions first.
+func (st *SessionStats) TopUsers(n int) []UserCount {
+	users := []UserCount{}
+	for userID, count := range st.Users {
+		users = append(users, UserCount{UserID: userID, Sessions: count})
+	}
+	sort.Slice(users, func(i, j int) bool {
+		if users[i].Sessions != users[j].Sessions {
+			return users[i].Sessions > users[j].Sessions
+		}
+		return users[i].UserID < users[j].UserID
+	})
+	if n > 0 && len(users) > n {
+		users = users[:n]
+	}
+	return users
+}
+
+// CollectSessionStats returns statistics about the sessions of the stores. The
+// keys, if any, decrypt the encrypted sessions.
+func CollectSessionStats(ctx context.Context, store, stateStore MaintainableStore,
+	keys *SessionKeys) (*SessionStats, error) {
+
+	stats := &SessionStats{Users: map[string]int{}}
+	err := store.ForEachSession(ctx, func(rec SessionRecord) error {
+		stats.Sessions++
+		values, err := recordValues(rec, keys)
+		if err != nil {
+			common.StandardLogger().Warnf("Couldn't read session '%s': %v", rec.ID, err)
+			return nil
+		}
+		if userID, ok := values[UserSessionUserID].(string); ok {
+			stats.Users[userID]++
+		}
+		if secs, ok := values[UserSessionCreatedAt].(int64); ok {
+			createdAt := time.Unix(secs, 0)
+			if stats.Oldest.IsZero() || createdAt.Before(stats.Oldest) {
+				stats.Oldest = createdAt
+			}
+			if createdAt.After(stats.Newest) {
+				stats.Newest = createdAt
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read sessions")
+	}
+	err = stateStore.ForEachSession(ctx, func(rec SessionRecord) error {
+		stats.OIDCStates++
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read OIDC states")
+	}
+	return stats, nil
+}
+
+// recordValues decodes the values of an exported session. Encrypted values are
+// decrypted if there are keys, or else only their plaintext user ID is
+// returned.
+func recordValues(rec SessionRecord, keys *SessionKeys) (map[interface{}]interface{}, error) {
+	values, err := decodeValues(rec.Data)
+	if err != nil {
+		return nil, err
+	}
+	enc, ok := values[encryptedValuesKey].(encryptedValues)
+	if !ok || keys == nil {
+		return values, nil
+	}
+	return keys.decrypt(rec.ID, enc)
+}
+
+func decodeValues(data []byte) (map[interface{}]interface{}, error) {
+	values := map[interface{}]interface{}{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&values); err != nil {
+		return nil, errors.Wrap(err, "failed to decode session values")
+	}
+	return values, nil
+}
+
+// copyBoltBucket copies the keys and the nested buckets, e.g., the keys of
+// the session index, of the src bucket to the dst bucket.
+func copyBoltBucket(dst, src *bolt.Bucket) error {
+	return src.ForEach(func(k, v []byte) error {
+		if v != nil {
+			return dst.Put(k, v)
+		}
+		nested, err := dst.CreateBucketIfNotExists(k)
+		if err != nil {
+			return err
+		}
+		return copyBoltBucket(nested, src.Bucket(k))
+	})
+}
+
+// CompactBoltDB rewrites the BoltDB file of the given path without its free
+// pages, which BoltDB never returns to the filesystem. AuthService must not be
+// using the file. It returns the sizes of the file before and after.
+func CompactBoltDB(path string) (int64, int64, error) {
+	src, err := bolt.Open(path, 0600, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "failed to open %s, is AuthService still running?", path)
+	}
+	defer src.Close()
+	compactPath := path + ".compact"
+	os.Remove(compactPath)
+	dst, err := bolt.Open(compactPath, 0600, nil)
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "failed to create %s", compactPath)
+	}
+	defer dst.Close()
+
+	err = src.View(func(srcTx *bolt.Tx) error {
+		return srcTx.ForEach(func(name []byte, srcBucket *bolt.Bucket) error {
+			return dst.Update(func(dstTx *bolt.Tx) error {
+				dstBucket, err := dstTx.CreateBucketIfNotExists(name)
+				if err != nil {
+					return err
+				}
+				return copyBoltBucket(dstBucket, srcBucket)
+			})
+		})
+	})
+	if err != nil {
+		os.Remove(compactPath)
+		return 0, 0, errors.Wrap(err, "failed to copy database")
+	}
+	before, err := fileSize(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	src.Close()
+	dst.Close()
+	after, err := fileSize(compactPath)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := os.Rename(compactPath, path); err != nil {
+		return 0, 0, errors.Wrap(err, "failed to replace database")
+	}
+	return before, after, nil
+}
+
+func fileSize(path string) (int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// The BoltDB session store signs the session IDs of its cookies with a fixed
+// key, while the other stores use the IDs as they are. The stores accept the
+// cookies of each other, so that users stay logged in when their sessions are
+// migrated.
+
+// boltCookieCodecs encode the session cookies of the BoltDB session store.
+var boltCookieCodecs = securecookie.CodecsFromPairs([]byte(secureCookieKeyPair))
+
+// rawSessionIDLength is the length of the session IDs of all the stores: 32
+// random bytes, encoded in base32 without padding.
+const rawSessionIDLength = 52
+
+// isRawSessionID examines if the cookie value is a session ID, as the stores
+// other than the BoltDB one use it.
+func isRawSessionID(value string) bool {
+	if len(value) != rawSessionIDLength {
+		return false
+	}
+	for _, c := range value {
+		if !(c >= 'A' && c <= 'Z' || c >= '2' && c <= '7') {
+			return false
+		}
+	}
+	return true
+}
+
+// boltCookieSessionID returns the session ID of a cookie of the BoltDB session
+// store.
+func boltCookieSessionID(name, value string) (string, bool) {
+	var id string
+	if err := securecookie.DecodeMulti(name, value, &id, boltCookieCodecs...); err != nil {
+		return "", false
+	}
+	return id, true
+}
+
+// withSessionCookie returns a copy of the request with the value of the
+// session cookie replaced.
+func withSessionCookie(r *http.Request, name, value string) *http.Request {
+	clone := r.Clone(r.Context())
+	clone.Header.Del("Cookie")
+	for _, c := range r.Cookies() {
+		if c.Name == name {
+			c.Value = value
+		}
+		clone.AddCookie(c)
+	}
+	return clone
+}
+
+// withRawSessionID replaces a session cookie of the BoltDB session store in
+// the request with the session ID it holds.
+func withRawSessionID(r *http.Request, name string) *http.Request {
+	c, err := r.Cookie(name)
+	if err != nil || isRawSessionID(c.Value) {
+		return r
+	}
+	if id, ok := boltCookieSessionID(name, c.Value); ok {
+		return withSessionCookie(r, name, id)
+	}
+	return r
+}
@@ -0,0 +1,122 @@
+package sessions
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/require"
+	"github.com/yosssi/boltstore/shared"
+)
+
+func TestSessionMaintenance(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	boltPath := filepath.Join(dir, "data.db")
+	boltStore, err := newBoltDBSessionStore(boltPath, shared.DefaultBucketName, false)
+	require.NoError(t, err)
+	boltStates, err := newBoltDBSessionStore(boltPath, "oidc_state", true)
+	require.NoError(t, err)
+
+	db, err := sql.Open(sqlDialectSQLite, filepath.Join(dir, "sessions.db"))
+	require.NoError(t, err)
+	sqlStore, err := newSQLSessionStore(db, sqlDialectSQLite, sqlSessionsTable)
+	require.NoError(t, err)
+	defer sqlStore.Close()
+	sqlStates, err := newSQLSessionStore(db, sqlDialectSQLite, sqlStatesTable)
+	require.NoError(t, err)
+	defer sqlStates.Close()
+
+	saveSession := func(store Store, userID string, createdAt time.Time) string {
+		session := NewSession(store, UserSessionCookie)
+		session.Options.MaxAge = 3600
+		session.Values[UserSessionUserID] = userID
+		session.Values[UserSessionCreatedAt] = createdAt.Unix()
+		w := httptest.NewRecorder()
+		require.NoError(t, session.Save(httptest.NewRequest("GET", "/", nil), w))
+		sessionID, err := SessionIDFromResponse(w, UserSessionCookie)
+		require.NoError(t, err)
+		return sessionID
+	}
+
+	created := time.Now().Add(-time.Hour).Truncate(time.Second)
+	aliceID := saveSession(boltStore, "alice", created)
+	saveSession(boltStore, "alice", created.Add(time.Minute))
+	saveSession(boltStore, "bob", created.Add(2*time.Minute))
+	saveSession(boltStates, "", created)
+	require.NoError(t, boltStore.IndexSession(ctx, aliceID, time.Hour, SubjectIndexKey("alice-sub")))
+
+	stats, err := CollectSessionStats(ctx, boltStore, boltStates, nil)
+	require.NoError(t, err)
+	require.Equal(t, 3, stats.Sessions)
+	require.Equal(t, 1, stats.OIDCStates)
+	require.Equal(t, []UserCount{{"alice", 2}, {"bob", 1}}, stats.TopUsers(0))
+	require.Equal(t, created, stats.Oldest)
+	require.Equal(t, created.Add(2*time.Minute), stats.Newest)
+
+	// Sessions survive an export and an import, along with their index
+	var export bytes.Buffer
+	exported, err := ExportSessions(ctx, boltStore, boltStates, &export)
+	require.NoError(t, err)
+	require.Equal(t, 5, exported)
+	imported, err := ImportSessions(ctx, sqlStore, sqlStates, &export)
+	require.NoError(t, err)
+	require.Equal(t, 5, imported)
+
+	// The cookies of the BoltDB session store are valid after a migration
+	session, err := SessionFromID(aliceID, sqlStore)
+	require.NoError(t, err)
+	require.False(t, session.IsNew)
+	require.Equal(t, "alice", session.Values[UserSessionUserID])
+	ids, err := sqlStore.IndexedSessions(ctx, SubjectIndexKey("alice-sub"))
+	require.NoError(t, err)
+	require.Equal(t, []string{aliceID}, ids)
+	stats, err = CollectSessionStats(ctx, sqlStore, sqlStates, nil)
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{"alice": 2, "bob": 1}, stats.Users)
+
+	// And the other way around
+	sqlID := saveSession(sqlStore, "carol", created)
+	_, err = CopySessions(ctx, sqlStore, sqlStates, func(rec SessionRecord) error {
+		return ImportRecord(ctx, boltStore, boltStates, rec)
+	})
+	require.NoError(t, err)
+	session, err = SessionFromID(sqlID, boltStore)
+	require.NoError(t, err)
+	require.False(t, session.IsNew)
+	require.Equal(t, "carol", session.Values[UserSessionUserID])
+	ids, err = boltStore.IndexedSessions(ctx, UserIndexKey("carol"))
+	require.NoError(t, err)
+	require.Equal(t, []string{sqlID}, ids)
+
+	// Expired sessions are purged
+	require.NoError(t, boltStore.ImportSession(ctx, SessionRecord{
+		ID:        "expired",
+		ExpiresAt: time.Now().Add(-time.Minute),
+		Data:      []byte{},
+	}))
+	purged, err := boltStore.PurgeExpired(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, purged)
+
+	// Compaction keeps the sessions
+	require.NoError(t, boltStates.Close())
+	require.NoError(t, boltStore.Close())
+	_, _, err = CompactBoltDB(boltPath)
+	require.NoError(t, err)
+	boltStore, err = newBoltDBSessionStore(boltPath, shared.DefaultBucketName, false)
+	require.NoError(t, err)
+	defer boltStore.Close()
+	session, err = SessionFromID(aliceID, boltStore)
+	require.NoError(t, err)
+	require.Equal(t, "alice", session.Values[UserSessionUserID])
+	// And the index
+	ids, err = boltStore.IndexedSessions(ctx, UserIndexKey("carol"))
+	require.NoError(t, err)
+	require.Equal(t, []string{sqlID}, ids)
+}
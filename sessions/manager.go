@@ -4,6 +4,7 @@ import (
 	"context"
 	"net/http"
 	"net/url"
+	"sync"
 	"time"
 
 	"github.com/arrikto/oidc-authservice/common"
@@ -17,11 +18,68 @@ import (
 )
 
 type SessionManager struct {
+	// discovery is shared by the copies of the SessionManager, so that
+	// discovering the provider again reaches all of them.
+	discovery *discovery
+	// pkceMethod is the PKCE code_challenge_method used in the Authorization
+	// Code flow. PKCE is disabled if it is set to oidc.PKCEMethodNone.
+	pkceMethod string
+	// pkceRequired rejects Authorization Code flows that weren't started
+	// with a PKCE code_verifier.
+	pkceRequired bool
+}
+
+// discovery holds the provider that SessionManager discovered, along with
+// the endpoints that derive from its discovery document.
+type discovery struct {
+	// ctx is the context of the HTTP client that discovers the provider,
+	// which the provider also uses to fetch its keys.
+	ctx         context.Context
+	providerURL *url.URL
+	oidcAuthURL *url.URL
+
+	mu      sync.RWMutex
+	current *discoveredProvider
+}
+
+type discoveredProvider struct {
 	provider      *goidc.Provider
 	oauth2Config  *oauth2.Config
 	deviceAuthURL string
 }
 
+// set makes the given provider the current one, with the endpoints of its
+// discovery document.
+func (d *discovery) set(provider *goidc.Provider, oauth2Config oauth2.Config) {
+	endpoint := provider.Endpoint()
+	if len(d.oidcAuthURL.String()) > 0 {
+		endpoint.AuthURL = d.oidcAuthURL.String()
+	}
+	oauth2Config.Endpoint = endpoint
+
+	// Prefer the device_authorization_endpoint of the discovery document and
+	// fall back to the legacy, Dex-specific, device code URL.
+	deviceAuthURL, err := oidc.DeviceAuthorizationEndpoint(provider)
+	if err != nil {
+		logrus.Debugf("%v, using legacy device code URL", err)
+		deviceAuthURL = d.providerURL.String() + "/device/code"
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.current = &discoveredProvider{
+		provider:      provider,
+		oauth2Config:  &oauth2Config,
+		deviceAuthURL: deviceAuthURL,
+	}
+}
+
+func (d *discovery) get() *discoveredProvider {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.current
+}
+
 func makeProvider(ctx context.Context, providerURL *url.URL) *goidc.Provider {
 	for {
 		provider, err := goidc.NewProvider(ctx, providerURL.String())
@@ -38,47 +96,125 @@ func makeProvider(ctx context.Context, providerURL *url.URL) *goidc.Provider {
 func NewSessionManager(ctx context.Context,
 	clientID, clientSecret string,
 	providerURL, oidcAuthURL, redirectURL *url.URL,
-	scopes []string) SessionManager {
+	scopes []string, pkceMethod string, pkceRequired bool) SessionManager {
 
 	provider := makeProvider(ctx, providerURL)
 
-	endpoint := provider.Endpoint()
-	if len(oidcAuthURL.String()) > 0 {
-		endpoint.AuthURL = oidcAuthURL.String()
+	if pkceMethod != oidc.PKCEMethodNone {
+		checkPKCESupport(provider, pkceMethod, pkceRequired)
 	}
 
+	d := &discovery{ctx: ctx, providerURL: providerURL, oidcAuthURL: oidcAuthURL}
 	// Get OIDC Session Authenticator
-	oauth2Config := &oauth2.Config{
+	d.set(provider, oauth2.Config{
 		ClientID:     clientID,
 		ClientSecret: clientSecret,
-		Endpoint:     endpoint,
 		RedirectURL:  redirectURL.String(),
 		Scopes:       scopes,
-	}
+	})
 
 	return SessionManager{
-		provider:      provider,
-		oauth2Config:  oauth2Config,
-		deviceAuthURL: providerURL.String() + "/device/code",
+		discovery:    d,
+		pkceMethod:   pkceMethod,
+		pkceRequired: pkceRequired,
 	}
 }
 
-func (s *SessionManager) AuthCodeURL(state string) string {
-	return s.oauth2Config.AuthCodeURL(state)
+// provider returns the current provider.
+func (s *SessionManager) provider() *goidc.Provider {
+	return s.discovery.get().provider
+}
+
+// oauth2Config returns the OAuth2 configuration of the current provider.
+func (s *SessionManager) oauth2Config() *oauth2.Config {
+	return s.discovery.get().oauth2Config
+}
+
+// checkPKCESupport examines if the provider advertises support for the
+// configured PKCE method. If PKCE is required and the method isn't supported,
+// it terminates the execution with a fatal log message.
+func checkPKCESupport(provider *goidc.Provider, pkceMethod string, pkceRequired bool) {
+	methods, err := oidc.CodeChallengeMethodsSupported(provider)
+	if err != nil {
+		logrus.Warnf("Error getting provider's code_challenge_methods_supported: %v", err)
+	}
+	for _, m := range methods {
+		if m == pkceMethod {
+			return
+		}
+	}
+	if pkceRequired {
+		logrus.Fatalf("PKCE is required but the OIDC provider doesn't advertise "+
+			"support for the '%s' code_challenge_method", pkceMethod)
+	}
+	logrus.Warnf("OIDC provider doesn't advertise support for the '%s' "+
+		"code_challenge_method, PKCE parameters may be ignored", pkceMethod)
+}
+
+// AuthCodeURL returns the URL of the provider's authorization endpoint for
+// the given state ID. The nonce of the state is included, as well as the PKCE
+// code_challenge if the state has a code_verifier and the parameters of the
+// step-up requirements if the state has any.
+func (s *SessionManager) AuthCodeURL(stateID string, state *State) string {
+	var opts []oauth2.AuthCodeOption
+	if state.Nonce != "" {
+		opts = append(opts, oauth2.SetAuthURLParam("nonce", state.Nonce))
+	}
+	if state.PKCEVerifier != "" {
+		opts = append(opts, oidc.CodeChallengeOptions(state.PKCEVerifier, s.pkceMethod)...)
+	}
+	if state.StepUp.Required() {
+		for k, v := range state.StepUp.AuthParams() {
+			opts = append(opts, oauth2.SetAuthURLParam(k, v))
+		}
+	}
+	return s.oauth2Config().AuthCodeURL(stateID, opts...)
+}
+
+// NewCodeVerifier returns a new PKCE code_verifier for an Authorization Code
+// flow, or an empty string if PKCE is disabled.
+func (s *SessionManager) NewCodeVerifier() (string, error) {
+	if s.pkceMethod == oidc.PKCEMethodNone {
+		return "", nil
+	}
+	return oidc.NewCodeVerifier()
+}
+
+// PKCERequired indicates if Authorization Code flows must use PKCE.
+func (s *SessionManager) PKCERequired() bool {
+	return s.pkceRequired
 }
 
 func (s *SessionManager) DeviceAuthURL() string {
-	return s.deviceAuthURL
+	return s.discovery.get().deviceAuthURL
+}
+
+// StartDeviceFlow starts an OAuth 2.0 Device Authorization Grant flow at the
+// provider.
+func (s *SessionManager) StartDeviceFlow(ctx context.Context) (*oidc.DeviceAuthorization, error) {
+	return oidc.RequestDeviceAuthorization(ctx, s.discovery.get().deviceAuthURL, s.oauth2Config())
+}
+
+// PollDeviceToken polls the provider's token endpoint for the token of a
+// device flow.
+func (s *SessionManager) PollDeviceToken(ctx context.Context, deviceCode string) (*oauth2.Token, error) {
+	return oidc.PollDeviceToken(ctx, deviceCode, s.oauth2Config())
 }
 
 func (s *SessionManager) GetUserInfo(
 	ctx context.Context, token *oauth2.Token) (*oidc.UserInfo, error) {
-	return oidc.GetUserInfo(ctx, s.provider, token)
+	return oidc.GetUserInfo(ctx, s.provider(), token)
 }
 
+// ExchangeCode exchanges the authorization code for a token. The PKCE
+// code_verifier is sent along, if the flow was started with one.
 func (s *SessionManager) ExchangeCode(
-	ctx context.Context, authCode string) (*oauth2.Token, error) {
-	return s.oauth2Config.Exchange(ctx, authCode)
+	ctx context.Context, authCode, codeVerifier string) (*oauth2.Token, error) {
+	var opts []oauth2.AuthCodeOption
+	if codeVerifier != "" {
+		opts = append(opts, oidc.CodeVerifierOption(codeVerifier))
+	}
+	return s.oauth2Config().Exchange(ctx, authCode, opts...)
 }
 
 func (s *SessionManager) RevokeSession(
@@ -87,23 +223,102 @@ func (s *SessionManager) RevokeSession(
 	return s.RevokeOIDCSession(ctx, w, session, tlsCfg, sessionDomain)
 }
 
+// EndSessionURL returns the URL of the provider's end_session_endpoint, which
+// logs the user out of the provider and then redirects them to the given
+// postLogoutRedirectURI.
+func (s *SessionManager) EndSessionURL(idToken, postLogoutRedirectURI string) (string, error) {
+	endSessionEndpoint, err := oidc.EndSessionEndpoint(s.provider())
+	if err != nil {
+		return "", err
+	}
+	return oidc.EndSessionURL(endSessionEndpoint, idToken,
+		s.oauth2Config().ClientID, postLogoutRedirectURI)
+}
+
+// Issuer returns the issuer of the provider, as found in the discovery
+// document.
+func (s *SessionManager) Issuer() string {
+	claims := struct {
+		Issuer string `json:"issuer"`
+	}{}
+	if err := s.provider().Claims(&claims); err != nil {
+		return ""
+	}
+	return claims.Issuer
+}
+
+// CheckDiscovery examines if the discovery document of the provider is still
+// available. If the document has changed, it discovers the provider again.
+func (s *SessionManager) CheckDiscovery(ctx context.Context) error {
+	err := oidc.CheckDiscovery(ctx, s.provider())
+	if errors.Is(err, oidc.ErrDiscoveryChanged) {
+		logrus.Infof("Discovery document of %s has changed, discovering the provider again",
+			s.discovery.providerURL)
+		return s.RefreshDiscovery()
+	}
+	return err
+}
+
+// RefreshDiscovery discovers the provider again and replaces the one that
+// the SessionManager and its copies use.
+func (s *SessionManager) RefreshDiscovery() error {
+	provider, err := goidc.NewProvider(s.discovery.ctx, s.discovery.providerURL.String())
+	if err != nil {
+		return errors.Wrap(err, "failed to discover the OIDC provider")
+	}
+	s.discovery.set(provider, *s.oauth2Config())
+	return nil
+}
+
+// CheckJWKS examines if the JWKS of the provider is available.
+func (s *SessionManager) CheckJWKS(ctx context.Context) error {
+	return oidc.CheckJWKS(ctx, s.provider())
+}
+
+// IntrospectionEndpoint returns the provider's introspection_endpoint.
+func (s *SessionManager) IntrospectionEndpoint() (string, error) {
+	return oidc.IntrospectionEndpoint(s.provider())
+}
+
+// IntrospectToken asks the provider's introspection_endpoint about the given
+// access token.
+func (s *SessionManager) IntrospectToken(ctx context.Context,
+	token string) (*oidc.Introspection, error) {
+	endpoint, err := s.IntrospectionEndpoint()
+	if err != nil {
+		return nil, err
+	}
+	return oidc.IntrospectToken(ctx, endpoint, token, s.oauth2Config())
+}
+
 func (s *SessionManager) Verify(ctx context.Context, idToken, clientID string) (*goidc.IDToken, error) {
 	if clientID == "" {
-		clientID = s.oauth2Config.ClientID
+		clientID = s.oauth2Config().ClientID
 	}
-	verifier := s.provider.Verifier(&goidc.Config{ClientID: clientID})
+	verifier := s.provider().Verifier(&goidc.Config{ClientID: clientID})
 	return verifier.Verify(ctx, idToken)
 }
 
+// VerifyLogoutToken verifies an OIDC Back-Channel Logout Token with the
+// provider's keys and returns the sessions it refers to.
+func (s *SessionManager) VerifyLogoutToken(ctx context.Context,
+	logoutToken string) (*oidc.LogoutToken, error) {
+	token, err := s.Verify(ctx, logoutToken, "")
+	if err != nil {
+		return nil, err
+	}
+	return oidc.ParseLogoutToken(token)
+}
+
 func (s *SessionManager) VerifyWithClientId(ctx context.Context,
 	clientId string, idToken string) (*goidc.IDToken, error) {
-	verifier := s.provider.Verifier(&goidc.Config{ClientID: clientId})
+	verifier := s.provider().Verifier(&goidc.Config{ClientID: clientId})
 	return verifier.Verify(ctx, idToken)
 }
 
 func (s *SessionManager) VerifyWithoutClientId(ctx context.Context,
 	idToken string) (*goidc.IDToken, error) {
-	verifier := s.provider.Verifier(&goidc.Config{SkipClientIDCheck: true})
+	verifier := s.provider().Verifier(&goidc.Config{SkipClientIDCheck: true})
 	return verifier.Verify(ctx, idToken)
 }
 
@@ -112,7 +327,7 @@ func (s *SessionManager) VerifyWithoutClientId(ctx context.Context,
 func (s *SessionManager) TokenSource(ctx context.Context,
 	token *oauth2.Token) (*oauth2.Token, bool, error) {
 
-	tokenSource := s.oauth2Config.TokenSource(ctx, token)
+	tokenSource := s.oauth2Config().TokenSource(ctx, token)
 
 	newToken, err := tokenSource.Token()
 	if err != nil {
@@ -157,21 +372,30 @@ func (s *SessionManager) SaveToken(session *sessions.Session, ctx context.Contex
 func (s *SessionManager) RevokeOIDCSession(ctx context.Context, w http.ResponseWriter,
 	session *sessions.Session, tlsCfg common.TlsConfig, sessionDomain string) error {
 
+	if err := s.RevokeOIDCTokens(ctx, session, tlsCfg); err != nil {
+		return err
+	}
+	return revokeSession(ctx, w, session, sessionDomain)
+}
+
+// RevokeOIDCTokens revokes the OAuth tokens of the given session at the
+// provider's revocation_endpoint, if the provider has one.
+func (s *SessionManager) RevokeOIDCTokens(ctx context.Context, session *sessions.Session,
+	tlsCfg common.TlsConfig) error {
+
 	logger := common.StandardLogger()
 
-	// Revoke the session's OAuth tokens
-	_revocationEndpoint, err := oidc.RevocationEndpoint(s.provider)
+	_revocationEndpoint, err := oidc.RevocationEndpoint(s.provider())
 	if err != nil {
 		logger.Warnf("Error getting provider's revocation_endpoint: %v", err)
-	} else {
-		token := session.Values[UserSessionOAuth2Tokens].(oauth2.Token)
-		err := oidc.RevokeTokens(tlsCfg.Context(ctx),
-			_revocationEndpoint, &token, s.oauth2Config.ClientID, s.oauth2Config.ClientSecret)
-		if err != nil {
-			return errors.Wrap(err, "Error revoking tokens")
-		}
-		logger.WithField("userid", session.Values[UserSessionUserID].(string)).Info("Access/Refresh tokens revoked")
+		return nil
 	}
-
-	return revokeSession(ctx, w, session, sessionDomain)
+	token := session.Values[UserSessionOAuth2Tokens].(oauth2.Token)
+	err = oidc.RevokeTokens(tlsCfg.Context(ctx),
+		_revocationEndpoint, &token, s.oauth2Config().ClientID, s.oauth2Config().ClientSecret)
+	if err != nil {
+		return errors.Wrap(err, "Error revoking tokens")
+	}
+	logger.WithField("userid", session.Values[UserSessionUserID].(string)).Info("Access/Refresh tokens revoked")
+	return nil
 }
@@ -0,0 +1,57 @@
+package sessions
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/arrikto/oidc-authservice/oidc"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionManagerCheckDiscovery(t *testing.T) {
+	var srvURL string
+	tokenPath := "/token"
+	keys := `{"keys": [{"kty": "RSA", "kid": "1", "n": "AQAB", "e": "AQAB"}]}`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{
+				"issuer":                 srvURL,
+				"authorization_endpoint": srvURL + "/auth",
+				"token_endpoint":         srvURL + tokenPath,
+				"jwks_uri":               srvURL + "/keys",
+			})
+		case "/keys":
+			w.Write([]byte(keys))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	srvURL = srv.URL
+	providerURL, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	sm := NewSessionManager(ctx, "client", "secret", providerURL, &url.URL{}, &url.URL{},
+		[]string{"openid"}, oidc.PKCEMethodNone, false)
+	copied := sm
+	require.NoError(t, sm.CheckDiscovery(ctx))
+	require.NoError(t, sm.CheckJWKS(ctx))
+
+	// The provider is discovered again once its document changes, for all
+	// the copies of the SessionManager
+	tokenPath = "/v2/token"
+	require.NoError(t, sm.CheckDiscovery(ctx))
+	require.Equal(t, srv.URL+"/v2/token", copied.oauth2Config().Endpoint.TokenURL)
+	require.Equal(t, []string{"openid"}, copied.oauth2Config().Scopes)
+	require.NoError(t, copied.CheckDiscovery(ctx))
+
+	srv.Close()
+	require.Error(t, sm.CheckDiscovery(ctx))
+}
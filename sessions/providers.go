@@ -0,0 +1,214 @@
+package sessions
+
+import (
+	"context"
+	"io/ioutil"
+	"net/url"
+	"strings"
+
+	"github.com/arrikto/oidc-authservice/common"
+	"github.com/gorilla/sessions"
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// DefaultProviderName is the name of the provider configured with the
+// OIDC_PROVIDER and CLIENT_ID settings.
+const DefaultProviderName = "default"
+
+// ProvidersConfig is the schema of the file with the additional OIDC
+// providers.
+type ProvidersConfig struct {
+	Providers []ProviderConfig `yaml:"providers"`
+}
+
+// ProviderConfig describes an OIDC provider and the client that AuthService
+// uses for it.
+type ProviderConfig struct {
+	// Name identifies the provider. It is stored in the sessions, so it
+	// must not change.
+	Name string `yaml:"name"`
+	// DisplayName is shown in the login selection page. Defaults to Name.
+	DisplayName string `yaml:"displayName"`
+	// Issuer is the URL of the provider, used for OIDC discovery.
+	Issuer string `yaml:"issuer"`
+	// AuthURL overrides the discovered authorization endpoint.
+	AuthURL          string   `yaml:"authURL"`
+	ClientID         string   `yaml:"clientID"`
+	ClientSecret     string   `yaml:"clientSecret"`
+	ClientSecretFile string   `yaml:"clientSecretFile"`
+	Scopes           []string `yaml:"scopes"`
+	UserIDClaim      string   `yaml:"userIDClaim"`
+	GroupsClaim      string   `yaml:"groupsClaim"`
+	// Hosts are the hosts whose users log in with this provider. A host
+	// may be a glob pattern, e.g., "*.example.com" matches all the
+	// subdomains of example.com.
+	Hosts []string `yaml:"hosts"`
+}
+
+// Provider is a configured OIDC provider along with its SessionManager.
+type Provider struct {
+	Name        string
+	DisplayName string
+	UserIDClaim string
+	GroupsClaim string
+	Hosts       []string
+
+	SessionManager *SessionManager
+}
+
+// Providers holds the configured OIDC providers. The default provider is
+// always first.
+type Providers struct {
+	providers []*Provider
+	byName    map[string]*Provider
+}
+
+// NewProviders returns the set of the given providers. The first one is the
+// default provider.
+func NewProviders(defaultProvider *Provider, providers ...*Provider) (*Providers, error) {
+	p := &Providers{byName: map[string]*Provider{}}
+	for _, provider := range append([]*Provider{defaultProvider}, providers...) {
+		if _, ok := p.byName[provider.Name]; ok {
+			return nil, errors.Errorf("duplicate OIDC provider name '%s'", provider.Name)
+		}
+		if provider.DisplayName == "" {
+			provider.DisplayName = provider.Name
+		}
+		p.providers = append(p.providers, provider)
+		p.byName[provider.Name] = provider
+	}
+	return p, nil
+}
+
+// LoadProvidersConfig reads and validates the file with the additional OIDC
+// providers.
+func LoadProvidersConfig(configPath string) (*ProvidersConfig, error) {
+	raw, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read OIDC providers file")
+	}
+	var c ProvidersConfig
+	if err := yaml.Unmarshal(raw, &c); err != nil {
+		return nil, errors.Wrap(err, "failed to parse OIDC providers file")
+	}
+	for i := range c.Providers {
+		pc := &c.Providers[i]
+		if pc.Name == "" {
+			return nil, errors.Errorf("provider %d: 'name' field is missing", i)
+		}
+		if pc.Name == DefaultProviderName {
+			return nil, errors.Errorf("provider %d: name '%s' is reserved", i, DefaultProviderName)
+		}
+		if pc.Issuer == "" || pc.ClientID == "" {
+			return nil, errors.Errorf("provider %s: 'issuer' and 'clientID' fields are required", pc.Name)
+		}
+		if pc.ClientSecretFile != "" {
+			secret, err := ioutil.ReadFile(pc.ClientSecretFile)
+			if err != nil {
+				return nil, errors.Wrapf(err, "provider %s: failed to read client secret", pc.Name)
+			}
+			pc.ClientSecret = strings.TrimSpace(string(secret))
+		}
+	}
+	return &c, nil
+}
+
+// NewProvider discovers the OIDC provider of the given configuration and
+// returns it along with its SessionManager. Settings that the configuration
+// doesn't specify, e.g., the scopes, are taken from the default provider.
+func NewProvider(ctx context.Context, pc ProviderConfig, defaultProvider *Provider,
+	redirectURL *url.URL, pkceMethod string, pkceRequired bool) (*Provider, error) {
+
+	issuer, err := url.Parse(pc.Issuer)
+	if err != nil {
+		return nil, errors.Wrapf(err, "provider %s: invalid issuer", pc.Name)
+	}
+	authURL, err := url.Parse(pc.AuthURL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "provider %s: invalid authURL", pc.Name)
+	}
+	scopes := pc.Scopes
+	if len(scopes) == 0 {
+		scopes = defaultProvider.SessionManager.oauth2Config().Scopes
+	}
+	userIDClaim := pc.UserIDClaim
+	if userIDClaim == "" {
+		userIDClaim = defaultProvider.UserIDClaim
+	}
+	groupsClaim := pc.GroupsClaim
+	if groupsClaim == "" {
+		groupsClaim = defaultProvider.GroupsClaim
+	}
+	for _, path := range []string{userIDClaim, groupsClaim} {
+		if _, err := common.ParseClaimPath(path); err != nil {
+			return nil, errors.Wrapf(err, "provider %s", pc.Name)
+		}
+	}
+
+	sm := NewSessionManager(ctx, pc.ClientID, pc.ClientSecret, issuer, authURL,
+		redirectURL, scopes, pkceMethod, pkceRequired)
+	return &Provider{
+		Name:           pc.Name,
+		DisplayName:    pc.DisplayName,
+		UserIDClaim:    userIDClaim,
+		GroupsClaim:    groupsClaim,
+		Hosts:          pc.Hosts,
+		SessionManager: &sm,
+	}, nil
+}
+
+// Default returns the default provider.
+func (p *Providers) Default() *Provider {
+	return p.providers[0]
+}
+
+// List returns all the providers, starting with the default one.
+func (p *Providers) List() []*Provider {
+	return p.providers
+}
+
+// Get returns the provider with the given name.
+func (p *Providers) Get(name string) (*Provider, bool) {
+	provider, ok := p.byName[name]
+	return provider, ok
+}
+
+// ForHost returns the provider whose host rules match the given host.
+func (p *Providers) ForHost(host string) (*Provider, bool) {
+	for _, provider := range p.providers {
+		if common.MatchHost(provider.Hosts, host) {
+			return provider, true
+		}
+	}
+	return nil, false
+}
+
+// ForIssuer returns the provider with the given issuer.
+func (p *Providers) ForIssuer(issuer string) (*Provider, bool) {
+	for _, provider := range p.providers {
+		if provider.SessionManager.Issuer() == issuer {
+			return provider, true
+		}
+	}
+	return nil, false
+}
+
+// ForSession returns the provider that the user of the given session logged
+// in with. Sessions created before multiple providers were supported belong
+// to the default provider.
+func (p *Providers) ForSession(session *sessions.Session) *Provider {
+	name, _ := session.Values[UserSessionProvider].(string)
+	if provider, ok := p.byName[name]; ok {
+		return provider
+	}
+	return p.Default()
+}
+
+// ForState returns the provider that the given login flow was started with.
+func (p *Providers) ForState(state *State) (*Provider, bool) {
+	if state.Provider == "" {
+		return p.Default(), true
+	}
+	return p.Get(state.Provider)
+}
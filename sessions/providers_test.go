@@ -0,0 +1,140 @@
+package sessions
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/sessions"
+	"github.com/stretchr/testify/require"
+)
+
+func testProviders(t *testing.T) *Providers {
+	providers, err := NewProviders(
+		&Provider{Name: DefaultProviderName, Hosts: []string{"app.example.com"}},
+		&Provider{Name: "corp", DisplayName: "Corporate", Hosts: []string{"*.corp.example.com"}},
+		&Provider{Name: "partners"},
+	)
+	require.NoError(t, err)
+	return providers
+}
+
+func TestProvidersForHost(t *testing.T) {
+	providers := testProviders(t)
+
+	tests := []struct {
+		host     string
+		provider string
+	}{
+		{host: "app.example.com", provider: DefaultProviderName},
+		{host: "APP.example.com:8080", provider: DefaultProviderName},
+		{host: "ml.corp.example.com", provider: "corp"},
+		{host: "corp.example.com", provider: ""},
+		{host: "other.example.com", provider: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.host, func(t *testing.T) {
+			provider, ok := providers.ForHost(test.host)
+			if test.provider == "" {
+				require.False(t, ok)
+				return
+			}
+			require.True(t, ok)
+			require.Equal(t, test.provider, provider.Name)
+		})
+	}
+}
+
+func TestProvidersForSessionAndState(t *testing.T) {
+	providers := testProviders(t)
+
+	session := sessions.NewSession(nil, "session")
+	require.Equal(t, DefaultProviderName, providers.ForSession(session).Name)
+	session.Values[UserSessionProvider] = "corp"
+	require.Equal(t, "corp", providers.ForSession(session).Name)
+	// Sessions of removed providers fall back to the default one
+	session.Values[UserSessionProvider] = "removed"
+	require.Equal(t, DefaultProviderName, providers.ForSession(session).Name)
+
+	provider, ok := providers.ForState(&State{})
+	require.True(t, ok)
+	require.Equal(t, DefaultProviderName, provider.Name)
+	provider, ok = providers.ForState(&State{Provider: "partners"})
+	require.True(t, ok)
+	require.Equal(t, "partners", provider.Name)
+	require.Equal(t, "partners", provider.DisplayName)
+	_, ok = providers.ForState(&State{Provider: "removed"})
+	require.False(t, ok)
+}
+
+func TestNewProvidersDuplicateName(t *testing.T) {
+	_, err := NewProviders(&Provider{Name: DefaultProviderName}, &Provider{Name: DefaultProviderName})
+	require.Error(t, err)
+}
+
+func TestLoadProvidersConfig(t *testing.T) {
+	dir := t.TempDir()
+	secretPath := filepath.Join(dir, "secret")
+	require.NoError(t, ioutil.WriteFile(secretPath, []byte("s3cr3t\n"), 0600))
+
+	tests := []struct {
+		testName string
+		config   string
+		success  bool
+	}{
+		{
+			testName: "valid",
+			config: `
+providers:
+- name: corp
+  issuer: https://corp.example.com
+  clientID: authservice
+  clientSecretFile: ` + secretPath + `
+  hosts: ["*.corp.example.com"]
+`,
+			success: true,
+		},
+		{
+			testName: "missing name",
+			config: `
+providers:
+- issuer: https://corp.example.com
+  clientID: authservice
+`,
+			success: false,
+		},
+		{
+			testName: "reserved name",
+			config: `
+providers:
+- name: default
+  issuer: https://corp.example.com
+  clientID: authservice
+`,
+			success: false,
+		},
+		{
+			testName: "missing issuer",
+			config: `
+providers:
+- name: corp
+  clientID: authservice
+`,
+			success: false,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			path := filepath.Join(dir, "providers.yaml")
+			require.NoError(t, ioutil.WriteFile(path, []byte(test.config), 0600))
+			c, err := LoadProvidersConfig(path)
+			if !test.success {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, c.Providers, 1)
+			require.Equal(t, "s3cr3t", c.Providers[0].ClientSecret)
+		})
+	}
+}
@@ -2,21 +2,107 @@ package sessions
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/arrikto/oidc-authservice/common"
 	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/sessions"
+	"github.com/pkg/errors"
 	"github.com/rbcervilla/redisstore/v8"
 )
 
+const (
+	// redisDefaultKeyPrefix is the key prefix that redisstore uses by default.
+	redisDefaultKeyPrefix = "session:"
+	redisIndexKeyPrefix   = "index:"
+)
 
-func newRedisSessionStore(addr, password, keyPrefix string, db int) (*redisstore.RedisStore, error) {
-	log := common.StandardLogger()
+type redisSessionStore struct {
+	*redisstore.RedisStore
+	// client is the underlying Redis client.
+	client redis.UniversalClient
+	// keyPrefix is the key prefix of the sessions.
+	keyPrefix string
+	// indexPrefix is the key prefix of the SessionIndex entries.
+	indexPrefix string
+}
 
-	client := redis.NewClient(&redis.Options{
-		Addr: addr,
-		Password: password,
-		DB: db,
-	})
+// redisOptions returns the options of the Redis clients of the session stores,
+// as configured. The addresses are the ones of the Redis server, the sentinels
+// or the cluster nodes, depending on the type of the session store.
+func redisOptions(c *common.Config) (*redis.UniversalOptions, error) {
+	opts := &redis.UniversalOptions{
+		Addrs:            c.SessionStoreRedisAddr,
+		DB:               c.SessionStoreRedisDB,
+		Username:         c.SessionStoreRedisUsername,
+		Password:         c.SessionStoreRedisPWD,
+		MasterName:       c.SessionStoreRedisMasterName,
+		SentinelUsername: c.SessionStoreRedisSentinelUsername,
+		SentinelPassword: c.SessionStoreRedisSentinelPWD,
+		PoolSize:         c.SessionStoreRedisPoolSize,
+		DialTimeout:      c.SessionStoreRedisDialTimeout,
+		ReadTimeout:      c.SessionStoreRedisReadTimeout,
+		WriteTimeout:     c.SessionStoreRedisWriteTimeout,
+	}
+	if !c.SessionStoreRedisTLSEnabled {
+		return opts, nil
+	}
+
+	opts.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.SessionStoreRedisTLSCAPath != "" {
+		caBundle, err := ioutil.ReadFile(c.SessionStoreRedisTLSCAPath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not read Redis CA bundle %s", c.SessionStoreRedisTLSCAPath)
+		}
+		rootCAs, err := x509.SystemCertPool()
+		if err != nil {
+			rootCAs = x509.NewCertPool()
+		}
+		if !rootCAs.AppendCertsFromPEM(caBundle) {
+			return nil, errors.Errorf("no certificates found in Redis CA bundle %s", c.SessionStoreRedisTLSCAPath)
+		}
+		opts.TLSConfig.RootCAs = rootCAs
+	}
+	if c.SessionStoreRedisTLSCertPath != "" {
+		cert, err := tls.LoadX509KeyPair(c.SessionStoreRedisTLSCertPath, c.SessionStoreRedisTLSKeyPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not load Redis client certificate")
+		}
+		opts.TLSConfig.Certificates = []tls.Certificate{cert}
+	}
+	return opts, nil
+}
+
+// newRedisStoreOfType returns a Redis session store of the given type, i.e.,
+// redis, redisfailover or rediscluster.
+func newRedisStoreOfType(storeType string, opts *redis.UniversalOptions, keyPrefix string) (*redisSessionStore, error) {
+	switch storeType {
+	case "redisfailover":
+		return newRedisFailoverSessionStore(opts, keyPrefix)
+	case "rediscluster":
+		return newRedisClusterSessionStore(opts, keyPrefix)
+	default:
+		return newRedisSessionStore(opts, keyPrefix)
+	}
+}
+
+func newRedisSessionStore(opts *redis.UniversalOptions, keyPrefix string) (*redisSessionStore, error) {
+	client := redis.NewClient(opts.Simple())
+
+	return newRedisSessionStoreFromClient(client, keyPrefix)
+}
+
+// newRedisSessionStoreFromClient returns a session store backed by the given
+// Redis client. Sessions are stored under the given key prefix.
+func newRedisSessionStoreFromClient(client redis.UniversalClient, keyPrefix string) (*redisSessionStore, error) {
+	log := common.StandardLogger()
 
 	store, err := redisstore.NewRedisStore(context.Background(), client)
 	if err != nil {
@@ -24,6 +110,159 @@ func newRedisSessionStore(addr, password, keyPrefix string, db int) (*redisstore
 	}
 	if keyPrefix != "" {
 		store.KeyPrefix(keyPrefix)
+	} else {
+		keyPrefix = redisDefaultKeyPrefix
+	}
+	return &redisSessionStore{
+		RedisStore:  store,
+		client:      client,
+		keyPrefix:   keyPrefix,
+		indexPrefix: keyPrefix + redisIndexKeyPrefix,
+	}, nil
+}
+
+func (rs *redisSessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(rs, name)
+}
+
+// New loads the session of the request. Cookies of the BoltDB session store
+// are accepted, so that sessions migrated from it stay valid.
+func (rs *redisSessionStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	return rs.RedisStore.New(withRawSessionID(r, name), name)
+}
+
+func (rs *redisSessionStore) Ping(ctx context.Context) error {
+	return rs.client.Ping(ctx).Err()
+}
+
+// Each index key is stored as a sorted set, whose members are the session IDs
+// and their scores are the expiration times of the sessions.
+
+func (rs *redisSessionStore) IndexSession(ctx context.Context, sessionID string,
+	maxAge time.Duration, keys ...string) error {
+
+	expiresAt := time.Now().Add(maxAge).Unix()
+	_, err := rs.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, key := range keys {
+			indexKey := rs.indexPrefix + key
+			pipe.ZAdd(ctx, indexKey, &redis.Z{Score: float64(expiresAt), Member: sessionID})
+			pipe.ZRemRangeByScore(ctx, indexKey, "-inf", strconv.FormatInt(time.Now().Unix(), 10))
+			// The newest session is the last one to expire.
+			pipe.Expire(ctx, indexKey, maxAge)
+		}
+		return nil
+	})
+	return err
+}
+
+func (rs *redisSessionStore) IndexedSessions(ctx context.Context, key string) ([]string, error) {
+	return rs.client.ZRangeByScore(ctx, rs.indexPrefix+key, &redis.ZRangeBy{
+		Min: "(" + strconv.FormatInt(time.Now().Unix(), 10),
+		Max: "+inf",
+	}).Result()
+}
+
+func (rs *redisSessionStore) UnindexSession(ctx context.Context, sessionID string, keys ...string) error {
+	_, err := rs.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, key := range keys {
+			pipe.ZRem(ctx, rs.indexPrefix+key, sessionID)
+		}
+		return nil
+	})
+	return err
+}
+
+// scan calls fn with each key that matches the pattern, on all the masters of
+// a cluster.
+func (rs *redisSessionStore) scan(ctx context.Context, match string, fn func(key string) error) error {
+	var mu sync.Mutex
+	scanNode := func(ctx context.Context, client redis.UniversalClient) error {
+		iter := client.Scan(ctx, 0, match, 100).Iterator()
+		for iter.Next(ctx) {
+			mu.Lock()
+			err := fn(iter.Val())
+			mu.Unlock()
+			if err != nil {
+				return err
+			}
+		}
+		return iter.Err()
+	}
+	if cluster, ok := rs.client.(*redis.ClusterClient); ok {
+		return cluster.ForEachMaster(ctx, func(ctx context.Context, client *redis.Client) error {
+			return scanNode(ctx, client)
+		})
 	}
-	return store, nil
+	return scanNode(ctx, rs.client)
+}
+
+func (rs *redisSessionStore) ForEachSession(ctx context.Context, fn func(SessionRecord) error) error {
+	return rs.scan(ctx, rs.keyPrefix+"*", func(key string) error {
+		if strings.HasPrefix(key, rs.indexPrefix) {
+			return nil
+		}
+		data, err := rs.client.Get(ctx, key).Bytes()
+		if err == redis.Nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		ttl, err := rs.client.PTTL(ctx, key).Result()
+		if err != nil {
+			return err
+		}
+		if ttl <= 0 {
+			return nil
+		}
+		return fn(SessionRecord{
+			ID:        strings.TrimPrefix(key, rs.keyPrefix),
+			ExpiresAt: time.Now().Add(ttl),
+			Data:      data,
+		})
+	})
+}
+
+func (rs *redisSessionStore) ForEachIndexEntry(ctx context.Context, fn func(SessionRecord) error) error {
+	return rs.scan(ctx, rs.indexPrefix+"*", func(key string) error {
+		entries, err := rs.client.ZRangeByScoreWithScores(ctx, key, &redis.ZRangeBy{
+			Min: "(" + strconv.FormatInt(time.Now().Unix(), 10),
+			Max: "+inf",
+		}).Result()
+		if err != nil {
+			return err
+		}
+		for _, z := range entries {
+			rec := SessionRecord{
+				ID:        z.Member.(string),
+				Key:       strings.TrimPrefix(key, rs.indexPrefix),
+				ExpiresAt: time.Unix(int64(z.Score), 0),
+			}
+			if err := fn(rec); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (rs *redisSessionStore) ImportSession(ctx context.Context, rec SessionRecord) error {
+	ttl := time.Until(rec.ExpiresAt)
+	if ttl <= 0 {
+		return nil
+	}
+	return rs.client.Set(ctx, rs.keyPrefix+rec.ID, rec.Data, ttl).Err()
+}
+
+// PurgeExpired removes the expired sessions from the index. Redis expires the
+// sessions themselves.
+func (rs *redisSessionStore) PurgeExpired(ctx context.Context) (int, error) {
+	purged := 0
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	err := rs.scan(ctx, rs.indexPrefix+"*", func(key string) error {
+		removed, err := rs.client.ZRemRangeByScore(ctx, key, "-inf", now).Result()
+		purged += int(removed)
+		return err
+	})
+	return purged, err
 }
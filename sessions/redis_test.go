@@ -0,0 +1,88 @@
+package sessions
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/arrikto/oidc-authservice/common"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestKeyPair writes a self-signed certificate and its key to PEM files
+// and returns their paths.
+func writeTestKeyPair(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "authservice"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "tls.crt")
+	keyPath := filepath.Join(dir, "tls.key")
+	require.NoError(t, ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certPath, keyPath
+}
+
+func TestRedisOptions(t *testing.T) {
+	c := &common.Config{
+		SessionStoreRedisAddr:             []string{"sentinel-0:26379", "sentinel-1:26379"},
+		SessionStoreRedisUsername:         "authservice",
+		SessionStoreRedisPWD:              "password",
+		SessionStoreRedisMasterName:       "sessions",
+		SessionStoreRedisSentinelUsername: "sentinel",
+		SessionStoreRedisSentinelPWD:      "sentinel-password",
+		SessionStoreRedisPoolSize:         10,
+		SessionStoreRedisDialTimeout:      time.Second,
+	}
+	opts, err := redisOptions(c)
+	require.NoError(t, err)
+	require.Nil(t, opts.TLSConfig)
+
+	failover := opts.Failover()
+	require.Equal(t, "sessions", failover.MasterName)
+	require.Equal(t, c.SessionStoreRedisAddr, failover.SentinelAddrs)
+	require.Equal(t, "authservice", failover.Username)
+	require.Equal(t, "sentinel", failover.SentinelUsername)
+	require.Equal(t, 10, failover.PoolSize)
+	require.Equal(t, time.Second, failover.DialTimeout)
+
+	// TLS with a custom CA and a client certificate
+	certPath, keyPath := writeTestKeyPair(t)
+	c.SessionStoreRedisTLSEnabled = true
+	c.SessionStoreRedisTLSCAPath = certPath
+	c.SessionStoreRedisTLSCertPath = certPath
+	c.SessionStoreRedisTLSKeyPath = keyPath
+	opts, err = redisOptions(c)
+	require.NoError(t, err)
+	require.NotNil(t, opts.TLSConfig.RootCAs)
+	require.Len(t, opts.TLSConfig.Certificates, 1)
+	require.Equal(t, opts.TLSConfig, opts.Cluster().TLSConfig)
+
+	// Invalid CA bundles are rejected
+	c.SessionStoreRedisTLSCAPath = keyPath
+	_, err = redisOptions(c)
+	require.Error(t, err)
+	c.SessionStoreRedisTLSCAPath = filepath.Join(t.TempDir(), "missing.crt")
+	_, err = redisOptions(c)
+	require.Error(t, err)
+}
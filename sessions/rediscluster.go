@@ -0,0 +1,13 @@
+package sessions
+
+import (
+	"github.com/go-redis/redis/v8"
+)
+
+// newRedisClusterSessionStore returns a session store backed by a Redis
+// Cluster, which it discovers through the given nodes.
+func newRedisClusterSessionStore(opts *redis.UniversalOptions, keyPrefix string) (*redisSessionStore, error) {
+	client := redis.NewClusterClient(opts.Cluster())
+
+	return newRedisSessionStoreFromClient(client, keyPrefix)
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"sync"
 
 	"github.com/arrikto/oidc-authservice/common"
@@ -23,6 +24,7 @@ const (
 	UserSessionClaims       = "claims"
 	UserSessionIDToken      = "idtoken"
 	UserSessionOAuth2Tokens = "oauth2tokens"
+	UserSessionProvider     = "provider"
 )
 
 const (
@@ -137,19 +139,33 @@ func revokeSession(ctx context.Context, w http.ResponseWriter,
 	return nil
 }
 
+// DeleteSession deletes the given session from its store, e.g., when an
+// administrator revokes it.
+func DeleteSession(ctx context.Context, session *sessions.Session) error {
+	return revokeSession(ctx, httptest.NewRecorder(), session, "")
+}
+
 var mutex sync.Mutex
 
 // InitiateSessionStores initiates both the required stores for the:
 // * users sessions
 // * OIDC states
-// Based on the configured session store (boltdb, or redis) this function will
+// Based on the configured session store (boltdb, redis, sql or cookie) this function will
 // return these two session stores, or will terminate the execution with a fatal
 // log message.
-func InitiateSessionStores(c *common.Config) (ClosableStore, ClosableStore) {
+func InitiateSessionStores(c *common.Config) (IndexedStore, ClosableStore) {
 	logger := common.StandardLogger()
 
-	var store, oidcStateStore ClosableStore
+	var store IndexedStore
+	var oidcStateStore ClosableStore
 	var err error
+	var keys *SessionKeys
+	if len(c.SessionEncryptionKeyPaths) > 0 {
+		keys, err = LoadSessionKeys(c.SessionEncryptionKeyPaths)
+		if err != nil {
+			logger.Fatalf("Error loading session encryption keys: %v", err)
+		}
+	}
 	switch c.SessionStoreType {
 	case "boltdb":
 		// Setup session store
@@ -162,31 +178,64 @@ func InitiateSessionStores(c *common.Config) (ClosableStore, ClosableStore) {
 		if err != nil {
 			logger.Fatalf("Error creating oidc state store: %v", err)
 		}
-	case "redis":
+	case "redis", "redisfailover", "rediscluster":
+		redisOpts, err := redisOptions(c)
+		if err != nil {
+			logger.Fatalf("Error configuring redis client: %v", err)
+		}
 		// Setup session store
-		store, err = newRedisSessionStore(c.SessionStoreRedisAddr, c.SessionStoreRedisPWD, "", c.SessionStoreRedisDB)
+		store, err = newRedisStoreOfType(c.SessionStoreType, redisOpts, "")
 		if err != nil {
 			logger.Fatalf("Error creating session store: %v", err)
 		}
 		// Setup state store
-		oidcStateStore, err = newRedisSessionStore(c.SessionStoreRedisAddr, c.SessionStoreRedisPWD, "oidc_state:", c.SessionStoreRedisDB)
+		oidcStateStore, err = newRedisStoreOfType(c.SessionStoreType, redisOpts, "oidc_state:")
 		if err != nil {
 			logger.Fatalf("Error creating session store: %v", err)
 		}
-	case "redisfailover":
+	case "sql":
 		// Setup session store
-		store, err = newRedisFailoverSessionStore(c.SessionStoreRedisAddr, c.SessionStoreRedisPWD, "", c.SessionStoreRedisDB)
+		store, err = newPostgresSessionStore(c.SessionStoreSQLDSN, sqlSessionsTable)
 		if err != nil {
 			logger.Fatalf("Error creating session store: %v", err)
 		}
 		// Setup state store
-		oidcStateStore, err = newRedisFailoverSessionStore(c.SessionStoreRedisAddr, c.SessionStoreRedisPWD, "oidc_state:", c.SessionStoreRedisDB)
+		oidcStateStore, err = newPostgresSessionStore(c.SessionStoreSQLDSN, sqlStatesTable)
 		if err != nil {
-			logger.Fatalf("Error creating session store: %v", err)
+			logger.Fatalf("Error creating oidc state store: %v", err)
+		}
+	case "cookie":
+		// Both the sessions and the states are kept in encrypted
+		// cookies, so there is nothing to set up.
+		if keys == nil {
+			logger.Fatal("The cookie session store requires SESSION_ENCRYPTION_KEY_PATHS")
 		}
+		return newCookieSessionStore(keys), newCookieSessionStore(keys)
 	default:
 		logger.Fatalf("Unsupported session store type: %s", c.SessionStoreType)
 	}
 
+	// Encrypt the user sessions, which hold the tokens of the users, at rest.
+	if keys != nil {
+		store = NewEncryptedStore(store, keys, c.SessionEncryptionAllowPlaintext)
+	}
+
 	return store, oidcStateStore
 }
+
+// pinger is a session store which can examine its connectivity.
+type pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// PingStore examines if the session store can reach its database. Stores
+// without a database are always reachable.
+func PingStore(ctx context.Context, store Store) error {
+	if es, ok := store.(*encryptedStore); ok {
+		store = es.IndexedStore
+	}
+	if p, ok := store.(pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
@@ -0,0 +1,450 @@
+package sessions
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"encoding/gob"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/arrikto/oidc-authservice/common"
+	"github.com/gorilla/sessions"
+	_ "github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// SQL dialects that the SQL session store supports. SQLite is only meant for
+// tests.
+const (
+	sqlDialectPostgres = "postgres"
+	sqlDialectSQLite   = "sqlite3"
+)
+
+const (
+	sqlSessionsTable = "authservice_sessions"
+	sqlStatesTable   = "authservice_oidc_states"
+	sqlIndexTable    = "authservice_session_index"
+
+	// sqlReapInterval is how often the expired rows are deleted.
+	sqlReapInterval = time.Minute
+)
+
+// sqlMigrations are the schema migrations of the SQL session store, in order.
+// Each one is applied once, in a transaction, and recorded in the migrations
+// table. The BLOB type is replaced with the binary type of the dialect.
+var sqlMigrations = []string{
+	// 1: The sessions, the OIDC states and the session index.
+	`CREATE TABLE authservice_sessions (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL DEFAULT '',
+		data BLOB NOT NULL,
+		expires_at BIGINT NOT NULL
+	);
+	CREATE INDEX authservice_sessions_user_id ON authservice_sessions (user_id);
+	CREATE INDEX authservice_sessions_expires_at ON authservice_sessions (expires_at);
+	CREATE TABLE authservice_oidc_states (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL DEFAULT '',
+		data BLOB NOT NULL,
+		expires_at BIGINT NOT NULL
+	);
+	CREATE INDEX authservice_oidc_states_expires_at ON authservice_oidc_states (expires_at);
+	CREATE TABLE authservice_session_index (
+		index_key TEXT NOT NULL,
+		session_id TEXT NOT NULL,
+		expires_at BIGINT NOT NULL,
+		PRIMARY KEY (index_key, session_id)
+	);
+	CREATE INDEX authservice_session_index_expires_at ON authservice_session_index (expires_at);`,
+}
+
+// sqlSessionStore is a session store backed by a SQL database. The sessions of
+// the store are kept in its table, along with the user ID of each session, so
+// that the sessions of a user are found without an index.
+type sqlSessionStore struct {
+	db      *sql.DB
+	dialect string
+	table   string
+	// Channels for the reaper
+	// quitC sends the quit signal to the reaper goroutine.
+	// doneC receives the signal that the reaper has quit.
+	quitC chan struct{}
+	doneC chan struct{}
+}
+
+// newSQLSessionStore returns a session store which keeps its sessions in the
+// given table of the database. It migrates the schema of the database first.
+func newSQLSessionStore(db *sql.DB, dialect, table string) (*sqlSessionStore, error) {
+	if err := migrateSQLSchema(db, dialect); err != nil {
+		return nil, err
+	}
+	store := &sqlSessionStore{
+		db:      db,
+		dialect: dialect,
+		table:   table,
+		quitC:   make(chan struct{}),
+		doneC:   make(chan struct{}),
+	}
+	go store.reap(sqlReapInterval)
+	return store, nil
+}
+
+// newPostgresSessionStore connects to the PostgreSQL database of the given
+// connection string and returns a session store in the given table of it.
+func newPostgresSessionStore(dsn, table string) (*sqlSessionStore, error) {
+	db, err := sql.Open(sqlDialectPostgres, dsn)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open database")
+	}
+	store, err := newSQLSessionStore(db, sqlDialectPostgres, table)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// rebind adapts a query, which uses the $N placeholders of PostgreSQL, to the
+// dialect.
+func rebind(dialect, query string) string {
+	if dialect == sqlDialectSQLite {
+		return strings.ReplaceAll(query, "$", "?")
+	}
+	return query
+}
+
+func migrateSQLSchema(db *sql.DB, dialect string) error {
+	ctx := context.Background()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to start schema migration")
+	}
+	defer tx.Rollback()
+
+	// Replicas that start at the same time migrate the schema one by one.
+	if dialect == sqlDialectPostgres {
+		if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(7242001)"); err != nil {
+			return errors.Wrap(err, "failed to lock the schema")
+		}
+	}
+	_, err = tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS authservice_schema_migrations (
+		version INTEGER PRIMARY KEY
+	)`)
+	if err != nil {
+		return errors.Wrap(err, "failed to create migrations table")
+	}
+	var version int
+	err = tx.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM authservice_schema_migrations").Scan(&version)
+	if err != nil {
+		return errors.Wrap(err, "failed to get schema version")
+	}
+
+	blobType := "BLOB"
+	if dialect == sqlDialectPostgres {
+		blobType = "BYTEA"
+	}
+	for i := version; i < len(sqlMigrations); i++ {
+		common.StandardLogger().Infof("Migrating session store schema to version %d", i+1)
+		migration := strings.ReplaceAll(sqlMigrations[i], "BLOB", blobType)
+		for _, stmt := range strings.Split(migration, ";") {
+			if strings.TrimSpace(stmt) == "" {
+				continue
+			}
+			if _, err := tx.ExecContext(ctx, stmt); err != nil {
+				return errors.Wrapf(err, "failed to migrate schema to version %d", i+1)
+			}
+		}
+		_, err := tx.ExecContext(ctx, rebind(dialect,
+			"INSERT INTO authservice_schema_migrations (version) VALUES ($1)"), i+1)
+		if err != nil {
+			return errors.Wrapf(err, "failed to migrate schema to version %d", i+1)
+		}
+	}
+	return errors.Wrap(tx.Commit(), "failed to commit schema migration")
+}
+
+func (ss *sqlSessionStore) query(query string) string {
+	return rebind(ss.dialect, strings.ReplaceAll(query, "{table}", ss.table))
+}
+
+func (ss *sqlSessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(ss, name)
+}
+
+// New loads the session of the cookie of the request. Sessions that don't
+// exist or have expired are returned as new. Cookies of the BoltDB session
+// store are accepted, so that sessions migrated from it stay valid.
+func (ss *sqlSessionStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	r = withRawSessionID(r, name)
+	session := sessions.NewSession(ss, name)
+	session.Options = &sessions.Options{Path: "/"}
+	session.IsNew = true
+	c, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+
+	var data []byte
+	var expiresAt int64
+	err = ss.db.QueryRowContext(r.Context(),
+		ss.query("SELECT data, expires_at FROM {table} WHERE id = $1 AND expires_at > $2"),
+		c.Value, time.Now().Unix()).Scan(&data, &expiresAt)
+	if err == sql.ErrNoRows {
+		return session, nil
+	}
+	if err != nil {
+		return session, errors.Wrap(err, "failed to load session")
+	}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&session.Values); err != nil {
+		return session, errors.Wrap(err, "failed to decode session values")
+	}
+	session.ID = c.Value
+	// Saving the session again keeps its expiration.
+	session.Options.MaxAge = int(time.Until(time.Unix(expiresAt, 0)).Seconds()) + 1
+	session.IsNew = false
+	return session, nil
+}
+
+// Save writes the session to the database and sets its cookie. Sessions with
+// a MaxAge of zero or less are deleted.
+func (ss *sqlSessionStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	ctx := r.Context()
+	if session.Options.MaxAge <= 0 {
+		_, err := ss.db.ExecContext(ctx, ss.query("DELETE FROM {table} WHERE id = $1"), session.ID)
+		if err != nil {
+			return errors.Wrap(err, "failed to delete session")
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	if session.ID == "" {
+		id := make([]byte, 32)
+		if _, err := io.ReadFull(rand.Reader, id); err != nil {
+			return errors.Wrap(err, "failed to generate session ID")
+		}
+		session.ID = strings.TrimRight(base32.StdEncoding.EncodeToString(id), "=")
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(session.Values); err != nil {
+		return errors.Wrap(err, "failed to encode session values")
+	}
+	userID, _ := session.Values[UserSessionUserID].(string)
+	expiresAt := time.Now().Add(time.Duration(session.Options.MaxAge) * time.Second)
+	if err := ss.put(ctx, session.ID, userID, buf.Bytes(), expiresAt); err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), session.ID, session.Options))
+	return nil
+}
+
+// put inserts or updates the row of a session.
+func (ss *sqlSessionStore) put(ctx context.Context, id, userID string, data []byte, expiresAt time.Time) error {
+	_, err := ss.db.ExecContext(ctx, ss.query(`INSERT INTO {table} (id, user_id, data, expires_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (id) DO UPDATE SET user_id = excluded.user_id, data = excluded.data,
+		expires_at = excluded.expires_at`),
+		id, userID, data, expiresAt.Unix())
+	return errors.Wrap(err, "failed to save session")
+}
+
+// reap deletes the expired sessions and index entries periodically, as the
+// BoltDB reaper does.
+func (ss *sqlSessionStore) reap(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ss.quitC:
+			close(ss.doneC)
+			return
+		case <-ticker.C:
+			if _, err := ss.deleteExpired(context.Background(), time.Now()); err != nil {
+				common.StandardLogger().Errorf("Failed to delete expired sessions: %v", err)
+			}
+		}
+	}
+}
+
+// deleteExpired deletes the rows that expired before now and returns their
+// number.
+func (ss *sqlSessionStore) deleteExpired(ctx context.Context, now time.Time) (int, error) {
+	deleted := 0
+	tables := []string{ss.table}
+	if ss.table == sqlSessionsTable {
+		tables = append(tables, sqlIndexTable)
+	}
+	for _, table := range tables {
+		res, err := ss.db.ExecContext(ctx, rebind(ss.dialect, "DELETE FROM "+table+" WHERE expires_at <= $1"), now.Unix())
+		if err != nil {
+			return deleted, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return deleted, err
+		}
+		deleted += int(n)
+	}
+	return deleted, nil
+}
+
+func (ss *sqlSessionStore) Ping(ctx context.Context) error {
+	return ss.db.PingContext(ctx)
+}
+
+func (ss *sqlSessionStore) Close() error {
+	close(ss.quitC)
+	<-ss.doneC
+	return ss.db.Close()
+}
+
+// The sessions of a user and all the sessions are found through the user ID
+// column of the sessions table, so they aren't kept in the index table. The
+// other index keys are kept in the index table, with the expiration of their
+// sessions.
+
+// sqlDerivedIndexKey examines if the sessions under the index key are found
+// in the sessions table, rather than the index table.
+func sqlDerivedIndexKey(key string) bool {
+	return key == AllSessionsIndexKey || strings.HasPrefix(key, userIndexPrefix)
+}
+
+func (ss *sqlSessionStore) IndexSession(ctx context.Context, sessionID string,
+	maxAge time.Duration, keys ...string) error {
+
+	expiresAt := time.Now().Add(maxAge).Unix()
+	tx, err := ss.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, key := range keys {
+		if sqlDerivedIndexKey(key) {
+			continue
+		}
+		_, err := tx.ExecContext(ctx, ss.query(`INSERT INTO `+sqlIndexTable+` (index_key, session_id, expires_at)
+			VALUES ($1, $2, $3)
+			ON CONFLICT (index_key, session_id) DO UPDATE SET expires_at = excluded.expires_at`),
+			key, sessionID, expiresAt)
+		if err != nil {
+			return errors.Wrapf(err, "error indexing session under key '%s'", key)
+		}
+	}
+	return tx.Commit()
+}
+
+func (ss *sqlSessionStore) IndexedSessions(ctx context.Context, key string) ([]string, error) {
+	var rows *sql.Rows
+	var err error
+	now := time.Now().Unix()
+	switch {
+	case key == AllSessionsIndexKey:
+		rows, err = ss.db.QueryContext(ctx, ss.query(
+			"SELECT id FROM {table} WHERE expires_at > $1"), now)
+	case strings.HasPrefix(key, userIndexPrefix):
+		rows, err = ss.db.QueryContext(ctx, ss.query(
+			"SELECT id FROM {table} WHERE user_id = $1 AND expires_at > $2"),
+			strings.TrimPrefix(key, userIndexPrefix), now)
+	default:
+		rows, err = ss.db.QueryContext(ctx, ss.query(
+			"SELECT session_id FROM "+sqlIndexTable+" WHERE index_key = $1 AND expires_at > $2"),
+			key, now)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var sessionIDs []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		sessionIDs = append(sessionIDs, id)
+	}
+	return sessionIDs, rows.Err()
+}
+
+func (ss *sqlSessionStore) UnindexSession(ctx context.Context, sessionID string, keys ...string) error {
+	for _, key := range keys {
+		if sqlDerivedIndexKey(key) {
+			continue
+		}
+		_, err := ss.db.ExecContext(ctx, ss.query(
+			"DELETE FROM "+sqlIndexTable+" WHERE index_key = $1 AND session_id = $2"), key, sessionID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ss *sqlSessionStore) ForEachSession(ctx context.Context, fn func(SessionRecord) error) error {
+	rows, err := ss.db.QueryContext(ctx, ss.query(
+		"SELECT id, data, expires_at FROM {table} WHERE expires_at > $1"), time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var rec SessionRecord
+		var expiresAt int64
+		if err := rows.Scan(&rec.ID, &rec.Data, &expiresAt); err != nil {
+			return err
+		}
+		rec.ExpiresAt = time.Unix(expiresAt, 0)
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// ForEachIndexEntry also returns the entries of the sessions under the keys
+// that the store derives from the sessions table, so that the stores that
+// keep all the keys in their index get them.
+func (ss *sqlSessionStore) ForEachIndexEntry(ctx context.Context, fn func(SessionRecord) error) error {
+	if ss.table != sqlSessionsTable {
+		return nil
+	}
+	now := time.Now().Unix()
+	rows, err := ss.db.QueryContext(ctx, ss.query(`SELECT index_key, session_id, expires_at
+		FROM `+sqlIndexTable+` WHERE expires_at > $1
+		UNION ALL SELECT CAST($2 AS TEXT), id, expires_at FROM {table} WHERE expires_at > $3
+		UNION ALL SELECT CAST($4 AS TEXT) || user_id, id, expires_at FROM {table} WHERE expires_at > $5 AND user_id <> ''`),
+		now, AllSessionsIndexKey, now, userIndexPrefix, now)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var rec SessionRecord
+		var expiresAt int64
+		if err := rows.Scan(&rec.Key, &rec.ID, &expiresAt); err != nil {
+			return err
+		}
+		rec.ExpiresAt = time.Unix(expiresAt, 0)
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (ss *sqlSessionStore) ImportSession(ctx context.Context, rec SessionRecord) error {
+	values, err := decodeValues(rec.Data)
+	if err != nil {
+		return err
+	}
+	userID, _ := values[UserSessionUserID].(string)
+	return ss.put(ctx, rec.ID, userID, rec.Data, rec.ExpiresAt)
+}
+
+func (ss *sqlSessionStore) PurgeExpired(ctx context.Context) (int, error) {
+	return ss.deleteExpired(ctx, time.Now())
+}
@@ -0,0 +1,87 @@
+package sessions
+
+import (
+	"context"
+	"database/sql"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSQLSessionStore(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open(sqlDialectSQLite, filepath.Join(t.TempDir(), "sessions.db"))
+	require.NoError(t, err)
+	store, err := newSQLSessionStore(db, sqlDialectSQLite, sqlSessionsTable)
+	require.NoError(t, err)
+	defer store.Close()
+
+	// Migrations are applied once
+	require.NoError(t, migrateSQLSchema(db, sqlDialectSQLite))
+	var version int
+	require.NoError(t, db.QueryRow("SELECT MAX(version) FROM authservice_schema_migrations").Scan(&version))
+	require.Equal(t, len(sqlMigrations), version)
+
+	saveSession := func(userID string, maxAge int) string {
+		session := NewSession(store, UserSessionCookie)
+		session.Options.MaxAge = maxAge
+		session.Values[UserSessionUserID] = userID
+		w := httptest.NewRecorder()
+		require.NoError(t, session.Save(httptest.NewRequest("GET", "/", nil), w))
+		sessionID, err := SessionIDFromResponse(w, UserSessionCookie)
+		require.NoError(t, err)
+		return sessionID
+	}
+
+	aliceID := saveSession("alice", 3600)
+	bobID := saveSession("bob", 3600)
+	session, err := SessionFromID(aliceID, store)
+	require.NoError(t, err)
+	require.False(t, session.IsNew)
+	require.Equal(t, "alice", session.Values[UserSessionUserID])
+
+	// Sessions are found by user ID, without an index
+	ids, err := store.IndexedSessions(ctx, UserIndexKey("alice"))
+	require.NoError(t, err)
+	require.Equal(t, []string{aliceID}, ids)
+	ids, err = store.IndexedSessions(ctx, AllSessionsIndexKey)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{aliceID, bobID}, ids)
+
+	// Other keys are kept in the index table
+	require.NoError(t, store.IndexSession(ctx, aliceID, time.Hour, SubjectIndexKey("alice-sub"), UserIndexKey("alice")))
+	ids, err = store.IndexedSessions(ctx, SubjectIndexKey("alice-sub"))
+	require.NoError(t, err)
+	require.Equal(t, []string{aliceID}, ids)
+	revoked, err := RevokeIndexedSessions(ctx, store, SubjectIndexKey("alice-sub"))
+	require.NoError(t, err)
+	require.Equal(t, 1, revoked)
+	session, err = SessionFromID(aliceID, store)
+	require.NoError(t, err)
+	require.True(t, session.IsNew)
+	ids, err = store.IndexedSessions(ctx, SubjectIndexKey("alice-sub"))
+	require.NoError(t, err)
+	require.Empty(t, ids)
+
+	// Expired sessions are new and the reaper deletes them
+	expiredID := saveSession("carol", 1)
+	require.NoError(t, store.IndexSession(ctx, expiredID, time.Second, SubjectIndexKey("carol-sub")))
+	later := time.Now().Add(time.Minute)
+	_, err = db.Exec("UPDATE authservice_sessions SET expires_at = ? WHERE id = ?", time.Now().Unix()-1, expiredID)
+	require.NoError(t, err)
+	session, err = SessionFromID(expiredID, store)
+	require.NoError(t, err)
+	require.True(t, session.IsNew)
+	deleted, err := store.deleteExpired(ctx, later)
+	require.NoError(t, err)
+	require.Equal(t, 2, deleted)
+	var count int
+	require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM authservice_sessions").Scan(&count))
+	require.Equal(t, 1, count)
+	require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM authservice_session_index").Scan(&count))
+	require.Equal(t, 0, count)
+}
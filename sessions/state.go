@@ -3,6 +3,7 @@
 package sessions
 
 import (
+	"crypto/subtle"
 	"encoding/gob"
 	"math/rand"
 	"net/http"
@@ -10,6 +11,8 @@ import (
 	"strings"
 	"time"
 
+	"github.com/arrikto/oidc-authservice/common"
+	"github.com/coreos/go-oidc"
 	"github.com/gorilla/sessions"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
@@ -19,6 +22,7 @@ const (
 	oidcStateCookie   = "oidc_state_csrf"
 	sessionValueState = "state"
 	charset           = "abcdefghijklmnopqrstuvwxyz"
+	nonceLength       = 32
 )
 
 var seededRand *rand.Rand = rand.New(
@@ -32,6 +36,18 @@ type State struct {
 	// FirstVisitedURL is the URL that the user visited when we redirected them
 	// to login.
 	FirstVisitedURL string
+	// PKCEVerifier is the PKCE code_verifier of the Authorization Code flow.
+	// It is empty if PKCE is disabled.
+	PKCEVerifier string
+	// Nonce is the value sent in the Authentication Request, which the
+	// provider must include in the ID token.
+	Nonce string
+	// Provider is the name of the OIDC provider that the flow was started
+	// with. It is empty for the default provider.
+	Provider string
+	// StepUp are the step-up authentication requirements that the flow
+	// was started for. It is nil for regular logins.
+	StepUp *common.StepUp
 }
 
 type Config struct {
@@ -84,6 +100,29 @@ func newSchemeAndHost(config *Config) StateFunc {
 	}
 }
 
+// NewNonce returns a cryptographically random nonce for an OIDC
+// Authentication Request.
+func NewNonce() (string, error) {
+	nonce, err := common.CreateNonce(nonceLength)
+	if err != nil {
+		return "", errors.Wrap(err, "error generating nonce")
+	}
+	return nonce, nil
+}
+
+// VerifyNonce confirms that the nonce claim of the ID token matches the nonce
+// of the state. States created before nonces were introduced are ignored.
+func VerifyNonce(state *State, idToken *oidc.IDToken) error {
+	if state.Nonce == "" {
+		return nil
+	}
+	if subtle.ConstantTimeCompare([]byte(state.Nonce), []byte(idToken.Nonce)) != 1 {
+		return errors.New("ID token nonce doesn't match the nonce of the " +
+			"authentication request")
+	}
+	return nil
+}
+
 // stringWithCharset creates a random string of length from charset
 func stringWithCharset(length int, charset string) string {
 	b := make([]byte, length)
@@ -98,18 +137,17 @@ func randString(length int) string {
 	return stringWithCharset(length, charset)
 }
 
-// CreateState creates the state parameter from the incoming request, stores
-// it in the session store and sets a cookie with the session key.
+// CreateState stores the given state, created from the incoming request, in
+// the session store and sets a cookie with the session key.
 // It returns the session key, which can be used as the state value to start
 // an OIDC authentication request.
 func CreateState(r *http.Request, w http.ResponseWriter, store sessions.Store,
-	sessionDomain string, fn StateFunc, dynamicOidcStateCookieName bool) (string, error) {
+	sessionDomain string, s *State, dynamicOidcStateCookieName bool) (string, error) {
 	nonce := randString(8)
 	oidcStateCookieName := oidcStateCookie
 	if dynamicOidcStateCookieName {
 		oidcStateCookieName += "_" + nonce
 	}
-	s := fn(r)
 	session := sessions.NewSession(store, oidcStateCookieName)
 	session.Options.MaxAge = int((20 * time.Minute).Seconds())
 	session.Options.Path = "/"
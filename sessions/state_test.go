@@ -0,0 +1,26 @@
+package sessions
+
+import (
+	"testing"
+
+	"github.com/coreos/go-oidc"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyNonce(t *testing.T) {
+	nonce, err := NewNonce()
+	require.NoError(t, err)
+	state := &State{Nonce: nonce}
+
+	require.NoError(t, VerifyNonce(state, &oidc.IDToken{Nonce: nonce}))
+
+	other, err := NewNonce()
+	require.NoError(t, err)
+	require.Error(t, VerifyNonce(state, &oidc.IDToken{Nonce: other}))
+
+	// An ID token without the nonce claim doesn't match either
+	require.Error(t, VerifyNonce(state, &oidc.IDToken{}))
+
+	// States created before nonces were introduced are ignored
+	require.NoError(t, VerifyNonce(&State{}, &oidc.IDToken{Nonce: other}))
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/arrikto/oidc-authservice/common"
+	"github.com/arrikto/oidc-authservice/sessions"
+	"github.com/pkg/errors"
+)
+
+const sessionsUsage = `Usage: oidc-authservice sessions <command> [flags]
+
+Maintain the session store that AuthService is configured with, using the
+same environment variables. Stop AuthService first, or at least make sure
+that no users log in meanwhile.
+
+Commands:
+  export   Write the sessions and the OIDC states to a JSON file
+  import   Read the sessions and the OIDC states from a JSON file
+  migrate  Copy the sessions and the OIDC states to another type of store
+  compact  Shrink the BoltDB files of the session store
+  purge    Delete the expired sessions and OIDC states
+  stats    Print statistics about the sessions
+`
+
+// runSessionsCommand runs the `oidc-authservice sessions` subcommand with the given
+// arguments and returns the exit code of the process.
+func runSessionsCommand(args []string) int {
+	if len(args) == 0 || args[0] == "-h" || args[0] == "--help" || args[0] == "help" {
+		fmt.Fprint(os.Stderr, sessionsUsage)
+		return 2
+	}
+
+	commands := map[string]func(*common.Config, []string) error{
+		"export":  sessionsExport,
+		"import":  sessionsImport,
+		"migrate": sessionsMigrate,
+		"compact": sessionsCompact,
+		"purge":   sessionsPurge,
+		"stats":   sessionsStats,
+	}
+	command, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command '%s'\n\n%s", args[0], sessionsUsage)
+		return 2
+	}
+
+	c, err := common.ParseConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to parse configuration: %v\n", err)
+		return 1
+	}
+	common.SetLogLevel(c.LogLevel)
+	if err := command(c, args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// maintainableStores are the session stores of a configuration, as the
+// sessions command works on them.
+type maintainableStores struct {
+	store, stateStore sessions.MaintainableStore
+	closers           []sessions.ClosableStore
+}
+
+func openMaintainableStores(c *common.Config) (*maintainableStores, error) {
+	store, stateStore := sessions.InitiateSessionStores(c)
+	ms := &maintainableStores{closers: []sessions.ClosableStore{store, stateStore}}
+	var err error
+	if ms.store, err = sessions.Maintainable(store); err != nil {
+		ms.Close()
+		return nil, err
+	}
+	if ms.stateStore, err = sessions.Maintainable(stateStore); err != nil {
+		ms.Close()
+		return nil, err
+	}
+	return ms, nil
+}
+
+func (ms *maintainableStores) Close() {
+	for _, store := range ms.closers {
+		if err := store.Close(); err != nil {
+			common.StandardLogger().Errorf("Error closing session store: %v", err)
+		}
+	}
+}
+
+func sessionsExport(c *common.Config, args []string) error {
+	flags := flag.NewFlagSet("sessions export", flag.ExitOnError)
+	file := flags.String("file", "-", "File to write the sessions to, or - for stdout")
+	flags.Parse(args)
+
+	ms, err := openMaintainableStores(c)
+	if err != nil {
+		return err
+	}
+	defer ms.Close()
+
+	var w io.Writer = os.Stdout
+	if *file != "-" {
+		// Exports hold the tokens of the users.
+		f, err := os.OpenFile(*file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return errors.Wrap(err, "failed to create export file")
+		}
+		defer f.Close()
+		w = f
+	}
+	n, err := sessions.ExportSessions(context.Background(), ms.store, ms.stateStore, w)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d records\n", n)
+	return nil
+}
+
+func sessionsImport(c *common.Config, args []string) error {
+	flags := flag.NewFlagSet("sessions import", flag.ExitOnError)
+	file := flags.String("file", "-", "File to read the sessions from, or - for stdin")
+	flags.Parse(args)
+
+	ms, err := openMaintainableStores(c)
+	if err != nil {
+		return err
+	}
+	defer ms.Close()
+
+	var r io.Reader = os.Stdin
+	if *file != "-" {
+		f, err := os.Open(*file)
+		if err != nil {
+			return errors.Wrap(err, "failed to open import file")
+		}
+		defer f.Close()
+		r = f
+	}
+	n, err := sessions.ImportSessions(context.Background(), ms.store, ms.stateStore, r)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Imported %d records\n", n)
+	return nil
+}
+
+func sessionsMigrate(c *common.Config, args []string) error {
+	flags := flag.NewFlagSet("sessions migrate", flag.ExitOnError)
+	to := flags.String("to", "", "Type of the session store to copy the sessions to, "+
+		"configured with the SESSION_STORE_* variables of that type")
+	flags.Parse(args)
+	if *to == "" {
+		return errors.New("-to is required")
+	}
+	if *to == c.SessionStoreType {
+		return errors.Errorf("the session store is already of type %s", *to)
+	}
+
+	src, err := openMaintainableStores(c)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	targetConfig := *c
+	targetConfig.SessionStoreType = *to
+	dst, err := openMaintainableStores(&targetConfig)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	ctx := context.Background()
+	n, err := sessions.CopySessions(ctx, src.store, src.stateStore, func(rec sessions.SessionRecord) error {
+		return sessions.ImportRecord(ctx, dst.store, dst.stateStore, rec)
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Copied %d records from %s to %s. Set SESSION_STORE_TYPE=%s to use them.\n",
+		n, c.SessionStoreType, *to, *to)
+	return nil
+}
+
+func sessionsCompact(c *common.Config, args []string) error {
+	flags := flag.NewFlagSet("sessions compact", flag.ExitOnError)
+	flags.Parse(args)
+	if c.SessionStoreType != "boltdb" {
+		return errors.Errorf("only the boltdb session store needs compaction, not %s", c.SessionStoreType)
+	}
+
+	paths := []string{c.SessionStorePath}
+	if c.OIDCStateStorePath != c.SessionStorePath {
+		paths = append(paths, c.OIDCStateStorePath)
+	}
+	for _, path := range paths {
+		before, after, err := sessions.CompactBoltDB(path)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Compacted %s from %d to %d bytes\n", path, before, after)
+	}
+	return nil
+}
+
+func sessionsPurge(c *common.Config, args []string) error {
+	flags := flag.NewFlagSet("sessions purge", flag.ExitOnError)
+	flags.Parse(args)
+
+	ms, err := openMaintainableStores(c)
+	if err != nil {
+		return err
+	}
+	defer ms.Close()
+
+	ctx := context.Background()
+	purged, err := ms.store.PurgeExpired(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to purge sessions")
+	}
+	purgedStates, err := ms.stateStore.PurgeExpired(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to purge OIDC states")
+	}
+	fmt.Fprintf(os.Stderr, "Purged %d expired session entries and %d expired OIDC states\n", purged, purgedStates)
+	return nil
+}
+
+func sessionsStats(c *common.Config, args []string) error {
+	flags := flag.NewFlagSet("sessions stats", flag.ExitOnError)
+	top := flags.Int("top", 10, "Number of the users with the most sessions to print, or 0 for all")
+	flags.Parse(args)
+
+	ms, err := openMaintainableStores(c)
+	if err != nil {
+		return err
+	}
+	defer ms.Close()
+	var keys *sessions.SessionKeys
+	if len(c.SessionEncryptionKeyPaths) > 0 {
+		if keys, err = sessions.LoadSessionKeys(c.SessionEncryptionKeyPaths); err != nil {
+			return err
+		}
+	}
+
+	stats, err := sessions.CollectSessionStats(context.Background(), ms.store, ms.stateStore, keys)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Sessions:    %d\n", stats.Sessions)
+	fmt.Printf("OIDC states: %d\n", stats.OIDCStates)
+	fmt.Printf("Users:       %d\n", len(stats.Users))
+	if !stats.Oldest.IsZero() {
+		fmt.Printf("Oldest:      %s\n", stats.Oldest.Format(time.RFC3339))
+		fmt.Printf("Newest:      %s\n", stats.Newest.Format(time.RFC3339))
+	}
+	if len(stats.Users) > 0 {
+		fmt.Printf("\nSessions per user:\n")
+		for _, user := range stats.TopUsers(*top) {
+			fmt.Printf("  %6d  %s\n", user.Sessions, user.UserID)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/arrikto/oidc-authservice/common"
+	"github.com/arrikto/oidc-authservice/sessions"
+)
+
+// gracefulShutdown shuts AuthService down without dropping the requests in
+// flight, e.g., during a rollout.
+type gracefulShutdown struct {
+	health *healthServer
+	// delay is how long the servers keep serving requests after the
+	// readiness probe fails, until the endpoints of the Service are updated.
+	delay time.Duration
+	// timeout is how long the servers wait for the requests in flight.
+	timeout time.Duration
+	// servers are drained after the delay.
+	servers []*http.Server
+	// healthServer serves the probes until everything else has stopped.
+	healthServer *http.Server
+	// stores are closed after the servers have been drained.
+	stores []sessions.ClosableStore
+}
+
+// Shutdown fails the readiness probe, waits for the delay, drains the
+// servers and then closes the stores and stops the config watchers.
+func (gs *gracefulShutdown) Shutdown() {
+	log := common.StandardLogger()
+
+	log.Infof("Shutting down, failing the readiness probe for %v", gs.delay)
+	gs.health.draining.Set()
+	time.Sleep(gs.delay)
+
+	log.Infof("Draining the requests in flight")
+	ctx, cancel := context.WithTimeout(context.Background(), gs.timeout)
+	defer cancel()
+	done := make(chan struct{})
+	for _, srv := range gs.servers {
+		go func(srv *http.Server) {
+			defer func() { done <- struct{}{} }()
+			if err := srv.Shutdown(ctx); err != nil {
+				log.Errorf("Error shutting down server at %s: %v", srv.Addr, err)
+			}
+		}(srv)
+	}
+	for range gs.servers {
+		<-done
+	}
+
+	for _, store := range gs.stores {
+		if err := store.Close(); err != nil {
+			log.Errorf("Error closing session store: %v", err)
+		}
+	}
+	common.StopWatchers()
+
+	if gs.healthServer != nil {
+		if err := gs.healthServer.Close(); err != nil {
+			log.Errorf("Error closing readiness probe server: %v", err)
+		}
+	}
+	log.Info("Shutdown complete")
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/arrikto/oidc-authservice/sessions"
+	"github.com/stretchr/testify/require"
+	"github.com/tevino/abool"
+)
+
+type fakeClosableStore struct {
+	sessions.Store
+	closed *abool.AtomicBool
+}
+
+func (s fakeClosableStore) Close() error {
+	s.closed.Set()
+	return nil
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	isReady := abool.NewBool(true)
+	health := &healthServer{isReady: isReady, draining: abool.New(), timeout: time.Second}
+
+	// A request that is in flight when the shutdown starts
+	started := make(chan struct{})
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("done"))
+	})}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(ln)
+
+	respC := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String())
+		if err != nil {
+			respC <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		respC <- string(body)
+	}()
+	<-started
+
+	closed := abool.New()
+	gs := &gracefulShutdown{
+		health:  health,
+		delay:   100 * time.Millisecond,
+		timeout: time.Second,
+		servers: []*http.Server{srv},
+		stores:  []sessions.ClosableStore{fakeClosableStore{closed: closed}},
+	}
+	done := make(chan struct{})
+	go func() {
+		gs.Shutdown()
+		close(done)
+	}()
+
+	// The readiness probe fails during the delay
+	time.Sleep(20 * time.Millisecond)
+	w := httptest.NewRecorder()
+	health.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+	w = httptest.NewRecorder()
+	health.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+	require.False(t, closed.IsSet())
+
+	// The request in flight completes before the stores are closed
+	<-done
+	require.Equal(t, "done", <-respC)
+	require.True(t, closed.IsSet())
+	_, err = http.Get("http://" + ln.Addr().String())
+	require.Error(t, err)
+}
@@ -12,8 +12,10 @@ import (
 )
 
 const (
-	tmplLanding     = "homepage.html"
-	tmplAfterLogout = "after_logout.html"
+	tmplLanding      = "homepage.html"
+	tmplAfterLogout  = "after_logout.html"
+	tmplLogin        = "login.html"
+	tmplSessionLimit = "session_limit.html"
 )
 
 var (
@@ -27,17 +29,38 @@ type WebServer struct {
 	ClientName  string
 	ThemeURL    string
 	Frontend    map[string]string
+	// LoginURL is the URL of the judge server's login endpoint, where the
+	// login selection page sends the users.
+	LoginURL string
+	// Providers are the OIDC providers that the login selection page lists.
+	Providers []LoginProvider
+}
+
+// LoginProvider is an OIDC provider, as shown in the login selection page.
+type LoginProvider struct {
+	Name        string
+	DisplayName string
+	// URL starts the login with this provider. It is set per request.
+	URL string
 }
 
 func (s *WebServer) Start(addr string) error {
+	handler, err := s.Handler()
+	if err != nil {
+		return err
+	}
+	return http.ListenAndServe(addr, handler)
+}
+
+// Handler loads the templates and returns the handler of the web server.
+func (s *WebServer) Handler() (http.Handler, error) {
 
-	// Start web server
 	// Load templates
 	filenames := []string{}
 	for _, p := range s.TemplatePaths {
 		tmpls, err := listTemplates(p)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		filenames = append(filenames, tmpls...)
 	}
@@ -51,19 +74,12 @@ func (s *WebServer) Start(addr string) error {
 
 	templates, err := template.New("").Funcs(funcs).ParseFiles(filenames...)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	router := mux.NewRouter()
 
-	data := struct {
-		// Frontend-related values for context
-		Frontend map[string]string
-		// OIDC-related settings
-		ProviderURL string
-		ThemeURL    string
-		ClientName  string
-	}{
+	data := siteContext{
 		Frontend:    s.Frontend,
 		ProviderURL: s.ProviderURL,
 		ThemeURL:    s.ThemeURL,
@@ -71,6 +87,8 @@ func (s *WebServer) Start(addr string) error {
 	}
 	router.HandleFunc(common.HomepagePath, siteHandler(templates.Lookup(tmplLanding), data)).Methods(http.MethodGet)
 	router.HandleFunc(common.AfterLogoutPath, siteHandler(templates.Lookup(tmplAfterLogout), data)).Methods(http.MethodGet)
+	router.HandleFunc(common.LoginSelectionPath, s.loginSelectionHandler(templates.Lookup(tmplLogin), data)).Methods(http.MethodGet)
+	router.HandleFunc(common.SessionLimitPath, siteHandler(templates.Lookup(tmplSessionLimit), data)).Methods(http.MethodGet)
 
 	// Themes
 	router.
@@ -82,7 +100,17 @@ func (s *WebServer) Start(addr string) error {
 			),
 		)
 
-	return http.ListenAndServe(addr, router)
+	return router, nil
+}
+
+// siteContext holds the values available in each template's context.
+type siteContext struct {
+	// Frontend-related values for context
+	Frontend map[string]string
+	// OIDC-related settings
+	ProviderURL string
+	ThemeURL    string
+	ClientName  string
 }
 
 // siteHandler returns an http.HandlerFunc that serves a given template
@@ -95,6 +123,39 @@ func siteHandler(tmpl *template.Template, data interface{}) http.HandlerFunc {
 	}
 }
 
+// loginSelectionHandler returns an http.HandlerFunc that serves the login
+// selection page, which links to the login endpoint of each provider. The
+// "next" query parameter of the request is passed on to the login endpoint.
+func (s *WebServer) loginSelectionHandler(tmpl *template.Template, data siteContext) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := common.RequestLogger(r, "web server")
+
+		providers := []LoginProvider{}
+		for _, p := range s.Providers {
+			loginURL := common.MustParseURL(s.LoginURL)
+			q := loginURL.Query()
+			q.Set("provider", p.Name)
+			if next := r.URL.Query().Get("next"); next != "" {
+				q.Set("next", next)
+			}
+			loginURL.RawQuery = q.Encode()
+			p.URL = loginURL.String()
+			providers = append(providers, p)
+		}
+
+		loginData := struct {
+			siteContext
+			Providers []LoginProvider
+		}{
+			siteContext: data,
+			Providers:   providers,
+		}
+		if err := tmpl.Execute(w, loginData); err != nil {
+			logger.Errorf("Error executing template: %v", err)
+		}
+	}
+}
+
 func listTemplates(dir string) ([]string, error) {
 	tmplPaths := []string{}
 	files, err := ioutil.ReadDir(dir)
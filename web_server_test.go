@@ -15,6 +15,11 @@ func TestWebServerDefault(t *testing.T) {
 		ClientName:    "Kubeflow",
 		ThemeURL:      "themes/kubeflow",
 		Frontend:      map[string]string{},
+		LoginURL:      "http://authservice.test/authservice/login",
+		Providers: []LoginProvider{
+			{Name: "default", DisplayName: "Default"},
+			{Name: "corp", DisplayName: "Corporate"},
+		},
 	}
 	// Start web server
 	go func() {
@@ -24,6 +29,8 @@ func TestWebServerDefault(t *testing.T) {
 	baseURL := common.MustParseURL("http://localhost:8082")
 	homepage := baseURL.ResolveReference(common.MustParseURL("/site/homepage"))
 	afterLogout := baseURL.ResolveReference(common.MustParseURL("/site/after_logout"))
+	login := baseURL.ResolveReference(common.MustParseURL("/site/login?next=/app"))
+	sessionLimit := baseURL.ResolveReference(common.MustParseURL("/site/session_limit"))
 	image := baseURL.ResolveReference(common.MustParseURL("/site/themes/kubeflow/styles.css"))
 
 	tests := []struct {
@@ -32,6 +39,8 @@ func TestWebServerDefault(t *testing.T) {
 	}{
 		{name: "homepage", url: homepage.String()},
 		{name: "afterLogout", url: afterLogout.String()},
+		{name: "login", url: login.String()},
+		{name: "sessionLimit", url: sessionLimit.String()},
 		{name: "image", url: image.String()},
 	}
 